@@ -0,0 +1,26 @@
+package libdiscover
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// splitHostPort splits an address with an optional port
+func splitHostPort(addr string, defaultPort int) (string, int, error) {
+	if !strings.Contains(addr, ":") {
+		return addr, defaultPort, nil
+	}
+
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, port, nil
+}
@@ -0,0 +1,316 @@
+package libdiscover
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	announceStateName = "announce"
+
+	// announceProtocol is the version of the announcement format.  Newer
+	// versions only add fields so older members can still decode them.
+	announceProtocol = 1
+)
+
+// AnnounceMode controls how members announce themselves when they start and
+// stop
+type AnnounceMode int
+
+const (
+	// AnnounceLegacy gossips announcements and also sends the node-join and
+	// node-leave user events for consumers that still depend on them.  It
+	// is the default.
+	AnnounceLegacy AnnounceMode = iota
+	// AnnounceGossip gossips announcements and publishes them to
+	// subscribers as AnnounceEvents
+	AnnounceGossip
+	// AnnounceOff disables announcements
+	AnnounceOff
+)
+
+// Announcement describes a member as announced by the member itself
+type Announcement struct {
+	// Protocol is the announce protocol version of the sender
+	Protocol     int               `json:"protocol"`
+	Node         string            `json:"node"`
+	Addr         string            `json:"addr"`
+	Version      string            `json:"version,omitempty"`
+	Capabilities []string          `json:"capabilities,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	// Leaving is set when the member is shutting down
+	Leaving   bool      `json:"leaving,omitempty"`
+	Timestamp Timestamp `json:"timestamp"`
+}
+
+// HasCapability reports whether the member announced the capability
+func (a *Announcement) HasCapability(c string) bool {
+	for _, v := range a.Capabilities {
+		if v == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AnnounceEvent is published to subscribers when a member announces itself
+// or changes its announcement (EventMemberAnnounce) and when it announces
+// that it is leaving (EventMemberDepart)
+type AnnounceEvent struct {
+	Type         serf.EventType
+	Announcement *Announcement
+}
+
+func (e AnnounceEvent) EventType() serf.EventType {
+	return e.Type
+}
+
+func (e AnnounceEvent) String() string {
+	return fmt.Sprintf("%s: node=%s version=%s", EventTypeName(e.Type), e.Announcement.Node, e.Announcement.Version)
+}
+
+// announcer keeps the latest announcement of every member
+type announcer struct {
+	d            *Discover
+	clock        *hlc
+	mode         AnnounceMode
+	version      string
+	capabilities []string
+
+	mu    sync.RWMutex
+	nodes map[string]*Announcement
+}
+
+func newAnnouncer(d *Discover, cfg *Config) *announcer {
+	a := &announcer{
+		d:            d,
+		clock:        d.newHLC(),
+		mode:         cfg.Announce,
+		version:      cfg.Version,
+		capabilities: append([]string(nil), cfg.Capabilities...),
+		nodes:        map[string]*Announcement{},
+	}
+
+	if a.mode == AnnounceOff {
+		return a
+	}
+
+	d.handleMessage(messageAnnounceType, a.handleDelta)
+	d.handleState(announceStateName, a)
+
+	d.Subscribe(func(evt serf.Event) {
+		e, ok := evt.(serf.MemberEvent)
+		if !ok || e.Type != serf.EventMemberReap {
+			return
+		}
+
+		a.mu.Lock()
+		for _, m := range e.Members {
+			if m.Name != d.name {
+				delete(a.nodes, m.Name)
+			}
+		}
+		a.mu.Unlock()
+	})
+
+	return a
+}
+
+// Announcement returns the latest announcement of the member
+func (d *Discover) Announcement(name string) (*Announcement, bool) {
+	d.announcer.mu.RLock()
+	defer d.announcer.mu.RUnlock()
+
+	a, ok := d.announcer.nodes[name]
+	if !ok {
+		return nil, false
+	}
+
+	c := *a
+	return &c, true
+}
+
+// Announcements returns the latest announcement of every member sorted by
+// node name
+func (d *Discover) Announcements() []*Announcement {
+	d.announcer.mu.RLock()
+	defer d.announcer.mu.RUnlock()
+
+	announcements := make([]*Announcement, 0, len(d.announcer.nodes))
+	for _, a := range d.announcer.nodes {
+		c := *a
+		announcements = append(announcements, &c)
+	}
+
+	sort.Slice(announcements, func(i, j int) bool {
+		return announcements[i].Node < announcements[j].Node
+	})
+
+	return announcements
+}
+
+// start announces the node once it has joined
+func (a *announcer) start() error {
+	if err := a.announce(false); err != nil {
+		return err
+	}
+
+	return a.announceLegacy(false)
+}
+
+// stop announces that the node is leaving
+func (a *announcer) stop() error {
+	if err := a.announce(true); err != nil {
+		return err
+	}
+
+	return a.announceLegacy(true)
+}
+
+// announce gossips the local announcement
+func (a *announcer) announce(leaving bool) error {
+	if a.mode == AnnounceOff {
+		return nil
+	}
+
+	local := &Announcement{
+		Protocol:     announceProtocol,
+		Node:         a.d.name,
+		Addr:         a.d.Addr(),
+		Version:      a.version,
+		Capabilities: a.capabilities,
+		Tags:         a.d.Tags(),
+		Leaving:      leaving,
+		Timestamp:    a.clock.Now(),
+	}
+
+	a.mu.Lock()
+	a.nodes[a.d.name] = local
+	a.mu.Unlock()
+
+	a.publish(local)
+
+	data, err := json.Marshal(local)
+	if err != nil {
+		return err
+	}
+
+	a.d.broadcast(messageAnnounceType, data)
+
+	return nil
+}
+
+// announceLegacy sends the node-join and node-leave user events in legacy
+// mode
+func (a *announcer) announceLegacy(leaving bool) error {
+	if a.mode != AnnounceLegacy {
+		return nil
+	}
+
+	info := map[string]string{
+		"name": a.d.Name(),
+		"addr": a.d.Addr(),
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	name := "node-join"
+	if leaving {
+		name = "node-leave"
+	}
+
+	return a.d.SendEvent(name, data, false)
+}
+
+func (a *announcer) publish(an *Announcement) {
+	t := EventMemberAnnounce
+	if an.Leaving {
+		t = EventMemberDepart
+	}
+
+	c := *an
+	a.d.publish(AnnounceEvent{Type: t, Announcement: &c})
+}
+
+// merge applies a remote announcement if it is newer and reports whether
+// it was applied
+func (a *announcer) merge(an *Announcement) bool {
+	// the local node is the only source of its own announcement
+	if an.Node == a.d.name || an.Protocol < 1 {
+		return false
+	}
+
+	a.clock.Update(an.Timestamp)
+
+	a.mu.Lock()
+	cur, ok := a.nodes[an.Node]
+	if ok && !cur.Timestamp.Before(an.Timestamp) {
+		a.mu.Unlock()
+		return false
+	}
+	a.nodes[an.Node] = an
+	a.mu.Unlock()
+
+	// a member that is already known only announces changes
+	if ok && cur.Leaving == an.Leaving && cur.Version == an.Version &&
+		reflect.DeepEqual(cur.Capabilities, an.Capabilities) && reflect.DeepEqual(cur.Tags, an.Tags) {
+		return true
+	}
+
+	a.publish(an)
+
+	return true
+}
+
+func (a *announcer) handleDelta(msg []byte) {
+	var an Announcement
+	if err := json.Unmarshal(msg, &an); err != nil {
+		a.d.decodeError("announce")
+		logrus.Errorf("error decoding announcement: %s", err)
+		return
+	}
+
+	if a.merge(&an) {
+		// pass newer announcements along
+		a.d.rebroadcast(messageAnnounceType, msg)
+	}
+}
+
+func (a *announcer) LocalState(join bool) []byte {
+	a.mu.RLock()
+	nodes := make([]*Announcement, 0, len(a.nodes))
+	for _, an := range a.nodes {
+		nodes = append(nodes, an)
+	}
+	data, err := json.Marshal(nodes)
+	a.mu.RUnlock()
+
+	if err != nil {
+		logrus.Errorf("error encoding announce state: %s", err)
+		return nil
+	}
+
+	return data
+}
+
+func (a *announcer) MergeRemoteState(buf []byte, join bool) {
+	var nodes []*Announcement
+	if err := json.Unmarshal(buf, &nodes); err != nil {
+		a.d.decodeError("announce_state")
+		logrus.Errorf("error decoding announce state: %s", err)
+		return
+	}
+
+	for _, an := range nodes {
+		a.merge(an)
+	}
+}
@@ -0,0 +1,116 @@
+package libdiscover_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestAnnounce(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{
+		Configure: func(i int, cfg *libdiscover.Config) {
+			cfg.Announce = libdiscover.AnnounceGossip
+			cfg.Version = "1.4.2"
+			cfg.Capabilities = []string{"kv", "dns"}
+		},
+	})
+
+	c.WaitFor("every announcement on every node", func() bool {
+		for _, d := range c.Nodes() {
+			if len(d.Announcements()) != c.Len() {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	a, ok := c.Node(0).Announcement(c.Name(2))
+	if !ok || a.Version != "1.4.2" || !a.HasCapability("dns") || a.HasCapability("api") {
+		t.Fatalf("unexpected announcement %+v", a)
+	}
+
+	if a.Tags["dc"] != "dc1" {
+		t.Fatalf("expected the tags in the announcement; got %v", a.Tags)
+	}
+
+	events := make(chan libdiscover.AnnounceEvent, 16)
+	stop := c.Node(0).Subscribe(func(evt serf.Event) {
+		if e, ok := evt.(libdiscover.AnnounceEvent); ok {
+			events <- e
+		}
+	})
+	defer stop()
+
+	// a tag change is announced again
+	if err := c.Node(1).SetTags(map[string]string{"role": "web"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForAnnounce := func(typ serf.EventType, node string) *libdiscover.Announcement {
+		t.Helper()
+
+		timeout := time.After(time.Second * 10)
+		for {
+			select {
+			case e := <-events:
+				if e.Type == typ && e.Announcement.Node == node {
+					return e.Announcement
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for %s from %s", libdiscover.EventTypeName(typ), node)
+			}
+		}
+	}
+
+	if a := waitForAnnounce(libdiscover.EventMemberAnnounce, c.Name(1)); a.Tags["role"] != "web" {
+		t.Fatalf("expected the new tag; got %v", a.Tags)
+	}
+
+	if err := c.Node(2).Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if a := waitForAnnounce(libdiscover.EventMemberDepart, c.Name(2)); !a.Leaving {
+		t.Fatalf("expected a leaving announcement; got %+v", a)
+	}
+}
+
+func TestAnnounceLegacy(t *testing.T) {
+	// legacy is the default
+	c := testcluster.New(t, nil)
+
+	var info map[string]string
+	evt := c.WaitForEvent(0, "node-join")
+	if err := json.Unmarshal(evt.Payload, &info); err != nil {
+		t.Fatal(err)
+	}
+
+	if info["name"] == "" || info["addr"] == "" {
+		t.Fatalf("expected the name and address; got %v", info)
+	}
+
+	if err := c.Node(2).Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		evt := c.WaitForEvent(0, "node-leave")
+		if err := json.Unmarshal(evt.Payload, &info); err != nil {
+			t.Fatal(err)
+		}
+
+		if info["name"] == c.Name(2) {
+			break
+		}
+	}
+
+	// announcements are gossiped as well
+	if _, ok := c.Node(0).Announcement(c.Name(1)); !ok {
+		t.Fatalf("expected the announcement of %s", c.Name(1))
+	}
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+)
+
+// ChaosRule is a libdiscover.ChaosRule with durations such as 100ms
+type ChaosRule struct {
+	Direction string  `json:"direction,omitempty"`
+	Peer      string  `json:"peer,omitempty"`
+	Message   string  `json:"message,omitempty"`
+	Drop      float64 `json:"drop,omitempty"`
+	Duplicate float64 `json:"duplicate,omitempty"`
+	Delay     string  `json:"delay,omitempty"`
+	Jitter    string  `json:"jitter,omitempty"`
+	Reorder   float64 `json:"reorder,omitempty"`
+}
+
+// Chaos is a libdiscover.ChaosConfig with durations such as 100ms
+type Chaos struct {
+	Rules        []ChaosRule `json:"rules"`
+	FreezeEvents bool        `json:"freeze_events"`
+	ClockSkew    string      `json:"clock_skew,omitempty"`
+	Seed         int64       `json:"seed,omitempty"`
+}
+
+// NewChaos returns the API representation of cfg
+func NewChaos(cfg *libdiscover.ChaosConfig) *Chaos {
+	c := &Chaos{
+		Rules:        []ChaosRule{},
+		FreezeEvents: cfg.FreezeEvents,
+		Seed:         cfg.Seed,
+	}
+
+	if cfg.ClockSkew != 0 {
+		c.ClockSkew = cfg.ClockSkew.String()
+	}
+
+	for _, r := range cfg.Rules {
+		rule := ChaosRule{
+			Direction: string(r.Direction),
+			Peer:      r.Peer,
+			Message:   r.Message,
+			Drop:      r.Drop,
+			Duplicate: r.Duplicate,
+			Reorder:   r.Reorder,
+		}
+
+		if r.Delay != 0 {
+			rule.Delay = r.Delay.String()
+		}
+
+		if r.Jitter != 0 {
+			rule.Jitter = r.Jitter.String()
+		}
+
+		c.Rules = append(c.Rules, rule)
+	}
+
+	return c
+}
+
+// Config returns the libdiscover.ChaosConfig of c
+func (c *Chaos) Config() (*libdiscover.ChaosConfig, error) {
+	cfg := &libdiscover.ChaosConfig{
+		FreezeEvents: c.FreezeEvents,
+		Seed:         c.Seed,
+	}
+
+	var err error
+	if cfg.ClockSkew, err = chaosDuration(c.ClockSkew); err != nil {
+		return nil, fmt.Errorf("clock_skew: %s", err)
+	}
+
+	for i, r := range c.Rules {
+		rule := libdiscover.ChaosRule{
+			Direction: libdiscover.ChaosDirection(r.Direction),
+			Peer:      r.Peer,
+			Message:   r.Message,
+			Drop:      r.Drop,
+			Duplicate: r.Duplicate,
+			Reorder:   r.Reorder,
+		}
+
+		if rule.Delay, err = chaosDuration(r.Delay); err != nil {
+			return nil, fmt.Errorf("rule %d: delay: %s", i, err)
+		}
+
+		if rule.Jitter, err = chaosDuration(r.Jitter); err != nil {
+			return nil, fmt.Errorf("rule %d: jitter: %s", i, err)
+		}
+
+		cfg.Rules = append(cfg.Rules, rule)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func chaosDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+func (s *Server) chaos(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	d, ok := s.segment(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var req Chaos
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		cfg, err := req.Config()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := d.SetChaos(cfg); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case http.MethodDelete:
+		if err := d.SetChaos(nil); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, NewChaos(d.Chaos()))
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// eventGap tells a resuming client that events were lost because they
+	// were no longer in the replay buffer
+	eventGap = "gap"
+	// eventOverflow is sent before a slow client is disconnected; it can
+	// reconnect with the id of the last event it received
+	eventOverflow = "overflow"
+
+	// wsCloseTryAgain is the websocket close code sent to slow clients
+	wsCloseTryAgain = 1013
+)
+
+// Event is a cluster event as sent to API clients
+type Event struct {
+	ID      uint64                   `json:"id,omitempty"`
+	Type    string                   `json:"type"`
+	Name    string                   `json:"name,omitempty"`
+	Payload []byte                   `json:"payload,omitempty"`
+	LTime   uint64                   `json:"ltime,omitempty"`
+	Members []Member                 `json:"members,omitempty"`
+	Check   *libdiscover.CheckResult `json:"check,omitempty"`
+
+	Announcement *libdiscover.Announcement `json:"announcement,omitempty"`
+	Heartbeat    *libdiscover.Heartbeat    `json:"heartbeat,omitempty"`
+}
+
+// NewEvent converts a serf or libdiscover event for API clients
+func NewEvent(d *libdiscover.Discover, evt serf.Event) *Event {
+	e := &Event{
+		Type: libdiscover.EventTypeName(evt.EventType()),
+	}
+
+	switch v := evt.(type) {
+	case serf.MemberEvent:
+		for _, m := range v.Members {
+			e.Members = append(e.Members, newMember(d, m))
+		}
+	case serf.UserEvent:
+		e.Name = v.Name
+		e.Payload = v.Payload
+		e.LTime = uint64(v.LTime)
+	case *serf.Query:
+		e.Name = v.Name
+		e.Payload = v.Payload
+		e.LTime = uint64(v.LTime)
+	case libdiscover.HealthEvent:
+		e.Check = v.Check
+	case libdiscover.AnnounceEvent:
+		e.Announcement = v.Announcement
+	case libdiscover.LivenessEvent:
+		e.Heartbeat = v.Heartbeat
+	}
+
+	return e
+}
+
+// events streams cluster events as server-sent events or over a websocket.
+// Clients can filter by event type and name and resume after the id of the
+// last event they received while it is still in the replay buffer.
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	q := r.URL.Query()
+	filter := newEventFilter(q["type"], q["name"])
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if v := q.Get("last_event_id"); v != "" {
+		lastEventID = v
+	}
+
+	var lastID uint64
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid last event id")
+			return
+		}
+		lastID = id
+	}
+
+	// browsers do not apply the same-origin policy to websockets
+	if isWebsocket(r) && !s.allowedOrigin(r) {
+		writeError(w, http.StatusForbidden, "origin not allowed")
+		return
+	}
+
+	c, complete := s.broker.subscribe(filter, lastID, lastEventID != "")
+	defer s.broker.unsubscribe(c)
+
+	if isWebsocket(r) {
+		s.streamWebsocket(w, r, c, complete)
+		return
+	}
+
+	s.streamSSE(w, r, c, complete)
+}
+
+func (s *Server) streamSSE(w http.ResponseWriter, r *http.Request, c *streamClient, complete bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(e *Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		if e.ID > 0 {
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		} else {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		flusher.Flush()
+
+		return err
+	}
+
+	if !complete {
+		if err := write(&Event{Type: eventGap}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-c.ch:
+			if err := write(e); err != nil {
+				return
+			}
+		case <-c.overflow:
+			logrus.Warnf("api: event client too slow; disconnecting: %s", r.RemoteAddr)
+			write(&Event{Type: eventOverflow})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) streamWebsocket(w http.ResponseWriter, r *http.Request, c *streamClient, complete bool) {
+	ws, err := upgradeWebsocket(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	write := func(e *Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		return ws.WriteText(data)
+	}
+
+	if !complete {
+		if err := write(&Event{Type: eventGap}); err != nil {
+			ws.shutdown()
+			return
+		}
+	}
+
+	for {
+		select {
+		case e := <-c.ch:
+			if err := write(e); err != nil {
+				ws.shutdown()
+				return
+			}
+		case <-c.overflow:
+			logrus.Warnf("api: event client too slow; disconnecting: %s", r.RemoteAddr)
+			ws.Close(wsCloseTryAgain, eventOverflow)
+			return
+		case <-ws.Closed():
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSSE returns the next event of the stream
+func readSSE(t *testing.T, r *bufio.Reader) *Event {
+	t.Helper()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.HasPrefix(line, "data: ") {
+			var e Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				t.Fatal(err)
+			}
+
+			return &e
+		}
+	}
+}
+
+func TestEventsSSE(t *testing.T) {
+	c, ts := newTestServer(t, &Config{Token: "secret"})
+
+	// browsers cannot set headers on an EventSource
+	resp, err := http.Get(ts.URL + "/v1/events?type=user&token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200; got %d", resp.StatusCode)
+	}
+
+	if err := c.Node(1).SendEvent("deploy", []byte("v2"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	e := readSSE(t, bufio.NewReader(resp.Body))
+	if e.Type != "user" || e.Name != "deploy" || string(e.Payload) != "v2" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+
+	// a client resuming from before the event is sent it from the buffer
+	resp2, err := http.Get(ts.URL + "/v1/events?type=user&token=secret&last_event_id=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+
+	if e := readSSE(t, bufio.NewReader(resp2.Body)); e.Name != "deploy" {
+		t.Fatalf("expected the buffered event to be replayed; got %+v", e)
+	}
+}
+
+func TestEventsWebsocketOrigin(t *testing.T) {
+	_, ts := newTestServer(t, &Config{AllowedOrigins: []string{"https://dash.example.com"}})
+
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	tests := []struct {
+		origin string
+		code   int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{"http://" + host, http.StatusSwitchingProtocols},
+		{"https://dash.example.com", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", ts.URL+"/v1/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+
+		client := &http.Client{Timeout: time.Second * 5}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.code {
+			t.Errorf("origin %q: expected %d; got %d", tt.origin, tt.code, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/hashicorp/serf/serf"
+)
+
+// maxBodySize limits request bodies; events and queries are far smaller
+const maxBodySize = 64 * 1024
+
+// Member is a cluster member
+type Member struct {
+	Name   string                   `json:"name"`
+	Addr   string                   `json:"addr"`
+	Port   uint16                   `json:"port"`
+	Tags   map[string]string        `json:"tags"`
+	Status string                   `json:"status"`
+	Health libdiscover.HealthStatus `json:"health"`
+}
+
+// QueryResponse is the result of a query
+type QueryResponse struct {
+	Acks      []string          `json:"acks"`
+	Responses map[string][]byte `json:"responses"`
+}
+
+// KeyResponse is the result of a key operation
+type KeyResponse struct {
+	Messages map[string]string `json:"messages"`
+	NumNodes int               `json:"num_nodes"`
+	NumResp  int               `json:"num_resp"`
+	NumErr   int               `json:"num_err"`
+	Keys     map[string]int    `json:"keys"`
+}
+
+type keyRequest struct {
+	Key string `json:"key"`
+}
+
+func newMember(d *libdiscover.Discover, m serf.Member) Member {
+	return Member{
+		Name:   m.Name,
+		Addr:   m.Addr.String(),
+		Port:   m.Port,
+		Tags:   m.Tags,
+		Status: m.Status.String(),
+		Health: d.Health().NodeStatus(m.Name),
+	}
+}
+
+// parseTags parses key:value pairs
+func parseTags(values []string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, v := range values {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid tag filter %q; expected key:value", v)
+		}
+
+		tags[parts[0]] = parts[1]
+	}
+
+	return tags, nil
+}
+
+// segment returns the segment named by the segment parameter or the
+// default pool
+func (s *Server) segment(w http.ResponseWriter, r *http.Request) (*libdiscover.Discover, bool) {
+	d, err := s.d.Segment(r.URL.Query().Get("segment"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+
+	return d, true
+}
+
+func (s *Server) members(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	d, ok := s.segment(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	tags, err := parseTags(q["tag"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	all := d.Members()
+	if dc := q.Get("dc"); dc != "" {
+		if all, err = d.MembersIn(dc); err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+
+	members := []Member{}
+	for _, m := range all {
+		if status := q.Get("status"); status != "" && m.Status.String() != status {
+			continue
+		}
+
+		if !strings.HasPrefix(m.Name, q.Get("name")) {
+			continue
+		}
+
+		match := true
+		for k, v := range tags {
+			if m.Tags[k] != v {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			members = append(members, newMember(d, m))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, members)
+}
+
+func (s *Server) local(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	d, ok := s.segment(w, r)
+	if !ok {
+		return
+	}
+
+	for _, m := range d.Members() {
+		if m.Name == d.Name() {
+			writeJSON(w, http.StatusOK, newMember(d, m))
+			return
+		}
+	}
+
+	writeError(w, http.StatusServiceUnavailable, "local node is not running")
+}
+
+func (s *Server) tags(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	d, ok := s.segment(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		tags := map[string]string{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&tags); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := d.SetTags(tags); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	case http.MethodDelete:
+		if err := d.DeleteTags(r.URL.Query()["key"]...); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, d.Tags())
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	d, ok := s.segment(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, d.Stats())
+}
+
+func (s *Server) coordinate(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	var (
+		coord *coordinate.Coordinate
+		err   error
+	)
+
+	if node := strings.TrimPrefix(r.URL.Path, "/v1/coordinate/"); node != "" && node != r.URL.Path {
+		c, ok := s.d.MemberCoordinate(node)
+		if !ok {
+			writeError(w, http.StatusNotFound, "no coordinate for member "+node)
+			return
+		}
+
+		coord = c
+	} else {
+		coord, err = s.d.Coordinate()
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, coord)
+}
+
+func (s *Server) event(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost, http.MethodPut) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/event/")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "event name required")
+		return
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	coalesce, _ := strconv.ParseBool(r.URL.Query().Get("coalesce"))
+
+	d, ok := s.segment(w, r)
+	if !ok {
+		return
+	}
+
+	if err := d.SendEventIn(r.URL.Query().Get("dc"), name, payload, coalesce); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost, http.MethodPut) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/query/")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "query name required")
+		return
+	}
+
+	if libdiscover.ReservedQuery(name) {
+		writeError(w, http.StatusBadRequest, libdiscover.ErrReservedQuery.Error())
+		return
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	q := r.URL.Query()
+	tags, err := parseTags(q["tag"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	params := &serf.QueryParam{
+		FilterNodes: q["node"],
+		FilterTags:  tags,
+	}
+	params.RequestAck, _ = strconv.ParseBool(q.Get("ack"))
+
+	if params.Timeout, err = parseDuration(r, "timeout", 0); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	d, ok := s.segment(w, r)
+	if !ok {
+		return
+	}
+
+	result := QueryResponse{
+		Acks:      []string{},
+		Responses: map[string][]byte{},
+	}
+
+	// queries for other datacenters are relayed by the gateways without
+	// acks
+	if dc := q.Get("dc"); dc != "" && dc != d.Datacenter() {
+		responses, err := d.QueryIn(dc, name, payload, params)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+
+		for _, nr := range responses {
+			result.Responses[nr.From] = nr.Payload
+		}
+
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	resp, err := d.Query(name, payload, params)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ackCh := resp.AckCh()
+	respCh := resp.ResponseCh()
+	for ackCh != nil || respCh != nil {
+		select {
+		case a, ok := <-ackCh:
+			if !ok {
+				ackCh = nil
+				continue
+			}
+			result.Acks = append(result.Acks, a)
+		case nr, ok := <-respCh:
+			if !ok {
+				respCh = nil
+				continue
+			}
+			result.Responses[nr.From] = nr.Payload
+		case <-r.Context().Done():
+			resp.Close()
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) datacenters(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	dcs, err := s.d.Datacenters()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, dcs)
+}
+
+func (s *Server) segments(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.d.Segments())
+}
+
+func (s *Server) forceLeave(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost, http.MethodPut) {
+		return
+	}
+
+	d, ok := s.segment(w, r)
+	if !ok {
+		return
+	}
+
+	node := strings.TrimPrefix(r.URL.Path, "/v1/force-leave/")
+	if node == "" {
+		writeError(w, http.StatusBadRequest, "node name required")
+		return
+	}
+
+	if err := d.ForceLeave(node); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) keys(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	d, ok := s.segment(w, r)
+	if !ok {
+		return
+	}
+
+	var req keyRequest
+	if r.Method != http.MethodGet {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if req.Key == "" {
+			writeError(w, http.StatusBadRequest, "key required")
+			return
+		}
+	}
+
+	var (
+		resp *serf.KeyResponse
+		err  error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		resp, err = d.ListKeys()
+	case http.MethodPost:
+		resp, err = d.InstallKey(req.Key)
+	case http.MethodPut:
+		resp, err = d.UseKey(req.Key)
+	case http.MethodDelete:
+		resp, err = d.RemoveKey(req.Key)
+	}
+
+	if resp == nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		// the response still holds the per node errors
+		status = http.StatusInternalServerError
+	}
+
+	writeJSON(w, status, KeyResponse{
+		Messages: resp.Messages,
+		NumNodes: resp.NumNodes,
+		NumResp:  resp.NumResp,
+		NumErr:   resp.NumErr,
+		Keys:     resp.Keys,
+	})
+}
+
+func (s *Server) heartbeats(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		status, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := s.d.Liveness().Beat(status); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, s.d.Liveness().Heartbeats())
+}
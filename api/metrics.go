@@ -0,0 +1,98 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/ehazlett/libdiscover"
+)
+
+// MetricsInterval is an interval of the in-memory metrics sink
+type MetricsInterval struct {
+	Interval time.Time         `json:"interval"`
+	Gauges   []Gauge           `json:"gauges"`
+	Counters []AggregateSample `json:"counters"`
+	Samples  []AggregateSample `json:"samples"`
+}
+
+// Gauge is the last value of a gauge in an interval
+type Gauge struct {
+	Name  string  `json:"name"`
+	Value float32 `json:"value"`
+}
+
+// AggregateSample summarizes the values of a counter or timer in an
+// interval; timers are in milliseconds
+type AggregateSample struct {
+	Name   string  `json:"name"`
+	Count  int     `json:"count"`
+	Sum    float64 `json:"sum"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	Stddev float64 `json:"stddev"`
+}
+
+// NewMetricsIntervals returns the API representation of the intervals kept
+// by an in-memory sink, oldest first
+func NewMetricsIntervals(inm *metrics.InmemSink) []*MetricsInterval {
+	intervals := []*MetricsInterval{}
+	for _, data := range inm.Data() {
+		data.RLock()
+
+		intv := &MetricsInterval{
+			Interval: data.Interval,
+			Gauges:   []Gauge{},
+			Counters: aggregateSamples(data.Counters),
+			Samples:  aggregateSamples(data.Samples),
+		}
+
+		for name, v := range data.Gauges {
+			intv.Gauges = append(intv.Gauges, Gauge{Name: name, Value: v})
+		}
+		sort.Slice(intv.Gauges, func(i, j int) bool { return intv.Gauges[i].Name < intv.Gauges[j].Name })
+
+		data.RUnlock()
+
+		intervals = append(intervals, intv)
+	}
+
+	return intervals
+}
+
+func aggregateSamples(m map[string]*metrics.AggregateSample) []AggregateSample {
+	samples := []AggregateSample{}
+	for name, a := range m {
+		samples = append(samples, AggregateSample{
+			Name:   name,
+			Count:  a.Count,
+			Sum:    a.Sum,
+			Min:    a.Min,
+			Max:    a.Max,
+			Mean:   a.Mean(),
+			Stddev: a.Stddev(),
+		})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Name < samples[j].Name })
+
+	return samples
+}
+
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+
+	switch sink := s.d.Metrics().(type) {
+	case *metrics.InmemSink:
+		writeJSON(w, http.StatusOK, NewMetricsIntervals(sink))
+	case *libdiscover.PrometheusSink:
+		sink.ServeHTTP(w, r)
+	case nil:
+		writeError(w, http.StatusNotFound, "metrics are not enabled")
+	default:
+		writeError(w, http.StatusNotFound, "metrics are sent to an external sink")
+	}
+}
@@ -0,0 +1,239 @@
+// Package api serves an HTTP/JSON management API for a Discover instance.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAddr = "127.0.0.1:7947"
+
+	tokenHeader = "X-Discover-Token"
+)
+
+// Config configures the API server
+type Config struct {
+	// Addr is the listen address; defaults to 127.0.0.1:7947
+	Addr string
+	// Token, when set, must be sent by clients as a bearer token, in the
+	// X-Discover-Token header or, for browser event streams that cannot set
+	// headers, in the token parameter
+	Token string
+	// AllowedOrigins are the browser origins, such as
+	// https://dash.example.com, that may change state or open a websocket
+	// to /v1/events besides the origin of the API itself; "*" allows any
+	// origin
+	AllowedOrigins []string
+	// ReplayBuffer is the number of recent events kept so that event stream
+	// clients can resume; defaults to 1024
+	ReplayBuffer int
+	// ClientBuffer is the number of events queued for a stream client
+	// before it is considered too slow and disconnected; defaults to 256
+	ClientBuffer int
+	// EnableChaos serves /v1/chaos to inject faults at runtime; it is meant
+	// for staging and off by default
+	EnableChaos bool
+}
+
+// Server is the HTTP API server
+type Server struct {
+	d   *libdiscover.Discover
+	cfg Config
+	mux *http.ServeMux
+	srv *http.Server
+
+	broker      *broker
+	unsubscribe func()
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// New returns an API server for d
+func New(d *libdiscover.Discover, cfg *Config) *Server {
+	s := &Server{
+		d:   d,
+		cfg: *cfg,
+		mux: http.NewServeMux(),
+	}
+
+	if s.cfg.Addr == "" {
+		s.cfg.Addr = defaultAddr
+	}
+
+	s.mux.HandleFunc("/v1/members", s.members)
+	s.mux.HandleFunc("/v1/local", s.local)
+	s.mux.HandleFunc("/v1/datacenters", s.datacenters)
+	s.mux.HandleFunc("/v1/segments", s.segments)
+	s.mux.HandleFunc("/v1/tags", s.tags)
+	s.mux.HandleFunc("/v1/stats", s.stats)
+	s.mux.HandleFunc("/v1/coordinate", s.coordinate)
+	s.mux.HandleFunc("/v1/coordinate/", s.coordinate)
+	s.mux.HandleFunc("/v1/event/", s.event)
+	s.mux.HandleFunc("/v1/query/", s.query)
+	s.mux.HandleFunc("/v1/force-leave/", s.forceLeave)
+	s.mux.HandleFunc("/v1/keys", s.keys)
+	s.mux.HandleFunc("/v1/heartbeats", s.heartbeats)
+	s.mux.HandleFunc("/v1/events", s.events)
+	s.mux.HandleFunc("/v1/metrics", s.metrics)
+
+	if s.cfg.EnableChaos {
+		s.mux.HandleFunc("/v1/chaos", s.chaos)
+	}
+
+	s.broker = newBroker(s.cfg.ReplayBuffer, s.cfg.ClientBuffer)
+	s.unsubscribe = d.Subscribe(func(evt serf.Event) {
+		s.broker.publish(NewEvent(d, evt))
+	})
+
+	s.srv = &http.Server{
+		Addr:    s.cfg.Addr,
+		Handler: s.Handler(),
+	}
+
+	return s
+}
+
+// Handle registers an additional handler on the API under the same
+// authentication
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// Handler returns the authenticated API handler.  Requests that change
+// state must come from an allowed origin and send their body as
+// application/json, which a page on another site cannot do without a CORS
+// preflight.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if !s.allowedOrigin(r) {
+				writeError(w, http.StatusForbidden, "origin not allowed")
+				return
+			}
+
+			if r.ContentLength != 0 && !isJSON(r) {
+				writeError(w, http.StatusUnsupportedMediaType, "content type must be application/json")
+				return
+			}
+		}
+
+		s.mux.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe serves the API until Shutdown
+func (s *Server) ListenAndServe() error {
+	logrus.Debugf("api: listening on %s", s.cfg.Addr)
+
+	if err := s.srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.unsubscribe()
+
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.cfg.Token == "" {
+		return true
+	}
+
+	token := r.URL.Query().Get("token")
+	if v := r.Header.Get(tokenHeader); v != "" {
+		token = v
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1
+}
+
+// allowedOrigin reports whether a browser on the origin of the request may
+// use the API.  Requests without an Origin header are not from a browser.
+func (s *Server) allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, o := range s.cfg.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// isJSON reports whether the request body is sent as application/json
+func isJSON(r *http.Request) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == "application/json"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Errorf("api: error encoding response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+// allow writes a method not allowed error unless the request uses one of
+// the methods
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+
+	return false
+}
+
+func parseDuration(r *http.Request, key string, def time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+
+	return time.ParseDuration(v)
+}
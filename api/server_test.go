@@ -0,0 +1,270 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+)
+
+// newTestServer serves the API of node 0 of a new cluster
+func newTestServer(t *testing.T, cfg *Config) (*testcluster.Cluster, *httptest.Server) {
+	t.Helper()
+
+	c := testcluster.New(t, nil)
+
+	s := New(c.Node(0), cfg)
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+	})
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	return c, ts
+}
+
+// do sends the request and decodes the JSON response into v unless v is nil.
+// Bodies are sent as JSON unless the header sets a content type.
+func do(t *testing.T, method, url string, body io.Reader, header http.Header, v interface{}) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	for k, vals := range header {
+		req.Header[k] = vals
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("error decoding %s %s: %s", method, url, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestMembers(t *testing.T) {
+	c, ts := newTestServer(t, &Config{})
+
+	var members []Member
+	if code := do(t, "GET", ts.URL+"/v1/members", nil, nil, &members); code != http.StatusOK {
+		t.Fatalf("expected 200; got %d", code)
+	}
+
+	if len(members) != c.Len() {
+		t.Fatalf("expected %d members; got %d", c.Len(), len(members))
+	}
+
+	for _, m := range members {
+		if m.Status != "alive" || m.Health != libdiscover.HealthPassing {
+			t.Fatalf("expected alive and passing members; got %+v", m)
+		}
+	}
+
+	if code := do(t, "GET", ts.URL+"/v1/members?name="+c.Name(1), nil, nil, &members); code != http.StatusOK {
+		t.Fatalf("expected 200; got %d", code)
+	}
+
+	if len(members) != 1 || members[0].Name != c.Name(1) {
+		t.Fatalf("expected %s only; got %+v", c.Name(1), members)
+	}
+
+	if code := do(t, "GET", ts.URL+"/v1/members?tag=invalid", nil, nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid tag filter; got %d", code)
+	}
+
+	if code := do(t, "POST", ts.URL+"/v1/members", nil, nil, nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405; got %d", code)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	c, ts := newTestServer(t, &Config{})
+
+	var m Member
+	if code := do(t, "GET", ts.URL+"/v1/local", nil, nil, &m); code != http.StatusOK {
+		t.Fatalf("expected 200; got %d", code)
+	}
+
+	if m.Name != c.Name(0) {
+		t.Fatalf("expected %s; got %s", c.Name(0), m.Name)
+	}
+}
+
+func TestTags(t *testing.T) {
+	c, ts := newTestServer(t, &Config{})
+
+	tags := map[string]string{}
+	if code := do(t, "PUT", ts.URL+"/v1/tags", strings.NewReader(`{"role":"web"}`), nil, &tags); code != http.StatusOK {
+		t.Fatalf("expected 200; got %d", code)
+	}
+
+	if tags["role"] != "web" {
+		t.Fatalf("expected the role tag; got %v", tags)
+	}
+
+	c.WaitFor("role tag on node-1", func() bool {
+		for _, m := range c.Node(1).Members() {
+			if m.Name == c.Name(0) {
+				return m.Tags["role"] == "web"
+			}
+		}
+
+		return false
+	})
+
+	tags = map[string]string{}
+	if code := do(t, "DELETE", ts.URL+"/v1/tags?key=role", nil, nil, &tags); code != http.StatusOK {
+		t.Fatalf("expected 200; got %d", code)
+	}
+
+	if _, ok := tags["role"]; ok {
+		t.Fatalf("expected the role tag to be deleted; got %v", tags)
+	}
+
+	if code := do(t, "PUT", ts.URL+"/v1/tags", strings.NewReader(`[`), nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid JSON; got %d", code)
+	}
+}
+
+func TestEvent(t *testing.T) {
+	c, ts := newTestServer(t, &Config{})
+
+	if code := do(t, "POST", ts.URL+"/v1/event/deploy", strings.NewReader("v2"), nil, nil); code != http.StatusNoContent {
+		t.Fatalf("expected 204; got %d", code)
+	}
+
+	if evt := c.WaitForEvent(1, "deploy"); string(evt.Payload) != "v2" {
+		t.Fatalf("expected payload v2; got %q", evt.Payload)
+	}
+
+	if code := do(t, "POST", ts.URL+"/v1/event/", nil, nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a name; got %d", code)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	c, ts := newTestServer(t, &Config{})
+
+	var result QueryResponse
+	if code := do(t, "POST", ts.URL+"/v1/query/ping?ack=true&timeout=1s", nil, nil, &result); code != http.StatusOK {
+		t.Fatalf("expected 200; got %d", code)
+	}
+
+	if len(result.Acks) != c.Len() {
+		t.Fatalf("expected %d acks; got %v", c.Len(), result.Acks)
+	}
+}
+
+func TestQueryReserved(t *testing.T) {
+	_, ts := newTestServer(t, &Config{})
+
+	var e errorResponse
+	if code := do(t, "POST", ts.URL+"/v1/query/libdiscover:lock", strings.NewReader(`{"op":"release"}`), nil, &e); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an internal query; got %d", code)
+	}
+
+	if e.Error != libdiscover.ErrReservedQuery.Error() {
+		t.Fatalf("unexpected error: %s", e.Error)
+	}
+}
+
+func TestCrossSiteRequests(t *testing.T) {
+	_, ts := newTestServer(t, &Config{AllowedOrigins: []string{"https://dash.example.com"}})
+
+	evil := http.Header{"Origin": {"https://evil.example.com"}}
+	text := http.Header{"Content-Type": {"text/plain"}}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header http.Header
+		code   int
+	}{
+		{"read from another origin", "GET", "/v1/tags", "", evil, http.StatusOK},
+		{"tags from another origin", "PUT", "/v1/tags", `{"role":"web"}`, evil, http.StatusForbidden},
+		{"tags delete from another origin", "DELETE", "/v1/tags?key=role", "", evil, http.StatusForbidden},
+		{"tags as text", "PUT", "/v1/tags", `{"role":"web"}`, text, http.StatusUnsupportedMediaType},
+		{"event from another origin", "POST", "/v1/event/deploy", "v2", evil, http.StatusForbidden},
+		{"event as text", "POST", "/v1/event/deploy", "v2", text, http.StatusUnsupportedMediaType},
+		{"event as form", "POST", "/v1/event/deploy", "a=b", http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}, http.StatusUnsupportedMediaType},
+		{"keys from another origin", "POST", "/v1/keys", `{"key":"x"}`, evil, http.StatusForbidden},
+		{"keys as text", "POST", "/v1/keys", `{"key":"x"}`, text, http.StatusUnsupportedMediaType},
+		{"force leave from another origin", "POST", "/v1/force-leave/node-9", "", evil, http.StatusForbidden},
+		{"event from an allowed origin", "POST", "/v1/event/deploy", "v2", http.Header{"Origin": {"https://dash.example.com"}}, http.StatusNoContent},
+		{"event from the same origin", "POST", "/v1/event/deploy", "v2", http.Header{"Origin": {ts.URL}}, http.StatusNoContent},
+		{"event with a charset", "POST", "/v1/event/deploy", "v2", http.Header{"Content-Type": {"application/json; charset=utf-8"}}, http.StatusNoContent},
+	}
+
+	for _, tc := range tests {
+		var body io.Reader
+		if tc.body != "" {
+			body = strings.NewReader(tc.body)
+		}
+
+		if code := do(t, tc.method, ts.URL+tc.path, body, tc.header, nil); code != tc.code {
+			t.Errorf("%s: expected %d; got %d", tc.name, tc.code, code)
+		}
+	}
+}
+
+func TestToken(t *testing.T) {
+	_, ts := newTestServer(t, &Config{Token: "secret"})
+
+	tests := []struct {
+		name   string
+		header http.Header
+		code   int
+	}{
+		{"none", nil, http.StatusUnauthorized},
+		{"wrong", http.Header{"Authorization": {"Bearer wrong"}}, http.StatusUnauthorized},
+		{"bearer", http.Header{"Authorization": {"Bearer secret"}}, http.StatusOK},
+		{"header", http.Header{tokenHeader: {"secret"}}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := do(t, "GET", ts.URL+"/v1/local", nil, tt.header, nil); code != tt.code {
+				t.Fatalf("expected %d; got %d", tt.code, code)
+			}
+		})
+	}
+}
+
+func TestSegmentNotFound(t *testing.T) {
+	_, ts := newTestServer(t, &Config{})
+
+	if code := do(t, "GET", ts.URL+"/v1/members?segment=missing", nil, nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404; got %d", code)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	_, ts := newTestServer(t, &Config{})
+
+	if code := do(t, "GET", ts.URL+"/v1/metrics", nil, nil, nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 without metrics; got %d", code)
+	}
+}
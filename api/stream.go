@@ -0,0 +1,180 @@
+package api
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	defaultReplayBuffer = 1024
+	defaultClientBuffer = 256
+)
+
+// eventFilter limits the events sent to a client
+type eventFilter struct {
+	types map[string]bool
+	names []string
+}
+
+func newEventFilter(types, names []string) *eventFilter {
+	f := &eventFilter{
+		types: map[string]bool{},
+		names: names,
+	}
+
+	for _, t := range types {
+		f.types[t] = true
+	}
+
+	return f
+}
+
+// match reports whether the event passes the filter.  Names ending in *
+// match by prefix.
+func (f *eventFilter) match(e *Event) bool {
+	if len(f.types) > 0 && !f.types[e.Type] {
+		return false
+	}
+
+	if len(f.names) == 0 {
+		return true
+	}
+
+	for _, n := range f.names {
+		if strings.HasSuffix(n, "*") && strings.HasPrefix(e.Name, strings.TrimSuffix(n, "*")) {
+			return true
+		}
+
+		if n == e.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamClient is a connected event stream.  When a client cannot keep up
+// its buffer overflows and it is disconnected so that it can resume from
+// the replay buffer instead of silently missing events.
+type streamClient struct {
+	filter   *eventFilter
+	ch       chan *Event
+	overflow chan struct{}
+	once     sync.Once
+}
+
+func (c *streamClient) send(e *Event) {
+	if !c.filter.match(e) {
+		return
+	}
+
+	select {
+	case c.ch <- e:
+	default:
+		c.once.Do(func() {
+			close(c.overflow)
+		})
+	}
+}
+
+// broker numbers events, keeps the most recent ones for replay and fans
+// them out to stream clients
+type broker struct {
+	mu           sync.Mutex
+	replay       []*Event
+	size         int
+	lastID       uint64
+	clientBuffer int
+	clients      map[*streamClient]struct{}
+}
+
+func newBroker(replay, clientBuffer int) *broker {
+	if replay <= 0 {
+		replay = defaultReplayBuffer
+	}
+
+	if clientBuffer <= 0 {
+		clientBuffer = defaultClientBuffer
+	}
+
+	return &broker{
+		replay:       make([]*Event, 0, replay),
+		size:         replay,
+		clientBuffer: clientBuffer,
+		clients:      map[*streamClient]struct{}{},
+	}
+}
+
+func (b *broker) publish(e *Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e.ID = b.lastID
+
+	if len(b.replay) == b.size {
+		copy(b.replay, b.replay[1:])
+		b.replay = b.replay[:b.size-1]
+	}
+	b.replay = append(b.replay, e)
+
+	for c := range b.clients {
+		c.send(e)
+	}
+}
+
+// subscribe registers a client and queues the events after lastID that are
+// still in the replay buffer.  It reports false when events after lastID
+// have already been dropped from the buffer, or when lastID was handed out
+// before the server restarted and numbering started over.
+func (b *broker) subscribe(filter *eventFilter, lastID uint64, resume bool) (*streamClient, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := &streamClient{
+		filter:   filter,
+		overflow: make(chan struct{}),
+	}
+
+	complete := true
+	backlog := []*Event{}
+	if resume {
+		if lastID > b.lastID {
+			// the client resumes from an earlier process; every event
+			// since the restart is new to it
+			complete = false
+			lastID = 0
+		}
+
+		if len(b.replay) > 0 && b.replay[0].ID > lastID+1 {
+			complete = false
+		}
+
+		for _, e := range b.replay {
+			if e.ID > lastID && filter.match(e) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	size := b.clientBuffer
+	if len(backlog) > size {
+		size = len(backlog)
+	}
+
+	c.ch = make(chan *Event, size)
+	for _, e := range backlog {
+		c.ch <- e
+	}
+
+	b.clients[c] = struct{}{}
+
+	return c, complete
+}
+
+func (b *broker) unsubscribe(c *streamClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.clients, c)
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+// ids drains the events queued for the client
+func ids(c *streamClient) []uint64 {
+	ids := []uint64{}
+	for {
+		select {
+		case e := <-c.ch:
+			ids = append(ids, e.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestBrokerResume(t *testing.T) {
+	b := newBroker(3, 0)
+	for i := 0; i < 5; i++ {
+		b.publish(&Event{Type: "user"})
+	}
+
+	tests := []struct {
+		name     string
+		lastID   uint64
+		ids      []uint64
+		complete bool
+	}{
+		{"in buffer", 3, []uint64{4, 5}, true},
+		{"buffer start", 2, []uint64{3, 4, 5}, true},
+		{"dropped", 1, []uint64{3, 4, 5}, false},
+		{"up to date", 5, []uint64{}, true},
+		// the server restarted after handing out id 9
+		{"restarted", 9, []uint64{3, 4, 5}, false},
+	}
+
+	filter := newEventFilter(nil, nil)
+	for _, tc := range tests {
+		c, complete := b.subscribe(filter, tc.lastID, true)
+		b.unsubscribe(c)
+
+		if complete != tc.complete {
+			t.Errorf("%s: expected complete %v; got %v", tc.name, tc.complete, complete)
+		}
+
+		if got := ids(c); !reflect.DeepEqual(got, tc.ids) {
+			t.Errorf("%s: expected %v; got %v", tc.name, tc.ids, got)
+		}
+	}
+}
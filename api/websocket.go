@@ -0,0 +1,225 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is the key suffix defined by RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+
+	wsWriteTimeout = time.Second * 10
+
+	// maxControlFrame is the largest control frame allowed by RFC 6455
+	maxControlFrame = 125
+)
+
+// wsConn is the server side of a websocket that only sends text messages;
+// frames from the client are read to answer pings and closes
+type wsConn struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	mu     sync.Mutex
+	closed chan struct{}
+	once   sync.Once
+}
+
+func isWebsocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// upgradeWebsocket performs the opening handshake
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("unsupported websocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("missing websocket key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("websocket not supported")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", accept)
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &wsConn{
+		conn:   conn,
+		rw:     rw,
+		closed: make(chan struct{}),
+	}
+
+	go ws.readLoop()
+
+	return ws, nil
+}
+
+// Closed is closed when the client goes away
+func (ws *wsConn) Closed() <-chan struct{} {
+	return ws.closed
+}
+
+func (ws *wsConn) WriteText(data []byte) error {
+	return ws.writeFrame(wsOpText, data)
+}
+
+// Close sends a close frame with the status code and closes the connection
+func (ws *wsConn) Close(code uint16, reason string) error {
+	if len(reason) > maxControlFrame-2 {
+		reason = reason[:maxControlFrame-2]
+	}
+
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	payload = append(payload, reason...)
+
+	err := ws.writeFrame(wsOpClose, payload)
+	ws.shutdown()
+
+	return err
+}
+
+func (ws *wsConn) shutdown() {
+	ws.once.Do(func() {
+		close(ws.closed)
+		ws.conn.Close()
+	})
+}
+
+func (ws *wsConn) writeFrame(op byte, data []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	header := []byte{0x80 | op}
+	switch n := len(data); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127)
+		l := make([]byte, 8)
+		binary.BigEndian.PutUint64(l, uint64(n))
+		header = append(header, l...)
+	}
+
+	// a client that stops reading eventually blocks the write
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+
+	if _, err := ws.rw.Write(header); err != nil {
+		return err
+	}
+
+	if _, err := ws.rw.Write(data); err != nil {
+		return err
+	}
+
+	return ws.rw.Flush()
+}
+
+func (ws *wsConn) readLoop() {
+	defer ws.shutdown()
+
+	for {
+		op, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+
+		switch op {
+		case wsOpClose:
+			ws.writeFrame(wsOpClose, payload)
+			return
+		case wsOpPing:
+			if err := ws.writeFrame(wsOpPong, payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (ws *wsConn) readFrame() (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(ws.rw, h[:]); err != nil {
+		return 0, nil, err
+	}
+
+	op := h[0] & 0x0f
+	masked := h[1]&0x80 != 0
+	n := uint64(h[1] & 0x7f)
+
+	switch n {
+	case 126:
+		var l [2]byte
+		if _, err := io.ReadFull(ws.rw, l[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(l[:]))
+	case 127:
+		var l [8]byte
+		if _, err := io.ReadFull(ws.rw, l[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(l[:])
+	}
+
+	// clients only send control frames and small messages
+	if n > maxBodySize {
+		return 0, nil, fmt.Errorf("websocket frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return op, payload, nil
+}
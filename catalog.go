@@ -0,0 +1,369 @@
+package libdiscover
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const catalogStateName = "catalog"
+
+// Service is an instance of a service running on a member
+type Service struct {
+	// ID is unique per node; defaults to the service name
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Version  string            `json:"version,omitempty"`
+	Address  string            `json:"address,omitempty"`
+	Port     int               `json:"port"`
+	Protocol string            `json:"protocol,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	// Node is the member running the instance; it is set on registration
+	Node string `json:"node"`
+}
+
+// ServiceQuery filters service lookups.  Empty fields match everything.
+type ServiceQuery struct {
+	Name    string
+	Version string
+	Meta    map[string]string
+}
+
+func (q *ServiceQuery) match(s *Service) bool {
+	if q == nil {
+		return true
+	}
+
+	if q.Name != "" && q.Name != s.Name {
+		return false
+	}
+
+	if q.Version != "" && q.Version != s.Version {
+		return false
+	}
+
+	for k, v := range q.Meta {
+		if s.Meta[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nodeServices is the set of services owned by a node.  A node always
+// gossips its full set so the newest set replaces older ones.
+type nodeServices struct {
+	Node      string              `json:"node"`
+	Timestamp Timestamp           `json:"timestamp"`
+	Services  map[string]*Service `json:"services"`
+}
+
+type catalogWatcher struct {
+	query  ServiceQuery
+	fn     func(services []*Service)
+	ch     chan struct{}
+	last   []*Service
+	stopCh chan struct{}
+}
+
+// Catalog is the cluster wide registry of services.  Services are owned by
+// the node that registered them and are only returned while that node is
+// alive, so they disappear when the node leaves or fails.
+type Catalog struct {
+	d     *Discover
+	clock *hlc
+
+	mu       sync.RWMutex
+	nodes    map[string]*nodeServices
+	watchers map[int]*catalogWatcher
+	watchID  int
+}
+
+func newCatalog(d *Discover) *Catalog {
+	c := &Catalog{
+		d:        d,
+		clock:    d.newHLC(),
+		nodes:    map[string]*nodeServices{},
+		watchers: map[int]*catalogWatcher{},
+	}
+
+	// a restarted node replaces the services of its previous run
+	c.nodes[d.name] = &nodeServices{
+		Node:      d.name,
+		Timestamp: c.clock.Now(),
+		Services:  map[string]*Service{},
+	}
+
+	d.handleMessage(messageServiceType, c.handleDelta)
+	d.handleState(catalogStateName, c)
+
+	d.Subscribe(func(evt serf.Event) {
+		e, ok := evt.(serf.MemberEvent)
+		if !ok {
+			return
+		}
+
+		if e.Type == serf.EventMemberReap {
+			c.mu.Lock()
+			for _, m := range e.Members {
+				if m.Name != d.name {
+					delete(c.nodes, m.Name)
+				}
+			}
+			c.mu.Unlock()
+		}
+
+		// member status decides which services are visible
+		c.notify()
+	})
+
+	return c
+}
+
+// Catalog returns the service catalog
+func (d *Discover) Catalog() *Catalog {
+	return d.catalog
+}
+
+// Register adds or replaces a service on the local node
+func (c *Catalog) Register(s *Service) error {
+	if s.Name == "" {
+		return fmt.Errorf("service name cannot be empty")
+	}
+
+	svc := *s
+	if svc.ID == "" {
+		svc.ID = svc.Name
+	}
+
+	if svc.Address == "" {
+		svc.Address = c.d.advertiseHost()
+	}
+
+	svc.Node = c.d.name
+
+	return c.updateLocal(func(services map[string]*Service) {
+		services[svc.ID] = &svc
+	})
+}
+
+// Deregister removes a service from the local node
+func (c *Catalog) Deregister(id string) error {
+	return c.updateLocal(func(services map[string]*Service) {
+		delete(services, id)
+	})
+}
+
+// Lookup returns the services on alive members that match the query
+// sorted by node and id
+func (c *Catalog) Lookup(q *ServiceQuery) []*Service {
+	alive := map[string]bool{
+		c.d.name: true,
+	}
+	for _, m := range c.d.Members() {
+		if m.Status == serf.StatusAlive {
+			alive[m.Name] = true
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	services := []*Service{}
+	for node, ns := range c.nodes {
+		if !alive[node] {
+			continue
+		}
+
+		for _, s := range ns.Services {
+			if !q.match(s) {
+				continue
+			}
+
+			svc := *s
+			services = append(services, &svc)
+		}
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Node != services[j].Node {
+			return services[i].Node < services[j].Node
+		}
+
+		return services[i].ID < services[j].ID
+	})
+
+	return services
+}
+
+// Watch calls fn with the matching services whenever they change.  fn is
+// called once with the current services.  The returned func stops the
+// watch.
+func (c *Catalog) Watch(q *ServiceQuery, fn func(services []*Service)) func() {
+	w := &catalogWatcher{
+		fn:     fn,
+		ch:     make(chan struct{}, 1),
+		stopCh: make(chan struct{}),
+	}
+
+	if q != nil {
+		w.query = *q
+	}
+
+	c.mu.Lock()
+	id := c.watchID
+	c.watchID++
+	c.watchers[id] = w
+	c.mu.Unlock()
+
+	go func() {
+		first := true
+		for {
+			select {
+			case <-w.ch:
+				services := c.Lookup(&w.query)
+				if !first && reflect.DeepEqual(services, w.last) {
+					continue
+				}
+
+				first = false
+				w.last = services
+				w.fn(services)
+			case <-w.stopCh:
+				return
+			}
+		}
+	}()
+
+	w.ch <- struct{}{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			delete(c.watchers, id)
+			c.mu.Unlock()
+
+			close(w.stopCh)
+		})
+	}
+}
+
+// notify wakes every watcher; changes are coalesced
+func (c *Catalog) notify() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, w := range c.watchers {
+		select {
+		case w.ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *Catalog) updateLocal(fn func(services map[string]*Service)) error {
+	c.mu.Lock()
+	cur := c.nodes[c.d.name]
+
+	next := &nodeServices{
+		Node:      c.d.name,
+		Timestamp: c.clock.Now(),
+		Services:  make(map[string]*Service, len(cur.Services)),
+	}
+	for id, s := range cur.Services {
+		next.Services[id] = s
+	}
+
+	fn(next.Services)
+	c.nodes[c.d.name] = next
+	c.mu.Unlock()
+
+	c.notify()
+
+	data, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+
+	c.d.broadcast(messageServiceType, data)
+
+	return nil
+}
+
+// merge applies the services of a remote node if they are newer and
+// reports whether they were applied
+func (c *Catalog) merge(ns *nodeServices) bool {
+	// the local node is the only source of its own services
+	if ns.Node == c.d.name {
+		return false
+	}
+
+	c.clock.Update(ns.Timestamp)
+
+	c.mu.Lock()
+	if cur, ok := c.nodes[ns.Node]; ok && !cur.Timestamp.Before(ns.Timestamp) {
+		c.mu.Unlock()
+		return false
+	}
+
+	if ns.Services == nil {
+		ns.Services = map[string]*Service{}
+	}
+	c.nodes[ns.Node] = ns
+	c.mu.Unlock()
+
+	c.notify()
+
+	return true
+}
+
+func (c *Catalog) handleDelta(msg []byte) {
+	var ns nodeServices
+	if err := json.Unmarshal(msg, &ns); err != nil {
+		c.d.decodeError("catalog")
+		logrus.Errorf("error decoding services: %s", err)
+		return
+	}
+
+	if c.merge(&ns) {
+		// pass newer changes along
+		c.d.rebroadcast(messageServiceType, msg)
+	}
+}
+
+func (c *Catalog) LocalState(join bool) []byte {
+	c.mu.RLock()
+	nodes := make([]*nodeServices, 0, len(c.nodes))
+	for _, ns := range c.nodes {
+		nodes = append(nodes, ns)
+	}
+	data, err := json.Marshal(nodes)
+	c.mu.RUnlock()
+
+	if err != nil {
+		logrus.Errorf("error encoding catalog state: %s", err)
+		return nil
+	}
+
+	return data
+}
+
+func (c *Catalog) MergeRemoteState(buf []byte, join bool) {
+	var nodes []*nodeServices
+	if err := json.Unmarshal(buf, &nodes); err != nil {
+		c.d.decodeError("catalog_state")
+		logrus.Errorf("error decoding catalog state: %s", err)
+		return
+	}
+
+	for _, ns := range nodes {
+		c.merge(ns)
+	}
+}
@@ -0,0 +1,131 @@
+package libdiscover_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+)
+
+// waitForServices waits until every node finds n instances of the service
+func waitForServices(c *testcluster.Cluster, name string, n int) {
+	c.WaitFor(fmt.Sprintf("%d instances of %s on every node", n, name), func() bool {
+		for _, d := range c.Nodes() {
+			if len(d.Catalog().Lookup(&libdiscover.ServiceQuery{Name: name})) != n {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+func TestCatalogRegisterDeregister(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Configure: slowPushPull})
+
+	err := c.Node(0).Catalog().Register(&libdiscover.Service{
+		Name:    "api",
+		Version: "1.2.0",
+		Port:    8080,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForServices(c, "api", 1)
+
+	svc := c.Node(2).Catalog().Lookup(&libdiscover.ServiceQuery{Name: "api"})[0]
+	if svc.Node != c.Name(0) || svc.ID != "api" || svc.Port != 8080 {
+		t.Fatalf("unexpected service %+v", svc)
+	}
+
+	if n := len(c.Node(2).Catalog().Lookup(&libdiscover.ServiceQuery{Name: "api", Version: "2.0.0"})); n != 0 {
+		t.Fatalf("expected no instances of another version; got %d", n)
+	}
+
+	if err := c.Node(1).Catalog().Register(&libdiscover.Service{Name: "api", Port: 8081}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForServices(c, "api", 2)
+
+	if err := c.Node(0).Catalog().Deregister("api"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForServices(c, "api", 1)
+
+	if svc := c.Node(2).Catalog().Lookup(&libdiscover.ServiceQuery{Name: "api"})[0]; svc.Node != c.Name(1) {
+		t.Fatalf("expected the instance on %s to remain; got %+v", c.Name(1), svc)
+	}
+}
+
+func TestCatalogLargeServiceSet(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Configure: slowPushPull})
+
+	// the set is far larger than a gossip message
+	for i := 0; i < 8; i++ {
+		err := c.Node(0).Catalog().Register(&libdiscover.Service{
+			ID:   fmt.Sprintf("api-%d", i),
+			Name: "api",
+			Meta: map[string]string{"padding": strings.Repeat("x", 256)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForServices(c, "api", 8)
+}
+
+func TestCatalogWatch(t *testing.T) {
+	c := testcluster.New(t, nil)
+
+	updates := make(chan []*libdiscover.Service, 16)
+	stop := c.Node(1).Catalog().Watch(&libdiscover.ServiceQuery{Name: "api"}, func(services []*libdiscover.Service) {
+		updates <- services
+	})
+	defer stop()
+
+	wait := func(n int) {
+		t.Helper()
+
+		for services := range updates {
+			if len(services) == n {
+				return
+			}
+		}
+	}
+
+	wait(0)
+
+	if err := c.Node(0).Catalog().Register(&libdiscover.Service{Name: "api"}); err != nil {
+		t.Fatal(err)
+	}
+	wait(1)
+
+	if err := c.Node(0).Catalog().Deregister("api"); err != nil {
+		t.Fatal(err)
+	}
+	wait(0)
+}
+
+func TestCatalogNodeLeaves(t *testing.T) {
+	c := testcluster.New(t, nil)
+
+	if err := c.Node(2).Catalog().Register(&libdiscover.Service{Name: "api"}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForServices(c, "api", 1)
+
+	if err := c.Node(2).Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.WaitFor("the instance to go away", func() bool {
+		return len(c.Node(0).Catalog().Lookup(&libdiscover.ServiceQuery{Name: "api"})) == 0
+	})
+}
@@ -0,0 +1,567 @@
+package libdiscover
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// chaosReorderTimeout releases reordered messages when no later message
+	// arrives to overtake them
+	chaosReorderTimeout = time.Second
+
+	// maxFrozenEvents limits the events held while event delivery is
+	// frozen; the oldest are dropped past it
+	maxFrozenEvents = 4096
+)
+
+// ChaosDirection selects the messages a chaos rule applies to
+type ChaosDirection string
+
+const (
+	// ChaosBoth matches received and sent messages
+	ChaosBoth ChaosDirection = ""
+	// ChaosInbound matches received messages
+	ChaosInbound ChaosDirection = "in"
+	// ChaosOutbound matches sent messages
+	ChaosOutbound ChaosDirection = "out"
+)
+
+// chaosMessages names the message types for chaos rules
+var chaosMessages = map[byte]string{
+	0:                         "leave",
+	1:                         "join",
+	2:                         "push-pull",
+	3:                         "user-event",
+	4:                         "query",
+	5:                         "query-response",
+	6:                         "conflict-response",
+	7:                         "key-request",
+	8:                         "key-response",
+	byte(messageKVType):       "kv",
+	byte(messageCRDTType):     "crdt",
+	byte(messageServiceType):  "service",
+	byte(messageHealthType):   "health",
+	byte(messageAnnounceType): "announce",
+}
+
+const (
+	// chaosPushPull is the push/pull state exchange
+	chaosPushPull = "push-pull"
+	// chaosPing is the coordinate and heartbeat carried on ping acks
+	chaosPing = "ping"
+)
+
+// ChaosRule injects faults into the gossip messages that match it.  Drop,
+// Duplicate and Reorder are probabilities between 0 and 1 applied to every
+// transmission; gossip is retransmitted, so a dropped transmission does not
+// always lose the message.
+type ChaosRule struct {
+	Direction ChaosDirection
+	// Peer limits the rule to messages about the member: the origin of
+	// queries, the responder of query responses, the member of join and
+	// leave intents and the member that answered a ping.  Gossip is relayed
+	// by any member, so Peer is the subject of the message rather than the
+	// node it came from.  Other messages do not match a rule with a Peer.
+	Peer string
+	// Message limits the rule to a message type: leave, join, push-pull,
+	// user-event, query, query-response, conflict-response, key-request,
+	// key-response, kv, crdt, service, health, announce or ping
+	Message   string
+	Drop      float64
+	Duplicate float64
+	// Delay holds messages for Delay plus up to Jitter
+	Delay  time.Duration
+	Jitter time.Duration
+	// Reorder holds messages back until a later message overtakes them
+	Reorder float64
+}
+
+// ChaosConfig injects faults to rehearse failure handling.  Rules are
+// checked in order and the first matching rule applies.  Push/pull state
+// and ping acks can only be dropped or delayed, and only received ones can
+// be delayed; dropping sent push/pull state only withholds the libdiscover
+// state as serf needs its own.  Memberlist probes are not affected: a ping
+// rule drops the coordinate and heartbeat carried on the ack but the probe
+// still succeeds, so failure detection needs a partition instead.
+type ChaosConfig struct {
+	Rules []ChaosRule
+	// FreezeEvents holds events from handlers and subscribers until it is
+	// turned off again
+	FreezeEvents bool
+	// ClockSkew offsets the clock of the node used for timestamps in the
+	// KV store, the catalog, health checks, announcements and events
+	ClockSkew time.Duration
+	// Seed makes the faults repeatable; zero uses a random seed
+	Seed int64
+}
+
+// Validate reports invalid rules
+func (c *ChaosConfig) Validate() error {
+	for i, r := range c.Rules {
+		switch r.Direction {
+		case ChaosBoth, ChaosInbound, ChaosOutbound:
+		default:
+			return fmt.Errorf("chaos rule %d: unknown direction %q", i, r.Direction)
+		}
+
+		if r.Message != "" && !validChaosMessage(r.Message) {
+			return fmt.Errorf("chaos rule %d: unknown message type %q", i, r.Message)
+		}
+
+		for _, p := range []float64{r.Drop, r.Duplicate, r.Reorder} {
+			if p < 0 || p > 1 {
+				return fmt.Errorf("chaos rule %d: probabilities must be between 0 and 1", i)
+			}
+		}
+
+		if r.Delay < 0 || r.Jitter < 0 {
+			return fmt.Errorf("chaos rule %d: delay and jitter cannot be negative", i)
+		}
+	}
+
+	return nil
+}
+
+func validChaosMessage(name string) bool {
+	if name == chaosPing {
+		return true
+	}
+
+	for _, n := range chaosMessages {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+type chaosVerdict struct {
+	drop    bool
+	copies  int
+	delay   time.Duration
+	reorder bool
+}
+
+type chaosMsg struct {
+	msg   []byte
+	at    time.Time
+	round int
+}
+
+// chaos injects the faults of a ChaosConfig
+type chaos struct {
+	d *Discover
+
+	mu    sync.Mutex
+	cfg   ChaosConfig
+	rand  *rand.Rand
+	peers bool
+
+	// outbound messages that are delayed or reordered
+	pending []chaosMsg
+	round   int
+
+	// inbound messages that are reordered
+	held      [][]byte
+	heldTimer *time.Timer
+
+	events  []serf.Event
+	flushCh chan struct{}
+}
+
+func newChaos(d *Discover) *chaos {
+	return &chaos{
+		d:       d,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		flushCh: make(chan struct{}, 1),
+	}
+}
+
+func (c *chaos) set(cfg *ChaosConfig) error {
+	if cfg == nil {
+		cfg = &ChaosConfig{}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cfg = *cfg
+	c.cfg.Rules = append([]ChaosRule{}, cfg.Rules...)
+
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c.rand = rand.New(rand.NewSource(seed))
+
+	c.peers = false
+	for _, r := range c.cfg.Rules {
+		if r.Peer != "" {
+			c.peers = true
+		}
+	}
+
+	if len(c.cfg.Rules) > 0 || c.cfg.FreezeEvents || c.cfg.ClockSkew != 0 {
+		logrus.Warnf("chaos: enabled: rules=%d freeze-events=%v clock-skew=%s", len(c.cfg.Rules), c.cfg.FreezeEvents, c.cfg.ClockSkew)
+	}
+
+	// release the events held while frozen
+	if !c.cfg.FreezeEvents && len(c.events) > 0 {
+		c.flush()
+	}
+
+	return nil
+}
+
+func (c *chaos) config() *ChaosConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg := c.cfg
+	cfg.Rules = append([]ChaosRule{}, c.cfg.Rules...)
+
+	return &cfg
+}
+
+func (c *chaos) now() time.Time {
+	c.mu.Lock()
+	skew := c.cfg.ClockSkew
+	c.mu.Unlock()
+
+	return time.Now().Add(skew)
+}
+
+// decide rolls the faults for a message; it is called with the lock held
+func (c *chaos) decide(dir ChaosDirection, name, peer string) *chaosVerdict {
+	for _, r := range c.cfg.Rules {
+		if r.Direction != ChaosBoth && r.Direction != dir {
+			continue
+		}
+
+		if r.Message != "" && r.Message != name {
+			continue
+		}
+
+		if r.Peer != "" && r.Peer != peer {
+			continue
+		}
+
+		v := &chaosVerdict{
+			drop:    c.roll(r.Drop),
+			copies:  1,
+			delay:   r.Delay,
+			reorder: c.roll(r.Reorder),
+		}
+
+		if c.roll(r.Duplicate) {
+			v.copies = 2
+		}
+
+		if r.Jitter > 0 {
+			v.delay += time.Duration(c.rand.Int63n(int64(r.Jitter)))
+		}
+
+		return v
+	}
+
+	return nil
+}
+
+func (c *chaos) roll(p float64) bool {
+	return p > 0 && c.rand.Float64() < p
+}
+
+// message returns the name and the peer of a gossip message
+func (c *chaos) message(buf []byte) (string, string) {
+	name, ok := chaosMessages[buf[0]]
+	if !ok {
+		name = fmt.Sprintf("unknown-%d", buf[0])
+	}
+
+	if !c.peers || buf[0] > 5 {
+		return name, ""
+	}
+
+	var msg struct {
+		Node string
+		From string
+		Addr []byte
+		Port uint16
+	}
+
+	if err := codec.NewDecoder(bytes.NewReader(buf[1:]), &codec.MsgpackHandle{}).Decode(&msg); err != nil {
+		return name, ""
+	}
+
+	switch {
+	case msg.Node != "":
+		return name, msg.Node
+	case msg.From != "":
+		return name, msg.From
+	case msg.Addr != nil:
+		addr := net.IP(msg.Addr)
+		for _, m := range c.d.Members() {
+			if m.Addr.Equal(addr) && m.Port == msg.Port {
+				return name, m.Name
+			}
+		}
+	}
+
+	return name, ""
+}
+
+// inbound applies the rules to a received message before deliver is called
+func (c *chaos) inbound(buf []byte, deliver func(buf []byte)) {
+	c.mu.Lock()
+	if len(c.cfg.Rules) == 0 && len(c.held) == 0 {
+		c.mu.Unlock()
+		deliver(buf)
+		return
+	}
+
+	var v *chaosVerdict
+	if len(c.cfg.Rules) > 0 {
+		name, peer := c.message(buf)
+		v = c.decide(ChaosInbound, name, peer)
+	}
+
+	if v == nil {
+		held := c.release()
+		c.mu.Unlock()
+
+		deliver(buf)
+		for _, msg := range held {
+			deliver(msg)
+		}
+		return
+	}
+
+	if v.drop {
+		c.mu.Unlock()
+		return
+	}
+
+	// the buffer may be reused after we return
+	msg := make([]byte, len(buf))
+	copy(msg, buf)
+
+	if v.reorder {
+		for i := 0; i < v.copies; i++ {
+			c.held = append(c.held, msg)
+		}
+
+		if c.heldTimer == nil {
+			c.heldTimer = time.AfterFunc(chaosReorderTimeout, func() {
+				c.mu.Lock()
+				held := c.release()
+				c.mu.Unlock()
+
+				for _, msg := range held {
+					deliver(msg)
+				}
+			})
+		}
+		c.mu.Unlock()
+		return
+	}
+
+	held := c.release()
+	c.mu.Unlock()
+
+	for i := 0; i < v.copies; i++ {
+		if v.delay > 0 {
+			time.AfterFunc(v.delay, func() {
+				deliver(msg)
+			})
+			continue
+		}
+
+		deliver(msg)
+	}
+
+	for _, msg := range held {
+		deliver(msg)
+	}
+}
+
+// release returns the reordered inbound messages; it is called with the
+// lock held
+func (c *chaos) release() [][]byte {
+	held := c.held
+	c.held = nil
+
+	if c.heldTimer != nil {
+		c.heldTimer.Stop()
+		c.heldTimer = nil
+	}
+
+	return held
+}
+
+// outbound applies the rules to the messages about to be gossiped and adds
+// the delayed messages that are due
+func (c *chaos) outbound(msgs [][]byte, overhead, limit int) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.cfg.Rules) == 0 && len(c.pending) == 0 {
+		return msgs
+	}
+
+	now := time.Now()
+	out := make([][]byte, 0, len(msgs))
+	used := 0
+	for _, msg := range msgs {
+		var v *chaosVerdict
+		if len(c.cfg.Rules) > 0 && len(msg) > 0 {
+			name, peer := c.message(msg)
+			v = c.decide(ChaosOutbound, name, peer)
+		}
+
+		switch {
+		case v == nil:
+			out = append(out, msg)
+			used += len(msg) + overhead
+		case v.drop:
+		default:
+			for i := 0; i < v.copies; i++ {
+				if v.delay > 0 || v.reorder {
+					c.pending = append(c.pending, chaosMsg{msg: msg, at: now.Add(v.delay), round: c.round})
+					continue
+				}
+
+				out = append(out, msg)
+				used += len(msg) + overhead
+			}
+		}
+	}
+
+	// held messages go out after the messages of a later round
+	pending := c.pending[:0]
+	for _, p := range c.pending {
+		if p.round < c.round && !now.Before(p.at) && used+len(p.msg)+overhead <= limit {
+			out = append(out, p.msg)
+			used += len(p.msg) + overhead
+			continue
+		}
+
+		pending = append(pending, p)
+	}
+	c.pending = pending
+	c.round++
+
+	return out
+}
+
+// exchange applies the rules to push/pull state and ping acks, which can
+// only be dropped or delayed.  It returns false when the message is
+// dropped; callers apply the delay to received messages only.
+func (c *chaos) exchange(dir ChaosDirection, name, peer string) (bool, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.cfg.Rules) == 0 {
+		return true, 0
+	}
+
+	v := c.decide(dir, name, peer)
+	if v == nil {
+		return true, 0
+	}
+
+	return !v.drop, v.delay
+}
+
+// queued returns the number of delayed outbound messages, reordered
+// inbound messages and frozen events
+func (c *chaos) queued() (int, int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.pending), len(c.held), len(c.events)
+}
+
+// holdEvent holds the event while event delivery is frozen and until the
+// events held before it are delivered
+func (c *chaos) holdEvent(e serf.Event) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.cfg.FreezeEvents && len(c.events) == 0 {
+		return false
+	}
+
+	if len(c.events) >= maxFrozenEvents {
+		logrus.Warnf("chaos: too many frozen events; dropping %s", EventTypeName(c.events[0].EventType()))
+		c.events = c.events[1:]
+	}
+	c.events = append(c.events, e)
+
+	if !c.cfg.FreezeEvents {
+		c.flush()
+	}
+
+	return true
+}
+
+// flush signals the event handler to deliver the held events; it is called
+// with the lock held
+func (c *chaos) flush() {
+	select {
+	case c.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// heldEvents returns the held events once event delivery is unfrozen
+func (c *chaos) heldEvents() []serf.Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cfg.FreezeEvents {
+		return nil
+	}
+
+	events := c.events
+	c.events = nil
+
+	return events
+}
+
+// Chaos returns the chaos settings in effect
+func (d *Discover) Chaos() *ChaosConfig {
+	return d.chaos.config()
+}
+
+// SetChaos replaces the chaos settings at runtime; nil turns chaos off.
+// Events held by FreezeEvents are delivered once it is turned off.
+func (d *Discover) SetChaos(cfg *ChaosConfig) error {
+	return d.chaos.set(cfg)
+}
+
+// now returns the time of the node including the chaos clock skew
+func (d *Discover) now() time.Time {
+	return d.chaos.now()
+}
+
+// newHLC returns a clock for the node that follows the chaos clock skew
+func (d *Discover) newHLC() *hlc {
+	c := newHLC(d.name)
+	c.now = d.now
+
+	return c
+}
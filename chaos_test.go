@@ -0,0 +1,37 @@
+package libdiscover_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+)
+
+func TestChaosPushPullDelay(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{
+		Nodes: 2,
+		Configure: func(i int, cfg *libdiscover.Config) {
+			if i != 1 {
+				return
+			}
+
+			// longer than the memberlist TCP timeout
+			cfg.Chaos = &libdiscover.ChaosConfig{
+				Rules: []libdiscover.ChaosRule{
+					{Direction: libdiscover.ChaosInbound, Message: "push-pull", Delay: time.Second * 15},
+				},
+			}
+		},
+	})
+
+	// the delay is applied after the exchange so joins do not wait on it
+	start := time.Now()
+	if _, err := c.Node(1).Join(c.Node(0).Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := time.Since(start); d > time.Second*2 {
+		t.Fatalf("expected the join not to wait for the delayed state; took %s", d)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/api"
+	"github.com/sirupsen/logrus"
+)
+
+const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+func randomName() string {
+	b := make([]byte, 8)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+
+	return strings.ToLower("node-" + string(b))
+}
+
+func eventHandler(e libdiscover.Event) error {
+	logrus.Infof("user event: name=%s data=%s", e.Name, string(e.Payload))
+
+	return nil
+}
+
+// agent runs a Discover and its management API and applies config reloads
+type agent struct {
+	paths []string
+	flags *agentConfig
+	cfg   *agentConfig
+
+	d        *libdiscover.Discover
+	srv      *api.Server
+	handlers *eventHandlers
+}
+
+// agentFlags registers the agent flags.  The returned config only holds the
+// flags that were set once the flag set is parsed.
+func agentFlags(fs *flag.FlagSet) (*stringSlice, func() (*agentConfig, error)) {
+	var (
+		flNodeName      string
+		flBindAddr      string
+		flAdvertiseAddr string
+		flJoinAddr      string
+		flNodeTimeout   int
+		flDebug         bool
+		flLogLevel      string
+		flClusterDebug  bool
+		flEncryptKey    string
+		flHTTPAddr      string
+		flToken         string
+		flTags          stringSlice
+		flConfig        stringSlice
+		flHandlers      stringSlice
+		flAnnounce      string
+		flDatacenter    string
+		flWANBind       string
+		flWANAdvertise  string
+		flWANJoin       string
+		flProfile       string
+		flEnableChaos   bool
+	)
+
+	fs.Var(&flConfig, "config", "JSON, YAML or HCL config file or directory of them (repeatable)")
+	fs.StringVar(&flNodeName, "name", "", "node name (default random)")
+	fs.StringVar(&flBindAddr, "bind", defaultBindAddr, "bind address")
+	fs.StringVar(&flAdvertiseAddr, "advertise", defaultBindAddr, "advertise address")
+	fs.StringVar(&flJoinAddr, "join", "", "join address")
+	fs.StringVar(&flDatacenter, "datacenter", "dc1", "datacenter of the node")
+	fs.StringVar(&flWANBind, "wan-bind", "", "WAN bind address; makes the node a WAN gateway")
+	fs.StringVar(&flWANAdvertise, "wan-advertise", "", "WAN advertise address (default the WAN bind address)")
+	fs.StringVar(&flWANJoin, "wan-join", "", "comma separated WAN addresses of gateways in other datacenters")
+	fs.StringVar(&flProfile, "profile", "lan", "gossip timing profile: lan, wan, local or fast-failure")
+	fs.IntVar(&flNodeTimeout, "timeout", int(defaultTimeout/time.Second), "node timeout (seconds)")
+	fs.BoolVar(&flDebug, "debug", false, "enable debug; same as -log-level debug")
+	fs.StringVar(&flLogLevel, "log-level", "info", "log level")
+	fs.BoolVar(&flClusterDebug, "cluster-debug", false, "enable cluster debug messages")
+	fs.StringVar(&flEncryptKey, "encrypt", "", "base64 gossip encryption key")
+	fs.StringVar(&flHTTPAddr, "http-addr", defaultHTTPAddr, "management API address")
+	fs.StringVar(&flToken, "token", "", "management API token")
+	fs.BoolVar(&flEnableChaos, "enable-chaos", false, "serve /v1/chaos to inject faults; for staging only")
+	fs.StringVar(&flAnnounce, "announce", "legacy", "announce protocol: legacy (gossip and also send node-join and node-leave events), gossip or off")
+	fs.Var(&flTags, "tag", "node tag as key=value (repeatable)")
+	fs.Var(&flHandlers, "event-handler", "run a command for events as [event=]command, i.e. member-join,member-leave=./update.sh (repeatable)")
+
+	return &flConfig, func() (*agentConfig, error) {
+		c := &agentConfig{}
+
+		var err error
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "name":
+				c.Name = flNodeName
+			case "bind":
+				c.Bind = flBindAddr
+			case "advertise":
+				c.Advertise = flAdvertiseAddr
+			case "join":
+				c.Join = flJoinAddr
+			case "datacenter":
+				c.Datacenter = flDatacenter
+			case "wan-bind":
+				c.WANBind = flWANBind
+			case "wan-advertise":
+				c.WANAdvertise = flWANAdvertise
+			case "wan-join":
+				c.WANJoin = flWANJoin
+			case "profile":
+				c.Profile = flProfile
+			case "timeout":
+				c.Timeout = duration(time.Second * time.Duration(flNodeTimeout))
+			case "debug":
+				if flDebug {
+					c.LogLevel = "debug"
+				}
+			case "log-level":
+				c.LogLevel = flLogLevel
+			case "cluster-debug":
+				c.ClusterDebug = &flClusterDebug
+			case "encrypt":
+				c.Encrypt = flEncryptKey
+			case "http-addr":
+				c.HTTPAddr = flHTTPAddr
+			case "token":
+				c.Token = flToken
+			case "enable-chaos":
+				c.EnableChaos = &flEnableChaos
+			case "tag":
+				c.Tags, err = parseKeyValues(flTags)
+			case "announce":
+				c.Announce = flAnnounce
+			case "event-handler":
+				for _, h := range flHandlers {
+					c.EventHandlers = append(c.EventHandlers, parseHandlerFlag(h))
+				}
+			}
+		})
+
+		return c, err
+	}
+}
+
+func runAgent(args []string) error {
+	fs := newFlagSet("agent")
+	paths, flagConfig := agentFlags(fs)
+	fs.Parse(args)
+
+	flags, err := flagConfig()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(*paths, flags)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Name == "" {
+		cfg.Name = randomName()
+	}
+
+	a := &agent{
+		paths: *paths,
+		flags: flags,
+		cfg:   cfg,
+	}
+
+	return a.run()
+}
+
+func (a *agent) run() error {
+	level, _ := logrus.ParseLevel(a.cfg.LogLevel)
+	logrus.SetLevel(level)
+	logrus.Debug("debug enabled")
+
+	clusterDebug := isTrue(a.cfg.ClusterDebug)
+	announce, _ := announceMode(a.cfg.Announce)
+	profile, _ := libdiscover.ParseProfile(a.cfg.Profile)
+	chaos, _ := a.cfg.chaos()
+
+	d, err := libdiscover.NewDiscover(&libdiscover.Config{
+		Name:          a.cfg.Name,
+		BindAddr:      a.cfg.Bind,
+		AdvertiseAddr: a.cfg.Advertise,
+		JoinAddr:      a.cfg.Join,
+		Debug:         clusterDebug,
+		NodeTimeout:   time.Duration(a.cfg.Timeout),
+		EventHandler:  eventHandler,
+		Tags:          a.cfg.Tags,
+		EncryptKey:    a.cfg.Encrypt,
+		Announce:      announce,
+		Version:       a.cfg.Version,
+		Capabilities:  a.cfg.Capabilities,
+
+		DisableCoordinates: isTrue(a.cfg.DisableCoordinates),
+
+		Datacenter:       a.cfg.Datacenter,
+		WANBindAddr:      a.cfg.WANBind,
+		WANAdvertiseAddr: a.cfg.WANAdvertise,
+		WANJoinAddr:      a.cfg.WANJoin,
+		Segments:         a.cfg.libdiscoverSegments(),
+		Profile:          profile,
+		Tuning:           a.cfg.Tuning.tuning(),
+		Chaos:            chaos,
+		Metrics:          a.cfg.Metrics.metrics(),
+	})
+	if err != nil {
+		return err
+	}
+	a.d = d
+
+	logrus.Infof("node id: %s", a.cfg.Name)
+
+	// handlers are subscribed before joining so that they see the join
+	a.handlers = newEventHandlers(d)
+	if err := a.handlers.update(a.cfg.EventHandlers); err != nil {
+		return err
+	}
+	unsubscribe := d.Subscribe(a.handlers.handle)
+
+	if err := d.Run(); err != nil {
+		return err
+	}
+
+	for _, k := range a.cfg.Keyring {
+		if _, err := d.InstallKey(k); err != nil {
+			logrus.Errorf("error installing key: %s", err)
+		}
+	}
+
+	for _, c := range a.cfg.Checks {
+		if err := d.Health().AddCheck(c.healthCheck()); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	a.srv = api.New(d, &api.Config{
+		Addr:           a.cfg.HTTPAddr,
+		Token:          a.cfg.Token,
+		AllowedOrigins: a.cfg.AllowedOrigins,
+		EnableChaos:    isTrue(a.cfg.EnableChaos),
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- a.srv.ListenAndServe()
+	}()
+
+	// handle interrupt and reload
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for running := true; running; {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				a.reload()
+				continue
+			}
+			running = false
+		case err := <-errCh:
+			if err != nil {
+				logrus.Errorf("api: %s", err)
+			}
+			running = false
+		}
+	}
+
+	logrus.Debug("stopping")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if err := a.srv.Shutdown(ctx); err != nil {
+		logrus.Error(err)
+	}
+
+	unsubscribe()
+	a.handlers.stop()
+
+	return d.Stop()
+}
+
+// reload reads the config again and applies the settings that can change
+// while running: log level, tags, health checks, event handlers, encryption
+// keys and chaos.  An invalid config is logged and the running config is
+// kept.
+func (a *agent) reload() {
+	logrus.Info("reloading config")
+
+	cfg, err := loadConfig(a.paths, a.flags)
+	if err != nil {
+		logrus.Errorf("error reloading config: %s", err)
+		return
+	}
+
+	if cfg.Name == "" {
+		cfg.Name = a.cfg.Name
+	}
+
+	restart := []string{}
+	if cfg.Name != a.cfg.Name {
+		restart = append(restart, "name")
+	}
+	if cfg.Bind != a.cfg.Bind {
+		restart = append(restart, "bind")
+	}
+	if cfg.Advertise != a.cfg.Advertise {
+		restart = append(restart, "advertise")
+	}
+	if cfg.Timeout != a.cfg.Timeout {
+		restart = append(restart, "timeout")
+	}
+	if !reflect.DeepEqual(cfg.ClusterDebug, a.cfg.ClusterDebug) {
+		restart = append(restart, "cluster_debug")
+	}
+	if cfg.Announce != a.cfg.Announce || cfg.Version != a.cfg.Version ||
+		!reflect.DeepEqual(cfg.Capabilities, a.cfg.Capabilities) {
+		restart = append(restart, "announce")
+	}
+	if isTrue(cfg.DisableCoordinates) != isTrue(a.cfg.DisableCoordinates) {
+		restart = append(restart, "disable_coordinates")
+	}
+	if cfg.Datacenter != a.cfg.Datacenter {
+		restart = append(restart, "datacenter")
+	}
+	if cfg.WANBind != a.cfg.WANBind || cfg.WANAdvertise != a.cfg.WANAdvertise || cfg.WANJoin != a.cfg.WANJoin {
+		restart = append(restart, "wan")
+	}
+	if cfg.Profile != a.cfg.Profile || !reflect.DeepEqual(cfg.Tuning, a.cfg.Tuning) {
+		restart = append(restart, "profile")
+	}
+	if !reflect.DeepEqual(cfg.Segments, a.cfg.Segments) {
+		restart = append(restart, "segments")
+	}
+	if cfg.HTTPAddr != a.cfg.HTTPAddr {
+		restart = append(restart, "http_addr")
+	}
+	if cfg.Token != a.cfg.Token {
+		restart = append(restart, "token")
+	}
+	if !reflect.DeepEqual(cfg.AllowedOrigins, a.cfg.AllowedOrigins) {
+		restart = append(restart, "allowed_origins")
+	}
+	if isTrue(cfg.EnableChaos) != isTrue(a.cfg.EnableChaos) {
+		restart = append(restart, "enable_chaos")
+	}
+	if !reflect.DeepEqual(cfg.Metrics, a.cfg.Metrics) {
+		restart = append(restart, "metrics")
+	}
+	if len(restart) > 0 {
+		logrus.Warnf("config changes require a restart: %s", strings.Join(restart, ", "))
+	}
+
+	if cfg.LogLevel != a.cfg.LogLevel {
+		level, _ := logrus.ParseLevel(cfg.LogLevel)
+		logrus.SetLevel(level)
+		logrus.Infof("log level: %s", level)
+	}
+
+	a.reloadTags(cfg)
+	a.reloadChecks(cfg)
+	a.reloadKeys(cfg)
+
+	if !reflect.DeepEqual(cfg.Chaos, a.cfg.Chaos) {
+		chaos, _ := cfg.chaos()
+		if err := a.d.SetChaos(chaos); err != nil {
+			logrus.Errorf("error updating chaos: %s", err)
+		}
+	}
+
+	if !reflect.DeepEqual(cfg.EventHandlers, a.cfg.EventHandlers) {
+		if err := a.handlers.update(cfg.EventHandlers); err != nil {
+			logrus.Errorf("error updating event handlers: %s", err)
+		}
+	}
+
+	// settings that need a restart keep their running values
+	cfg.Name = a.cfg.Name
+	cfg.Bind = a.cfg.Bind
+	cfg.Advertise = a.cfg.Advertise
+	cfg.Timeout = a.cfg.Timeout
+	cfg.ClusterDebug = a.cfg.ClusterDebug
+	cfg.DisableCoordinates = a.cfg.DisableCoordinates
+	cfg.Datacenter = a.cfg.Datacenter
+	cfg.WANBind = a.cfg.WANBind
+	cfg.WANAdvertise = a.cfg.WANAdvertise
+	cfg.WANJoin = a.cfg.WANJoin
+	cfg.Segments = a.cfg.Segments
+	cfg.Profile = a.cfg.Profile
+	cfg.Tuning = a.cfg.Tuning
+	cfg.Announce = a.cfg.Announce
+	cfg.Version = a.cfg.Version
+	cfg.Capabilities = a.cfg.Capabilities
+	cfg.HTTPAddr = a.cfg.HTTPAddr
+	cfg.Token = a.cfg.Token
+	cfg.AllowedOrigins = a.cfg.AllowedOrigins
+	cfg.EnableChaos = a.cfg.EnableChaos
+	cfg.Metrics = a.cfg.Metrics
+
+	a.cfg = cfg
+}
+
+// reloadTags applies tag changes; tags set at runtime that were never in the
+// config are kept
+func (a *agent) reloadTags(cfg *agentConfig) {
+	set := map[string]string{}
+	for k, v := range cfg.Tags {
+		if cur, ok := a.cfg.Tags[k]; !ok || cur != v {
+			set[k] = v
+		}
+	}
+
+	remove := []string{}
+	for k := range a.cfg.Tags {
+		if _, ok := cfg.Tags[k]; !ok {
+			remove = append(remove, k)
+		}
+	}
+
+	if len(set) > 0 {
+		if err := a.d.SetTags(set); err != nil {
+			logrus.Errorf("error updating tags: %s", err)
+		}
+	}
+
+	if len(remove) > 0 {
+		if err := a.d.DeleteTags(remove...); err != nil {
+			logrus.Errorf("error removing tags: %s", err)
+		}
+	}
+}
+
+// reloadChecks restarts changed checks and removes deleted ones
+func (a *agent) reloadChecks(cfg *agentConfig) {
+	current := map[string]*checkConfig{}
+	for _, c := range a.cfg.Checks {
+		current[c.ID] = c
+	}
+
+	for _, c := range cfg.Checks {
+		if cur, ok := current[c.ID]; ok && reflect.DeepEqual(cur, c) {
+			delete(current, c.ID)
+			continue
+		}
+		delete(current, c.ID)
+
+		if err := a.d.Health().AddCheck(c.healthCheck()); err != nil {
+			logrus.Errorf("error adding check: %s", err)
+		}
+	}
+
+	for id := range current {
+		a.d.Health().RemoveCheck(id)
+	}
+}
+
+// reloadKeys installs new keys and switches to a new primary key.  Keys are
+// not removed so that members still using them can be reached; remove them
+// with the keys command once the rotation is complete.
+func (a *agent) reloadKeys(cfg *agentConfig) {
+	installed := map[string]bool{a.cfg.Encrypt: true}
+	for _, k := range a.cfg.Keyring {
+		installed[k] = true
+	}
+
+	if cfg.Encrypt != "" && a.cfg.Encrypt == "" {
+		logrus.Warn("encryption cannot be enabled without a restart")
+		cfg.Encrypt = ""
+		cfg.Keyring = nil
+		return
+	}
+
+	if cfg.Encrypt == "" && a.cfg.Encrypt != "" {
+		logrus.Warn("encryption cannot be disabled without a restart")
+		cfg.Encrypt = a.cfg.Encrypt
+	}
+
+	keys := append([]string{cfg.Encrypt}, cfg.Keyring...)
+	for _, k := range keys {
+		if k == "" || installed[k] {
+			continue
+		}
+
+		if _, err := a.d.InstallKey(k); err != nil {
+			logrus.Errorf("error installing key: %s", err)
+		}
+	}
+
+	if cfg.Encrypt != "" && cfg.Encrypt != a.cfg.Encrypt {
+		if _, err := a.d.UseKey(cfg.Encrypt); err != nil {
+			logrus.Errorf("error changing primary key: %s", err)
+		}
+	}
+}
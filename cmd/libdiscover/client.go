@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// client talks to the management API of a running agent
+type client struct {
+	addr    string
+	token   string
+	segment string
+	http    *http.Client
+}
+
+// responseError is returned for unsuccessful responses; Body holds the
+// response for endpoints that report details alongside the failure
+type responseError struct {
+	Status string
+	Msg    string
+	Body   []byte
+}
+
+func (e *responseError) Error() string {
+	if e.Msg != "" {
+		return e.Msg
+	}
+
+	return "unexpected response: " + e.Status
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+
+	return def
+}
+
+// clientFlags registers the flags used to reach the agent
+func clientFlags(fs *flag.FlagSet) *client {
+	c := &client{
+		http: &http.Client{},
+	}
+
+	fs.StringVar(&c.addr, "http-addr", envOr("LIBDISCOVER_HTTP_ADDR", "127.0.0.1:7947"), "agent management API address")
+	fs.StringVar(&c.token, "token", os.Getenv("LIBDISCOVER_TOKEN"), "agent management API token")
+	fs.StringVar(&c.segment, "segment", "", "use a segment of the agent instead of the default pool")
+
+	return c
+}
+
+func (c *client) url(path string, q url.Values) string {
+	addr := c.addr
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	if c.segment != "" {
+		v := url.Values{"segment": {c.segment}}
+		for k, vals := range q {
+			v[k] = vals
+		}
+		q = v
+	}
+
+	u := strings.TrimSuffix(addr, "/") + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	return u
+}
+
+// do sends the request and returns the response when it succeeded
+func (c *client) do(method, path string, q url.Values, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(path, q), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	// the API only takes JSON bodies; payloads are passed through as is
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		data, _ := ioutil.ReadAll(resp.Body)
+		e := &responseError{
+			Status: resp.Status,
+			Body:   data,
+		}
+
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(data, &msg); err == nil {
+			e.Msg = msg.Error
+		}
+
+		return nil, e
+	}
+
+	return resp, nil
+}
+
+// call sends the request and decodes the JSON response into out when not nil
+func (c *client) call(method, path string, q url.Values, in, out interface{}) error {
+	var body io.Reader
+	switch v := in.(type) {
+	case nil:
+	case []byte:
+		body = bytes.NewReader(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	resp, err := c.do(method, path, q, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/api"
+	"github.com/ehazlett/libdiscover/sim"
+)
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+func formatTags(tags map[string]string) string {
+	keys := []string{}
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+tags[k])
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// payloadArg returns the optional payload argument; "-" reads stdin
+func payloadArg(args []string, i int) ([]byte, error) {
+	if len(args) <= i {
+		return nil, nil
+	}
+
+	if args[i] == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+
+	return []byte(args[i]), nil
+}
+
+func runMembers(args []string) error {
+	var (
+		flStatus string
+		flName   string
+		flDC     string
+		flJSON   bool
+		flTags   stringSlice
+	)
+
+	fs := newFlagSet("members")
+	c := clientFlags(fs)
+	fs.StringVar(&flDC, "dc", "", "list the members of another datacenter")
+	fs.StringVar(&flStatus, "status", "", "only show members with the status (alive, leaving, left, failed)")
+	fs.StringVar(&flName, "name", "", "only show members whose name starts with the prefix")
+	fs.Var(&flTags, "tag", "only show members with the tag as key=value (repeatable)")
+	fs.BoolVar(&flJSON, "json", false, "output JSON")
+	fs.Parse(args)
+
+	tags, err := parseKeyValues(flTags)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	if flStatus != "" {
+		q.Set("status", flStatus)
+	}
+	if flName != "" {
+		q.Set("name", flName)
+	}
+	if flDC != "" {
+		q.Set("dc", flDC)
+	}
+	for k, v := range tags {
+		q.Add("tag", k+":"+v)
+	}
+
+	members := []api.Member{}
+	if err := c.call(http.MethodGet, "/v1/members", q, nil, &members); err != nil {
+		return err
+	}
+
+	if flJSON {
+		return printJSON(members)
+	}
+
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDRESS\tSTATUS\tHEALTH\tTAGS")
+	for _, m := range members {
+		fmt.Fprintf(w, "%s\t%s:%d\t%s\t%s\t%s\n", m.Name, m.Addr, m.Port, m.Status, m.Health, formatTags(m.Tags))
+	}
+
+	return w.Flush()
+}
+
+func runDatacenters(args []string) error {
+	fs := newFlagSet("datacenters")
+	c := clientFlags(fs)
+	fs.Parse(args)
+
+	dcs := []string{}
+	if err := c.call(http.MethodGet, "/v1/datacenters", nil, nil, &dcs); err != nil {
+		return err
+	}
+
+	for _, dc := range dcs {
+		fmt.Println(dc)
+	}
+
+	return nil
+}
+
+func runSegments(args []string) error {
+	fs := newFlagSet("segments")
+	c := clientFlags(fs)
+	fs.Parse(args)
+
+	segments := []string{}
+	if err := c.call(http.MethodGet, "/v1/segments", nil, nil, &segments); err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		fmt.Println(s)
+	}
+
+	return nil
+}
+
+func runEvent(args []string) error {
+	var (
+		flCoalesce bool
+		flDC       string
+	)
+
+	fs := newFlagSet("event")
+	c := clientFlags(fs)
+	fs.BoolVar(&flCoalesce, "coalesce", false, "allow the event to be coalesced with events of the same name")
+	fs.StringVar(&flDC, "dc", "", "send the event to another datacenter")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	payload, err := payloadArg(fs.Args(), 1)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	if flCoalesce {
+		q.Set("coalesce", "true")
+	}
+	if flDC != "" {
+		q.Set("dc", flDC)
+	}
+
+	return c.call(http.MethodPost, "/v1/event/"+url.PathEscape(fs.Arg(0)), q, payload, nil)
+}
+
+func runQuery(args []string) error {
+	var (
+		flTimeout string
+		flDC      string
+		flAck     bool
+		flJSON    bool
+		flNodes   stringSlice
+		flTags    stringSlice
+	)
+
+	fs := newFlagSet("query")
+	c := clientFlags(fs)
+	fs.StringVar(&flTimeout, "timeout", "", "query timeout (default based on cluster size)")
+	fs.Var(&flNodes, "node", "only send the query to the node (repeatable)")
+	fs.Var(&flTags, "tag", "only send the query to nodes with the tag as key=regexp (repeatable)")
+	fs.StringVar(&flDC, "dc", "", "send the query to another datacenter; acks are not relayed")
+	fs.BoolVar(&flAck, "ack", false, "request acknowledgements")
+	fs.BoolVar(&flJSON, "json", false, "output JSON")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	payload, err := payloadArg(fs.Args(), 1)
+	if err != nil {
+		return err
+	}
+
+	tags, err := parseKeyValues(flTags)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	if flTimeout != "" {
+		q.Set("timeout", flTimeout)
+	}
+	if flAck {
+		q.Set("ack", "true")
+	}
+	if flDC != "" {
+		q.Set("dc", flDC)
+	}
+	for _, n := range flNodes {
+		q.Add("node", n)
+	}
+	for k, v := range tags {
+		q.Add("tag", k+":"+v)
+	}
+
+	var resp api.QueryResponse
+	if err := c.call(http.MethodPost, "/v1/query/"+url.PathEscape(fs.Arg(0)), q, payload, &resp); err != nil {
+		return err
+	}
+
+	if flJSON {
+		return printJSON(resp)
+	}
+
+	if flAck {
+		sort.Strings(resp.Acks)
+		for _, a := range resp.Acks {
+			fmt.Printf("ack from %s\n", a)
+		}
+	}
+
+	nodes := []string{}
+	for n := range resp.Responses {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+
+	for _, n := range nodes {
+		fmt.Printf("response from %s: %s\n", n, strings.TrimRight(string(resp.Responses[n]), "\n"))
+	}
+
+	if flAck {
+		fmt.Printf("total acks: %d\n", len(resp.Acks))
+	}
+	fmt.Printf("total responses: %d\n", len(resp.Responses))
+
+	return nil
+}
+
+func runTags(args []string) error {
+	var (
+		flSet    stringSlice
+		flDelete stringSlice
+		flJSON   bool
+	)
+
+	fs := newFlagSet("tags")
+	c := clientFlags(fs)
+	fs.Var(&flSet, "set", "set the tag as key=value (repeatable)")
+	fs.Var(&flDelete, "delete", "delete the tag (repeatable)")
+	fs.BoolVar(&flJSON, "json", false, "output JSON")
+	fs.Parse(args)
+
+	set, err := parseKeyValues(flSet)
+	if err != nil {
+		return err
+	}
+
+	tags := map[string]string{}
+	if len(set) > 0 {
+		if err := c.call(http.MethodPut, "/v1/tags", nil, set, &tags); err != nil {
+			return err
+		}
+	}
+
+	if len(flDelete) > 0 {
+		q := url.Values{"key": flDelete}
+		if err := c.call(http.MethodDelete, "/v1/tags", q, nil, &tags); err != nil {
+			return err
+		}
+	}
+
+	if len(set) == 0 && len(flDelete) == 0 {
+		if err := c.call(http.MethodGet, "/v1/tags", nil, nil, &tags); err != nil {
+			return err
+		}
+	}
+
+	if flJSON {
+		return printJSON(tags)
+	}
+
+	keys := []string{}
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Printf("%s=%s\n", k, tags[k])
+	}
+
+	return nil
+}
+
+func runKeys(args []string) error {
+	var (
+		flList    bool
+		flInstall string
+		flUse     string
+		flRemove  string
+	)
+
+	fs := newFlagSet("keys")
+	c := clientFlags(fs)
+	fs.BoolVar(&flList, "list", false, "list the installed keys and how many nodes have them")
+	fs.StringVar(&flInstall, "install", "", "install a new key on every node")
+	fs.StringVar(&flUse, "use", "", "make an installed key the primary key")
+	fs.StringVar(&flRemove, "remove", "", "remove a key from every node")
+	fs.Parse(args)
+
+	method, key := "", ""
+	n := 0
+	if flList {
+		method = http.MethodGet
+		n++
+	}
+	if flInstall != "" {
+		method, key = http.MethodPost, flInstall
+		n++
+	}
+	if flUse != "" {
+		method, key = http.MethodPut, flUse
+		n++
+	}
+	if flRemove != "" {
+		method, key = http.MethodDelete, flRemove
+		n++
+	}
+
+	if n != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var in interface{}
+	if key != "" {
+		in = map[string]string{"key": key}
+	}
+
+	var resp api.KeyResponse
+	err := c.call(method, "/v1/keys", nil, in, &resp)
+	if e, ok := err.(*responseError); ok {
+		// the per node errors are reported with the failure
+		if json.Unmarshal(e.Body, &resp) == nil && len(resp.Messages) > 0 {
+			for node, msg := range resp.Messages {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", node, msg)
+			}
+
+			return fmt.Errorf("%d of %d nodes failed", resp.NumErr, resp.NumNodes)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if flList {
+		keys := []string{}
+		for k := range resp.Keys {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Printf("%s [%d/%d]\n", k, resp.Keys[k], resp.NumNodes)
+		}
+
+		return nil
+	}
+
+	fmt.Printf("%d of %d nodes responded\n", resp.NumResp, resp.NumNodes)
+
+	return nil
+}
+
+func runChaos(args []string) error {
+	var (
+		flFile string
+		flOff  bool
+	)
+
+	fs := newFlagSet("chaos")
+	c := clientFlags(fs)
+	fs.StringVar(&flFile, "file", "", "set the chaos settings from a JSON file; - reads stdin")
+	fs.BoolVar(&flOff, "off", false, "turn chaos off")
+	fs.Parse(args)
+
+	if flFile != "" && flOff {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	method := http.MethodGet
+	var in interface{}
+	switch {
+	case flOff:
+		method = http.MethodDelete
+	case flFile != "":
+		var (
+			data []byte
+			err  error
+		)
+		if flFile == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(flFile)
+		}
+		if err != nil {
+			return err
+		}
+
+		var chaos api.Chaos
+		if err := json.Unmarshal(data, &chaos); err != nil {
+			return fmt.Errorf("error parsing %s: %s", flFile, err)
+		}
+
+		method, in = http.MethodPut, &chaos
+	}
+
+	var resp api.Chaos
+	if err := c.call(method, "/v1/chaos", nil, in, &resp); err != nil {
+		return err
+	}
+
+	return printJSON(resp)
+}
+
+func runForceLeave(args []string) error {
+	fs := newFlagSet("force-leave")
+	c := clientFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	return c.call(http.MethodPost, "/v1/force-leave/"+url.PathEscape(fs.Arg(0)), nil, nil, nil)
+}
+
+func runMonitor(args []string) error {
+	var (
+		flTypes stringSlice
+		flNames stringSlice
+		flJSON  bool
+	)
+
+	fs := newFlagSet("monitor")
+	c := clientFlags(fs)
+	fs.Var(&flTypes, "type", "only show events of the type, i.e. member-join or user (repeatable)")
+	fs.Var(&flNames, "name", "only show events with the name; a trailing * matches a prefix (repeatable)")
+	fs.BoolVar(&flJSON, "json", false, "output JSON")
+	fs.Parse(args)
+
+	q := url.Values{}
+	for _, t := range flTypes {
+		q.Add("type", t)
+	}
+	for _, n := range flNames {
+		q.Add("name", n)
+	}
+
+	resp, err := c.do(http.MethodGet, "/v1/events", q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		data := strings.TrimPrefix(line, "data: ")
+		if flJSON {
+			fmt.Println(data)
+			continue
+		}
+
+		var e api.Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return err
+		}
+
+		printEvent(&e)
+	}
+
+	return scanner.Err()
+}
+
+func printEvent(e *api.Event) {
+	switch {
+	case len(e.Members) > 0:
+		for _, m := range e.Members {
+			fmt.Printf("%s: %s %s:%d\n", e.Type, m.Name, m.Addr, m.Port)
+		}
+	case e.Announcement != nil:
+		fmt.Printf("%s: %s %s version=%s capabilities=%s\n", e.Type, e.Announcement.Node, e.Announcement.Addr,
+			e.Announcement.Version, strings.Join(e.Announcement.Capabilities, ","))
+	case e.Heartbeat != nil:
+		fmt.Printf("%s: %s last seen %s\n", e.Type, e.Heartbeat.Node, e.Heartbeat.LastSeen.Format(time.RFC3339))
+	case e.Check != nil:
+		fmt.Printf("%s: %s %s %s\n", e.Type, e.Check.Node, e.Check.ID, e.Check.Status)
+	case e.Name != "":
+		fmt.Printf("%s: %s %s\n", e.Type, e.Name, e.Payload)
+	default:
+		fmt.Println(e.Type)
+	}
+}
+
+func runInfo(args []string) error {
+	var flJSON bool
+
+	fs := newFlagSet("info")
+	c := clientFlags(fs)
+	fs.BoolVar(&flJSON, "json", false, "output JSON")
+	fs.Parse(args)
+
+	var local api.Member
+	if err := c.call(http.MethodGet, "/v1/local", nil, nil, &local); err != nil {
+		return err
+	}
+
+	stats := map[string]string{}
+	if err := c.call(http.MethodGet, "/v1/stats", nil, nil, &stats); err != nil {
+		return err
+	}
+
+	if flJSON {
+		return printJSON(map[string]interface{}{
+			"member": local,
+			"stats":  stats,
+		})
+	}
+
+	fmt.Printf("name: %s\n", local.Name)
+	fmt.Printf("addr: %s:%d\n", local.Addr, local.Port)
+	fmt.Printf("status: %s\n", local.Status)
+	fmt.Printf("health: %s\n", local.Health)
+	fmt.Printf("tags: %s\n", formatTags(local.Tags))
+
+	keys := []string{}
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Println("stats:")
+	for _, k := range keys {
+		fmt.Printf("  %s: %s\n", k, stats[k])
+	}
+
+	return nil
+}
+
+func runSimulate(args []string) error {
+	var (
+		cfg         sim.Config
+		flProfile   string
+		flTuning    string
+		flJSON      bool
+		flDegradedN sim.Network
+	)
+
+	fs := newFlagSet("simulate")
+	fs.IntVar(&cfg.Nodes, "nodes", 100, "number of nodes")
+	fs.StringVar(&flProfile, "profile", "", "gossip profile: lan, wan, local or fast-failure")
+	fs.StringVar(&flTuning, "tuning", "", "JSON file with timing overrides, as in the agent tuning config")
+	fs.DurationVar(&cfg.Network.Latency, "latency", time.Millisecond, "one way network latency")
+	fs.DurationVar(&cfg.Network.Jitter, "jitter", 0, "network latency jitter")
+	fs.Float64Var(&cfg.Network.Loss, "loss", 0, "packet loss probability")
+	fs.Float64Var(&cfg.Degraded, "degraded", 0, "share of nodes on the degraded network")
+	fs.DurationVar(&flDegradedN.Latency, "degraded-latency", time.Millisecond*100, "one way latency of degraded nodes")
+	fs.DurationVar(&flDegradedN.Jitter, "degraded-jitter", time.Millisecond*50, "latency jitter of degraded nodes")
+	fs.Float64Var(&flDegradedN.Loss, "degraded-loss", 0.1, "packet loss probability of degraded nodes")
+	fs.DurationVar(&cfg.Duration, "duration", time.Minute*5, "virtual time to simulate")
+	fs.DurationVar(&cfg.JoinWindow, "join-window", time.Second*10, "window in which the nodes start")
+	fs.IntVar(&cfg.Failures, "failures", 0, "number of nodes to crash")
+	fs.DurationVar(&cfg.FailAt, "fail-at", time.Minute, "when the nodes crash")
+	fs.IntVar(&cfg.Events, "events", 0, "number of user events to send")
+	fs.DurationVar(&cfg.EventAt, "event-at", time.Second*90, "when the first user event is sent")
+	fs.IntVar(&cfg.EventSize, "event-size", 64, "user event payload size in bytes")
+	fs.Int64Var(&cfg.Seed, "seed", 0, "random seed; 0 picks one")
+	fs.BoolVar(&flJSON, "json", false, "output JSON")
+	fs.Parse(args)
+
+	profile, err := libdiscover.ParseProfile(flProfile)
+	if err != nil {
+		return err
+	}
+	cfg.Profile = profile
+	cfg.DegradedNetwork = flDegradedN
+
+	if flTuning != "" {
+		data, err := ioutil.ReadFile(flTuning)
+		if err != nil {
+			return err
+		}
+
+		var t tuningConfig
+		if err := json.Unmarshal(data, &t); err != nil {
+			return fmt.Errorf("error parsing %s: %s", flTuning, jsonError(data, err))
+		}
+		cfg.Tuning = t.tuning()
+	}
+
+	r, err := sim.Run(&cfg)
+	if err != nil {
+		return err
+	}
+
+	if flJSON {
+		return printJSON(r)
+	}
+
+	r.WriteReport(os.Stdout)
+
+	return nil
+}
@@ -0,0 +1,910 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/api"
+	"github.com/hashicorp/hcl"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultBindAddr = "127.0.0.1:7946"
+	defaultHTTPAddr = "127.0.0.1:7947"
+	defaultTimeout  = time.Second * 60
+)
+
+// duration is a time.Duration read from a string such as "10s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s; expected a string such as \"10s\"", b)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = duration(v)
+
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// agentConfig is the agent configuration.  It is merged from config files,
+// environment variables and flags, in that order, with later sources
+// overriding earlier ones.
+type agentConfig struct {
+	Name         string   `json:"name,omitempty"`
+	Bind         string   `json:"bind,omitempty"`
+	Advertise    string   `json:"advertise,omitempty"`
+	Join         string   `json:"join,omitempty"`
+	Timeout      duration `json:"timeout,omitempty"`
+	LogLevel     string   `json:"log_level,omitempty"`
+	ClusterDebug *bool    `json:"cluster_debug,omitempty"`
+	// DisableCoordinates turns off network coordinates
+	DisableCoordinates *bool `json:"disable_coordinates,omitempty"`
+	// Datacenter defaults to dc1; agents with WANBind are WAN gateways
+	Datacenter   string            `json:"datacenter,omitempty"`
+	WANBind      string            `json:"wan_bind,omitempty"`
+	WANAdvertise string            `json:"wan_advertise,omitempty"`
+	WANJoin      string            `json:"wan_join,omitempty"`
+	Encrypt      string            `json:"encrypt,omitempty"`
+	Keyring      []string          `json:"keyring,omitempty"`
+	HTTPAddr     string            `json:"http_addr,omitempty"`
+	Token        string            `json:"token,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	// AllowedOrigins are the browser origins that may open a websocket
+	// to the event stream besides the origin of the API
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// EnableChaos serves /v1/chaos; Chaos injects faults from the start and
+	// can be changed on reload
+	EnableChaos *bool      `json:"enable_chaos,omitempty"`
+	Chaos       *api.Chaos `json:"chaos,omitempty"`
+	// Metrics selects the metrics sink
+	Metrics *metricsConfig `json:"metrics,omitempty"`
+	// Profile is lan, wan, local or fast-failure and Tuning overrides its
+	// timings
+	Profile string        `json:"profile,omitempty"`
+	Tuning  *tuningConfig `json:"tuning,omitempty"`
+	// Segments are isolated gossip pools the agent joins as well
+	Segments []*segmentConfig `json:"segments,omitempty"`
+	// Announce is gossip, legacy or off; see libdiscover.AnnounceMode
+	Announce     string         `json:"announce,omitempty"`
+	Version      string         `json:"version,omitempty"`
+	Capabilities []string       `json:"capabilities,omitempty"`
+	Checks       []*checkConfig `json:"checks,omitempty"`
+	// EventHandlers run commands for cluster events
+	EventHandlers []*handlerConfig `json:"event_handlers,omitempty"`
+}
+
+// tuningConfig overrides gossip timings; see libdiscover.Tuning
+type tuningConfig struct {
+	ProbeInterval       duration `json:"probe_interval,omitempty"`
+	ProbeTimeout        duration `json:"probe_timeout,omitempty"`
+	IndirectChecks      int      `json:"indirect_checks,omitempty"`
+	SuspicionMult       int      `json:"suspicion_mult,omitempty"`
+	GossipNodes         int      `json:"gossip_nodes,omitempty"`
+	GossipInterval      duration `json:"gossip_interval,omitempty"`
+	RetransmitMult      int      `json:"retransmit_mult,omitempty"`
+	PushPullInterval    duration `json:"push_pull_interval,omitempty"`
+	ReapInterval        duration `json:"reap_interval,omitempty"`
+	ReconnectInterval   duration `json:"reconnect_interval,omitempty"`
+	ReconnectTimeout    duration `json:"reconnect_timeout,omitempty"`
+	CoalescePeriod      duration `json:"coalesce_period,omitempty"`
+	QuiescentPeriod     duration `json:"quiescent_period,omitempty"`
+	UserCoalescePeriod  duration `json:"user_coalesce_period,omitempty"`
+	UserQuiescentPeriod duration `json:"user_quiescent_period,omitempty"`
+	QueueDepthWarning   int      `json:"queue_depth_warning,omitempty"`
+	MaxQueueDepth       int      `json:"max_queue_depth,omitempty"`
+	HandoffQueueDepth   int      `json:"handoff_queue_depth,omitempty"`
+}
+
+// metricsConfig selects the metrics sink; see libdiscover.MetricsConfig
+type metricsConfig struct {
+	Sink     string   `json:"sink,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	Interval duration `json:"interval,omitempty"`
+	Retain   duration `json:"retain,omitempty"`
+}
+
+func (m *metricsConfig) metrics() *libdiscover.MetricsConfig {
+	if m == nil {
+		return nil
+	}
+
+	return &libdiscover.MetricsConfig{
+		Sink:     libdiscover.MetricsSink(m.Sink),
+		Address:  m.Address,
+		Interval: time.Duration(m.Interval),
+		Retain:   time.Duration(m.Retain),
+	}
+}
+
+// chaos returns the chaos settings; nil turns chaos off
+func (c *agentConfig) chaos() (*libdiscover.ChaosConfig, error) {
+	if c.Chaos == nil {
+		return nil, nil
+	}
+
+	return c.Chaos.Config()
+}
+
+func (t *tuningConfig) tuning() *libdiscover.Tuning {
+	if t == nil {
+		return nil
+	}
+
+	return &libdiscover.Tuning{
+		ProbeInterval:       time.Duration(t.ProbeInterval),
+		ProbeTimeout:        time.Duration(t.ProbeTimeout),
+		IndirectChecks:      t.IndirectChecks,
+		SuspicionMult:       t.SuspicionMult,
+		GossipNodes:         t.GossipNodes,
+		GossipInterval:      time.Duration(t.GossipInterval),
+		RetransmitMult:      t.RetransmitMult,
+		PushPullInterval:    time.Duration(t.PushPullInterval),
+		ReapInterval:        time.Duration(t.ReapInterval),
+		ReconnectInterval:   time.Duration(t.ReconnectInterval),
+		ReconnectTimeout:    time.Duration(t.ReconnectTimeout),
+		CoalescePeriod:      time.Duration(t.CoalescePeriod),
+		QuiescentPeriod:     time.Duration(t.QuiescentPeriod),
+		UserCoalescePeriod:  time.Duration(t.UserCoalescePeriod),
+		UserQuiescentPeriod: time.Duration(t.UserQuiescentPeriod),
+		QueueDepthWarning:   t.QueueDepthWarning,
+		MaxQueueDepth:       t.MaxQueueDepth,
+		HandoffQueueDepth:   t.HandoffQueueDepth,
+	}
+}
+
+// segmentConfig is a segment the agent belongs to
+type segmentConfig struct {
+	Name      string            `json:"name"`
+	Bind      string            `json:"bind"`
+	Advertise string            `json:"advertise,omitempty"`
+	Join      string            `json:"join,omitempty"`
+	Encrypt   string            `json:"encrypt,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+// checkConfig is a health check; exactly one of HTTP, TCP or Script is set
+type checkConfig struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name,omitempty"`
+	ServiceID string   `json:"service_id,omitempty"`
+	HTTP      string   `json:"http,omitempty"`
+	Method    string   `json:"method,omitempty"`
+	TCP       string   `json:"tcp,omitempty"`
+	Script    []string `json:"script,omitempty"`
+	Interval  duration `json:"interval,omitempty"`
+	Timeout   duration `json:"timeout,omitempty"`
+}
+
+// merge overrides the config with the values set in o.  Tags are merged by
+// key, segments by name and checks by id.
+func (c *agentConfig) merge(o *agentConfig) {
+	if o.Name != "" {
+		c.Name = o.Name
+	}
+	if o.Bind != "" {
+		c.Bind = o.Bind
+	}
+	if o.Advertise != "" {
+		c.Advertise = o.Advertise
+	}
+	if o.Join != "" {
+		c.Join = o.Join
+	}
+	if o.Timeout != 0 {
+		c.Timeout = o.Timeout
+	}
+	if o.LogLevel != "" {
+		c.LogLevel = o.LogLevel
+	}
+	if o.ClusterDebug != nil {
+		c.ClusterDebug = o.ClusterDebug
+	}
+	if o.DisableCoordinates != nil {
+		c.DisableCoordinates = o.DisableCoordinates
+	}
+	if o.Datacenter != "" {
+		c.Datacenter = o.Datacenter
+	}
+	if o.WANBind != "" {
+		c.WANBind = o.WANBind
+	}
+	if o.WANAdvertise != "" {
+		c.WANAdvertise = o.WANAdvertise
+	}
+	if o.WANJoin != "" {
+		c.WANJoin = o.WANJoin
+	}
+	if o.Encrypt != "" {
+		c.Encrypt = o.Encrypt
+	}
+	if len(o.Keyring) > 0 {
+		c.Keyring = append(c.Keyring, o.Keyring...)
+	}
+	if o.HTTPAddr != "" {
+		c.HTTPAddr = o.HTTPAddr
+	}
+	if o.Token != "" {
+		c.Token = o.Token
+	}
+	if len(o.AllowedOrigins) > 0 {
+		c.AllowedOrigins = o.AllowedOrigins
+	}
+
+	if o.Announce != "" {
+		c.Announce = o.Announce
+	}
+	if o.Version != "" {
+		c.Version = o.Version
+	}
+	if len(o.Capabilities) > 0 {
+		c.Capabilities = o.Capabilities
+	}
+
+	if len(o.Tags) > 0 && c.Tags == nil {
+		c.Tags = map[string]string{}
+	}
+	for k, v := range o.Tags {
+		c.Tags[k] = v
+	}
+
+	if o.EnableChaos != nil {
+		c.EnableChaos = o.EnableChaos
+	}
+	if o.Chaos != nil {
+		c.Chaos = o.Chaos
+	}
+	if o.Metrics != nil {
+		c.Metrics = o.Metrics
+	}
+
+	if o.Profile != "" {
+		c.Profile = o.Profile
+	}
+	if o.Tuning != nil {
+		c.Tuning = o.Tuning
+	}
+
+	for _, seg := range o.Segments {
+		replaced := false
+		for i, cs := range c.Segments {
+			if cs.Name == seg.Name {
+				c.Segments[i] = seg
+				replaced = true
+				break
+			}
+		}
+
+		if !replaced {
+			c.Segments = append(c.Segments, seg)
+		}
+	}
+
+	for _, oc := range o.Checks {
+		replaced := false
+		for i, cc := range c.Checks {
+			if oc.ID != "" && cc.ID == oc.ID {
+				c.Checks[i] = oc
+				replaced = true
+				break
+			}
+		}
+
+		if !replaced {
+			c.Checks = append(c.Checks, oc)
+		}
+	}
+
+	c.EventHandlers = append(c.EventHandlers, o.EventHandlers...)
+}
+
+// isTrue returns the value of an optional boolean setting
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+// defaultConfig returns the built in defaults
+func defaultConfig() *agentConfig {
+	return &agentConfig{
+		Bind:      defaultBindAddr,
+		Advertise: defaultBindAddr,
+		Timeout:   duration(defaultTimeout),
+		LogLevel:  "info",
+		HTTPAddr:  defaultHTTPAddr,
+	}
+}
+
+// envConfig reads the LIBDISCOVER_* environment variables
+func envConfig() (*agentConfig, error) {
+	c := &agentConfig{
+		Name:         os.Getenv("LIBDISCOVER_NAME"),
+		Announce:     os.Getenv("LIBDISCOVER_ANNOUNCE"),
+		Bind:         os.Getenv("LIBDISCOVER_BIND"),
+		Advertise:    os.Getenv("LIBDISCOVER_ADVERTISE"),
+		Join:         os.Getenv("LIBDISCOVER_JOIN"),
+		Datacenter:   os.Getenv("LIBDISCOVER_DATACENTER"),
+		WANBind:      os.Getenv("LIBDISCOVER_WAN_BIND"),
+		WANAdvertise: os.Getenv("LIBDISCOVER_WAN_ADVERTISE"),
+		WANJoin:      os.Getenv("LIBDISCOVER_WAN_JOIN"),
+		Profile:      os.Getenv("LIBDISCOVER_PROFILE"),
+		LogLevel:     os.Getenv("LIBDISCOVER_LOG_LEVEL"),
+		Encrypt:      os.Getenv("LIBDISCOVER_ENCRYPT"),
+		HTTPAddr:     os.Getenv("LIBDISCOVER_HTTP_ADDR"),
+		Token:        os.Getenv("LIBDISCOVER_TOKEN"),
+	}
+
+	if v := os.Getenv("LIBDISCOVER_TIMEOUT"); v != "" {
+		t, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("LIBDISCOVER_TIMEOUT: %s", err)
+		}
+		c.Timeout = duration(t)
+	}
+
+	if v := os.Getenv("LIBDISCOVER_CLUSTER_DEBUG"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("LIBDISCOVER_CLUSTER_DEBUG: %s", err)
+		}
+		c.ClusterDebug = &b
+	}
+
+	if v := os.Getenv("LIBDISCOVER_TAGS"); v != "" {
+		tags, err := parseKeyValues(strings.Split(v, ","))
+		if err != nil {
+			return nil, fmt.Errorf("LIBDISCOVER_TAGS: %s", err)
+		}
+		c.Tags = tags
+	}
+
+	return c, nil
+}
+
+// configFiles expands the paths to the config files they name.  The .json,
+// .yaml, .yml and .hcl files in a directory are loaded in lexical order;
+// other files are ignored.
+func configFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+
+		names := []string{}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+
+			switch filepath.Ext(e.Name()) {
+			case ".json", ".yaml", ".yml", ".hcl":
+				names = append(names, e.Name())
+			}
+		}
+		sort.Strings(names)
+
+		for _, n := range names {
+			files = append(files, filepath.Join(p, n))
+		}
+	}
+
+	return files, nil
+}
+
+// loadConfigFile reads a single config file.  YAML and HCL files are
+// converted to JSON so that every format is decoded and checked the same
+// way.
+func loadConfigFile(path string) (*agentConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// positions in the converted JSON do not match the file
+	positions := true
+
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+	case ".yaml", ".yml", ".hcl":
+		var v interface{}
+		if ext == ".hcl" {
+			err = hcl.Unmarshal(data, &v)
+		} else {
+			err = yaml.Unmarshal(data, &v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		v, err = normalize(v, reflect.TypeOf(agentConfig{}))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		if data, err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		positions = false
+	default:
+		return nil, fmt.Errorf("%s: config files must have a .json, .yaml, .yml or .hcl extension", path)
+	}
+
+	c := &agentConfig{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		if !positions {
+			data = nil
+		}
+		return nil, fmt.Errorf("%s: %s", path, jsonError(data, err))
+	}
+
+	return c, nil
+}
+
+// normalize converts a value decoded from YAML or HCL into the form JSON
+// decodes into t.  YAML maps get string keys; HCL blocks, which decode as
+// lists of objects, become a single object unless t is a list.
+func normalize(v interface{}, t reflect.Type) (interface{}, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			m[fmt.Sprint(k)] = e
+		}
+
+		return normalize(m, t)
+	case []map[string]interface{}:
+		if t != nil && t.Kind() != reflect.Slice {
+			if len(val) != 1 {
+				return nil, fmt.Errorf("expected a single block, got %d", len(val))
+			}
+
+			return normalize(val[0], t)
+		}
+
+		list := make([]interface{}, len(val))
+		for i, e := range val {
+			list[i] = e
+		}
+
+		return normalize(list, t)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			n, err := normalize(e, fieldType(t, k))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", k, err)
+			}
+			m[k] = n
+		}
+
+		return m, nil
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			elem = t.Elem()
+		}
+
+		list := make([]interface{}, len(val))
+		for i, e := range val {
+			n, err := normalize(e, elem)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = n
+		}
+
+		return list, nil
+	}
+
+	return v, nil
+}
+
+// fieldType returns the type JSON decodes the key of a t into, or nil when
+// it is not known
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = f.Name
+			}
+
+			if strings.EqualFold(name, key) {
+				return f.Type
+			}
+		}
+	}
+
+	return nil
+}
+
+// jsonError adds the line and column to JSON decoding errors.  data is nil
+// when the positions would not match the file.
+func jsonError(data []byte, err error) string {
+	if data == nil {
+		if e, ok := err.(*json.UnmarshalTypeError); ok && e.Field != "" {
+			return fmt.Sprintf("%s: expected %s, got %s", e.Field, e.Type, e.Value)
+		}
+
+		return strings.TrimPrefix(err.Error(), "json: ")
+	}
+
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		if e.Field != "" {
+			return fmt.Sprintf("%s: %s: expected %s, got %s", position(data, e.Offset), e.Field, e.Type, e.Value)
+		}
+		offset = e.Offset
+	default:
+		return strings.TrimPrefix(err.Error(), "json: ")
+	}
+
+	return fmt.Sprintf("%s: %s", position(data, offset), strings.TrimPrefix(err.Error(), "json: "))
+}
+
+func position(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	line, col := 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+			continue
+		}
+		col++
+	}
+
+	return fmt.Sprintf("%d:%d", line, col)
+}
+
+// loadConfig merges the defaults, config files, environment and flags
+func loadConfig(paths []string, flags *agentConfig) (*agentConfig, error) {
+	cfg := defaultConfig()
+
+	files, err := configFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		c, err := loadConfigFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.merge(c)
+	}
+
+	env, err := envConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.merge(env)
+	cfg.merge(flags)
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// validate reports every invalid setting
+func (c *agentConfig) validate() error {
+	errs := []string{}
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	addrs := []struct {
+		field string
+		addr  string
+	}{
+		{"bind", c.Bind},
+		{"advertise", c.Advertise},
+		{"join", c.Join},
+		{"http_addr", c.HTTPAddr},
+		{"wan_bind", c.WANBind},
+		{"wan_advertise", c.WANAdvertise},
+	}
+	for _, a := range addrs {
+		if a.addr == "" && (a.field == "join" || strings.HasPrefix(a.field, "wan_")) {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			invalid(a.field, "invalid address %q; expected host:port", a.addr)
+		}
+	}
+
+	for _, addr := range strings.Split(c.WANJoin, ",") {
+		if addr == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			invalid("wan_join", "invalid address %q; expected host:port", addr)
+		}
+	}
+
+	if (c.WANAdvertise != "" || c.WANJoin != "") && c.WANBind == "" {
+		invalid("wan_bind", "required to advertise or join the WAN")
+	}
+
+	if strings.ContainsAny(c.Datacenter, ". \t") {
+		invalid("datacenter", "cannot contain dots or spaces")
+	}
+
+	if c.Timeout <= 0 {
+		invalid("timeout", "must be greater than zero")
+	}
+
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		invalid("log_level", "unknown level %q", c.LogLevel)
+	}
+
+	if c.Encrypt != "" {
+		if err := validateKey(c.Encrypt); err != nil {
+			invalid("encrypt", "%s", err)
+		}
+	}
+
+	for i, k := range c.Keyring {
+		if err := validateKey(k); err != nil {
+			invalid(fmt.Sprintf("keyring[%d]", i), "%s", err)
+		}
+	}
+
+	if len(c.Keyring) > 0 && c.Encrypt == "" {
+		invalid("keyring", "requires encrypt to be set")
+	}
+
+	if _, err := announceMode(c.Announce); err != nil {
+		invalid("announce", "%s", err)
+	}
+
+	for k := range c.Tags {
+		if k == "" {
+			invalid("tags", "tag names cannot be empty")
+		}
+		if k == libdiscover.DatacenterTag || k == libdiscover.WANTag || k == libdiscover.SegmentTag {
+			invalid("tags", "%s is set by libdiscover", k)
+		}
+	}
+
+	if profile, err := libdiscover.ParseProfile(c.Profile); err != nil {
+		invalid("profile", "%s", err)
+	} else if err := c.Tuning.tuning().Validate(profile); err != nil {
+		invalid("tuning", "%s", err)
+	}
+
+	if _, err := c.chaos(); err != nil {
+		invalid("chaos", "%s", err)
+	}
+
+	if m := c.Metrics.metrics(); m != nil {
+		if err := m.Validate(); err != nil {
+			invalid("metrics", "%s", err)
+		}
+	}
+
+	segments := map[string]bool{}
+	for i, seg := range c.Segments {
+		field := fmt.Sprintf("segments[%d]", i)
+
+		if seg.Name == "" {
+			invalid(field+".name", "required")
+		} else if segments[seg.Name] {
+			invalid(field+".name", "duplicate segment %q", seg.Name)
+		}
+		segments[seg.Name] = true
+
+		for _, a := range []struct {
+			field string
+			addr  string
+		}{
+			{"bind", seg.Bind},
+			{"advertise", seg.Advertise},
+			{"join", seg.Join},
+		} {
+			if a.addr == "" && a.field != "bind" {
+				continue
+			}
+
+			if _, _, err := net.SplitHostPort(a.addr); err != nil {
+				invalid(field+"."+a.field, "invalid address %q; expected host:port", a.addr)
+			}
+		}
+
+		if seg.Encrypt != "" {
+			if err := validateKey(seg.Encrypt); err != nil {
+				invalid(field+".encrypt", "%s", err)
+			}
+		}
+	}
+
+	for i, chk := range c.Checks {
+		field := fmt.Sprintf("checks[%d]", i)
+
+		if chk.ID == "" {
+			invalid(field+".id", "required")
+		}
+
+		n := 0
+		if chk.HTTP != "" {
+			n++
+		}
+		if chk.TCP != "" {
+			n++
+			if _, _, err := net.SplitHostPort(chk.TCP); err != nil {
+				invalid(field+".tcp", "invalid address %q; expected host:port", chk.TCP)
+			}
+		}
+		if len(chk.Script) > 0 {
+			n++
+		}
+		if n != 1 {
+			invalid(field, "exactly one of http, tcp or script is required")
+		}
+
+		if chk.Method != "" && chk.HTTP == "" {
+			invalid(field+".method", "only valid for http checks")
+		}
+
+		if chk.Interval < 0 {
+			invalid(field+".interval", "must not be negative")
+		}
+
+		if chk.Timeout < 0 {
+			invalid(field+".timeout", "must not be negative")
+		}
+	}
+
+	for i, h := range c.EventHandlers {
+		field := fmt.Sprintf("event_handlers[%d]", i)
+
+		if strings.TrimSpace(h.Command) == "" {
+			invalid(field+".command", "required")
+		}
+
+		if _, err := parseHandlerFilters(h.Event); err != nil {
+			invalid(field+".event", "%s", err)
+		}
+
+		if h.Timeout < 0 {
+			invalid(field+".timeout", "must not be negative")
+		}
+
+		if h.Concurrency < 0 {
+			invalid(field+".concurrency", "must not be negative")
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+}
+
+// libdiscoverSegments converts the segment settings
+func (c *agentConfig) libdiscoverSegments() []libdiscover.SegmentConfig {
+	segments := []libdiscover.SegmentConfig{}
+	for _, s := range c.Segments {
+		segments = append(segments, libdiscover.SegmentConfig{
+			Name:          s.Name,
+			BindAddr:      s.Bind,
+			AdvertiseAddr: s.Advertise,
+			JoinAddr:      s.Join,
+			EncryptKey:    s.Encrypt,
+			Tags:          s.Tags,
+		})
+	}
+
+	return segments
+}
+
+// announceMode parses the announce setting; empty is gossip
+func announceMode(s string) (libdiscover.AnnounceMode, error) {
+	switch s {
+	case "gossip":
+		return libdiscover.AnnounceGossip, nil
+	case "", "legacy":
+		return libdiscover.AnnounceLegacy, nil
+	case "off":
+		return libdiscover.AnnounceOff, nil
+	}
+
+	return 0, fmt.Errorf("unknown mode %q; expected gossip, legacy or off", s)
+}
+
+func validateKey(key string) error {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("invalid base64 key")
+	}
+
+	switch len(k) {
+	case 16, 24, 32:
+		return nil
+	}
+
+	return fmt.Errorf("key must be 16, 24 or 32 bytes")
+}
+
+// healthCheck converts the config to a health check
+func (c *checkConfig) healthCheck() *libdiscover.HealthCheck {
+	hc := &libdiscover.HealthCheck{
+		ID:        c.ID,
+		Name:      c.Name,
+		ServiceID: c.ServiceID,
+		Interval:  time.Duration(c.Interval),
+		Timeout:   time.Duration(c.Timeout),
+	}
+
+	switch {
+	case c.HTTP != "":
+		hc.Checker = &libdiscover.HTTPCheck{URL: c.HTTP, Method: c.Method}
+	case c.TCP != "":
+		hc.Checker = &libdiscover.TCPCheck{Addr: c.TCP}
+	default:
+		hc.Checker = &libdiscover.ScriptCheck{Command: c.Script}
+	}
+
+	return hc
+}
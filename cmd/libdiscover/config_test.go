@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libdiscover-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, n := range []string{"b.json", "a.json", "c.yaml", "d.hcl", ".e.json"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, n), []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := configFiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		filepath.Join(dir, "a.json"),
+		filepath.Join(dir, "b.json"),
+		filepath.Join(dir, "c.yaml"),
+		filepath.Join(dir, "d.hcl"),
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected %v; got %v", expected, files)
+	}
+
+	// a file named explicitly must still have a known extension
+	path := filepath.Join(dir, "f.toml")
+	if err := ioutil.WriteFile(path, []byte(""), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadConfigFile(path); err == nil {
+		t.Fatal("expected an error loading a TOML config file")
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libdiscover-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"c.json": `{
+  "name": "node-00",
+  "timeout": "30s",
+  "enable_chaos": true,
+  "tags": {"role": "web"},
+  "tuning": {"gossip_nodes": 4, "push_pull_interval": "60s"},
+  "segments": [{"name": "tenant-a", "bind": "127.0.0.1:7950"}],
+  "checks": [
+    {"id": "web", "http": "http://127.0.0.1:8080/health", "interval": "10s"},
+    {"id": "disk", "script": ["/usr/local/bin/check-disk"]}
+  ]
+}`,
+		"c.yaml": `
+name: node-00
+timeout: 30s
+enable_chaos: true
+tags:
+  role: web
+tuning:
+  gossip_nodes: 4
+  push_pull_interval: 60s
+segments:
+  - name: tenant-a
+    bind: 127.0.0.1:7950
+checks:
+  - id: web
+    http: http://127.0.0.1:8080/health
+    interval: 10s
+  - id: disk
+    script: [/usr/local/bin/check-disk]
+`,
+		"c.hcl": `
+name = "node-00"
+timeout = "30s"
+enable_chaos = true
+
+tags {
+  role = "web"
+}
+
+tuning {
+  gossip_nodes = 4
+  push_pull_interval = "60s"
+}
+
+segments {
+  name = "tenant-a"
+  bind = "127.0.0.1:7950"
+}
+
+checks {
+  id = "web"
+  http = "http://127.0.0.1:8080/health"
+  interval = "10s"
+}
+
+checks {
+  id = "disk"
+  script = ["/usr/local/bin/check-disk"]
+}
+`,
+	}
+
+	configs := map[string]*agentConfig{}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := loadConfigFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs[name] = c
+	}
+
+	expected := configs["c.json"]
+	if expected.Name != "node-00" || len(expected.Checks) != 2 || len(expected.Segments) != 1 {
+		t.Fatalf("unexpected JSON config %+v", expected)
+	}
+
+	for _, name := range []string{"c.yaml", "c.hcl"} {
+		if !reflect.DeepEqual(configs[name], expected) {
+			a, _ := json.Marshal(expected)
+			b, _ := json.Marshal(configs[name])
+			t.Errorf("%s: expected %s; got %s", name, a, b)
+		}
+	}
+}
+
+func TestConfigFormatErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "libdiscover-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, tc := range map[string]struct {
+		data string
+		err  string
+	}{
+		"unknown.yaml":  {"nmae: node-00\n", `unknown field "nmae"`},
+		"type.yaml":     {"tuning:\n  gossip_nodes: many\n", "tuning.gossip_nodes: expected int"},
+		"duration.yaml": {"timeout: 10\n", "invalid duration 10"},
+		"syntax.yaml":   {"tags: [\n", "yaml: line"},
+		"unknown.hcl":   {"nmae = \"node-00\"\n", `unknown field "nmae"`},
+		"type.hcl":      {"tags = [\"web\"]\n", "tags: expected map[string]string"},
+		"blocks.hcl":    {"tuning {\n}\ntuning {\n}\n", "tuning: expected a single block, got 2"},
+		"syntax.hcl":    {"tags {\n  role = \"web\"\n", "At 3:2: object expected closing RBRACE"},
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(tc.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := loadConfigFile(path)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error containing %q; got %v", name, tc.err, err)
+		}
+	}
+}
+
+func TestMergeBool(t *testing.T) {
+	enabled, disabled := true, false
+
+	c := defaultConfig()
+	c.merge(&agentConfig{EnableChaos: &enabled, DisableCoordinates: &enabled})
+	if !isTrue(c.EnableChaos) || !isTrue(c.DisableCoordinates) {
+		t.Fatal("expected the settings to be enabled")
+	}
+
+	// unset settings keep their value
+	c.merge(&agentConfig{})
+	if !isTrue(c.EnableChaos) || !isTrue(c.DisableCoordinates) {
+		t.Fatal("expected the settings to stay enabled")
+	}
+
+	c.merge(&agentConfig{EnableChaos: &disabled, DisableCoordinates: &disabled})
+	if isTrue(c.EnableChaos) || isTrue(c.DisableCoordinates) {
+		t.Fatal("expected a later false to override true")
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHandlerTimeout = time.Second * 60
+
+	// handlerQueueSize is the number of events queued for a busy handler
+	// before new events are dropped
+	handlerQueueSize = 128
+
+	// maxHandlerOutput limits the output kept for logging
+	maxHandlerOutput = 8 * 1024
+)
+
+// handlerEvents are the event types a handler can subscribe to
+var handlerEvents = map[string]bool{
+	"member-join":     true,
+	"member-leave":    true,
+	"member-failed":   true,
+	"member-update":   true,
+	"member-reap":     true,
+	"user":            true,
+	"query":           true,
+	"health-update":   true,
+	"member-announce": true,
+	"member-depart":   true,
+	"member-stale":    true,
+	"member-fresh":    true,
+}
+
+// handlerConfig runs Command with sh -c for the events matching Event.
+// Event is a comma separated list of event types; user and query events can
+// be limited by name as user:<name> and query:<name>.  Empty or * matches
+// every event.
+type handlerConfig struct {
+	Event   string `json:"event,omitempty"`
+	Command string `json:"command"`
+	// Timeout kills the command; queries are also limited by their deadline
+	Timeout duration `json:"timeout,omitempty"`
+	// Concurrency is the number of events handled at once; defaults to 1
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// parseHandlerFlag parses a handler given as [event=]command.  A prefix
+// that is not a list of event types, such as an environment assignment, is
+// part of the command.
+func parseHandlerFlag(v string) *handlerConfig {
+	h := &handlerConfig{Command: v}
+
+	if i := strings.Index(v, "="); i > 0 && !strings.ContainsAny(v[:i], " \t'\"") {
+		if _, err := parseHandlerFilters(v[:i]); err != nil {
+			return h
+		}
+
+		h.Event = v[:i]
+		h.Command = v[i+1:]
+	}
+
+	return h
+}
+
+// handlerFilter matches an event type and optional name
+type handlerFilter struct {
+	event string
+	name  string
+}
+
+func parseHandlerFilters(spec string) ([]handlerFilter, error) {
+	filters := []handlerFilter{}
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" || f == "*" {
+			filters = append(filters, handlerFilter{event: "*"})
+			continue
+		}
+
+		parts := strings.SplitN(f, ":", 2)
+		hf := handlerFilter{event: parts[0]}
+		if len(parts) == 2 {
+			if hf.event != "user" && hf.event != "query" {
+				return nil, fmt.Errorf("only user and query events can be filtered by name: %q", f)
+			}
+			hf.name = parts[1]
+		}
+
+		if !handlerEvents[hf.event] {
+			return nil, fmt.Errorf("unknown event type %q", hf.event)
+		}
+
+		filters = append(filters, hf)
+	}
+
+	return filters, nil
+}
+
+func (f handlerFilter) match(event, name string) bool {
+	if f.event == "*" {
+		return true
+	}
+
+	return f.event == event && (f.name == "" || f.name == name)
+}
+
+// handlerJob is an event queued for a handler
+type handlerJob struct {
+	evt serf.Event
+	// respond is set for the handler that answers a query
+	respond bool
+}
+
+// scriptHandler runs a handler command for matching events
+type scriptHandler struct {
+	cfg     *handlerConfig
+	filters []handlerFilter
+	queue   chan *handlerJob
+	wg      sync.WaitGroup
+}
+
+// eventHandlers dispatches cluster events to handler commands.  The
+// handlers can be replaced while running.
+type eventHandlers struct {
+	d *libdiscover.Discover
+
+	mu       sync.RWMutex
+	handlers []*scriptHandler
+}
+
+func newEventHandlers(d *libdiscover.Discover) *eventHandlers {
+	return &eventHandlers{d: d}
+}
+
+// update replaces the handlers; events already queued for the old handlers
+// are still handled
+func (h *eventHandlers) update(configs []*handlerConfig) error {
+	handlers := []*scriptHandler{}
+	for _, cfg := range configs {
+		filters, err := parseHandlerFilters(cfg.Event)
+		if err != nil {
+			return err
+		}
+
+		sh := &scriptHandler{
+			cfg:     cfg,
+			filters: filters,
+			queue:   make(chan *handlerJob, handlerQueueSize),
+		}
+
+		n := cfg.Concurrency
+		if n <= 0 {
+			n = 1
+		}
+
+		for i := 0; i < n; i++ {
+			sh.wg.Add(1)
+			go h.worker(sh)
+		}
+
+		handlers = append(handlers, sh)
+	}
+
+	h.mu.Lock()
+	old := h.handlers
+	h.handlers = handlers
+	h.mu.Unlock()
+
+	for _, sh := range old {
+		close(sh.queue)
+	}
+
+	return nil
+}
+
+// stop waits for the running handlers to finish
+func (h *eventHandlers) stop() {
+	h.mu.Lock()
+	old := h.handlers
+	h.handlers = nil
+	h.mu.Unlock()
+
+	for _, sh := range old {
+		close(sh.queue)
+		sh.wg.Wait()
+	}
+}
+
+// handle queues the event for the matching handlers.  It does not block so
+// that it can be used as a Discover subscriber.
+func (h *eventHandlers) handle(evt serf.Event) {
+	event := libdiscover.EventTypeName(evt.EventType())
+
+	name := ""
+	switch e := evt.(type) {
+	case serf.UserEvent:
+		name = e.Name
+	case *serf.Query:
+		// queries answered by libdiscover itself
+		if libdiscover.ReservedQuery(e.Name) {
+			return
+		}
+		name = e.Name
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	responder := true
+	for _, sh := range h.handlers {
+		matched := false
+		for _, f := range sh.filters {
+			if f.match(event, name) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		// only the first matching handler answers a query
+		job := &handlerJob{evt: evt}
+		if _, ok := evt.(*serf.Query); ok {
+			job.respond = responder
+			responder = false
+		}
+
+		select {
+		case sh.queue <- job:
+		default:
+			logrus.Warnf("event handler busy; dropping %s event: %s", event, sh.cfg.Command)
+		}
+	}
+}
+
+func (h *eventHandlers) worker(sh *scriptHandler) {
+	defer sh.wg.Done()
+
+	for job := range sh.queue {
+		h.run(sh.cfg, job)
+	}
+}
+
+// run executes the handler command for a single event
+func (h *eventHandlers) run(cfg *handlerConfig, job *handlerJob) {
+	event := libdiscover.EventTypeName(job.evt.EventType())
+
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = defaultHandlerTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	q, isQuery := job.evt.(*serf.Query)
+	if isQuery {
+		deadlineCtx, deadlineCancel := context.WithDeadline(ctx, q.Deadline())
+		defer deadlineCancel()
+		ctx = deadlineCtx
+	}
+
+	stdin, env, err := h.eventInput(job.evt)
+	if err != nil {
+		logrus.Errorf("event handler: %s", err)
+		return
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", cfg.Command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &limitedBuffer{buf: &stdout, max: maxHandlerOutput}
+	cmd.Stderr = &limitedBuffer{buf: &stderr, max: maxHandlerOutput}
+	// background children of the script can hold the output open
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err = cmd.Run()
+
+	fields := logrus.Fields{
+		"event":    event,
+		"command":  cfg.Command,
+		"duration": time.Since(start).String(),
+	}
+	if stdout.Len() > 0 {
+		fields["stdout"] = strings.TrimSpace(stdout.String())
+	}
+	if stderr.Len() > 0 {
+		fields["stderr"] = strings.TrimSpace(stderr.String())
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		logrus.WithFields(fields).Errorf("event handler timed out")
+		return
+	}
+
+	if err != nil {
+		logrus.WithFields(fields).Errorf("event handler failed: %s", err)
+		return
+	}
+
+	if stdout.Len() > 0 || stderr.Len() > 0 {
+		logrus.WithFields(fields).Info("event handler finished")
+	} else {
+		logrus.WithFields(fields).Debug("event handler finished")
+	}
+
+	if !isQuery || !job.respond {
+		return
+	}
+
+	if err := q.Respond(stdout.Bytes()); err != nil {
+		logrus.Errorf("event handler: error responding to query %s: %s", q.Name, err)
+	}
+}
+
+// eventInput returns the stdin and environment for a handler.  Member events
+// write one member per line as name, address, status and tags separated by
+// tabs; user events and queries write their payload.
+func (h *eventHandlers) eventInput(evt serf.Event) ([]byte, []string, error) {
+	env := []string{
+		"LIBDISCOVER_EVENT=" + libdiscover.EventTypeName(evt.EventType()),
+		"LIBDISCOVER_SELF_NAME=" + h.d.Name(),
+	}
+
+	tags := h.d.Tags()
+	for k, v := range tags {
+		env = append(env, "LIBDISCOVER_TAG_"+envName(k)+"="+v)
+	}
+
+	var stdin []byte
+	switch e := evt.(type) {
+	case serf.MemberEvent:
+		var b bytes.Buffer
+		for _, m := range e.Members {
+			fmt.Fprintf(&b, "%s\t%s\t%s\t%s\n", m.Name, m.Addr, m.Status, formatTags(m.Tags))
+		}
+		stdin = b.Bytes()
+	case serf.UserEvent:
+		env = append(env,
+			"LIBDISCOVER_USER_EVENT="+e.Name,
+			fmt.Sprintf("LIBDISCOVER_USER_LTIME=%d", e.LTime),
+		)
+		stdin = e.Payload
+	case *serf.Query:
+		env = append(env,
+			"LIBDISCOVER_QUERY_NAME="+e.Name,
+			fmt.Sprintf("LIBDISCOVER_QUERY_LTIME=%d", e.LTime),
+		)
+		stdin = e.Payload
+	case libdiscover.HealthEvent:
+		data, err := json.Marshal(e.Check)
+		if err != nil {
+			return nil, nil, err
+		}
+		stdin = append(data, '\n')
+	case libdiscover.AnnounceEvent:
+		data, err := json.Marshal(e.Announcement)
+		if err != nil {
+			return nil, nil, err
+		}
+		stdin = append(data, '\n')
+	case libdiscover.LivenessEvent:
+		data, err := json.Marshal(e.Heartbeat)
+		if err != nil {
+			return nil, nil, err
+		}
+		stdin = append(data, '\n')
+	}
+
+	return stdin, env, nil
+}
+
+// envName converts a tag name for use in an environment variable
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// limitedBuffer discards writes past max so that a noisy handler cannot
+// use unbounded memory
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if n := l.max - l.buf.Len(); n > 0 {
+		if len(p) > n {
+			l.buf.Write(p[:n])
+		} else {
+			l.buf.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover/testcluster"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestParseHandlerFlag(t *testing.T) {
+	tests := []struct {
+		flag    string
+		event   string
+		command string
+	}{
+		{"./deploy.sh", "", "./deploy.sh"},
+		{"user:deploy=./deploy.sh", "user:deploy", "./deploy.sh"},
+		{"member-join,member-leave=echo a=b", "member-join,member-leave", "echo a=b"},
+		{"FOO=bar ./run.sh", "", "FOO=bar ./run.sh"},
+		{"echo 'a=b'", "", "echo 'a=b'"},
+	}
+
+	for _, tt := range tests {
+		h := parseHandlerFlag(tt.flag)
+		if h.Event != tt.event || h.Command != tt.command {
+			t.Errorf("%q: expected event %q and command %q; got %q and %q", tt.flag, tt.event, tt.command, h.Event, h.Command)
+		}
+	}
+}
+
+func TestHandlerFilters(t *testing.T) {
+	for _, spec := range []string{"bogus", "member-join:web", "user:deploy,nope"} {
+		if _, err := parseHandlerFilters(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+
+	tests := []struct {
+		spec  string
+		event string
+		name  string
+		match bool
+	}{
+		{"", "member-join", "", true},
+		{"*", "query", "ping", true},
+		{"user", "user", "deploy", true},
+		{"user:deploy", "user", "deploy", true},
+		{"user:deploy", "user", "restart", false},
+		{"user:deploy", "query", "deploy", false},
+		{"member-join, member-leave", "member-leave", "", true},
+		{"member-join, member-leave", "member-failed", "", false},
+	}
+
+	for _, tt := range tests {
+		filters, err := parseHandlerFilters(tt.spec)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.spec, err)
+		}
+
+		matched := false
+		for _, f := range filters {
+			if f.match(tt.event, tt.name) {
+				matched = true
+			}
+		}
+
+		if matched != tt.match {
+			t.Errorf("%q: expected match %v for %s %q", tt.spec, tt.match, tt.event, tt.name)
+		}
+	}
+}
+
+// tempDir returns a directory removed when the test finishes
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "libdiscover-handlers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	return dir
+}
+
+func TestScriptHandler(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Nodes: 1})
+	if err := c.Node(0).SetTags(map[string]string{"role": "web"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := tempDir(t)
+	out := filepath.Join(dir, "out")
+
+	h := newEventHandlers(c.Node(0))
+	err := h.update([]*handlerConfig{
+		{
+			Event:   "user:deploy",
+			Command: `{ echo "$LIBDISCOVER_EVENT $LIBDISCOVER_USER_EVENT $LIBDISCOVER_USER_LTIME $LIBDISCOVER_SELF_NAME $LIBDISCOVER_TAG_ROLE"; cat; } > ` + out,
+		},
+		{
+			Event:   "user:other",
+			Command: "touch " + filepath.Join(dir, "other"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.handle(serf.UserEvent{Name: "deploy", LTime: 7, Payload: []byte("v2")})
+	h.stop()
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "user deploy 7 " + c.Name(0) + " web\nv2"
+	if string(data) != expected {
+		t.Fatalf("expected %q; got %q", expected, data)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "other")); !os.IsNotExist(err) {
+		t.Fatal("expected the handler for other events not to run")
+	}
+}
+
+func TestScriptHandlerMemberEvent(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Nodes: 1})
+
+	out := filepath.Join(tempDir(t), "out")
+
+	h := newEventHandlers(c.Node(0))
+	if err := h.update([]*handlerConfig{{Event: "member-join", Command: "cat > " + out}}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.handle(serf.MemberEvent{
+		Type: serf.EventMemberJoin,
+		Members: []serf.Member{
+			{Name: "node-a", Status: serf.StatusAlive, Tags: map[string]string{"role": "web"}},
+		},
+	})
+	h.stop()
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(data)), "\t")
+	if len(fields) != 4 || fields[0] != "node-a" || fields[2] != "alive" || fields[3] != "role=web" {
+		t.Fatalf("unexpected member line: %q", data)
+	}
+}
+
+func TestScriptHandlerQuery(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Nodes: 2})
+
+	h := newEventHandlers(c.Node(0))
+	err := h.update([]*handlerConfig{
+		{Event: "query:ping", Command: `printf "pong "; cat`},
+		// only the first matching handler responds
+		{Event: "query", Command: "echo second"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.stop()
+
+	unsubscribe := c.Node(0).Subscribe(h.handle)
+	defer unsubscribe()
+
+	resp, err := c.Node(1).Query("ping", []byte("hello"), &serf.QueryParam{
+		FilterNodes: []string{c.Name(0)},
+		Timeout:     time.Second * 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responses := []string{}
+	for r := range resp.ResponseCh() {
+		responses = append(responses, string(r.Payload))
+	}
+
+	if len(responses) != 1 || responses[0] != "pong hello" {
+		t.Fatalf("expected a single pong response; got %q", responses)
+	}
+}
+
+func TestScriptHandlerTimeout(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Nodes: 1})
+
+	h := newEventHandlers(c.Node(0))
+	err := h.update([]*handlerConfig{{
+		Command: "sleep 30",
+		Timeout: duration(time.Millisecond * 100),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	h.handle(serf.UserEvent{Name: "deploy"})
+	h.stop()
+
+	if d := time.Since(start); d > time.Second*5 {
+		t.Fatalf("expected the handler to be killed after its timeout; took %s", d)
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	var buf bytes.Buffer
+	l := &limitedBuffer{buf: &buf, max: 4}
+
+	for _, p := range []string{"ab", "cde", "fg"} {
+		if n, err := l.Write([]byte(p)); n != len(p) || err != nil {
+			t.Fatalf("expected the write to succeed; got %d, %v", n, err)
+		}
+	}
+
+	if buf.String() != "abcd" {
+		t.Fatalf("expected the output to be truncated; got %q", buf.String())
+	}
+}
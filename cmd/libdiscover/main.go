@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is a libdiscover subcommand
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"agent":       {"agent [options]", "run a libdiscover agent", runAgent},
+		"members":     {"members [options]", "list cluster members", runMembers},
+		"datacenters": {"datacenters [options]", "list the known datacenters", runDatacenters},
+		"event":       {"event [options] <name> [payload]", "send a user event", runEvent},
+		"query":       {"query [options] <name> [payload]", "send a query and print the responses", runQuery},
+		"segments":    {"segments [options]", "list the segments of the agent", runSegments},
+		"tags":        {"tags [options]", "show or modify the tags of the agent", runTags},
+		"keys":        {"keys [options]", "manage the gossip encryption keyring", runKeys},
+		"chaos":       {"chaos [options]", "show or change the injected faults of an agent with -enable-chaos", runChaos},
+		"force-leave": {"force-leave [options] <node>", "force a failed member into the left state", runForceLeave},
+		"monitor":     {"monitor [options]", "stream cluster events", runMonitor},
+		"info":        {"info [options]", "show information about the agent", runInfo},
+		"simulate":    {"simulate [options]", "estimate how a gossip tuning behaves with a model of the protocol", runSimulate},
+	}
+}
+
+// stringSlice is a repeatable string flag
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// parseKeyValues parses key=value pairs
+func parseKeyValues(values []string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid value %q; expected key=value", v)
+		}
+
+		m[parts[0]] = parts[1]
+	}
+
+	return m, nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: libdiscover %s\n\n%s\n\n", commands[name].usage, commands[name].help)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+func usage() {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "usage: libdiscover <command> [options]\n\ncommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun 'libdiscover <command> -h' for command options\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		usage()
+		return
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
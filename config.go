@@ -3,15 +3,69 @@ package libdiscover
 import (
 	"log"
 	"time"
+
+	"github.com/hashicorp/memberlist"
 )
 
 type Config struct {
-	Name          string
-	BindAddr      string
+	Name string
+	// BindAddr is the address the node listens on; port 0 picks a free
+	// port, which Addr returns once the node runs
+	BindAddr string
+	// AdvertiseAddr is the address other members reach the node at;
+	// defaults to BindAddr.  With bind port 0 the bound port is advertised.
 	AdvertiseAddr string
 	JoinAddr      string
 	Logger        *log.Logger
 	EventHandler  func(e Event) error
 	NodeTimeout   time.Duration
 	Debug         bool
+	Tags          map[string]string
+	// EncryptKey is a base64 encoded 16, 24 or 32 byte key used to encrypt
+	// gossip; keys can be rotated at runtime with InstallKey and UseKey
+	EncryptKey string
+	// Announce controls the announcements sent when the node starts and
+	// stops; defaults to AnnounceLegacy, see AnnounceMode
+	Announce AnnounceMode
+	// Version and Capabilities are included in announcements
+	Version      string
+	Capabilities []string
+	// DisableCoordinates turns off serf's network coordinates; RTT and
+	// NearestMembers then have no latency estimates
+	DisableCoordinates bool
+	// HeartbeatTimeout is how long a member that reports heartbeats can go
+	// without one before it is considered stale; defaults to 30 seconds.
+	// A warning is logged when the cluster grows so large that heartbeats
+	// take longer than this to reach every member.
+	HeartbeatTimeout time.Duration
+	// KVTombstoneTimeout is how long deleted keys are kept so the delete
+	// can reach every node; defaults to 24 hours
+	KVTombstoneTimeout time.Duration
+	// Datacenter is added to the member tags; defaults to dc1
+	Datacenter string
+	// WANBindAddr makes the node a gateway that also joins the WAN pool
+	// of every datacenter at WANJoinAddr.  WANAdvertiseAddr defaults to
+	// WANBindAddr.
+	WANBindAddr      string
+	WANAdvertiseAddr string
+	WANJoinAddr      string
+	// WANTuning overrides the WAN profile timings of the WAN pool
+	WANTuning *Tuning
+	// Profile selects the base gossip timings and Tuning overrides them
+	Profile Profile
+	Tuning  *Tuning
+	// Segments are additional isolated gossip pools the node joins; see
+	// Segment
+	Segments []SegmentConfig
+	// Chaos injects faults to rehearse failure handling; it can also be
+	// changed at runtime with SetChaos
+	Chaos *ChaosConfig
+	// Metrics selects the sink for libdiscover, serf and memberlist
+	// metrics; nil turns metrics off
+	Metrics *MetricsConfig
+	// Transport creates the memberlist transport of every gossip pool of
+	// the node, including the WAN pool and segments, for its bind address;
+	// nil uses UDP and TCP sockets.  See the memnet package for an
+	// in-memory network.
+	Transport func(bindAddr string) (memberlist.Transport, error)
 }
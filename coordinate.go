@@ -0,0 +1,137 @@
+package libdiscover
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/hashicorp/serf/serf"
+)
+
+// Coordinate returns the network coordinate of the local node
+func (d *Discover) Coordinate() (*coordinate.Coordinate, error) {
+	cluster := d.serf()
+	if cluster == nil {
+		return nil, fmt.Errorf("discover is not running")
+	}
+
+	return cluster.GetCoordinate()
+}
+
+// MemberCoordinate returns the last known network coordinate of a member
+func (d *Discover) MemberCoordinate(name string) (*coordinate.Coordinate, bool) {
+	if name == d.name {
+		c, err := d.Coordinate()
+		return c, err == nil
+	}
+
+	cluster := d.serf()
+	if cluster == nil {
+		return nil, false
+	}
+
+	return cluster.GetCachedCoordinate(name)
+}
+
+// serf returns the serf instance; nil until Run creates it
+func (d *Discover) serf() *serf.Serf {
+	d.clusterLock.RLock()
+	defer d.clusterLock.RUnlock()
+
+	return d.cluster
+}
+
+// RTT estimates the round trip time between two members from their network
+// coordinates
+func (d *Discover) RTT(a, b string) (time.Duration, error) {
+	if d.disableCoordinates {
+		return 0, fmt.Errorf("coordinates are disabled")
+	}
+
+	if a == b {
+		return 0, nil
+	}
+
+	ca, ok := d.MemberCoordinate(a)
+	if !ok {
+		return 0, fmt.Errorf("no coordinate for member %s", a)
+	}
+
+	cb, ok := d.MemberCoordinate(b)
+	if !ok {
+		return 0, fmt.Errorf("no coordinate for member %s", b)
+	}
+
+	if !ca.IsCompatibleWith(cb) {
+		return 0, fmt.Errorf("incompatible coordinates for %s and %s", a, b)
+	}
+
+	return ca.DistanceTo(cb), nil
+}
+
+// NearestMembers returns up to n alive members that pass filter sorted by
+// estimated round trip time from the local node, which is included with an
+// RTT of zero.  Members without a coordinate come last.  A nil filter
+// matches every member and n <= 0 returns all of them.  With coordinates
+// disabled the local node comes first and the others are sorted by name.
+func (d *Discover) NearestMembers(n int, filter func(m serf.Member) bool) []serf.Member {
+	type candidate struct {
+		member serf.Member
+		rtt    time.Duration
+		known  bool
+	}
+
+	var local *coordinate.Coordinate
+	if !d.disableCoordinates {
+		local, _ = d.MemberCoordinate(d.name)
+	}
+
+	candidates := []candidate{}
+	for _, m := range d.Members() {
+		if m.Status != serf.StatusAlive {
+			continue
+		}
+
+		if filter != nil && !filter(m) {
+			continue
+		}
+
+		c := candidate{member: m}
+		switch {
+		case m.Name == d.name:
+			c.known = true
+		case local != nil:
+			if other, ok := d.MemberCoordinate(m.Name); ok && local.IsCompatibleWith(other) {
+				c.rtt = local.DistanceTo(other)
+				c.known = true
+			}
+		}
+
+		candidates = append(candidates, c)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		if ci.known != cj.known {
+			return ci.known
+		}
+
+		if ci.rtt != cj.rtt {
+			return ci.rtt < cj.rtt
+		}
+
+		return ci.member.Name < cj.member.Name
+	})
+
+	if n > 0 && len(candidates) > n {
+		candidates = candidates[:n]
+	}
+
+	members := make([]serf.Member, len(candidates))
+	for i, c := range candidates {
+		members[i] = c.member
+	}
+
+	return members
+}
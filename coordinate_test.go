@@ -0,0 +1,146 @@
+package libdiscover_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+	"github.com/hashicorp/serf/serf"
+)
+
+// names returns the names of the members
+func names(members []serf.Member) []string {
+	out := make([]string, len(members))
+	for i, m := range members {
+		out[i] = m.Name
+	}
+
+	return out
+}
+
+func TestCoordinateNotRunning(t *testing.T) {
+	d, err := libdiscover.NewDiscover(&libdiscover.Config{Name: "node-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Coordinate(); err == nil {
+		t.Fatal("expected an error before the node runs")
+	}
+
+	if _, err := d.RTT("node-0", "node-1"); err == nil {
+		t.Fatal("expected an error before the node runs")
+	}
+
+	if members := d.NearestMembers(0, nil); len(members) != 0 {
+		t.Fatalf("expected no members; got %v", names(members))
+	}
+}
+
+func TestRTT(t *testing.T) {
+	c := testcluster.New(t, nil)
+	d := c.Node(0)
+
+	c.WaitFor("the coordinates of every member", func() bool {
+		for i := 0; i < c.Len(); i++ {
+			if _, ok := d.MemberCoordinate(c.Name(i)); !ok {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	if _, err := d.Coordinate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rtt, err := d.RTT(c.Name(1), c.Name(1)); err != nil || rtt != 0 {
+		t.Fatalf("expected no RTT to itself; got %s %v", rtt, err)
+	}
+
+	ab, err := d.RTT(c.Name(0), c.Name(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ba, err := d.RTT(c.Name(1), c.Name(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ab <= 0 || ab != ba {
+		t.Fatalf("expected the same positive RTT both ways; got %s and %s", ab, ba)
+	}
+
+	if _, err := d.RTT(c.Name(0), "missing"); err == nil {
+		t.Fatal("expected an error for an unknown member")
+	}
+}
+
+func TestNearestMembers(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Nodes: 4})
+	d := c.Node(0)
+
+	c.WaitFor("the coordinates of every member", func() bool {
+		for i := 1; i < c.Len(); i++ {
+			if _, ok := d.MemberCoordinate(c.Name(i)); !ok {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	all := d.NearestMembers(0, nil)
+	if len(all) != c.Len() || all[0].Name != c.Name(0) {
+		t.Fatalf("expected every member with the local node first; got %v", names(all))
+	}
+
+	// sorted by RTT from the local node
+	for i := 2; i < len(all); i++ {
+		prev, err := d.RTT(c.Name(0), all[i-1].Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next, err := d.RTT(c.Name(0), all[i].Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if next < prev {
+			t.Fatalf("expected members sorted by RTT; got %s before %s", prev, next)
+		}
+	}
+
+	if nearest := d.NearestMembers(2, nil); len(nearest) != 2 || nearest[1].Name != all[1].Name {
+		t.Fatalf("expected the two nearest members %v; got %v", names(all[:2]), names(nearest))
+	}
+
+	others := d.NearestMembers(0, func(m serf.Member) bool {
+		return m.Name != c.Name(0) && m.Name != all[1].Name
+	})
+	if len(others) != c.Len()-2 || others[0].Name != all[2].Name {
+		t.Fatalf("expected the filtered members %v; got %v", names(all[2:]), names(others))
+	}
+}
+
+func TestCoordinatesDisabled(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{
+		Configure: func(i int, cfg *libdiscover.Config) {
+			cfg.DisableCoordinates = true
+		},
+	})
+	d := c.Node(2)
+
+	if _, err := d.RTT(c.Name(0), c.Name(1)); err == nil {
+		t.Fatal("expected an error with coordinates disabled")
+	}
+
+	want := []string{c.Name(2), c.Name(0), c.Name(1)}
+	if got := names(d.NearestMembers(0, nil)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the local node first and the others by name %v; got %v", want, got)
+	}
+}
@@ -0,0 +1,281 @@
+package libdiscover
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const crdtStateName = "crdt"
+
+// CRDT is a conflict-free replicated data type.  Once registered with a
+// Discover by name, local changes are gossiped as deltas and the full state
+// is merged during join and push/pull.  Merging is commutative, associative
+// and idempotent so replicas converge without coordination.
+type CRDT interface {
+	// Type returns the name of the data type
+	Type() string
+	// State returns the encoded state of the replica
+	State() ([]byte, error)
+	// Merge merges the encoded state or delta of another replica and
+	// reports whether the local state changed
+	Merge(state []byte) (bool, error)
+	// Watch calls fn after every local or remote change.  The returned
+	// func stops the watch.
+	Watch(fn func()) func()
+
+	setPublisher(fn func(delta []byte))
+	setDefaultNode(node string)
+}
+
+type crdtMessage struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	State []byte `json:"state"`
+}
+
+// crdtBase holds what is common to every CRDT replica
+type crdtBase struct {
+	mu         sync.RWMutex
+	node       string
+	generation int64
+	clock      *hlc
+	publish    func(delta []byte)
+	watchers   map[int]func()
+	watchID    int
+}
+
+var (
+	generationLock sync.Mutex
+	lastGeneration int64
+)
+
+// nextGeneration returns a generation that is larger than any returned
+// before in the process and, as it is based on the time, by a node before
+// it restarted
+func nextGeneration() int64 {
+	generationLock.Lock()
+	defer generationLock.Unlock()
+
+	g := time.Now().UnixNano()
+	if g <= lastGeneration {
+		g = lastGeneration + 1
+	}
+	lastGeneration = g
+
+	return g
+}
+
+func newCRDTBase(node string) crdtBase {
+	return crdtBase{
+		node:       node,
+		generation: nextGeneration(),
+		clock:      newHLC(node),
+		watchers:   map[int]func(){},
+	}
+}
+
+// replica returns the ID the replica counts its own changes under.  A new
+// replica of the same node, such as after a restart, gets a new ID so that
+// its changes are not hidden by the ones its peers still hold.
+func (b *crdtBase) replica() string {
+	return fmt.Sprintf("%s/%d", b.node, b.generation)
+}
+
+// setDefaultNode names the replica after the node when it was created
+// without a name
+func (b *crdtBase) setDefaultNode(node string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.node != "" {
+		return
+	}
+
+	b.node = node
+	b.clock = newHLC(node)
+}
+
+func (b *crdtBase) setPublisher(fn func(delta []byte)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.publish = fn
+}
+
+func (b *crdtBase) Watch(fn func()) func() {
+	b.mu.Lock()
+	id := b.watchID
+	b.watchID++
+	b.watchers[id] = fn
+	b.mu.Unlock()
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.watchers, id)
+	}
+}
+
+// changed notifies watchers; it must be called with the lock held
+func (b *crdtBase) changed() {
+	for _, fn := range b.watchers {
+		go fn()
+	}
+}
+
+// emit notifies watchers and gossips the delta; it must be called with the
+// lock held
+func (b *crdtBase) emit(delta interface{}) error {
+	b.changed()
+
+	if b.publish == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+
+	b.publish(data)
+
+	return nil
+}
+
+// RegisterCRDT replicates c across the cluster under name.  A replica
+// created without a node name is named after the Discover.
+func (d *Discover) RegisterCRDT(name string, c CRDT) error {
+	d.crdtLock.Lock()
+	defer d.crdtLock.Unlock()
+
+	if _, ok := d.crdts[name]; ok {
+		return fmt.Errorf("crdt already registered: %s", name)
+	}
+
+	c.setDefaultNode(d.name)
+	c.setPublisher(func(delta []byte) {
+		d.publishCRDT(name, c.Type(), delta)
+	})
+
+	d.crdts[name] = c
+
+	return nil
+}
+
+// UnregisterCRDT stops replicating the named CRDT
+func (d *Discover) UnregisterCRDT(name string) {
+	d.crdtLock.Lock()
+	defer d.crdtLock.Unlock()
+
+	if c, ok := d.crdts[name]; ok {
+		c.setPublisher(nil)
+		delete(d.crdts, name)
+	}
+}
+
+// CRDT returns the CRDT registered under name
+func (d *Discover) CRDT(name string) (CRDT, bool) {
+	d.crdtLock.RLock()
+	defer d.crdtLock.RUnlock()
+
+	c, ok := d.crdts[name]
+	return c, ok
+}
+
+func (d *Discover) publishCRDT(name, typ string, state []byte) {
+	data, err := json.Marshal(crdtMessage{
+		Name:  name,
+		Type:  typ,
+		State: state,
+	})
+	if err != nil {
+		logrus.Errorf("error encoding crdt delta: %s", err)
+		return
+	}
+
+	d.broadcast(messageCRDTType, data)
+}
+
+func (d *Discover) mergeCRDT(m *crdtMessage) bool {
+	c, ok := d.CRDT(m.Name)
+	if !ok {
+		return false
+	}
+
+	if c.Type() != m.Type {
+		logrus.Warnf("crdt type mismatch: name=%s local=%s remote=%s", m.Name, c.Type(), m.Type)
+		return false
+	}
+
+	changed, err := c.Merge(m.State)
+	if err != nil {
+		logrus.Errorf("error merging crdt: name=%s err=%s", m.Name, err)
+		return false
+	}
+
+	return changed
+}
+
+func (d *Discover) handleCRDTDelta(msg []byte) {
+	var m crdtMessage
+	if err := json.Unmarshal(msg, &m); err != nil {
+		d.decodeError("crdt")
+		logrus.Errorf("error decoding crdt delta: %s", err)
+		return
+	}
+
+	if d.mergeCRDT(&m) {
+		// pass new changes along
+		d.rebroadcast(messageCRDTType, msg)
+	}
+}
+
+// crdtState exchanges the state of every registered CRDT during push/pull
+type crdtState struct {
+	d *Discover
+}
+
+func (s *crdtState) LocalState(join bool) []byte {
+	s.d.crdtLock.RLock()
+	msgs := make([]crdtMessage, 0, len(s.d.crdts))
+	for name, c := range s.d.crdts {
+		state, err := c.State()
+		if err != nil {
+			logrus.Errorf("error encoding crdt: name=%s err=%s", name, err)
+			continue
+		}
+
+		msgs = append(msgs, crdtMessage{
+			Name:  name,
+			Type:  c.Type(),
+			State: state,
+		})
+	}
+	s.d.crdtLock.RUnlock()
+
+	data, err := json.Marshal(msgs)
+	if err != nil {
+		logrus.Errorf("error encoding crdt state: %s", err)
+		return nil
+	}
+
+	return data
+}
+
+func (s *crdtState) MergeRemoteState(buf []byte, join bool) {
+	var msgs []crdtMessage
+	if err := json.Unmarshal(buf, &msgs); err != nil {
+		s.d.decodeError("crdt_state")
+		logrus.Errorf("error decoding crdt state: %s", err)
+		return
+	}
+
+	for i := range msgs {
+		s.d.mergeCRDT(&msgs[i])
+	}
+}
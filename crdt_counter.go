@@ -0,0 +1,171 @@
+package libdiscover
+
+import "encoding/json"
+
+// GCounter is a grow-only counter
+type GCounter struct {
+	crdtBase
+	counts map[string]uint64
+}
+
+// NewGCounter returns a grow-only counter replica for node; node defaults
+// to the name of the Discover it is registered with.  Every replica counts
+// under its own generation of the node, so the counts of a node that
+// restarts add to the ones it made before.
+func NewGCounter(node string) *GCounter {
+	return &GCounter{
+		crdtBase: newCRDTBase(node),
+		counts:   map[string]uint64{},
+	}
+}
+
+func (c *GCounter) Type() string {
+	return "g-counter"
+}
+
+// Inc increments the counter by n
+func (c *GCounter) Inc(n uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.replica()
+	c.counts[id] += n
+
+	return c.emit(map[string]uint64{id: c.counts[id]})
+}
+
+// Value returns the current count
+func (c *GCounter) Value() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return sumCounts(c.counts)
+}
+
+func (c *GCounter) State() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return json.Marshal(c.counts)
+}
+
+func (c *GCounter) Merge(state []byte) (bool, error) {
+	var counts map[string]uint64
+	if err := json.Unmarshal(state, &counts); err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := mergeCounts(c.counts, counts)
+	if changed {
+		c.changed()
+	}
+
+	return changed, nil
+}
+
+// PNCounter is a counter that can be incremented and decremented
+type PNCounter struct {
+	crdtBase
+	state pnState
+}
+
+type pnState struct {
+	P map[string]uint64 `json:"p"`
+	N map[string]uint64 `json:"n"`
+}
+
+// NewPNCounter returns a counter replica for node; like GCounter, every
+// replica counts under its own generation of the node
+func NewPNCounter(node string) *PNCounter {
+	return &PNCounter{
+		crdtBase: newCRDTBase(node),
+		state: pnState{
+			P: map[string]uint64{},
+			N: map[string]uint64{},
+		},
+	}
+}
+
+func (c *PNCounter) Type() string {
+	return "pn-counter"
+}
+
+// Inc increments the counter by n
+func (c *PNCounter) Inc(n uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.replica()
+	c.state.P[id] += n
+
+	return c.emit(pnState{P: map[string]uint64{id: c.state.P[id]}})
+}
+
+// Dec decrements the counter by n
+func (c *PNCounter) Dec(n uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.replica()
+	c.state.N[id] += n
+
+	return c.emit(pnState{N: map[string]uint64{id: c.state.N[id]}})
+}
+
+// Value returns the current count
+func (c *PNCounter) Value() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return int64(sumCounts(c.state.P)) - int64(sumCounts(c.state.N))
+}
+
+func (c *PNCounter) State() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return json.Marshal(c.state)
+}
+
+func (c *PNCounter) Merge(state []byte) (bool, error) {
+	var s pnState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := mergeCounts(c.state.P, s.P)
+	n := mergeCounts(c.state.N, s.N)
+	if p || n {
+		c.changed()
+	}
+
+	return p || n, nil
+}
+
+func sumCounts(counts map[string]uint64) uint64 {
+	var total uint64
+	for _, v := range counts {
+		total += v
+	}
+
+	return total
+}
+
+// mergeCounts keeps the largest count seen for each replica
+func mergeCounts(dst, src map[string]uint64) bool {
+	changed := false
+	for id, v := range src {
+		if v > dst[id] {
+			dst[id] = v
+			changed = true
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,181 @@
+package libdiscover
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+type lwwEntry struct {
+	Value     []byte    `json:"value,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Timestamp Timestamp `json:"timestamp"`
+}
+
+// LWWRegister holds a single value; the last write wins
+type LWWRegister struct {
+	crdtBase
+	state lwwEntry
+}
+
+// NewLWWRegister returns a last-writer-wins register replica for node
+func NewLWWRegister(node string) *LWWRegister {
+	return &LWWRegister{
+		crdtBase: newCRDTBase(node),
+	}
+}
+
+func (r *LWWRegister) Type() string {
+	return "lww-register"
+}
+
+// Set sets the value of the register
+func (r *LWWRegister) Set(v []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state = lwwEntry{
+		Value:     v,
+		Timestamp: r.clock.Now(),
+	}
+
+	return r.emit(r.state)
+}
+
+// Get returns the value of the register
+func (r *LWWRegister) Get() []byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.state.Value
+}
+
+func (r *LWWRegister) State() ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return json.Marshal(r.state)
+}
+
+func (r *LWWRegister) Merge(state []byte) (bool, error) {
+	var e lwwEntry
+	if err := json.Unmarshal(state, &e); err != nil {
+		return false, err
+	}
+
+	r.clock.Update(e.Timestamp)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.state.Timestamp.Before(e.Timestamp) {
+		return false, nil
+	}
+
+	r.state = e
+	r.changed()
+
+	return true, nil
+}
+
+// LWWMap is a map whose keys are independent last-writer-wins registers
+type LWWMap struct {
+	crdtBase
+	entries map[string]lwwEntry
+}
+
+// NewLWWMap returns a last-writer-wins map replica for node
+func NewLWWMap(node string) *LWWMap {
+	return &LWWMap{
+		crdtBase: newCRDTBase(node),
+		entries:  map[string]lwwEntry{},
+	}
+}
+
+func (m *LWWMap) Type() string {
+	return "lww-map"
+}
+
+// Set sets the value for the key
+func (m *LWWMap) Set(key string, v []byte) error {
+	return m.update(key, lwwEntry{Value: v})
+}
+
+// Delete removes the key
+func (m *LWWMap) Delete(key string) error {
+	return m.update(key, lwwEntry{Deleted: true})
+}
+
+func (m *LWWMap) update(key string, e lwwEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e.Timestamp = m.clock.Now()
+	m.entries[key] = e
+
+	return m.emit(map[string]lwwEntry{key: e})
+}
+
+// Get returns the value for the key
+func (m *LWWMap) Get(key string) ([]byte, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, ok := m.entries[key]
+	if !ok || e.Deleted {
+		return nil, false
+	}
+
+	return e.Value, true
+}
+
+// Keys returns the sorted keys of the map
+func (m *LWWMap) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := []string{}
+	for k, e := range m.entries {
+		if !e.Deleted {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (m *LWWMap) State() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return json.Marshal(m.entries)
+}
+
+func (m *LWWMap) Merge(state []byte) (bool, error) {
+	var entries map[string]lwwEntry
+	if err := json.Unmarshal(state, &entries); err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := false
+	for k, e := range entries {
+		m.clock.Update(e.Timestamp)
+
+		if cur, ok := m.entries[k]; ok && !cur.Timestamp.Before(e.Timestamp) {
+			continue
+		}
+
+		m.entries[k] = e
+		changed = true
+	}
+
+	if changed {
+		m.changed()
+	}
+
+	return changed, nil
+}
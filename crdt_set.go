@@ -0,0 +1,154 @@
+package libdiscover
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ORSet is an observed-remove set of strings.  An element is present if it
+// has an add that has not been observed by a remove, so concurrent adds win
+// over removes.
+type ORSet struct {
+	crdtBase
+	state orSetState
+}
+
+type orSetState struct {
+	// Adds maps each element to the unique tags of its adds
+	Adds map[string]map[string]bool `json:"adds"`
+	// Removes holds the tags of every removed add
+	Removes map[string]bool `json:"removes"`
+}
+
+// NewORSet returns an observed-remove set replica for node
+func NewORSet(node string) *ORSet {
+	return &ORSet{
+		crdtBase: newCRDTBase(node),
+		state: orSetState{
+			Adds:    map[string]map[string]bool{},
+			Removes: map[string]bool{},
+		},
+	}
+}
+
+func (s *ORSet) Type() string {
+	return "or-set"
+}
+
+// Add adds the element to the set
+func (s *ORSet) Add(e string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := s.clock.Now()
+	tag := fmt.Sprintf("%s/%d/%d", ts.Node, ts.Wall, ts.Logical)
+
+	if s.state.Adds[e] == nil {
+		s.state.Adds[e] = map[string]bool{}
+	}
+	s.state.Adds[e][tag] = true
+
+	return s.emit(orSetState{
+		Adds: map[string]map[string]bool{e: {tag: true}},
+	})
+}
+
+// Remove removes every add of the element observed by this replica
+func (s *ORSet) Remove(e string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := map[string]bool{}
+	for tag := range s.state.Adds[e] {
+		if !s.state.Removes[tag] {
+			s.state.Removes[tag] = true
+			removed[tag] = true
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil
+	}
+
+	return s.emit(orSetState{Removes: removed})
+}
+
+// Contains reports whether the element is in the set
+func (s *ORSet) Contains(e string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.contains(e)
+}
+
+func (s *ORSet) contains(e string) bool {
+	for tag := range s.state.Adds[e] {
+		if !s.state.Removes[tag] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Elements returns the sorted elements of the set
+func (s *ORSet) Elements() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	elements := []string{}
+	for e := range s.state.Adds {
+		if s.contains(e) {
+			elements = append(elements, e)
+		}
+	}
+
+	sort.Strings(elements)
+
+	return elements
+}
+
+func (s *ORSet) State() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return json.Marshal(s.state)
+}
+
+func (s *ORSet) Merge(state []byte) (bool, error) {
+	var o orSetState
+	if err := json.Unmarshal(state, &o); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for e, tags := range o.Adds {
+		if s.state.Adds[e] == nil {
+			s.state.Adds[e] = map[string]bool{}
+		}
+
+		for tag := range tags {
+			if !s.state.Adds[e][tag] {
+				s.state.Adds[e][tag] = true
+				changed = true
+			}
+		}
+	}
+
+	for tag := range o.Removes {
+		if !s.state.Removes[tag] {
+			s.state.Removes[tag] = true
+			changed = true
+		}
+	}
+
+	if changed {
+		s.changed()
+	}
+
+	return changed, nil
+}
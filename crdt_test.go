@@ -0,0 +1,305 @@
+package libdiscover
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+var crdtNodes = []string{"node-a", "node-b", "node-c"}
+
+// crdtKind builds replicas of one CRDT type and applies generated operations
+// to them
+type crdtKind struct {
+	name  string
+	new   func(node string) CRDT
+	apply func(c CRDT, op, arg int) error
+}
+
+var crdtKinds = []crdtKind{
+	{
+		name: "g-counter",
+		new:  func(node string) CRDT { return NewGCounter(node) },
+		apply: func(c CRDT, op, arg int) error {
+			return c.(*GCounter).Inc(uint64(arg + 1))
+		},
+	},
+	{
+		name: "pn-counter",
+		new:  func(node string) CRDT { return NewPNCounter(node) },
+		apply: func(c CRDT, op, arg int) error {
+			if op == 0 {
+				return c.(*PNCounter).Inc(uint64(arg + 1))
+			}
+			return c.(*PNCounter).Dec(uint64(arg + 1))
+		},
+	},
+	{
+		name: "or-set",
+		new:  func(node string) CRDT { return NewORSet(node) },
+		apply: func(c CRDT, op, arg int) error {
+			e := fmt.Sprintf("e%d", arg)
+			if op == 0 {
+				return c.(*ORSet).Add(e)
+			}
+			return c.(*ORSet).Remove(e)
+		},
+	},
+	{
+		name: "lww-register",
+		new:  func(node string) CRDT { return NewLWWRegister(node) },
+		apply: func(c CRDT, op, arg int) error {
+			return c.(*LWWRegister).Set([]byte(fmt.Sprintf("v%d", arg)))
+		},
+	},
+	{
+		name: "lww-map",
+		new:  func(node string) CRDT { return NewLWWMap(node) },
+		apply: func(c CRDT, op, arg int) error {
+			k := fmt.Sprintf("k%d", arg)
+			if op == 0 {
+				return c.(*LWWMap).Set(k, []byte(k))
+			}
+			return c.(*LWWMap).Delete(k)
+		},
+	},
+}
+
+// replay builds one replica per node from a generated history.  Each step
+// picks a replica and either applies an operation or merges the state of
+// another replica, so histories mix concurrent and causally ordered updates.
+func (k crdtKind) replay(t *testing.T, history []uint16) []CRDT {
+	replicas := make([]CRDT, len(crdtNodes))
+	for i, node := range crdtNodes {
+		replicas[i] = k.new(node)
+	}
+
+	for _, h := range history {
+		v := int(h)
+		r := replicas[v%len(replicas)]
+		action, arg := (v/3)%3, (v/9)%4
+
+		if action == 2 {
+			mergeState(t, r, replicas[arg%len(replicas)])
+			continue
+		}
+
+		if err := k.apply(r, action, arg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return replicas
+}
+
+// clone returns a replica holding the state of c
+func (k crdtKind) clone(t *testing.T, c CRDT, node string) CRDT {
+	n := k.new(node)
+	mergeState(t, n, c)
+
+	return n
+}
+
+func mergeState(t *testing.T, dst, src CRDT) bool {
+	state, err := src.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := dst.Merge(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return changed
+}
+
+func sameState(t *testing.T, a, b CRDT) bool {
+	sa, err := a.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := b.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.Equal(sa, sb)
+}
+
+func TestCRDTMergeCommutative(t *testing.T) {
+	for _, k := range crdtKinds {
+		t.Run(k.name, func(t *testing.T) {
+			f := func(history []uint16) bool {
+				r := k.replay(t, history)
+
+				ab := k.clone(t, r[0], "x")
+				mergeState(t, ab, r[1])
+
+				ba := k.clone(t, r[1], "x")
+				mergeState(t, ba, r[0])
+
+				return sameState(t, ab, ba)
+			}
+
+			if err := quick.Check(f, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCRDTMergeAssociative(t *testing.T) {
+	for _, k := range crdtKinds {
+		t.Run(k.name, func(t *testing.T) {
+			f := func(history []uint16) bool {
+				r := k.replay(t, history)
+
+				left := k.clone(t, r[0], "x")
+				mergeState(t, left, r[1])
+				mergeState(t, left, r[2])
+
+				bc := k.clone(t, r[1], "y")
+				mergeState(t, bc, r[2])
+				right := k.clone(t, r[0], "x")
+				mergeState(t, right, bc)
+
+				return sameState(t, left, right)
+			}
+
+			if err := quick.Check(f, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCRDTMergeIdempotent(t *testing.T) {
+	for _, k := range crdtKinds {
+		t.Run(k.name, func(t *testing.T) {
+			f := func(history []uint16) bool {
+				r := k.replay(t, history)
+
+				if mergeState(t, r[0], r[0]) {
+					return false
+				}
+
+				mergeState(t, r[0], r[1])
+				c := k.clone(t, r[0], "x")
+				if mergeState(t, r[0], r[1]) {
+					return false
+				}
+
+				return sameState(t, r[0], c)
+			}
+
+			if err := quick.Check(f, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCRDTConverge(t *testing.T) {
+	for _, k := range crdtKinds {
+		t.Run(k.name, func(t *testing.T) {
+			f := func(history []uint16) bool {
+				r := k.replay(t, history)
+
+				// two rounds of pairwise merges deliver every update to
+				// every replica
+				for round := 0; round < 2; round++ {
+					for _, dst := range r {
+						for _, src := range r {
+							mergeState(t, dst, src)
+						}
+					}
+				}
+
+				return sameState(t, r[0], r[1]) && sameState(t, r[1], r[2])
+			}
+
+			if err := quick.Check(f, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestORSetAddWins(t *testing.T) {
+	a, b := NewORSet("node-a"), NewORSet("node-b")
+
+	if err := a.Add("x"); err != nil {
+		t.Fatal(err)
+	}
+	mergeState(t, b, a)
+
+	// b removes the add it observed while a adds x again concurrently
+	if err := b.Remove("x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add("x"); err != nil {
+		t.Fatal(err)
+	}
+
+	mergeState(t, a, b)
+	mergeState(t, b, a)
+
+	if !a.Contains("x") || !b.Contains("x") {
+		t.Fatalf("expected the concurrent add to win: a=%v b=%v", a.Elements(), b.Elements())
+	}
+}
+
+func TestCounterRestart(t *testing.T) {
+	a, b := NewPNCounter("node-a"), NewPNCounter("node-b")
+	if err := a.Inc(5); err != nil {
+		t.Fatal(err)
+	}
+	mergeState(t, b, a)
+
+	// a restarted replica starts from zero but its counts add to the ones
+	// its peers hold
+	restarted := NewPNCounter("node-a")
+	if err := restarted.Inc(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Dec(1); err != nil {
+		t.Fatal(err)
+	}
+	mergeState(t, b, restarted)
+	mergeState(t, restarted, b)
+
+	if v := b.Value(); v != 6 {
+		t.Fatalf("expected 6; got %d", v)
+	}
+
+	if v := restarted.Value(); v != 6 {
+		t.Fatalf("expected the restarted replica to catch up to 6; got %d", v)
+	}
+}
+
+func TestCRDTDefaultNode(t *testing.T) {
+	d := &Discover{name: "node-a", crdts: map[string]CRDT{}}
+
+	c := NewGCounter("")
+	if err := d.RegisterCRDT("visits", c); err != nil {
+		t.Fatal(err)
+	}
+
+	if id := c.replica(); !strings.HasPrefix(id, "node-a/") {
+		t.Fatalf("expected the replica to be named after the node; got %s", id)
+	}
+
+	// a named replica keeps its name
+	named := NewGCounter("other")
+	if err := d.RegisterCRDT("named", named); err != nil {
+		t.Fatal(err)
+	}
+
+	if id := named.replica(); !strings.HasPrefix(id, "other/") {
+		t.Fatalf("expected the replica to keep its name; got %s", id)
+	}
+}
@@ -0,0 +1,430 @@
+// Package dns serves DNS records for the members and services of a
+// libdiscover cluster so that components that cannot use the Go API can
+// resolve them.
+//
+// The following names are answered under the configured domain:
+//
+//	<node>.node.<domain>            A/AAAA and TXT (member tags)
+//	<service>.service.<domain>      A/AAAA, SRV and TXT (service meta)
+//	<version>.<service>.service.<domain>
+//	<value>.<key>.tag.<domain>      A/AAAA of members with the tag
+//
+// Names outside the domain are forwarded to the configured recursors.
+package dns
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/hashicorp/serf/serf"
+	mdns "github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAddr    = "127.0.0.1:8600"
+	defaultDomain  = "discover."
+	defaultTTL     = time.Second * 10
+	defaultTimeout = time.Second * 2
+)
+
+// Config configures the DNS server
+type Config struct {
+	// Addr is the UDP and TCP listen address; defaults to 127.0.0.1:8600.
+	// With port 0 both listen on the same free port.
+	Addr string
+	// Domain is the zone answered from the cluster; defaults to discover.
+	Domain string
+	// NodeTTL is the TTL of node and tag records; defaults to 10 seconds
+	NodeTTL time.Duration
+	// ServiceTTL is the TTL of service records; defaults to 10 seconds
+	ServiceTTL time.Duration
+	// Recursors answer names outside Domain; without them such names are
+	// refused
+	Recursors []string
+	// RecursorTimeout bounds each forwarded query; defaults to 2 seconds
+	RecursorTimeout time.Duration
+}
+
+// Server is a DNS server backed by a Discover instance
+type Server struct {
+	d      *libdiscover.Discover
+	cfg    Config
+	client *mdns.Client
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	servers []*mdns.Server
+}
+
+// New returns a DNS server for d
+func New(d *libdiscover.Discover, cfg *Config) (*Server, error) {
+	c := *cfg
+
+	if c.Addr == "" {
+		c.Addr = defaultAddr
+	}
+
+	if c.Domain == "" {
+		c.Domain = defaultDomain
+	}
+	c.Domain = mdns.Fqdn(strings.ToLower(c.Domain))
+
+	if _, ok := mdns.IsDomainName(c.Domain); !ok {
+		return nil, fmt.Errorf("invalid domain: %s", c.Domain)
+	}
+
+	if c.NodeTTL == 0 {
+		c.NodeTTL = defaultTTL
+	}
+
+	if c.ServiceTTL == 0 {
+		c.ServiceTTL = defaultTTL
+	}
+
+	if c.RecursorTimeout == 0 {
+		c.RecursorTimeout = defaultTimeout
+	}
+
+	// the recursors are shared with the caller's config
+	recursors := make([]string, len(c.Recursors))
+	for i, r := range c.Recursors {
+		if _, _, err := net.SplitHostPort(r); err != nil {
+			r = net.JoinHostPort(r, "53")
+		}
+		recursors[i] = r
+	}
+	c.Recursors = recursors
+
+	return &Server{
+		d:   d,
+		cfg: c,
+		client: &mdns.Client{
+			Timeout: c.RecursorTimeout,
+		},
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// ListenAndServe answers queries over UDP and TCP until Shutdown.  Both
+// listeners are stopped when either fails.
+func (s *Server) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	// listen on the same port over TCP when the address asks for any port
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	mux := mdns.NewServeMux()
+	mux.HandleFunc(s.cfg.Domain, s.handleCluster)
+	mux.HandleFunc(".", s.handleRecurse)
+
+	servers := []*mdns.Server{
+		{PacketConn: pc, Handler: mux},
+		{Listener: l, Handler: mux},
+	}
+
+	s.mu.Lock()
+	s.servers = servers
+	s.mu.Unlock()
+
+	// a server can only be shut down once it has started
+	var started sync.WaitGroup
+	started.Add(len(servers))
+
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		var once sync.Once
+		srv.NotifyStartedFunc = func() {
+			once.Do(started.Done)
+		}
+
+		go func(srv *mdns.Server) {
+			err := srv.ActivateAndServe()
+			once.Do(started.Done)
+			errCh <- err
+		}(srv)
+	}
+
+	err = <-errCh
+
+	started.Wait()
+	s.Shutdown()
+
+	return err
+}
+
+// Shutdown stops the server
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	servers := s.servers
+	s.mu.Unlock()
+
+	var err error
+	for _, srv := range servers {
+		if e := srv.Shutdown(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+func (s *Server) handleCluster(w mdns.ResponseWriter, req *mdns.Msg) {
+	m := new(mdns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+
+	found := false
+	for _, q := range req.Question {
+		records, ok := s.answer(q)
+		m.Answer = append(m.Answer, records...)
+		found = found || ok
+	}
+
+	// names that exist without records of the asked type get an empty
+	// answer instead of a name error
+	if !found {
+		m.Rcode = mdns.RcodeNameError
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		logrus.Errorf("dns: error writing response: %s", err)
+	}
+}
+
+func (s *Server) handleRecurse(w mdns.ResponseWriter, req *mdns.Msg) {
+	for _, r := range s.cfg.Recursors {
+		resp, _, err := s.client.Exchange(req, r)
+		if err != nil {
+			logrus.Debugf("dns: recursor failed: addr=%s err=%s", r, err)
+			continue
+		}
+
+		if err := w.WriteMsg(resp); err != nil {
+			logrus.Errorf("dns: error writing response: %s", err)
+		}
+		return
+	}
+
+	m := new(mdns.Msg)
+	if len(s.cfg.Recursors) == 0 {
+		m.SetRcode(req, mdns.RcodeRefused)
+	} else {
+		m.SetRcode(req, mdns.RcodeServerFailure)
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		logrus.Errorf("dns: error writing response: %s", err)
+	}
+}
+
+// answer returns the records for a question in the cluster domain and
+// reports whether the name exists
+func (s *Server) answer(q mdns.Question) ([]mdns.RR, bool) {
+	name := strings.ToLower(q.Name)
+	labels := mdns.SplitDomainName(strings.TrimSuffix(name, s.cfg.Domain))
+
+	if len(labels) < 2 {
+		return nil, false
+	}
+
+	n := len(labels)
+	switch labels[n-1] {
+	case "node":
+		if n != 2 {
+			return nil, false
+		}
+
+		return s.nodeRecords(q, labels[0])
+	case "service":
+		query := &libdiscover.ServiceQuery{
+			Name: labels[n-2],
+		}
+
+		// versions may contain dots and span several labels
+		if n > 2 {
+			query.Version = strings.Join(labels[:n-2], ".")
+		}
+
+		return s.serviceRecords(q, query)
+	case "tag":
+		if n != 3 {
+			return nil, false
+		}
+
+		return s.tagRecords(q, labels[1], labels[0])
+	}
+
+	return nil, false
+}
+
+func (s *Server) aliveMembers() []serf.Member {
+	members := []serf.Member{}
+	for _, m := range s.d.Members() {
+		if m.Status == serf.StatusAlive {
+			members = append(members, m)
+		}
+	}
+
+	return members
+}
+
+func (s *Server) nodeRecords(q mdns.Question, node string) ([]mdns.RR, bool) {
+	ttl := uint32(s.cfg.NodeTTL / time.Second)
+
+	for _, m := range s.aliveMembers() {
+		if strings.ToLower(m.Name) != node {
+			continue
+		}
+
+		switch q.Qtype {
+		case mdns.TypeTXT:
+			keys := make([]string, 0, len(m.Tags))
+			for k := range m.Tags {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			txt := make([]string, 0, len(keys))
+			for _, k := range keys {
+				txt = append(txt, k+"="+m.Tags[k])
+			}
+
+			return []mdns.RR{&mdns.TXT{
+				Hdr: header(q.Name, mdns.TypeTXT, ttl),
+				Txt: txt,
+			}}, true
+		default:
+			return addrRecords(q, m.Addr, ttl), true
+		}
+	}
+
+	return nil, false
+}
+
+func (s *Server) tagRecords(q mdns.Question, key, value string) ([]mdns.RR, bool) {
+	ttl := uint32(s.cfg.NodeTTL / time.Second)
+
+	found := false
+	records := []mdns.RR{}
+	for _, m := range s.aliveMembers() {
+		for k, v := range m.Tags {
+			if strings.ToLower(k) == key && strings.ToLower(v) == value {
+				found = true
+				records = append(records, addrRecords(q, m.Addr, ttl)...)
+				break
+			}
+		}
+	}
+
+	return s.shuffle(records), found
+}
+
+func (s *Server) serviceRecords(q mdns.Question, query *libdiscover.ServiceQuery) ([]mdns.RR, bool) {
+	ttl := uint32(s.cfg.ServiceTTL / time.Second)
+	health := s.d.Health()
+
+	found := false
+	records := []mdns.RR{}
+	for _, svc := range s.d.Catalog().Lookup(nil) {
+		if strings.ToLower(svc.Name) != query.Name {
+			continue
+		}
+
+		if query.Version != "" && strings.ToLower(svc.Version) != query.Version {
+			continue
+		}
+
+		if health.ServiceStatus(svc.Node, svc.ID) == libdiscover.HealthCritical {
+			continue
+		}
+
+		found = true
+
+		switch q.Qtype {
+		case mdns.TypeSRV:
+			records = append(records, &mdns.SRV{
+				Hdr:      header(q.Name, mdns.TypeSRV, ttl),
+				Priority: 1,
+				Weight:   1,
+				Port:     uint16(svc.Port),
+				Target:   mdns.Fqdn(strings.ToLower(svc.Node) + ".node." + s.cfg.Domain),
+			})
+		case mdns.TypeTXT:
+			txt := []string{}
+			for k, v := range svc.Meta {
+				txt = append(txt, k+"="+v)
+			}
+			sort.Strings(txt)
+
+			records = append(records, &mdns.TXT{
+				Hdr: header(q.Name, mdns.TypeTXT, ttl),
+				Txt: txt,
+			})
+		default:
+			records = append(records, addrRecords(q, net.ParseIP(svc.Address), ttl)...)
+		}
+	}
+
+	return s.shuffle(records), found
+}
+
+// shuffle randomizes the order of the records to spread load
+func (s *Server) shuffle(records []mdns.RR) []mdns.RR {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rand.Shuffle(len(records), func(i, j int) {
+		records[i], records[j] = records[j], records[i]
+	})
+
+	return records
+}
+
+func addrRecords(q mdns.Question, ip net.IP, ttl uint32) []mdns.RR {
+	if ip == nil {
+		return nil
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if q.Qtype != mdns.TypeA && q.Qtype != mdns.TypeANY {
+			return nil
+		}
+
+		return []mdns.RR{&mdns.A{
+			Hdr: header(q.Name, mdns.TypeA, ttl),
+			A:   ip4,
+		}}
+	}
+
+	if q.Qtype != mdns.TypeAAAA && q.Qtype != mdns.TypeANY {
+		return nil
+	}
+
+	return []mdns.RR{&mdns.AAAA{
+		Hdr:  header(q.Name, mdns.TypeAAAA, ttl),
+		AAAA: ip,
+	}}
+}
+
+func header(name string, t uint16, ttl uint32) mdns.RR_Header {
+	return mdns.RR_Header{
+		Name:   name,
+		Rrtype: t,
+		Class:  mdns.ClassINET,
+		Ttl:    ttl,
+	}
+}
@@ -0,0 +1,304 @@
+package dns
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+	mdns "github.com/miekg/dns"
+)
+
+func TestNewRecursors(t *testing.T) {
+	cfg := &Config{
+		Recursors: []string{"10.0.0.1", "10.0.0.2:5353"},
+	}
+
+	s, err := New(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"10.0.0.1:53", "10.0.0.2:5353"}; !reflect.DeepEqual(s.cfg.Recursors, want) {
+		t.Fatalf("expected recursors %v; got %v", want, s.cfg.Recursors)
+	}
+
+	if want := []string{"10.0.0.1", "10.0.0.2:5353"}; !reflect.DeepEqual(cfg.Recursors, want) {
+		t.Fatalf("expected the config to be left as is; got %v", cfg.Recursors)
+	}
+}
+
+// serve starts the server and returns its address once it listens
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ListenAndServe()
+	}()
+	t.Cleanup(func() {
+		s.Shutdown()
+		<-errCh
+	})
+
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		servers := s.servers
+		s.mu.Unlock()
+
+		if len(servers) > 0 {
+			return servers[0].PacketConn.LocalAddr().String()
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatal("timeout waiting for the server to listen")
+	return ""
+}
+
+// recursor answers every A question with 192.0.2.1
+func recursor(t *testing.T) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	srv := &mdns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: mdns.HandlerFunc(func(w mdns.ResponseWriter, req *mdns.Msg) {
+			m := new(mdns.Msg)
+			m.SetReply(req)
+			m.Answer = []mdns.RR{&mdns.A{
+				Hdr: header(req.Question[0].Name, mdns.TypeA, 60),
+				A:   net.ParseIP("192.0.2.1"),
+			}}
+			w.WriteMsg(m)
+		}),
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return pc.LocalAddr().String()
+}
+
+// unused returns a UDP address with nothing listening on it
+func unused(t *testing.T) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	return pc.LocalAddr().String()
+}
+
+// records formats the answers so that they can be compared without their
+// order or TTLs
+func records(rrs []mdns.RR) []string {
+	out := []string{}
+	for _, rr := range rrs {
+		switch r := rr.(type) {
+		case *mdns.A:
+			out = append(out, "A "+r.A.String())
+		case *mdns.AAAA:
+			out = append(out, "AAAA "+r.AAAA.String())
+		case *mdns.SRV:
+			out = append(out, "SRV "+r.Target+" "+strconv.Itoa(int(r.Port)))
+		case *mdns.TXT:
+			out = append(out, "TXT "+strings.Join(r.Txt, ","))
+		default:
+			out = append(out, rr.String())
+		}
+	}
+	sort.Strings(out)
+
+	return out
+}
+
+func TestServer(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{
+		Nodes: 2,
+		Configure: func(i int, cfg *libdiscover.Config) {
+			cfg.Tags = map[string]string{"role": "db"}
+			if i == 1 {
+				cfg.Tags["role"] = "web"
+			}
+		},
+	})
+	d := c.Node(0)
+
+	for _, svc := range []*libdiscover.Service{
+		{ID: "api-1", Name: "api", Version: "1.0", Address: "127.0.0.1", Port: 8080, Meta: map[string]string{"zone": "a"}},
+		{ID: "api-2", Name: "api", Version: "2.0", Address: "::1", Port: 8081},
+	} {
+		if err := d.Catalog().Register(svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := New(d, &Config{
+		Addr:      "127.0.0.1:0",
+		Recursors: []string{unused(t), recursor(t)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, s)
+
+	node := c.Name(0) + ".node.discover."
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+		want  []string
+	}{
+		{node, mdns.TypeA, mdns.RcodeSuccess, []string{"A 127.0.0.1"}},
+		{strings.ToUpper(node), mdns.TypeA, mdns.RcodeSuccess, []string{"A 127.0.0.1"}},
+		{node, mdns.TypeAAAA, mdns.RcodeSuccess, []string{}},
+		{node, mdns.TypeTXT, mdns.RcodeSuccess, []string{"TXT dc=dc1,role=db"}},
+		{"missing.node.discover.", mdns.TypeA, mdns.RcodeNameError, []string{}},
+		{"api.service.discover.", mdns.TypeA, mdns.RcodeSuccess, []string{"A 127.0.0.1"}},
+		{"api.service.discover.", mdns.TypeAAAA, mdns.RcodeSuccess, []string{"AAAA ::1"}},
+		{"api.service.discover.", mdns.TypeSRV, mdns.RcodeSuccess, []string{
+			"SRV " + node + " 8080",
+			"SRV " + node + " 8081",
+		}},
+		{"api.service.discover.", mdns.TypeTXT, mdns.RcodeSuccess, []string{"TXT ", "TXT zone=a"}},
+		{"2.0.api.service.discover.", mdns.TypeAAAA, mdns.RcodeSuccess, []string{"AAAA ::1"}},
+		{"3.0.api.service.discover.", mdns.TypeA, mdns.RcodeNameError, []string{}},
+		{"missing.service.discover.", mdns.TypeSRV, mdns.RcodeNameError, []string{}},
+		{"web.role.tag.discover.", mdns.TypeA, mdns.RcodeSuccess, []string{"A 127.0.0.1"}},
+		{"db.role.tag.discover.", mdns.TypeAAAA, mdns.RcodeSuccess, []string{}},
+		{"cache.role.tag.discover.", mdns.TypeA, mdns.RcodeNameError, []string{}},
+		{"discover.", mdns.TypeA, mdns.RcodeNameError, []string{}},
+		{"example.com.", mdns.TypeA, mdns.RcodeSuccess, []string{"A 192.0.2.1"}},
+	} {
+		req := new(mdns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+
+		resp, err := mdns.Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("%s %s: %s", tc.name, mdns.TypeToString[tc.qtype], err)
+		}
+
+		if resp.Rcode != tc.rcode {
+			t.Errorf("%s %s: expected rcode %s; got %s", tc.name, mdns.TypeToString[tc.qtype],
+				mdns.RcodeToString[tc.rcode], mdns.RcodeToString[resp.Rcode])
+		}
+
+		if got := records(resp.Answer); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s %s: expected %v; got %v", tc.name, mdns.TypeToString[tc.qtype], tc.want, got)
+		}
+	}
+}
+
+func TestServerTCP(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Nodes: 1})
+
+	s, err := New(c.Node(0), &Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, s)
+
+	req := new(mdns.Msg)
+	req.SetQuestion(c.Name(0)+".node.discover.", mdns.TypeA)
+
+	client := &mdns.Client{Net: "tcp"}
+	resp, _, err := client.Exchange(req, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := records(resp.Answer); !reflect.DeepEqual(got, []string{"A 127.0.0.1"}) {
+		t.Fatalf("expected the node address over TCP; got %v", got)
+	}
+
+	// without recursors other names are refused
+	req.SetQuestion("example.com.", mdns.TypeA)
+	if resp, _, err = client.Exchange(req, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Rcode != mdns.RcodeRefused {
+		t.Fatalf("expected REFUSED; got %s", mdns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestListenAndServeStopsBothListeners(t *testing.T) {
+	// hold the TCP port so that only the UDP listener can start
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s, err := New(nil, &Config{Addr: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ListenAndServe(); err == nil {
+		t.Fatal("expected an error listening on a port in use")
+	}
+
+	// the UDP port is free again
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("expected the UDP listener to be closed: %s", err)
+	}
+	pc.Close()
+}
+
+func TestListenerFailureStopsServer(t *testing.T) {
+	s, err := New(nil, &Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ListenAndServe()
+	}()
+
+	var servers []*mdns.Server
+	for len(servers) == 0 {
+		time.Sleep(time.Millisecond * 10)
+
+		s.mu.Lock()
+		servers = s.servers
+		s.mu.Unlock()
+	}
+	addr := servers[0].PacketConn.LocalAddr().String()
+
+	// fail the TCP listener under the running server
+	servers[1].Listener.Close()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("expected the listener error")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout waiting for the server to stop")
+	}
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("expected the UDP listener to be closed: %s", err)
+	}
+	pc.Close()
+}
@@ -0,0 +1,538 @@
+package libdiscover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	electTagPrefix = "elect:"
+	electQueryName = "elect"
+
+	electorRefreshInterval = time.Second
+)
+
+// ElectorConfig scopes a leader election
+type ElectorConfig struct {
+	// Role is the name of the election
+	Role string
+	// NamePrefix limits candidates to members whose name has the prefix
+	NamePrefix string
+	// Tags limits candidates to members that have all of the tags
+	Tags map[string]string
+	// Quorum only elects a leader when a majority of the known candidates
+	// are alive.  Without it each side of a partition elects its own leader.
+	Quorum bool
+}
+
+// Leadership describes the current leader for a role
+type Leadership struct {
+	Role string `json:"role"`
+	// Leader is the name of the leading member
+	Leader string `json:"leader"`
+	// Token is a fencing token that increases on every leadership change
+	Token uint64 `json:"token"`
+	// IsLocal is true when the local node is the leader
+	IsLocal bool `json:"is_local"`
+}
+
+type electRequest struct {
+	Role  string `json:"role"`
+	Token uint64 `json:"token,omitempty"`
+}
+
+type electResponse struct {
+	Token uint64 `json:"token"`
+}
+
+// electTable is the highest fencing token each member has seen for every
+// role.  A new leader reads the tokens of a majority of the members and
+// writes its own token back to a majority, so its token is higher than the
+// token of every earlier leader for as long as a majority of the members
+// keep running.
+type electTable struct {
+	mu     sync.Mutex
+	tokens map[string]uint64
+}
+
+func newElectTable(d *Discover) *electTable {
+	t := &electTable{
+		tokens: map[string]uint64{},
+	}
+
+	d.handleQuery(electQueryName, t.handleQuery)
+
+	return t
+}
+
+func (t *electTable) handleQuery(q *serf.Query) ([]byte, error) {
+	var req electRequest
+	if err := json.Unmarshal(q.Payload, &req); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	if req.Token > t.tokens[req.Role] {
+		t.tokens[req.Role] = req.Token
+	}
+	resp := &electResponse{
+		Token: t.tokens[req.Role],
+	}
+	t.mu.Unlock()
+
+	return json.Marshal(resp)
+}
+
+// Elector elects exactly one leader among the candidates for a role.
+//
+// The leader is the alive candidate with the lowest name, so every member
+// with the same view of the cluster agrees on the leader without exchanging
+// messages.  When the local node becomes leader it reads the highest
+// fencing token for the role from a majority of the members and publishes
+// one higher, after writing it back to a majority.  During a partition, an
+// elector without Quorum elects a leader on each side and the sides may hand
+// out the same token; with Quorum only a side holding a majority of the
+// candidates has a leader and the minority steps down.
+type Elector struct {
+	d   *Discover
+	cfg ElectorConfig
+
+	// evalLock serializes evaluations and the election tag updates so
+	// that they happen in order.  It is not held while a token is claimed
+	// or observers are called.
+	evalLock sync.Mutex
+
+	mu          sync.Mutex
+	campaigning bool
+	isLeader    bool
+	claiming    bool
+	claimed     uint64
+	leader      Leadership
+	maxToken    uint64
+	observers   map[int]func(l Leadership)
+	observerID  int
+	// elected are closed when the local node leads
+	elected []chan struct{}
+	// pending are the leadership changes not yet passed to observers
+	pending  []Leadership
+	notifyCh chan struct{}
+
+	unsubscribe func()
+	stopCh      chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewElector returns an elector for the role described by cfg
+func (d *Discover) NewElector(cfg *ElectorConfig) (*Elector, error) {
+	if cfg.Role == "" {
+		return nil, fmt.Errorf("elector role cannot be empty")
+	}
+
+	e := &Elector{
+		d:         d,
+		cfg:       *cfg,
+		leader:    Leadership{Role: cfg.Role},
+		observers: map[int]func(l Leadership){},
+		notifyCh:  make(chan struct{}, 1),
+		stopCh:    make(chan struct{}),
+	}
+
+	e.unsubscribe = d.Subscribe(func(evt serf.Event) {
+		switch evt.EventType() {
+		case serf.EventMemberJoin, serf.EventMemberLeave, serf.EventMemberFailed, serf.EventMemberUpdate, serf.EventMemberReap:
+			// evaluating may update tags which must not block the event loop
+			go e.evaluate()
+		}
+	})
+
+	go e.refresh()
+	go e.notify()
+
+	return e, nil
+}
+
+func (e *Elector) tag() string {
+	return electTagPrefix + e.cfg.Role
+}
+
+// Campaign makes the local node a candidate and blocks until it is elected
+// or ctx is done.  The node stays a candidate until Resign is called.
+func (e *Elector) Campaign(ctx context.Context) error {
+	elected := make(chan struct{})
+
+	e.evalLock.Lock()
+	e.mu.Lock()
+	e.campaigning = true
+	e.elected = append(e.elected, elected)
+	e.mu.Unlock()
+
+	err := e.d.SetTags(map[string]string{e.tag(): "0"})
+	e.evalLock.Unlock()
+
+	if err != nil {
+		e.stopWaiting(elected)
+		return err
+	}
+
+	e.evaluate()
+
+	select {
+	case <-elected:
+		return nil
+	case <-ctx.Done():
+		e.stopWaiting(elected)
+		return ctx.Err()
+	}
+}
+
+// stopWaiting removes a Campaign that no longer waits to be elected
+func (e *Elector) stopWaiting(elected chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, ch := range e.elected {
+		if ch == elected {
+			e.elected = append(e.elected[:i], e.elected[i+1:]...)
+			return
+		}
+	}
+}
+
+// Resign gives up leadership and candidacy
+func (e *Elector) Resign() error {
+	e.evalLock.Lock()
+	e.mu.Lock()
+	e.campaigning = false
+	e.claimed = 0
+	e.mu.Unlock()
+
+	err := e.d.DeleteTags(e.tag())
+	e.evalLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	e.evaluate()
+
+	return nil
+}
+
+// Leader returns the current leader.  It returns false when there is no
+// leader or the elected member has not yet published its fencing token.
+func (e *Elector) Leader() (Leadership, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leader, e.leader.Leader != ""
+}
+
+// Observe calls fn on every leadership change.  Observers are called one
+// at a time in the order of the changes from a goroutine of the elector, so
+// fn must not block; it may call Resign and Campaign.  The returned func
+// stops the observation.
+func (e *Elector) Observe(fn func(l Leadership)) func() {
+	e.mu.Lock()
+	id := e.observerID
+	e.observerID++
+	e.observers[id] = fn
+	e.mu.Unlock()
+
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		delete(e.observers, id)
+	}
+}
+
+// Close stops the elector.  It does not resign.
+func (e *Elector) Close() {
+	e.closeOnce.Do(func() {
+		e.unsubscribe()
+		close(e.stopCh)
+	})
+}
+
+// notify passes the leadership changes to the observers
+func (e *Elector) notify() {
+	for {
+		select {
+		case <-e.notifyCh:
+		case <-e.stopCh:
+			return
+		case <-e.d.stopCh:
+			return
+		}
+
+		for {
+			e.mu.Lock()
+			if len(e.pending) == 0 {
+				e.mu.Unlock()
+				break
+			}
+
+			l := e.pending[0]
+			e.pending = e.pending[1:]
+
+			observers := make([]func(l Leadership), 0, len(e.observers))
+			for _, fn := range e.observers {
+				observers = append(observers, fn)
+			}
+			e.mu.Unlock()
+
+			for _, fn := range observers {
+				fn(l)
+			}
+		}
+	}
+}
+
+func (e *Elector) refresh() {
+	t := time.NewTicker(electorRefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			e.evaluate()
+		case <-e.stopCh:
+			return
+		case <-e.d.stopCh:
+			return
+		}
+	}
+}
+
+func (e *Elector) eligible(m serf.Member) bool {
+	if !strings.HasPrefix(m.Name, e.cfg.NamePrefix) {
+		return false
+	}
+
+	if _, ok := m.Tags[e.tag()]; !ok {
+		return false
+	}
+
+	for k, v := range e.cfg.Tags {
+		if m.Tags[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// evaluate elects the leader from the current membership
+func (e *Elector) evaluate() {
+	if e.d.cluster == nil {
+		return
+	}
+
+	e.evalLock.Lock()
+
+	alive := []serf.Member{}
+	known := 0
+	for _, m := range e.d.Members() {
+		if !e.eligible(m) {
+			continue
+		}
+
+		switch m.Status {
+		case serf.StatusAlive:
+			alive = append(alive, m)
+			known++
+		case serf.StatusFailed:
+			known++
+		}
+	}
+
+	sort.Slice(alive, func(i, j int) bool {
+		return alive[i].Name < alive[j].Name
+	})
+
+	e.mu.Lock()
+
+	for _, m := range alive {
+		if t, err := strconv.ParseUint(m.Tags[e.tag()], 10, 64); err == nil && t > e.maxToken {
+			e.maxToken = t
+		}
+	}
+
+	var leader *serf.Member
+	if len(alive) > 0 && (!e.cfg.Quorum || len(alive)*2 > known) {
+		leader = &alive[0]
+	}
+
+	local := e.d.Name()
+	isLeader := leader != nil && leader.Name == local
+	next := Leadership{Role: e.cfg.Role}
+	seen := e.maxToken
+	claim := false
+	var tags map[string]string
+
+	if leader != nil {
+		token, _ := strconv.ParseUint(leader.Tags[e.tag()], 10, 64)
+
+		switch {
+		case token > 0:
+			next.Leader = leader.Name
+			next.Token = token
+			next.IsLocal = isLeader
+		case isLeader && e.campaigning && e.claimed == 0 && !e.claiming:
+			// one claim at a time; evaluations go on while it runs
+			claim = true
+			e.claiming = true
+		}
+	}
+
+	e.isLeader = isLeader
+	if !isLeader {
+		e.claimed = 0
+
+		// step down when another candidate leads
+		if e.campaigning && e.d.Tags()[e.tag()] != "0" {
+			tags = map[string]string{e.tag(): "0"}
+		}
+	}
+
+	if next != e.leader {
+		logrus.Debugf("leadership change: role=%s leader=%s token=%d", next.Role, next.Leader, next.Token)
+
+		e.leader = next
+		e.pending = append(e.pending, next)
+		select {
+		case e.notifyCh <- struct{}{}:
+		default:
+		}
+	}
+
+	if next.IsLocal {
+		for _, ch := range e.elected {
+			close(ch)
+		}
+		e.elected = nil
+	}
+
+	e.mu.Unlock()
+
+	if tags != nil {
+		e.setTags(tags)
+	}
+
+	e.evalLock.Unlock()
+
+	if claim {
+		e.claim(seen)
+	}
+}
+
+// claim claims leadership with a new fencing token; the claim is visible
+// once the tag update reaches the local member
+func (e *Elector) claim(seen uint64) {
+	token, err := e.claimToken(seen)
+
+	e.evalLock.Lock()
+	defer e.evalLock.Unlock()
+
+	e.mu.Lock()
+	e.claiming = false
+	// the node may have resigned or lost the lead during the claim
+	publish := err == nil && e.campaigning && e.isLeader
+	if publish {
+		e.claimed = token
+		e.maxToken = token
+	}
+	e.mu.Unlock()
+
+	if err != nil {
+		logrus.Warnf("error claiming leadership: role=%s err=%s", e.cfg.Role, err)
+		return
+	}
+
+	if publish {
+		e.setTags(map[string]string{e.tag(): strconv.FormatUint(token, 10)})
+	}
+}
+
+func (e *Elector) setTags(tags map[string]string) {
+	if err := e.d.SetTags(tags); err != nil {
+		logrus.Errorf("error updating election tags: role=%s err=%s", e.cfg.Role, err)
+	}
+}
+
+// claimToken returns a fencing token higher than the token of every earlier
+// leader.  Without Quorum a leader that cannot reach a majority uses the
+// highest token the members it reaches have seen.
+func (e *Elector) claimToken(seen uint64) (uint64, error) {
+	latest, ok, err := e.exchangeToken(0)
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok && e.cfg.Quorum {
+		return 0, fmt.Errorf("no quorum to read the fencing token")
+	}
+
+	if latest < seen {
+		latest = seen
+	}
+	token := latest + 1
+
+	latest, ok, err = e.exchangeToken(token)
+	if err != nil {
+		return 0, err
+	}
+
+	if latest > token {
+		return 0, fmt.Errorf("fencing token %d was claimed by another leader", latest)
+	}
+
+	if !ok && e.cfg.Quorum {
+		return 0, fmt.Errorf("no quorum to write the fencing token")
+	}
+
+	return token, nil
+}
+
+// exchangeToken sends token to every member and returns the highest token
+// any member has seen and whether a majority of the members responded
+func (e *Elector) exchangeToken(token uint64) (uint64, bool, error) {
+	data, err := json.Marshal(&electRequest{
+		Role:  e.cfg.Role,
+		Token: token,
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	resp, err := e.d.query(internalQueryPrefix+electQueryName, data, nil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	responses := 0
+	var latest uint64
+	for r := range resp.ResponseCh() {
+		var er electResponse
+		if err := json.Unmarshal(r.Payload, &er); err != nil {
+			logrus.Warnf("error decoding election response: from=%s err=%s", r.From, err)
+			continue
+		}
+
+		responses++
+		if er.Token > latest {
+			latest = er.Token
+		}
+	}
+
+	return latest, e.d.majority(responses), nil
+}
@@ -0,0 +1,202 @@
+package libdiscover_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+)
+
+// newElectors starts an elector for the role on every node and campaigns on
+// all of them
+func newElectors(t *testing.T, c *testcluster.Cluster, cfg *libdiscover.ElectorConfig) []*libdiscover.Elector {
+	t.Helper()
+
+	electors := []*libdiscover.Elector{}
+	for i := 0; i < c.Len(); i++ {
+		e, err := c.Node(i).NewElector(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(e.Close)
+
+		go e.Campaign(context.Background())
+
+		electors = append(electors, e)
+	}
+
+	return electors
+}
+
+// waitForLeader waits until every listed elector sees leader and returns
+// the token
+func waitForLeader(t *testing.T, c *testcluster.Cluster, electors []*libdiscover.Elector, leader string) uint64 {
+	t.Helper()
+
+	var token uint64
+	c.WaitFor(fmt.Sprintf("leader %s", leader), func() bool {
+		token = 0
+		for _, e := range electors {
+			l, ok := e.Leader()
+			if !ok || l.Leader != leader {
+				return false
+			}
+
+			if token != 0 && l.Token != token {
+				return false
+			}
+			token = l.Token
+		}
+
+		return true
+	})
+
+	return token
+}
+
+func partitionTimeout(c *testcluster.Config) *testcluster.Config {
+	c.Timeout = time.Second * 30
+	return c
+}
+
+func TestElectorLowestNameLeads(t *testing.T) {
+	c := testcluster.New(t, nil)
+	electors := newElectors(t, c, &libdiscover.ElectorConfig{Role: "test"})
+
+	token := waitForLeader(t, c, electors, c.Name(0))
+	if token == 0 {
+		t.Fatal("expected a fencing token")
+	}
+
+	l, _ := electors[0].Leader()
+	if !l.IsLocal {
+		t.Fatalf("expected %s to lead locally", c.Name(0))
+	}
+
+	if err := electors[0].Resign(); err != nil {
+		t.Fatal(err)
+	}
+
+	next := waitForLeader(t, c, electors, c.Name(1))
+	if next <= token {
+		t.Fatalf("expected token above %d after resigning; got %d", token, next)
+	}
+}
+
+func TestElectorObserverResigns(t *testing.T) {
+	c := testcluster.New(t, nil)
+	electors := newElectors(t, c, &libdiscover.ElectorConfig{Role: "test"})
+
+	// an observer may call back into the elector
+	resigned := make(chan struct{}, 1)
+	electors[0].Observe(func(l libdiscover.Leadership) {
+		if !l.IsLocal {
+			return
+		}
+
+		if err := electors[0].Resign(); err != nil {
+			t.Error(err)
+		}
+
+		select {
+		case resigned <- struct{}{}:
+		default:
+		}
+	})
+
+	select {
+	case <-resigned:
+	case <-time.After(time.Second * 10):
+		t.Fatal("timeout waiting for the observer to resign")
+	}
+
+	waitForLeader(t, c, electors, c.Name(1))
+}
+
+func TestElectorSplitBrainWithQuorum(t *testing.T) {
+	t.Parallel()
+
+	c := testcluster.New(t, partitionTimeout(&testcluster.Config{}))
+	electors := newElectors(t, c, &libdiscover.ElectorConfig{
+		Role:   "test",
+		Quorum: true,
+	})
+
+	first := waitForLeader(t, c, electors, c.Name(0))
+
+	c.PartitionNodes([]int{0}, []int{1, 2})
+
+	// the majority side elects a new leader and the old leader steps down
+	second := waitForLeader(t, c, electors[1:], c.Name(1))
+	if second <= first {
+		t.Fatalf("expected token above %d; got %d", first, second)
+	}
+
+	c.WaitFor("minority without leader", func() bool {
+		_, ok := electors[0].Leader()
+		return !ok
+	})
+
+	c.Heal()
+	c.WaitForMembers(3)
+
+	third := waitForLeader(t, c, electors, c.Name(0))
+	if third <= second {
+		t.Fatalf("expected token above %d after healing; got %d", second, third)
+	}
+}
+
+func TestElectorSplitBrainWithoutQuorum(t *testing.T) {
+	t.Parallel()
+
+	c := testcluster.New(t, partitionTimeout(&testcluster.Config{}))
+	electors := newElectors(t, c, &libdiscover.ElectorConfig{Role: "test"})
+
+	waitForLeader(t, c, electors, c.Name(0))
+
+	c.PartitionNodes([]int{0}, []int{1, 2})
+
+	// each side has a leader
+	waitForLeader(t, c, electors[1:], c.Name(1))
+	waitForLeader(t, c, electors[:1], c.Name(0))
+
+	c.Heal()
+	c.WaitForMembers(3)
+
+	waitForLeader(t, c, electors, c.Name(0))
+}
+
+func TestElectorTokenSurvivesLeaderRestart(t *testing.T) {
+	c := testcluster.New(t, partitionTimeout(&testcluster.Config{}))
+	electors := newElectors(t, c, &libdiscover.ElectorConfig{Role: "test"})
+
+	first := waitForLeader(t, c, electors, c.Name(0))
+
+	// the restarted leader has no memory of its token and must read it
+	// back from the other members
+	electors[0].Close()
+	c.RestartNode(0)
+	c.WaitForMembers(3)
+
+	e, err := c.Node(0).NewElector(&libdiscover.ElectorConfig{Role: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	if err := e.Campaign(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	electors[0] = e
+	second := waitForLeader(t, c, electors, c.Name(0))
+	if second <= first {
+		t.Fatalf("expected token above %d after restart; got %d", first, second)
+	}
+}
@@ -9,23 +9,113 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// libdiscover event types are published to subscribers alongside the serf
+// event types.  serf.EventType.String panics on them; use EventTypeName.
+const (
+	EventHealthUpdate serf.EventType = 100 + iota
+	EventMemberAnnounce
+	EventMemberDepart
+	EventMemberStale
+	EventMemberFresh
+)
+
+// EventTypeName returns the name of a serf or libdiscover event type
+func EventTypeName(t serf.EventType) string {
+	switch t {
+	case EventHealthUpdate:
+		return "health-update"
+	case EventMemberAnnounce:
+		return "member-announce"
+	case EventMemberDepart:
+		return "member-depart"
+	case EventMemberStale:
+		return "member-stale"
+	case EventMemberFresh:
+		return "member-fresh"
+	}
+
+	if t >= serf.EventMemberJoin && t <= serf.EventQuery {
+		return t.String()
+	}
+
+	return fmt.Sprintf("unknown-%d", t)
+}
+
+// Event is a user event passed to Config.EventHandler.  Data holds the
+// decoded payload when it is JSON and is nil otherwise.
 type Event struct {
 	serf.UserEvent
 	Created int64 `json:"created"`
 	Data    interface{}
 }
 
-// eventHandler handles all events sent through the cluster
-func (d *Discover) eventHandler(eventCh chan serf.Event, errCh chan error) {
+// eventHandler handles all events sent through the cluster.  Handler errors
+// are logged so that one failing event does not hold up the others.
+func (d *Discover) eventHandler(eventCh chan serf.Event) {
 	for {
-		e := <-eventCh
-		if err := d.handleEvent(e); err != nil {
-			errCh <- err
+		select {
+		case e := <-eventCh:
+			if d.chaos.holdEvent(e) {
+				continue
+			}
+
+			if err := d.handleEvent(e); err != nil {
+				logrus.Error(err)
+			}
+		case <-d.chaos.flushCh:
+			for _, e := range d.chaos.heldEvents() {
+				if err := d.handleEvent(e); err != nil {
+					logrus.Error(err)
+				}
+			}
 		}
 	}
 }
 
+// Subscribe calls fn for every serf and libdiscover event.  Subscribers are
+// called in order and must not block.  The returned func removes the
+// subscription.
+func (d *Discover) Subscribe(fn func(e serf.Event)) func() {
+	d.subscriberLock.Lock()
+	id := d.subscriberID
+	d.subscriberID++
+	d.subscribers[id] = fn
+	d.subscriberLock.Unlock()
+
+	return func() {
+		d.subscriberLock.Lock()
+		defer d.subscriberLock.Unlock()
+
+		delete(d.subscribers, id)
+	}
+}
+
+func (d *Discover) publish(evt serf.Event) {
+	d.subscriberLock.RLock()
+	defer d.subscriberLock.RUnlock()
+
+	for _, fn := range d.subscribers {
+		fn(evt)
+	}
+}
+
 func (d *Discover) handleEvent(evt serf.Event) error {
+	name := EventTypeName(evt.EventType())
+	d.metrics.IncrCounter(append([]string{"events", "received"}, eventKey(evt)...), 1)
+	defer d.metrics.MeasureSince([]string{"handler", name}, time.Now())
+
+	if err := d.dispatchEvent(evt); err != nil {
+		d.metrics.IncrCounter([]string{"handler", "errors", name}, 1)
+		return err
+	}
+
+	return nil
+}
+
+// dispatchEvent publishes the event and runs the handlers for its type
+func (d *Discover) dispatchEvent(evt serf.Event) error {
+	d.publish(evt)
+
 	switch evt.EventType() {
 	case serf.EventMemberLeave:
 		if err := d.handleMemberLeave(evt); err != nil {
@@ -36,18 +126,26 @@ func (d *Discover) handleEvent(evt serf.Event) error {
 			return err
 		}
 	case serf.EventMemberJoin:
+	case serf.EventQuery:
+		d.respondInternalQuery(evt.(*serf.Query))
 	case serf.EventUser:
+		// subscribers already have the event
+		if d.userEventHandler == nil {
+			return nil
+		}
+
 		se := evt.(serf.UserEvent)
 
+		// payloads that are not JSON are passed on with nil Data
 		var data interface{}
 		if err := json.Unmarshal(se.Payload, &data); err != nil {
-			logrus.Errorf("payload: %v", string(se.Payload))
-			return fmt.Errorf("error unmarshalling payload: %s", err)
+			d.decodeError("event")
+			logrus.Debugf("user event payload is not JSON: name=%s err=%s", se.Name, err)
 		}
 
 		e := Event{
 			se,
-			time.Now().Unix(),
+			d.now().Unix(),
 			data,
 		}
 
@@ -0,0 +1,74 @@
+package libdiscover_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+)
+
+func TestEventHandler(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events = map[string]libdiscover.Event{}
+	)
+
+	c := testcluster.New(t, &testcluster.Config{
+		Configure: func(i int, cfg *libdiscover.Config) {
+			if i != 1 {
+				return
+			}
+
+			// errors from the handler must not hold up later events
+			cfg.EventHandler = func(e libdiscover.Event) error {
+				mu.Lock()
+				events[e.Name] = e
+				mu.Unlock()
+
+				return fmt.Errorf("handler failed")
+			}
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := c.Node(0).SendEvent(fmt.Sprintf("raw-%d", i), []byte("hello"), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Node(0).SendEvent("json", []byte(`{"version":"v2"}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	c.WaitForEvent(1, "json")
+	c.WaitFor("handled events", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// legacy announcements arrive as events as well
+		for _, name := range []string{"raw-0", "raw-1", "raw-2", "json"} {
+			if _, ok := events[name]; !ok {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		e := events[fmt.Sprintf("raw-%d", i)]
+		if e.Data != nil || string(e.Payload) != "hello" {
+			t.Fatalf("expected a raw payload without data; got %+v", e)
+		}
+	}
+
+	data, ok := events["json"].Data.(map[string]interface{})
+	if !ok || data["version"] != "v2" {
+		t.Fatalf("expected decoded data; got %#v", events["json"].Data)
+	}
+}
@@ -0,0 +1,333 @@
+package libdiscover
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/sirupsen/logrus"
+)
+
+// messageType identifies the libdiscover messages that are gossiped
+// alongside serf's own messages
+type messageType uint8
+
+const (
+	// serf uses the low message type values; libdiscover messages start
+	// well above them so both can share the memberlist delegate
+	messageKVType messageType = 128 + iota
+	messageCRDTType
+	messageServiceType
+	messageHealthType
+	messageAnnounceType
+)
+
+const (
+	// stateMagic prefixes the push/pull state so that it can be told apart
+	// from a plain serf push/pull message
+	stateMagic byte = 0xdc
+
+	// maxBroadcastSize is the largest message that will be gossiped; larger
+	// changes are sent to every member directly
+	maxBroadcastSize = 1024
+
+	// maxPushQueue is the number of large messages waiting to be sent; the
+	// oldest is dropped when it is full
+	maxPushQueue = 16
+	// pushInterval is the time between large messages
+	pushInterval = time.Second
+)
+
+// stateHandler is implemented by subsystems that take part in the
+// periodic push/pull state exchange
+type stateHandler interface {
+	LocalState(join bool) []byte
+	MergeRemoteState(buf []byte, join bool)
+}
+
+type pushPullState struct {
+	Serf  []byte            `json:"serf"`
+	State map[string][]byte `json:"state"`
+}
+
+type broadcast struct {
+	msg []byte
+}
+
+func (b *broadcast) Invalidates(other memberlist.Broadcast) bool {
+	return false
+}
+
+func (b *broadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *broadcast) Finished() {}
+
+// gossipDelegate wraps the serf memberlist delegate so that libdiscover
+// messages and state can be carried over the same gossip pool
+type gossipDelegate struct {
+	d    *Discover
+	serf memberlist.Delegate
+}
+
+func (g *gossipDelegate) NodeMeta(limit int) []byte {
+	return g.serf.NodeMeta(limit)
+}
+
+func (g *gossipDelegate) NotifyMsg(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+
+	g.d.chaos.inbound(buf, g.notify)
+}
+
+func (g *gossipDelegate) notify(buf []byte) {
+	t := messageType(buf[0])
+	if t < messageKVType {
+		g.serf.NotifyMsg(buf)
+		return
+	}
+
+	g.d.gossipLock.RLock()
+	fn, ok := g.d.msgHandlers[t]
+	g.d.gossipLock.RUnlock()
+
+	if !ok {
+		logrus.Warnf("received message of unknown type: %d", t)
+		return
+	}
+
+	// the buffer may be reused after we return
+	msg := make([]byte, len(buf)-1)
+	copy(msg, buf[1:])
+
+	fn(msg)
+}
+
+func (g *gossipDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	msgs := g.serf.GetBroadcasts(overhead, limit)
+
+	bytesUsed := 0
+	for _, msg := range msgs {
+		bytesUsed += len(msg) + overhead
+	}
+
+	if extra := g.d.broadcasts.GetBroadcasts(overhead, limit-bytesUsed); extra != nil {
+		msgs = append(msgs, extra...)
+	}
+
+	return g.d.chaos.outbound(msgs, overhead, limit)
+}
+
+// LocalState is sent in push/pull and join exchanges.  Chaos rules can only
+// drop it: memberlist waits on the stream, so a delay is applied to the
+// received state instead.
+func (g *gossipDelegate) LocalState(join bool) []byte {
+	if ok, _ := g.d.chaos.exchange(ChaosOutbound, chaosPushPull, ""); !ok {
+		// serf rejects empty state so send its state alone
+		return g.serf.LocalState(join)
+	}
+
+	pp := pushPullState{
+		Serf:  g.serf.LocalState(join),
+		State: map[string][]byte{},
+	}
+
+	g.d.gossipLock.RLock()
+	for name, h := range g.d.stateHandlers {
+		pp.State[name] = h.LocalState(join)
+	}
+	g.d.gossipLock.RUnlock()
+
+	data, err := json.Marshal(pp)
+	if err != nil {
+		logrus.Errorf("error encoding local state: %s", err)
+		return nil
+	}
+
+	return append([]byte{stateMagic}, data...)
+}
+
+// MergeRemoteState merges the state received in a push/pull or join
+// exchange.  Delayed state is merged in the background so that the
+// exchange completes within the memberlist TCP timeout.
+func (g *gossipDelegate) MergeRemoteState(buf []byte, join bool) {
+	ok, delay := g.d.chaos.exchange(ChaosInbound, chaosPushPull, "")
+	if !ok {
+		return
+	}
+
+	if delay > 0 {
+		state := make([]byte, len(buf))
+		copy(state, buf)
+		time.AfterFunc(delay, func() {
+			g.mergeRemoteState(state, join)
+		})
+		return
+	}
+
+	g.mergeRemoteState(buf, join)
+}
+
+func (g *gossipDelegate) mergeRemoteState(buf []byte, join bool) {
+	// peers that do not wrap their state only send serf state
+	if len(buf) == 0 || buf[0] != stateMagic {
+		g.serf.MergeRemoteState(buf, join)
+		return
+	}
+
+	var pp pushPullState
+	if err := json.Unmarshal(buf[1:], &pp); err != nil {
+		g.d.decodeError("state")
+		logrus.Errorf("error decoding remote state: %s", err)
+		return
+	}
+
+	g.serf.MergeRemoteState(pp.Serf, join)
+
+	g.d.gossipLock.RLock()
+	defer g.d.gossipLock.RUnlock()
+
+	for name, state := range pp.State {
+		h, ok := g.d.stateHandlers[name]
+		if !ok {
+			continue
+		}
+
+		h.MergeRemoteState(state, join)
+	}
+}
+
+// handleMessage registers the handler for a libdiscover message type
+func (d *Discover) handleMessage(t messageType, fn func(msg []byte)) {
+	d.gossipLock.Lock()
+	defer d.gossipLock.Unlock()
+
+	d.msgHandlers[t] = fn
+}
+
+// handleState registers a participant in the push/pull state exchange
+func (d *Discover) handleState(name string, h stateHandler) {
+	d.gossipLock.Lock()
+	defer d.gossipLock.Unlock()
+
+	d.stateHandlers[name] = h
+}
+
+// broadcast queues a libdiscover message to be gossiped to the cluster.
+// Messages too large to gossip are queued for the pusher instead.
+func (d *Discover) broadcast(t messageType, msg []byte) {
+	buf := append([]byte{byte(t)}, msg...)
+	if len(buf) > maxBroadcastSize {
+		logrus.Debugf("message too large to gossip; sending to every member: type=%d size=%d", t, len(buf))
+		d.pusher.queue(buf)
+		return
+	}
+
+	d.broadcasts.QueueBroadcast(&broadcast{msg: buf})
+}
+
+// rebroadcast gossips a message received from another member.  Messages too large
+// to gossip were sent to every member by their origin and are not relayed.
+func (d *Discover) rebroadcast(t messageType, msg []byte) {
+	buf := append([]byte{byte(t)}, msg...)
+	if len(buf) > maxBroadcastSize {
+		return
+	}
+
+	d.broadcasts.QueueBroadcast(&broadcast{msg: buf})
+}
+
+// pusher sends messages too large to gossip to every member over TCP.  A
+// single goroutine sends one message every pushInterval, one member at a
+// time, so that bursts of large changes do not open a connection per
+// member and message at once.  Members that miss a message catch up on the
+// next push/pull.
+type pusher struct {
+	d *Discover
+
+	mu      sync.Mutex
+	pending [][]byte
+}
+
+func (p *pusher) queue(buf []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, b := range p.pending {
+		if bytes.Equal(b, buf) {
+			return
+		}
+	}
+
+	if len(p.pending) == maxPushQueue {
+		logrus.Warnf("too many large messages; dropping the oldest: size=%d", len(p.pending[0]))
+		p.pending = p.pending[1:]
+	}
+
+	p.pending = append(p.pending, buf)
+}
+
+func (p *pusher) next() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.pending) == 0 {
+		return nil
+	}
+
+	buf := p.pending[0]
+	p.pending = p.pending[1:]
+
+	return buf
+}
+
+func (p *pusher) run(stopCh chan struct{}) {
+	t := time.NewTicker(pushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if buf := p.next(); buf != nil {
+				p.d.pushAll(buf)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// pushAll sends the message to every other live member over TCP
+func (d *Discover) pushAll(buf []byte) {
+	if d.cluster == nil {
+		return
+	}
+
+	for _, n := range d.cluster.Memberlist().Members() {
+		if n.Name == d.name {
+			continue
+		}
+
+		if err := d.cluster.Memberlist().SendToTCP(n, buf); err != nil {
+			logrus.Warnf("error sending message: node=%s err=%s", n.Name, err)
+		}
+	}
+}
+
+func (d *Discover) numNodes() int {
+	// memberlist asks for broadcasts before serf.Create returns
+	d.clusterLock.RLock()
+	cluster := d.cluster
+	d.clusterLock.RUnlock()
+
+	if cluster == nil {
+		return 1
+	}
+
+	return cluster.NumNodes()
+}
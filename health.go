@@ -0,0 +1,451 @@
+package libdiscover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	healthStateName = "health"
+
+	defaultCheckInterval = time.Second * 10
+	defaultCheckTimeout  = time.Second * 5
+
+	// maxCheckOutput keeps results small enough to gossip
+	maxCheckOutput = 256
+)
+
+// HealthStatus is the result of a health check
+type HealthStatus string
+
+const (
+	HealthPassing  HealthStatus = "passing"
+	HealthWarning  HealthStatus = "warning"
+	HealthCritical HealthStatus = "critical"
+)
+
+func (s HealthStatus) severity() int {
+	switch s {
+	case HealthPassing:
+		return 0
+	case HealthWarning:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// HealthCheck is a check run periodically on the local node
+type HealthCheck struct {
+	ID   string
+	Name string
+	// ServiceID ties the check to a local service; empty for node checks
+	ServiceID string
+	// Interval between runs; defaults to 10 seconds
+	Interval time.Duration
+	// Timeout for a single run; defaults to 5 seconds
+	Timeout time.Duration
+	Checker Checker
+}
+
+// CheckResult is the result of a health check on a member from when its
+// status last changed.  Results are only gossiped on status changes, so
+// Output and Updated are not refreshed while the status stays the same.
+type CheckResult struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	ServiceID string       `json:"service_id,omitempty"`
+	Node      string       `json:"node"`
+	Status    HealthStatus `json:"status"`
+	Output    string       `json:"output,omitempty"`
+	Updated   time.Time    `json:"updated"`
+}
+
+// HealthEvent is published to subscribers when the status of a check on
+// any member changes
+type HealthEvent struct {
+	Check    *CheckResult
+	Previous HealthStatus
+}
+
+func (e HealthEvent) EventType() serf.EventType {
+	return EventHealthUpdate
+}
+
+func (e HealthEvent) String() string {
+	return fmt.Sprintf("health-update: node=%s check=%s status=%s", e.Check.Node, e.Check.ID, e.Check.Status)
+}
+
+// nodeChecks is the set of check results owned by a node
+type nodeChecks struct {
+	Node      string                  `json:"node"`
+	Timestamp Timestamp               `json:"timestamp"`
+	Checks    map[string]*CheckResult `json:"checks"`
+}
+
+type runningCheck struct {
+	check  HealthCheck
+	stopCh chan struct{}
+}
+
+// Health runs local health checks and tracks the gossiped results of every
+// member
+type Health struct {
+	d     *Discover
+	clock *hlc
+
+	mu      sync.RWMutex
+	nodes   map[string]*nodeChecks
+	running map[string]*runningCheck
+}
+
+func newHealth(d *Discover) *Health {
+	h := &Health{
+		d:       d,
+		clock:   d.newHLC(),
+		nodes:   map[string]*nodeChecks{},
+		running: map[string]*runningCheck{},
+	}
+
+	h.nodes[d.name] = &nodeChecks{
+		Node:      d.name,
+		Timestamp: h.clock.Now(),
+		Checks:    map[string]*CheckResult{},
+	}
+
+	d.handleMessage(messageHealthType, h.handleDelta)
+	d.handleState(healthStateName, h)
+
+	d.Subscribe(func(evt serf.Event) {
+		e, ok := evt.(serf.MemberEvent)
+		if !ok || e.Type != serf.EventMemberReap {
+			return
+		}
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		for _, m := range e.Members {
+			if m.Name != d.name {
+				delete(h.nodes, m.Name)
+			}
+		}
+	})
+
+	return h
+}
+
+// Health returns the health check subsystem
+func (d *Discover) Health() *Health {
+	return d.health
+}
+
+// AddCheck starts running the check on the local node.  A check with the
+// same id is replaced.
+func (h *Health) AddCheck(c *HealthCheck) error {
+	if c.ID == "" {
+		return fmt.Errorf("check id cannot be empty")
+	}
+
+	if c.Checker == nil {
+		return fmt.Errorf("check %s has no checker", c.ID)
+	}
+
+	rc := &runningCheck{
+		check:  *c,
+		stopCh: make(chan struct{}),
+	}
+
+	if rc.check.Name == "" {
+		rc.check.Name = rc.check.ID
+	}
+
+	if rc.check.Interval <= 0 {
+		rc.check.Interval = defaultCheckInterval
+	}
+
+	if rc.check.Timeout <= 0 {
+		rc.check.Timeout = defaultCheckTimeout
+	}
+
+	h.mu.Lock()
+	if cur, ok := h.running[c.ID]; ok {
+		close(cur.stopCh)
+	}
+	h.running[c.ID] = rc
+	h.mu.Unlock()
+
+	go h.run(rc)
+
+	return nil
+}
+
+// RemoveCheck stops the check and removes its result
+func (h *Health) RemoveCheck(id string) {
+	h.mu.Lock()
+	if rc, ok := h.running[id]; ok {
+		close(rc.stopCh)
+		delete(h.running, id)
+	}
+	h.mu.Unlock()
+
+	h.updateLocal(func(checks map[string]*CheckResult) bool {
+		if _, ok := checks[id]; !ok {
+			return false
+		}
+
+		delete(checks, id)
+		return true
+	})
+}
+
+// Checks returns the latest results for the member sorted by id
+func (h *Health) Checks(node string) []*CheckResult {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	results := []*CheckResult{}
+	nc, ok := h.nodes[node]
+	if !ok {
+		return results
+	}
+
+	for _, c := range nc.Checks {
+		r := *c
+		results = append(results, &r)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ID < results[j].ID
+	})
+
+	return results
+}
+
+// NodeStatus returns the worst status of every check on the member.  A
+// member without checks is passing.
+func (h *Health) NodeStatus(node string) HealthStatus {
+	return worstStatus(h.Checks(node), nil)
+}
+
+// ServiceStatus returns the worst status of the node checks and the checks
+// of the service on the member
+func (h *Health) ServiceStatus(node, serviceID string) HealthStatus {
+	return worstStatus(h.Checks(node), func(c *CheckResult) bool {
+		return c.ServiceID == "" || c.ServiceID == serviceID
+	})
+}
+
+// MemberHealth returns the overall status and check results of a member
+func (d *Discover) MemberHealth(name string) (HealthStatus, []*CheckResult) {
+	checks := d.health.Checks(name)
+	return worstStatus(checks, nil), checks
+}
+
+func worstStatus(checks []*CheckResult, filter func(c *CheckResult) bool) HealthStatus {
+	status := HealthPassing
+	for _, c := range checks {
+		if filter != nil && !filter(c) {
+			continue
+		}
+
+		if c.Status.severity() > status.severity() {
+			status = c.Status
+		}
+	}
+
+	return status
+}
+
+func (h *Health) run(rc *runningCheck) {
+	t := time.NewTicker(rc.check.Interval)
+	defer t.Stop()
+
+	for {
+		h.runOnce(rc)
+
+		select {
+		case <-t.C:
+		case <-rc.stopCh:
+			return
+		case <-h.d.stopCh:
+			return
+		}
+	}
+}
+
+func (h *Health) runOnce(rc *runningCheck) {
+	ctx, cancel := context.WithTimeout(context.Background(), rc.check.Timeout)
+	status, output := rc.check.Checker.Check(ctx)
+	cancel()
+
+	if len(output) > maxCheckOutput {
+		// cut on a rune boundary so the output stays valid UTF-8
+		n := maxCheckOutput
+		for n > 0 && !utf8.RuneStart(output[n]) {
+			n--
+		}
+		output = output[:n]
+	}
+
+	result := &CheckResult{
+		ID:        rc.check.ID,
+		Name:      rc.check.Name,
+		ServiceID: rc.check.ServiceID,
+		Node:      h.d.name,
+		Status:    status,
+		Output:    output,
+		Updated:   h.d.now(),
+	}
+
+	h.updateLocal(func(checks map[string]*CheckResult) bool {
+		// the check may have been removed while it was running
+		select {
+		case <-rc.stopCh:
+			return false
+		default:
+		}
+
+		// only status changes are gossiped; output that changes on every
+		// run, such as a timestamp, would otherwise flood the cluster
+		if cur, ok := checks[result.ID]; ok && cur.Status == result.Status {
+			return false
+		}
+		checks[result.ID] = result
+
+		return true
+	})
+}
+
+// updateLocal applies fn to a copy of the local results and gossips them
+// when fn reports a change
+func (h *Health) updateLocal(fn func(checks map[string]*CheckResult) bool) {
+	h.mu.Lock()
+	cur := h.nodes[h.d.name]
+
+	next := &nodeChecks{
+		Node:   h.d.name,
+		Checks: make(map[string]*CheckResult, len(cur.Checks)),
+	}
+	for id, c := range cur.Checks {
+		next.Checks[id] = c
+	}
+
+	if !fn(next.Checks) {
+		h.mu.Unlock()
+		return
+	}
+
+	next.Timestamp = h.clock.Now()
+	h.nodes[h.d.name] = next
+	h.mu.Unlock()
+
+	h.publishChanges(cur, next)
+
+	data, err := json.Marshal(next)
+	if err != nil {
+		logrus.Errorf("error encoding checks: %s", err)
+		return
+	}
+
+	h.d.broadcast(messageHealthType, data)
+}
+
+// publishChanges sends a HealthEvent for every check whose status changed
+func (h *Health) publishChanges(prev, next *nodeChecks) {
+	for id, c := range next.Checks {
+		var previous HealthStatus
+		if prev != nil {
+			if p, ok := prev.Checks[id]; ok {
+				if p.Status == c.Status {
+					continue
+				}
+				previous = p.Status
+			}
+		}
+
+		r := *c
+		h.d.publish(HealthEvent{
+			Check:    &r,
+			Previous: previous,
+		})
+	}
+}
+
+func (h *Health) merge(nc *nodeChecks) bool {
+	// the local node is the only source of its own results
+	if nc.Node == h.d.name {
+		return false
+	}
+
+	h.clock.Update(nc.Timestamp)
+
+	h.mu.Lock()
+	prev, ok := h.nodes[nc.Node]
+	if ok && !prev.Timestamp.Before(nc.Timestamp) {
+		h.mu.Unlock()
+		return false
+	}
+
+	if nc.Checks == nil {
+		nc.Checks = map[string]*CheckResult{}
+	}
+	h.nodes[nc.Node] = nc
+	h.mu.Unlock()
+
+	h.publishChanges(prev, nc)
+
+	return true
+}
+
+func (h *Health) handleDelta(msg []byte) {
+	var nc nodeChecks
+	if err := json.Unmarshal(msg, &nc); err != nil {
+		h.d.decodeError("health")
+		logrus.Errorf("error decoding checks: %s", err)
+		return
+	}
+
+	if h.merge(&nc) {
+		// pass newer changes along
+		h.d.rebroadcast(messageHealthType, msg)
+	}
+}
+
+func (h *Health) LocalState(join bool) []byte {
+	h.mu.RLock()
+	nodes := make([]*nodeChecks, 0, len(h.nodes))
+	for _, nc := range h.nodes {
+		nodes = append(nodes, nc)
+	}
+	data, err := json.Marshal(nodes)
+	h.mu.RUnlock()
+
+	if err != nil {
+		logrus.Errorf("error encoding health state: %s", err)
+		return nil
+	}
+
+	return data
+}
+
+func (h *Health) MergeRemoteState(buf []byte, join bool) {
+	var nodes []*nodeChecks
+	if err := json.Unmarshal(buf, &nodes); err != nil {
+		h.d.decodeError("health_state")
+		logrus.Errorf("error decoding health state: %s", err)
+		return
+	}
+
+	for _, nc := range nodes {
+		h.merge(nc)
+	}
+}
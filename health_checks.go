@@ -0,0 +1,114 @@
+package libdiscover
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// Checker runs a single health check
+type Checker interface {
+	Check(ctx context.Context) (HealthStatus, string)
+}
+
+// CheckFunc adapts a func to a Checker
+type CheckFunc func(ctx context.Context) (HealthStatus, string)
+
+func (f CheckFunc) Check(ctx context.Context) (HealthStatus, string) {
+	return f(ctx)
+}
+
+// HTTPCheck passes on a 2xx response, warns on 429 and is critical
+// otherwise
+type HTTPCheck struct {
+	URL    string
+	Method string
+	Header http.Header
+	Client *http.Client
+}
+
+func (c *HTTPCheck) Check(ctx context.Context) (HealthStatus, string) {
+	method := c.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequest(method, c.URL, nil)
+	if err != nil {
+		return HealthCritical, err.Error()
+	}
+
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return HealthCritical, err.Error()
+	}
+	resp.Body.Close()
+
+	output := fmt.Sprintf("%s %s: %s", method, c.URL, resp.Status)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return HealthPassing, output
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return HealthWarning, output
+	default:
+		return HealthCritical, output
+	}
+}
+
+// TCPCheck passes when a connection can be opened to Addr
+type TCPCheck struct {
+	Addr string
+}
+
+func (c *TCPCheck) Check(ctx context.Context) (HealthStatus, string) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return HealthCritical, err.Error()
+	}
+	conn.Close()
+
+	return HealthPassing, fmt.Sprintf("tcp connect %s: success", c.Addr)
+}
+
+// ScriptCheck runs a command.  An exit code of 0 is passing, 1 is warning
+// and anything else is critical.  The combined output is kept.
+type ScriptCheck struct {
+	Command []string
+}
+
+func (c *ScriptCheck) Check(ctx context.Context) (HealthStatus, string) {
+	if len(c.Command) == 0 {
+		return HealthCritical, "no command"
+	}
+
+	out, err := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...).CombinedOutput()
+	output := strings.TrimSpace(string(out))
+
+	if err == nil {
+		return HealthPassing, output
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if exitErr.ExitCode() == 1 {
+			return HealthWarning, output
+		}
+
+		return HealthCritical, output
+	}
+
+	return HealthCritical, err.Error()
+}
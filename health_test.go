@@ -0,0 +1,126 @@
+package libdiscover_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+)
+
+// slowPushPull leaves gossip as the only way changes spread during a test
+func slowPushPull(i int, cfg *libdiscover.Config) {
+	cfg.Tuning = &libdiscover.Tuning{
+		PushPullInterval: time.Hour,
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Configure: slowPushPull})
+
+	status := make(chan libdiscover.HealthStatus, 1)
+	status <- libdiscover.HealthPassing
+
+	err := c.Node(0).Health().AddCheck(&libdiscover.HealthCheck{
+		ID:       "check",
+		Interval: time.Millisecond * 100,
+		Checker: libdiscover.CheckFunc(func(ctx context.Context) (libdiscover.HealthStatus, string) {
+			s := <-status
+			status <- s
+			return s, string(s)
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus := func(want libdiscover.HealthStatus) {
+		c.WaitFor(fmt.Sprintf("%s on every node", want), func() bool {
+			for _, d := range c.Nodes() {
+				if d.Health().NodeStatus(c.Name(0)) != want {
+					return false
+				}
+			}
+
+			return true
+		})
+	}
+
+	waitForStatus(libdiscover.HealthPassing)
+
+	<-status
+	status <- libdiscover.HealthCritical
+
+	waitForStatus(libdiscover.HealthCritical)
+}
+
+func TestHealthLargeCheckSet(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Configure: slowPushPull})
+
+	// the results of these checks are far larger than a gossip message
+	output := strings.Repeat("x", 256)
+	for i := 0; i < 8; i++ {
+		err := c.Node(0).Health().AddCheck(&libdiscover.HealthCheck{
+			ID:       fmt.Sprintf("check-%d", i),
+			Interval: time.Hour,
+			Checker: libdiscover.CheckFunc(func(ctx context.Context) (libdiscover.HealthStatus, string) {
+				return libdiscover.HealthCritical, output
+			}),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.WaitFor("every check on every node", func() bool {
+		for _, d := range c.Nodes() {
+			if len(d.Health().Checks(c.Name(0))) != 8 {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+func TestHealthOutputOnlyOnStatusChange(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Configure: slowPushPull})
+
+	var runs int64
+	err := c.Node(0).Health().AddCheck(&libdiscover.HealthCheck{
+		ID:       "check",
+		Interval: time.Millisecond * 50,
+		Checker: libdiscover.CheckFunc(func(ctx context.Context) (libdiscover.HealthStatus, string) {
+			n := atomic.AddInt64(&runs, 1)
+			// the output changes on every run and is cut mid rune
+			return libdiscover.HealthPassing, fmt.Sprintf("%d %s", n, strings.Repeat("é", 200))
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.WaitFor("the check on every node", func() bool {
+		return len(c.Node(1).Health().Checks(c.Name(0))) == 1
+	})
+
+	first := c.Node(1).Health().Checks(c.Name(0))[0].Output
+	if len(first) > 256 || !utf8.ValidString(first) {
+		t.Fatalf("expected at most 256 bytes of valid UTF-8; got %d bytes %q", len(first), first)
+	}
+
+	c.WaitFor("more runs", func() bool {
+		return atomic.LoadInt64(&runs) > 10
+	})
+
+	for _, d := range c.Nodes() {
+		if out := d.Health().Checks(c.Name(0))[0].Output; out != first {
+			t.Fatalf("expected output %q from the first run; got %q", first, out)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package libdiscover
+
+import (
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock timestamp.  Timestamps from
+// different nodes are totally ordered; ties are broken by node name.
+type Timestamp struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+	Node    string `json:"node"`
+}
+
+// Before reports whether t happened before o
+func (t Timestamp) Before(o Timestamp) bool {
+	if t.Wall != o.Wall {
+		return t.Wall < o.Wall
+	}
+
+	if t.Logical != o.Logical {
+		return t.Logical < o.Logical
+	}
+
+	return t.Node < o.Node
+}
+
+// Time returns the wall clock component of the timestamp
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, t.Wall)
+}
+
+// hlc is a hybrid logical clock
+type hlc struct {
+	mu      sync.Mutex
+	node    string
+	wall    int64
+	logical uint32
+	now     func() time.Time
+}
+
+func newHLC(node string) *hlc {
+	return &hlc{
+		node: node,
+		now:  time.Now,
+	}
+}
+
+// Now returns a timestamp for a local event
+func (c *hlc) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pt := c.now().UnixNano()
+	if pt > c.wall {
+		c.wall = pt
+		c.logical = 0
+	} else {
+		c.logical++
+	}
+
+	return Timestamp{
+		Wall:    c.wall,
+		Logical: c.logical,
+		Node:    c.node,
+	}
+}
+
+// Update witnesses a timestamp received from a remote node
+func (c *hlc) Update(remote Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pt := c.now().UnixNano()
+
+	switch {
+	case pt > c.wall && pt > remote.Wall:
+		c.wall = pt
+		c.logical = 0
+	case remote.Wall > c.wall:
+		c.wall = remote.Wall
+		c.logical = remote.Logical + 1
+	case c.wall > remote.Wall:
+		c.logical++
+	default:
+		if remote.Logical > c.logical {
+			c.logical = remote.Logical
+		}
+		c.logical++
+	}
+}
@@ -0,0 +1,56 @@
+package libdiscover
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+// decodeKey decodes a base64 gossip encryption key
+func decodeKey(key string) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding encryption key: %s", err)
+	}
+
+	switch len(k) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes")
+	}
+
+	return k, nil
+}
+
+// ListKeys returns the gossip encryption keys installed across the cluster
+func (d *Discover) ListKeys() (*serf.KeyResponse, error) {
+	return d.cluster.KeyManager().ListKeys()
+}
+
+// InstallKey installs a base64 gossip encryption key on every member
+func (d *Discover) InstallKey(key string) (*serf.KeyResponse, error) {
+	if _, err := decodeKey(key); err != nil {
+		return nil, err
+	}
+
+	return d.cluster.KeyManager().InstallKey(key)
+}
+
+// UseKey makes an installed key the primary key used to encrypt gossip
+func (d *Discover) UseKey(key string) (*serf.KeyResponse, error) {
+	return d.cluster.KeyManager().UseKey(key)
+}
+
+// RemoveKey removes a key that is no longer the primary key
+func (d *Discover) RemoveKey(key string) (*serf.KeyResponse, error) {
+	return d.cluster.KeyManager().RemoveKey(key)
+}
+
+// Keyring returns the local gossip keyring, or nil when gossip is not
+// encrypted.  Unlike InstallKey and UseKey, changes to it only apply to this
+// node.
+func (d *Discover) Keyring() *memberlist.Keyring {
+	return d.keyring
+}
@@ -0,0 +1,283 @@
+package libdiscover
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	kvStateName = "kv"
+
+	defaultKVTombstoneTimeout = time.Hour * 24
+	kvWatchBuffer             = 128
+)
+
+// KVEntry is a single key in the replicated key/value store.  Deleted
+// entries are kept as tombstones until they are garbage collected.
+type KVEntry struct {
+	Key       string    `json:"key"`
+	Value     []byte    `json:"value,omitempty"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Timestamp Timestamp `json:"timestamp"`
+}
+
+type kvWatcher struct {
+	prefix string
+	ch     chan *KVEntry
+}
+
+// KV is an eventually consistent key/value store replicated over gossip.
+// Conflicting writes are resolved by last-writer-wins using a hybrid
+// logical clock.  Changes are gossiped as deltas and the full store is
+// exchanged during push/pull so that nodes converge after partitions.
+type KV struct {
+	d                *Discover
+	clock            *hlc
+	tombstoneTimeout time.Duration
+
+	mu       sync.RWMutex
+	entries  map[string]*KVEntry
+	watchers map[int]*kvWatcher
+	watchID  int
+}
+
+func newKV(d *Discover, tombstoneTimeout time.Duration) *KV {
+	if tombstoneTimeout == 0 {
+		tombstoneTimeout = defaultKVTombstoneTimeout
+	}
+
+	kv := &KV{
+		d:                d,
+		clock:            d.newHLC(),
+		tombstoneTimeout: tombstoneTimeout,
+		entries:          map[string]*KVEntry{},
+		watchers:         map[int]*kvWatcher{},
+	}
+
+	d.handleMessage(messageKVType, kv.handleDelta)
+	d.handleState(kvStateName, kv)
+
+	return kv
+}
+
+// KV returns the replicated key/value store
+func (d *Discover) KV() *KV {
+	return d.kv
+}
+
+// Put sets the value for the key
+func (kv *KV) Put(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+
+	return kv.update(&KVEntry{
+		Key:       key,
+		Value:     value,
+		Timestamp: kv.clock.Now(),
+	})
+}
+
+// Delete removes the key
+func (kv *KV) Delete(key string) error {
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+
+	return kv.update(&KVEntry{
+		Key:       key,
+		Deleted:   true,
+		Timestamp: kv.clock.Now(),
+	})
+}
+
+// Get returns the value for the key
+func (kv *KV) Get(key string) ([]byte, bool) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	e, ok := kv.entries[key]
+	if !ok || e.Deleted {
+		return nil, false
+	}
+
+	return e.Value, true
+}
+
+// List returns all live entries whose key starts with prefix sorted by key
+func (kv *KV) List(prefix string) []*KVEntry {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	entries := []*KVEntry{}
+	for k, e := range kv.entries {
+		if e.Deleted || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+
+		c := *e
+		entries = append(entries, &c)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries
+}
+
+// Watch calls fn for every change to a key that starts with prefix,
+// whether local or replicated.  Deletes are delivered with Deleted set.
+// The returned func stops the watch.
+func (kv *KV) Watch(prefix string, fn func(e *KVEntry)) func() {
+	w := &kvWatcher{
+		prefix: prefix,
+		ch:     make(chan *KVEntry, kvWatchBuffer),
+	}
+
+	kv.mu.Lock()
+	id := kv.watchID
+	kv.watchID++
+	kv.watchers[id] = w
+	kv.mu.Unlock()
+
+	go func() {
+		for e := range w.ch {
+			fn(e)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			kv.mu.Lock()
+			delete(kv.watchers, id)
+			kv.mu.Unlock()
+
+			close(w.ch)
+		})
+	}
+}
+
+func (kv *KV) update(e *KVEntry) error {
+	kv.merge(e)
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	kv.d.broadcast(messageKVType, data)
+
+	return nil
+}
+
+// merge applies the entry if it is newer than the local one and reports
+// whether it was applied
+func (kv *KV) merge(e *KVEntry) bool {
+	kv.clock.Update(e.Timestamp)
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if cur, ok := kv.entries[e.Key]; ok && !cur.Timestamp.Before(e.Timestamp) {
+		return false
+	}
+
+	kv.entries[e.Key] = e
+
+	for _, w := range kv.watchers {
+		if !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+
+		c := *e
+		select {
+		case w.ch <- &c:
+		default:
+			logrus.Warnf("kv watch buffer full; dropping change: key=%s", e.Key)
+		}
+	}
+
+	return true
+}
+
+func (kv *KV) handleDelta(msg []byte) {
+	var e KVEntry
+	if err := json.Unmarshal(msg, &e); err != nil {
+		kv.d.decodeError("kv")
+		logrus.Errorf("error decoding kv delta: %s", err)
+		return
+	}
+
+	if kv.merge(&e) {
+		// pass newer changes along
+		kv.d.rebroadcast(messageKVType, msg)
+	}
+}
+
+func (kv *KV) LocalState(join bool) []byte {
+	kv.mu.RLock()
+	entries := make([]*KVEntry, 0, len(kv.entries))
+	for _, e := range kv.entries {
+		entries = append(entries, e)
+	}
+	kv.mu.RUnlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		logrus.Errorf("error encoding kv state: %s", err)
+		return nil
+	}
+
+	return data
+}
+
+func (kv *KV) MergeRemoteState(buf []byte, join bool) {
+	var entries []*KVEntry
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		kv.d.decodeError("kv_state")
+		logrus.Errorf("error decoding kv state: %s", err)
+		return
+	}
+
+	for _, e := range entries {
+		kv.merge(e)
+	}
+}
+
+// reapTombstones removes deletes older than the tombstone timeout.  A node
+// that has been partitioned for longer than the timeout may reintroduce
+// keys that were deleted while it was away.
+func (kv *KV) reapTombstones() {
+	cutoff := time.Now().Add(-kv.tombstoneTimeout)
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	for k, e := range kv.entries {
+		if e.Deleted && e.Timestamp.Time().Before(cutoff) {
+			delete(kv.entries, k)
+		}
+	}
+}
+
+func (kv *KV) reap(stopCh chan struct{}) {
+	t := time.NewTicker(kv.tombstoneTimeout / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			kv.reapTombstones()
+		case <-stopCh:
+			return
+		}
+	}
+}
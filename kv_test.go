@@ -0,0 +1,78 @@
+package libdiscover_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+)
+
+// waitForKey waits until every running node has the value for the key; nil
+// waits for the key to be deleted
+func waitForKey(c *testcluster.Cluster, key string, value []byte) {
+	c.WaitFor("key "+key, func() bool {
+		for _, d := range c.Nodes() {
+			v, ok := d.KV().Get(key)
+			if value == nil && ok || value != nil && !bytes.Equal(v, value) {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+func TestKV(t *testing.T) {
+	c := testcluster.New(t, nil)
+
+	changes := make(chan *libdiscover.KVEntry, 16)
+	unwatch := c.Node(2).KV().Watch("config/", func(e *libdiscover.KVEntry) {
+		changes <- e
+	})
+	defer unwatch()
+
+	if err := c.Node(0).KV().Put("config/version", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	waitForKey(c, "config/version", []byte("v1"))
+
+	if e := <-changes; e.Key != "config/version" || string(e.Value) != "v1" {
+		t.Fatalf("unexpected change: %+v", e)
+	}
+
+	// the last write wins on every node
+	if err := c.Node(1).KV().Put("config/version", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	waitForKey(c, "config/version", []byte("v2"))
+
+	// values too large to gossip are sent to every member directly
+	large := bytes.Repeat([]byte("x"), 4096)
+	if err := c.Node(1).KV().Put("config/large", large); err != nil {
+		t.Fatal(err)
+	}
+	waitForKey(c, "config/large", large)
+
+	if err := c.Node(2).KV().Delete("config/version"); err != nil {
+		t.Fatal(err)
+	}
+	waitForKey(c, "config/version", nil)
+
+	if entries := c.Node(0).KV().List("config/"); len(entries) != 1 || entries[0].Key != "config/large" {
+		t.Fatalf("expected only config/large; got %d entries", len(entries))
+	}
+
+	// a restarted node catches up when it joins; the others may only see
+	// the key after the next push/pull if a broadcast is lost
+	c.KillNode(2)
+	if err := c.Node(0).KV().Put("config/missed", []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	c.RestartNode(2)
+
+	c.WaitFor("config/missed on "+c.Name(2), func() bool {
+		v, _ := c.Node(2).KV().Get("config/missed")
+		return string(v) == "v3"
+	})
+}
@@ -1,40 +1,165 @@
 package libdiscover
 
 import (
-	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
 	"github.com/sirupsen/logrus"
 )
 
 type Discover struct {
-	name             string
-	bindAddr         string
-	advertiseAddr    string
-	joinAddr         string
-	cluster          *serf.Serf
-	logger           *log.Logger
-	userEventHandler func(e Event) error
-	nodeTimeout      time.Duration
-	debug            bool
+	name               string
+	bindAddr           string
+	advertiseAddr      string
+	joinAddr           string
+	cluster            *serf.Serf
+	clusterLock        sync.RWMutex
+	logger             *log.Logger
+	userEventHandler   func(e Event) error
+	nodeTimeout        time.Duration
+	debug              bool
+	disableCoordinates bool
+	encryptKey         string
+	keyring            *memberlist.Keyring
+	datacenter         string
+	wanBindAddr        string
+	wanAdvertiseAddr   string
+	wanJoinAddr        string
+	wan                *serf.Serf
+	profile            Profile
+	tuning             *Tuning
+	wanTuning          *Tuning
+	transport          func(bindAddr string) (memberlist.Transport, error)
+	segment            string
+	segments           map[string]*Discover
+	chaos              *chaos
+	metricsConfig      *MetricsConfig
+	metrics            *metrics.Metrics
+	metricsSink        *metricsSink
+	kv                 *KV
+	broadcasts         *memberlist.TransmitLimitedQueue
+	gossipLock         sync.RWMutex
+	msgHandlers        map[messageType]func(msg []byte)
+	stateHandlers      map[string]stateHandler
+	tags               map[string]string
+	tagLock            sync.RWMutex
+	subscribers        map[int]func(e serf.Event)
+	subscriberID       int
+	subscriberLock     sync.RWMutex
+	queryHandlers      map[string]func(q *serf.Query) ([]byte, error)
+	queryLock          sync.RWMutex
+	locks              *lockTable
+	elections          *electTable
+	catalog            *Catalog
+	health             *Health
+	announcer          *announcer
+	liveness           *Liveness
+	pusher             *pusher
+	crdtLock           sync.RWMutex
+	crdts              map[string]CRDT
+	stopCh             chan struct{}
+	stopOnce           sync.Once
 }
 
 func NewDiscover(cfg *Config) (*Discover, error) {
 	d := &Discover{
-		name:             cfg.Name,
-		bindAddr:         cfg.BindAddr,
-		advertiseAddr:    cfg.AdvertiseAddr,
-		joinAddr:         cfg.JoinAddr,
-		logger:           cfg.Logger,
-		userEventHandler: cfg.EventHandler,
-		nodeTimeout:      cfg.NodeTimeout,
-		debug:            cfg.Debug,
+		name:               cfg.Name,
+		bindAddr:           cfg.BindAddr,
+		advertiseAddr:      cfg.AdvertiseAddr,
+		joinAddr:           cfg.JoinAddr,
+		logger:             cfg.Logger,
+		userEventHandler:   cfg.EventHandler,
+		nodeTimeout:        cfg.NodeTimeout,
+		debug:              cfg.Debug,
+		disableCoordinates: cfg.DisableCoordinates,
+		encryptKey:         cfg.EncryptKey,
+		datacenter:         cfg.Datacenter,
+		wanBindAddr:        cfg.WANBindAddr,
+		wanAdvertiseAddr:   cfg.WANAdvertiseAddr,
+		wanJoinAddr:        cfg.WANJoinAddr,
+		profile:            cfg.Profile,
+		tuning:             cfg.Tuning,
+		wanTuning:          cfg.WANTuning,
+		transport:          cfg.Transport,
+		msgHandlers:        map[messageType]func(msg []byte){},
+		stateHandlers:      map[string]stateHandler{},
+		crdts:              map[string]CRDT{},
+		tags:               map[string]string{},
+		queryHandlers:      map[string]func(q *serf.Query) ([]byte, error){},
+		subscribers:        map[int]func(e serf.Event){},
+		segments:           map[string]*Discover{},
+		stopCh:             make(chan struct{}),
+	}
+	d.pusher = &pusher{d: d}
+
+	mCfg, _, err := gossipConfig(d.profile, d.tuning)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := gossipConfig(ProfileWAN, d.wanTuning); err != nil {
+		return nil, fmt.Errorf("WAN: %s", err)
+	}
+
+	if d.datacenter == "" {
+		d.datacenter = defaultDatacenter
+	}
+
+	if d.advertiseAddr == "" {
+		d.advertiseAddr = d.bindAddr
+	}
+
+	if d.wanAdvertiseAddr == "" {
+		d.wanAdvertiseAddr = d.wanBindAddr
+	}
+
+	for k, v := range cfg.Tags {
+		d.tags[k] = v
+	}
+	d.setReservedTags(d.tags)
+
+	d.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes:       d.numNodes,
+		RetransmitMult: mCfg.RetransmitMult,
+	}
+
+	if cfg.Metrics != nil {
+		if err := cfg.Metrics.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	d.metricsConfig = cfg.Metrics
+	d.metrics = newMetrics(metricsPrefix, &metrics.BlackholeSink{})
+
+	d.chaos = newChaos(d)
+	if err := d.chaos.set(cfg.Chaos); err != nil {
+		return nil, err
+	}
+
+	d.kv = newKV(d, cfg.KVTombstoneTimeout)
+
+	d.locks = newLockTable(d)
+	d.elections = newElectTable(d)
+	d.catalog = newCatalog(d)
+	d.health = newHealth(d)
+	d.announcer = newAnnouncer(d, cfg)
+	d.liveness = newLiveness(d, cfg.HeartbeatTimeout)
+
+	d.handleQuery(wanRelayQueryName, d.handleRelay)
+	d.handleMessage(messageCRDTType, d.handleCRDTDelta)
+	d.handleState(crdtStateName, &crdtState{d: d})
+
+	if err := d.newSegments(cfg); err != nil {
+		return nil, err
 	}
 
 	return d, nil
@@ -49,15 +174,55 @@ func (d *Discover) LocalNode() *memberlist.Node {
 }
 
 func (d *Discover) Members() []serf.Member {
-	return d.cluster.Members()
+	// the memberlist delegates can ask before serf.Create returns
+	d.clusterLock.RLock()
+	cluster := d.cluster
+	d.clusterLock.RUnlock()
+
+	if cluster == nil {
+		return nil
+	}
+
+	return cluster.Members()
+}
+
+// Stats returns serf and memberlist statistics for the local node
+func (d *Discover) Stats() map[string]string {
+	return d.cluster.Stats()
 }
 
+// ForceLeave transitions a failed member to the left state so that it is
+// no longer reconnected to
+func (d *Discover) ForceLeave(name string) error {
+	return d.cluster.RemoveFailedNode(name)
+}
+
+// Addr returns the address members reach the node at; with bind port 0 it
+// has the bound port once the node runs
 func (d *Discover) Addr() string {
+	d.clusterLock.RLock()
+	defer d.clusterLock.RUnlock()
+
 	return d.advertiseAddr
 }
 
+// advertiseHost returns the host portion of the advertise address
+func (d *Discover) advertiseHost() string {
+	addr := d.Addr()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
 func (d *Discover) Run() error {
-	mCfg := memberlist.DefaultLANConfig()
+	mCfg, cfg, err := gossipConfig(d.profile, d.tuning)
+	if err != nil {
+		return err
+	}
 	mCfg.Logger = d.logger
 
 	bindAddr := "127.0.0.1"
@@ -78,7 +243,7 @@ func (d *Discover) Run() error {
 	advertiseAddr := "127.0.0.1"
 	advertisePort := 7946
 
-	advParts := strings.Split(d.bindAddr, ":")
+	advParts := strings.Split(d.advertiseAddr, ":")
 
 	if len(advParts) > 1 {
 		advertiseAddr = advParts[0]
@@ -96,21 +261,44 @@ func (d *Discover) Run() error {
 	mCfg.AdvertiseAddr = advertiseAddr
 	mCfg.AdvertisePort = advertisePort
 
-	cfg := serf.DefaultConfig()
+	if d.transport != nil {
+		t, err := d.transport(net.JoinHostPort(bindAddr, strconv.Itoa(bindPort)))
+		if err != nil {
+			return err
+		}
+
+		mCfg.Transport = t
+	}
+
+	if d.encryptKey != "" {
+		key, err := decodeKey(d.encryptKey)
+		if err != nil {
+			return err
+		}
+
+		mCfg.SecretKey = key
+	}
+
 	cfg.NodeName = d.name
 	cfg.TombstoneTimeout = d.nodeTimeout
+	cfg.Tags = d.Tags()
+	cfg.DisableCoordinates = d.disableCoordinates
+
+	// gateways answer relays with the responses of a whole datacenter
+	if d.wanBindAddr != "" {
+		cfg.QueryResponseSizeLimit = wanResponseSizeLimit
+	}
+
+	// serf and memberlist report their metrics as they start
+	if err := d.startMetrics(); err != nil {
+		return err
+	}
 
 	// handle events
 	eventChan := make(chan serf.Event)
 	cfg.EventCh = eventChan
 
-	errorChan := make(chan error)
-	go func() {
-		err := <-errorChan
-		logrus.Error(err)
-	}()
-
-	go d.eventHandler(eventChan, errorChan)
+	go d.eventHandler(eventChan)
 
 	// set log output
 	if !d.debug {
@@ -120,12 +308,43 @@ func (d *Discover) Run() error {
 
 	cfg.MemberlistConfig = mCfg
 
+	// serf installs its own memberlist delegates; wrap them before
+	// memberlist starts so libdiscover messages and state share the
+	// gossip pool from the first message
+	cfg.MemberlistHook = func(mCfg *memberlist.Config) {
+		mCfg.Delegate = &gossipDelegate{
+			d:    d,
+			serf: mCfg.Delegate,
+		}
+
+		// heartbeats ride on the ping acks used for serf's coordinates
+		mCfg.Ping = &pingDelegate{
+			d:    d,
+			serf: mCfg.Ping,
+		}
+	}
+
 	srv, err := serf.Create(cfg)
 	if err != nil {
 		return err
 	}
 
+	// with bind port 0 memberlist advertises the port it bound
+	local := srv.Memberlist().LocalNode()
+
+	d.clusterLock.Lock()
 	d.cluster = srv
+	d.advertiseAddr = net.JoinHostPort(local.Addr.String(), strconv.Itoa(int(local.Port)))
+	d.clusterLock.Unlock()
+	// memberlist creates the keyring from the secret key
+	d.keyring = mCfg.Keyring
+
+	d.liveness.probeInterval = mCfg.ProbeInterval
+	d.liveness.pushPullInterval = mCfg.PushPullInterval
+
+	go d.kv.reap(d.stopCh)
+	go d.pusher.run(d.stopCh)
+	go d.liveness.run(d.stopCh)
 
 	if d.joinAddr != "" {
 		logrus.Debugf("joining cluster: addr=%s", d.joinAddr)
@@ -135,20 +354,17 @@ func (d *Discover) Run() error {
 		}
 	}
 
-	// broadcast join event
-	info := map[string]string{
-		"name": d.Name(),
-		"addr": d.Addr(),
-	}
-	data, err := json.Marshal(info)
-	if err != nil {
-		return err
+	if d.wanBindAddr != "" {
+		if err := d.runWAN(); err != nil {
+			return err
+		}
 	}
-	if err := d.SendEvent("node-join", data, false); err != nil {
+
+	if err := d.announcer.start(); err != nil {
 		return err
 	}
 
-	return nil
+	return d.runSegments()
 }
 
 // SendEvent allows for sending custom events in the cluster
@@ -156,25 +372,43 @@ func (d *Discover) SendEvent(name string, data []byte, coalesce bool) error {
 	if err := d.cluster.UserEvent(name, data, coalesce); err != nil {
 		return err
 	}
+	d.metrics.IncrCounter([]string{"events", "sent", name}, 1)
 
 	return nil
 }
 
-// Stop shuts down the cluster
+// Join joins the cluster through the members at addrs and returns the
+// number of members joined
+func (d *Discover) Join(addrs ...string) (int, error) {
+	return d.cluster.Join(addrs, true)
+}
+
+// Stop leaves the cluster and shuts the node down.  A node that did not
+// start only stops its background tasks.
 func (d *Discover) Stop() error {
-	// broadcast node leave
-	info := map[string]string{
-		"name": d.Name(),
-		"addr": d.Addr(),
+	if d.cluster == nil {
+		d.stop()
+		return nil
 	}
-	data, err := json.Marshal(info)
-	if err != nil {
+
+	if err := d.stopSegments(); err != nil {
 		return err
 	}
-	if err := d.SendEvent("node-leave", data, false); err != nil {
+
+	if err := d.announcer.stop(); err != nil {
 		return err
 	}
 
+	if d.wan != nil {
+		if err := d.wan.Leave(); err != nil {
+			return err
+		}
+
+		if err := d.wan.Shutdown(); err != nil {
+			return err
+		}
+	}
+
 	// leave serf cluster
 	if err := d.cluster.Leave(); err != nil {
 		return err
@@ -185,5 +419,47 @@ func (d *Discover) Stop() error {
 		return err
 	}
 
+	d.stop()
+
+	return nil
+}
+
+// Shutdown stops the node without leaving the cluster as if it crashed; the
+// other members detect it as failed.  It can be called more than once, after
+// Stop and on a node that failed to start.
+func (d *Discover) Shutdown() error {
+	for _, name := range d.Segments() {
+		s := d.segments[name]
+		if s.cluster == nil {
+			continue
+		}
+
+		if err := s.Shutdown(); err != nil {
+			return fmt.Errorf("segment %s: %s", name, err)
+		}
+	}
+
+	if d.wan != nil {
+		if err := d.wan.Shutdown(); err != nil {
+			return err
+		}
+	}
+
+	if d.cluster != nil {
+		if err := d.cluster.Shutdown(); err != nil {
+			return err
+		}
+	}
+
+	d.stop()
+
 	return nil
 }
+
+// stop stops the background tasks and metrics once
+func (d *Discover) stop() {
+	d.stopOnce.Do(func() {
+		d.stopMetrics()
+		close(d.stopCh)
+	})
+}
@@ -0,0 +1,532 @@
+package libdiscover
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	livenessStateName = "liveness"
+
+	defaultHeartbeatTimeout = time.Second * 30
+
+	// maxHeartbeatStatus keeps heartbeats small enough to ride on ping acks
+	maxHeartbeatStatus = 256
+
+	// maxRecentHeartbeats bounds the recently changed heartbeats that are
+	// piggybacked on acks and push/pull
+	maxRecentHeartbeats = 64
+
+	// maxPiggybackSize keeps the heartbeats on an ack within a UDP packet
+	maxPiggybackSize = 1024
+
+	// heartbeatRetransmitMult scales the number of acks that carry a
+	// changed heartbeat with the log of the cluster size
+	heartbeatRetransmitMult = 4
+
+	// pushPullScaleThreshold is the cluster size above which memberlist
+	// slows down push/pull
+	pushPullScaleThreshold = 32
+
+	// pingMagic prefixes ack payloads that carry a heartbeat alongside the
+	// serf coordinate
+	pingMagic byte = 0xdd
+)
+
+// Heartbeat is the latest application heartbeat of a member
+type Heartbeat struct {
+	Node string `json:"node"`
+	// Generation changes when the application restarts so that its counter
+	// can start over
+	Generation int64  `json:"generation"`
+	Counter    uint64 `json:"counter"`
+	Status     []byte `json:"status,omitempty"`
+	// LastSeen is the local time the counter last advanced
+	LastSeen time.Time `json:"last_seen"`
+	// Stale is set once the member has not reported for the heartbeat
+	// timeout
+	Stale bool `json:"stale"`
+}
+
+func (h *Heartbeat) newer(o *Heartbeat) bool {
+	if h.Generation != o.Generation {
+		return h.Generation > o.Generation
+	}
+
+	return h.Counter > o.Counter
+}
+
+// LivenessEvent is published to subscribers when a member stops reporting
+// heartbeats (EventMemberStale) and when it reports again
+// (EventMemberFresh)
+type LivenessEvent struct {
+	Type      serf.EventType
+	Heartbeat *Heartbeat
+}
+
+func (e LivenessEvent) EventType() serf.EventType {
+	return e.Type
+}
+
+func (e LivenessEvent) String() string {
+	return fmt.Sprintf("%s: node=%s counter=%d", EventTypeName(e.Type), e.Heartbeat.Node, e.Heartbeat.Counter)
+}
+
+// Liveness tracks application heartbeats.  Heartbeats are carried on ping
+// acks and push/pull instead of user events so they cost no extra gossip.
+// Besides its own heartbeat every member passes on a bounded set of the
+// heartbeats that changed recently so that they spread epidemically.
+type Liveness struct {
+	d       *Discover
+	timeout time.Duration
+
+	// probeInterval and pushPullInterval are the memberlist intervals
+	// that bound how quickly heartbeats spread
+	probeInterval    time.Duration
+	pushPullInterval time.Duration
+
+	mu         sync.RWMutex
+	generation int64
+	members    map[string]*Heartbeat
+	// recent holds the members whose heartbeat changed recently and the
+	// number of acks that carried it
+	recent map[string]int
+	// size is the number of alive members at the last check
+	size   int
+	warned bool
+}
+
+func newLiveness(d *Discover, timeout time.Duration) *Liveness {
+	if timeout <= 0 {
+		timeout = defaultHeartbeatTimeout
+	}
+
+	l := &Liveness{
+		d:          d,
+		timeout:    timeout,
+		generation: time.Now().UnixNano(),
+		members:    map[string]*Heartbeat{},
+		recent:     map[string]int{},
+	}
+
+	d.handleState(livenessStateName, l)
+
+	d.Subscribe(func(evt serf.Event) {
+		e, ok := evt.(serf.MemberEvent)
+		if !ok || e.Type != serf.EventMemberReap {
+			return
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		for _, m := range e.Members {
+			if m.Name != d.name {
+				delete(l.members, m.Name)
+				delete(l.recent, m.Name)
+			}
+		}
+	})
+
+	return l
+}
+
+// Liveness returns the heartbeat subsystem
+func (d *Discover) Liveness() *Liveness {
+	return d.liveness
+}
+
+// Beat records a heartbeat of the local application with an optional small
+// status payload
+func (l *Liveness) Beat(status []byte) error {
+	if len(status) > maxHeartbeatStatus {
+		return fmt.Errorf("heartbeat status cannot be larger than %d bytes", maxHeartbeatStatus)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hb := &Heartbeat{
+		Node:       l.d.name,
+		Generation: l.generation,
+		Status:     append([]byte(nil), status...),
+		LastSeen:   time.Now(),
+	}
+
+	if cur, ok := l.members[l.d.name]; ok {
+		hb.Counter = cur.Counter
+	}
+	hb.Counter++
+
+	l.members[l.d.name] = hb
+
+	return nil
+}
+
+// Heartbeat returns the latest heartbeat of the member
+func (l *Liveness) Heartbeat(node string) (*Heartbeat, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	hb, ok := l.members[node]
+	if !ok {
+		return nil, false
+	}
+
+	c := *hb
+	return &c, true
+}
+
+// Heartbeats returns the latest heartbeat of every member that reports them
+// sorted by node
+func (l *Liveness) Heartbeats() []*Heartbeat {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	heartbeats := make([]*Heartbeat, 0, len(l.members))
+	for _, hb := range l.members {
+		c := *hb
+		heartbeats = append(heartbeats, &c)
+	}
+
+	sort.Slice(heartbeats, func(i, j int) bool {
+		return heartbeats[i].Node < heartbeats[j].Node
+	})
+
+	return heartbeats
+}
+
+// LastSeen returns when the member last reported a heartbeat
+func (l *Liveness) LastSeen(node string) (time.Time, bool) {
+	hb, ok := l.Heartbeat(node)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return hb.LastSeen, true
+}
+
+// merge applies a heartbeat if it is newer
+func (l *Liveness) merge(hb *Heartbeat) {
+	if hb.Node == l.d.name || hb.Node == "" {
+		return
+	}
+
+	l.mu.Lock()
+	cur, ok := l.members[hb.Node]
+	if ok && !hb.newer(cur) {
+		l.mu.Unlock()
+		return
+	}
+
+	next := &Heartbeat{
+		Node:       hb.Node,
+		Generation: hb.Generation,
+		Counter:    hb.Counter,
+		Status:     hb.Status,
+		LastSeen:   time.Now(),
+	}
+	l.members[hb.Node] = next
+	l.touch(hb.Node)
+	l.mu.Unlock()
+
+	if ok && cur.Stale {
+		c := *next
+		l.d.publish(LivenessEvent{Type: EventMemberFresh, Heartbeat: &c})
+	}
+}
+
+// touch queues the changed heartbeat of the member to be passed on.  When
+// the set is full the heartbeat that was sent the most makes room; push/pull
+// still carries it on join.  The caller must hold mu.
+func (l *Liveness) touch(node string) {
+	if _, ok := l.recent[node]; !ok && len(l.recent) >= maxRecentHeartbeats {
+		drop, most := "", -1
+		for n, sent := range l.recent {
+			if sent > most || (sent == most && n < drop) {
+				drop, most = n, sent
+			}
+		}
+		delete(l.recent, drop)
+	}
+
+	l.recent[node] = 0
+}
+
+// retransmitLimit is the number of acks that carry a changed heartbeat in a
+// cluster of n members
+func retransmitLimit(n int) int {
+	if n < 1 {
+		n = 1
+	}
+
+	return heartbeatRetransmitMult * int(math.Ceil(math.Log2(float64(n+1))))
+}
+
+// spreadTime estimates how long a heartbeat takes to reach every member of
+// a cluster of n members.  Every probe pulls the recently changed
+// heartbeats of the probed member and every push/pull exchanges them, so a
+// change reaches everyone in about log2(n) rounds of the faster of the two.
+func (l *Liveness) spreadTime(n int) time.Duration {
+	if n <= 1 {
+		return 0
+	}
+
+	interval := l.probeInterval
+	if l.pushPullInterval > 0 {
+		if pushPull := pushPullScale(l.pushPullInterval, n); interval <= 0 || pushPull < interval {
+			interval = pushPull
+		}
+	}
+
+	rounds := math.Ceil(math.Log2(float64(n))) + 2
+	return time.Duration(rounds) * interval
+}
+
+// pushPullScale matches the push/pull interval memberlist uses for a
+// cluster of n members
+func pushPullScale(interval time.Duration, n int) time.Duration {
+	if n <= pushPullScaleThreshold {
+		return interval
+	}
+
+	multiplier := math.Ceil(math.Log2(float64(n))-math.Log2(pushPullScaleThreshold)) + 1.0
+	return time.Duration(multiplier) * interval
+}
+
+// run marks members stale once they stop reporting
+func (l *Liveness) run(stopCh chan struct{}) {
+	t := time.NewTicker(l.timeout / 4)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			l.checkStale()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (l *Liveness) checkStale() {
+	// members that left or failed are reported by serf instead
+	alive := map[string]bool{}
+	for _, m := range l.d.Members() {
+		if m.Status == serf.StatusAlive {
+			alive[m.Name] = true
+		}
+	}
+	spread := l.spreadTime(len(alive))
+
+	stale := []*Heartbeat{}
+
+	l.mu.Lock()
+	l.size = len(alive)
+
+	// the timeout is left as configured but healthy members may go stale
+	if spread > l.timeout && !l.warned {
+		logrus.Warnf("liveness: heartbeats take about %s to reach %d members, longer than the heartbeat timeout of %s", spread, len(alive), l.timeout)
+	}
+	l.warned = spread > l.timeout
+
+	for node, hb := range l.members {
+		if hb.Stale || !alive[node] || time.Since(hb.LastSeen) < l.timeout {
+			continue
+		}
+
+		hb.Stale = true
+		c := *hb
+		stale = append(stale, &c)
+	}
+	l.mu.Unlock()
+
+	for _, hb := range stale {
+		logrus.Debugf("liveness: member stale: %s", hb.Node)
+		l.d.publish(LivenessEvent{Type: EventMemberStale, Heartbeat: hb})
+	}
+}
+
+// piggyback returns the encoded local heartbeat followed by the recently
+// changed heartbeats that were sent the least, up to maxPiggybackSize; nil
+// when there are none
+func (l *Liveness) piggyback() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	nodes := make([]string, 0, len(l.recent)+1)
+	for node := range l.recent {
+		nodes = append(nodes, node)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if l.recent[nodes[i]] != l.recent[nodes[j]] {
+			return l.recent[nodes[i]] < l.recent[nodes[j]]
+		}
+
+		return nodes[i] < nodes[j]
+	})
+
+	if _, ok := l.members[l.d.name]; ok {
+		nodes = append([]string{l.d.name}, nodes...)
+	}
+
+	limit := retransmitLimit(l.size)
+	buf := []byte{'['}
+	for _, node := range nodes {
+		data, err := json.Marshal(l.members[node])
+		if err != nil {
+			logrus.Errorf("error encoding heartbeat: %s", err)
+			continue
+		}
+
+		// a smaller heartbeat may still fit
+		if len(buf)+len(data)+2 > maxPiggybackSize {
+			continue
+		}
+
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, data...)
+
+		if node == l.d.name {
+			continue
+		}
+
+		l.recent[node]++
+		if l.recent[node] >= limit {
+			delete(l.recent, node)
+		}
+	}
+
+	if len(buf) == 1 {
+		return nil
+	}
+
+	return append(buf, ']')
+}
+
+// LocalState sends every heartbeat on join and the local and recently
+// changed heartbeats otherwise so that push/pull stays bounded
+func (l *Liveness) LocalState(join bool) []byte {
+	l.mu.RLock()
+	heartbeats := make([]*Heartbeat, 0, len(l.members))
+	for node, hb := range l.members {
+		if _, ok := l.recent[node]; join || ok || node == l.d.name {
+			heartbeats = append(heartbeats, hb)
+		}
+	}
+	data, err := json.Marshal(heartbeats)
+	l.mu.RUnlock()
+
+	if err != nil {
+		logrus.Errorf("error encoding liveness state: %s", err)
+		return nil
+	}
+
+	return data
+}
+
+func (l *Liveness) MergeRemoteState(buf []byte, join bool) {
+	var heartbeats []*Heartbeat
+	if err := json.Unmarshal(buf, &heartbeats); err != nil {
+		l.d.decodeError("liveness_state")
+		logrus.Errorf("error decoding liveness state: %s", err)
+		return
+	}
+
+	for _, hb := range heartbeats {
+		l.merge(hb)
+	}
+}
+
+// pingDelegate wraps the serf ping delegate so that ping acks also carry
+// heartbeats.  The payload is the magic byte, the length of the serf
+// payload, the serf payload and the heartbeats.
+type pingDelegate struct {
+	d    *Discover
+	serf memberlist.PingDelegate
+}
+
+func (p *pingDelegate) AckPayload() []byte {
+	if ok, _ := p.d.chaos.exchange(ChaosOutbound, chaosPing, ""); !ok {
+		return nil
+	}
+
+	var serfPayload []byte
+	if p.serf != nil {
+		serfPayload = p.serf.AckPayload()
+	}
+
+	hb := p.d.liveness.piggyback()
+	if hb == nil {
+		return serfPayload
+	}
+
+	buf := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(serfPayload)+len(hb))
+	buf[0] = pingMagic
+	n := binary.PutUvarint(buf[1:], uint64(len(serfPayload)))
+	buf = buf[:1+n]
+	buf = append(buf, serfPayload...)
+
+	return append(buf, hb...)
+}
+
+func (p *pingDelegate) NotifyPingComplete(other *memberlist.Node, rtt time.Duration, payload []byte) {
+	ok, delay := p.d.chaos.exchange(ChaosInbound, chaosPing, other.Name)
+	if !ok {
+		return
+	}
+
+	if delay > 0 {
+		buf := make([]byte, len(payload))
+		copy(buf, payload)
+		time.AfterFunc(delay, func() {
+			p.notifyPingComplete(other, rtt, buf)
+		})
+		return
+	}
+
+	p.notifyPingComplete(other, rtt, payload)
+}
+
+func (p *pingDelegate) notifyPingComplete(other *memberlist.Node, rtt time.Duration, payload []byte) {
+	if len(payload) == 0 || payload[0] != pingMagic {
+		if p.serf != nil {
+			p.serf.NotifyPingComplete(other, rtt, payload)
+		}
+		return
+	}
+
+	size, n := binary.Uvarint(payload[1:])
+	if n <= 0 || uint64(len(payload)-1-n) < size {
+		logrus.Warnf("invalid ping payload from %s", other.Name)
+		return
+	}
+
+	serfPayload := payload[1+n : 1+n+int(size)]
+	if p.serf != nil {
+		p.serf.NotifyPingComplete(other, rtt, serfPayload)
+	}
+
+	var heartbeats []*Heartbeat
+	if err := json.Unmarshal(payload[1+n+int(size):], &heartbeats); err != nil {
+		p.d.decodeError("heartbeat")
+		logrus.Errorf("error decoding heartbeats from %s: %s", other.Name, err)
+		return
+	}
+
+	for _, hb := range heartbeats {
+		p.d.liveness.merge(hb)
+	}
+}
@@ -0,0 +1,182 @@
+package libdiscover
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpreadTime(t *testing.T) {
+	l := &Liveness{
+		timeout:          time.Second * 30,
+		probeInterval:    time.Second,
+		pushPullInterval: time.Second * 30,
+	}
+
+	tests := []struct {
+		n      int
+		spread time.Duration
+	}{
+		{1, 0},
+		{3, time.Second * 4},
+		{30, time.Second * 7},
+		{1000, time.Second * 12},
+	}
+
+	for _, tt := range tests {
+		if spread := l.spreadTime(tt.n); spread != tt.spread {
+			t.Errorf("%d members: expected %s; got %s", tt.n, tt.spread, spread)
+		}
+	}
+
+	// with slow probes push/pull spreads heartbeats first: 100 members
+	// take 9 rounds of the 90s scaled interval
+	l.probeInterval = time.Second * 300
+	if spread := l.spreadTime(100); spread != time.Second*810 {
+		t.Errorf("expected 13m30s with slow probes; got %s", spread)
+	}
+}
+
+// testLiveness returns liveness for node a without a cluster behind it
+func testLiveness() *Liveness {
+	return &Liveness{
+		d:       &Discover{name: "a"},
+		timeout: time.Second * 30,
+		members: map[string]*Heartbeat{},
+		recent:  map[string]int{},
+		size:    3,
+	}
+}
+
+// decodePiggyback returns the nodes of the heartbeats on an ack
+func decodePiggyback(t *testing.T, l *Liveness) []string {
+	t.Helper()
+
+	buf := l.piggyback()
+	if len(buf) > maxPiggybackSize {
+		t.Fatalf("expected at most %d bytes; got %d", maxPiggybackSize, len(buf))
+	}
+
+	var heartbeats []*Heartbeat
+	if buf != nil {
+		if err := json.Unmarshal(buf, &heartbeats); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nodes := []string{}
+	for _, hb := range heartbeats {
+		nodes = append(nodes, hb.Node)
+	}
+
+	return nodes
+}
+
+func TestPiggyback(t *testing.T) {
+	l := testLiveness()
+
+	if nodes := decodePiggyback(t, l); len(nodes) != 0 {
+		t.Fatalf("expected no heartbeats; got %v", nodes)
+	}
+
+	if err := l.Beat(nil); err != nil {
+		t.Fatal(err)
+	}
+	l.merge(&Heartbeat{Node: "b", Counter: 1})
+	l.merge(&Heartbeat{Node: "c", Counter: 1})
+
+	want := []string{"a", "b", "c"}
+	for i := 0; i < retransmitLimit(l.size); i++ {
+		if nodes := decodePiggyback(t, l); !reflect.DeepEqual(nodes, want) {
+			t.Fatalf("ack %d: expected %v; got %v", i, want, nodes)
+		}
+	}
+
+	// only the local heartbeat is sent once the others were passed on
+	if nodes := decodePiggyback(t, l); !reflect.DeepEqual(nodes, []string{"a"}) {
+		t.Fatalf("expected the local heartbeat; got %v", nodes)
+	}
+
+	// a newer heartbeat is passed on again
+	l.merge(&Heartbeat{Node: "b", Counter: 2})
+	if nodes := decodePiggyback(t, l); !reflect.DeepEqual(nodes, []string{"a", "b"}) {
+		t.Fatalf("expected the changed heartbeat; got %v", nodes)
+	}
+
+	// older heartbeats are not
+	l.merge(&Heartbeat{Node: "c", Counter: 1})
+	if _, ok := l.recent["c"]; ok {
+		t.Fatal("expected an old heartbeat to be ignored")
+	}
+}
+
+func TestPiggybackBounded(t *testing.T) {
+	l := testLiveness()
+	l.size = 1000
+
+	status := []byte(strings.Repeat("x", maxHeartbeatStatus))
+	for i := 0; i < maxRecentHeartbeats*2; i++ {
+		l.merge(&Heartbeat{Node: fmt.Sprintf("node-%03d", i), Counter: 1, Status: status})
+	}
+
+	if len(l.recent) != maxRecentHeartbeats {
+		t.Fatalf("expected %d recent heartbeats; got %d", maxRecentHeartbeats, len(l.recent))
+	}
+
+	// acks take turns carrying the heartbeats that were sent the least
+	sent := map[string]bool{}
+	for i := 0; i < maxRecentHeartbeats; i++ {
+		nodes := decodePiggyback(t, l)
+		if len(nodes) == 0 {
+			t.Fatal("expected heartbeats on every ack")
+		}
+
+		for _, node := range nodes {
+			sent[node] = true
+		}
+	}
+
+	if len(sent) != maxRecentHeartbeats {
+		t.Fatalf("expected every recent heartbeat to be sent; got %d", len(sent))
+	}
+
+	// push/pull carries the recent set and every heartbeat on join
+	for _, tc := range []struct {
+		join bool
+		n    int
+	}{
+		{false, len(l.recent)},
+		{true, len(l.members)},
+	} {
+		var heartbeats []*Heartbeat
+		if err := json.Unmarshal(l.LocalState(tc.join), &heartbeats); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(heartbeats) != tc.n {
+			t.Errorf("join=%v: expected %d heartbeats; got %d", tc.join, tc.n, len(heartbeats))
+		}
+	}
+}
+
+func TestPushPullScale(t *testing.T) {
+	tests := []struct {
+		n        int
+		interval time.Duration
+	}{
+		{1, time.Second * 30},
+		{32, time.Second * 30},
+		{33, time.Second * 60},
+		{64, time.Second * 60},
+		{65, time.Second * 90},
+	}
+
+	for _, tt := range tests {
+		if interval := pushPullScale(time.Second*30, tt.n); interval != tt.interval {
+			t.Errorf("%d members: expected %s; got %s", tt.n, tt.interval, interval)
+		}
+	}
+}
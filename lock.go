@@ -0,0 +1,349 @@
+package libdiscover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	lockQueryName = "lock"
+
+	lockAcquire = "acquire"
+	lockRenew   = "renew"
+	lockRelease = "release"
+
+	// contenders back off for a random time up to an interval that
+	// doubles from lockRetryInterval to lockMaxRetryInterval
+	lockRetryInterval    = time.Millisecond * 250
+	lockMaxRetryInterval = time.Second * 4
+
+	// lockDriftFactor is the part of the ttl the holder gives up its lease
+	// before the members expire it, to allow for clock drift
+	lockDriftFactor = 10
+)
+
+// ErrLockNotHeld is returned when a lease is no longer held
+var ErrLockNotHeld = fmt.Errorf("lock not held")
+
+type lockRequest struct {
+	Op    string        `json:"op"`
+	Name  string        `json:"name"`
+	ID    string        `json:"id"`
+	TTL   time.Duration `json:"ttl"`
+	Token uint64        `json:"token,omitempty"`
+}
+
+type lockResponse struct {
+	Granted bool   `json:"granted"`
+	Token   uint64 `json:"token"`
+}
+
+type lockHolder struct {
+	id      string
+	expires time.Time
+}
+
+// lockTable is the local vote for every lock.  Each member grants a lock to
+// a single lease at a time; a lease holds the lock while a majority of the
+// known members grant it.  Failed members count towards the majority so
+// only one side of a partition can hold a lock.
+type lockTable struct {
+	mu      sync.Mutex
+	holders map[string]*lockHolder
+	tokens  map[string]uint64
+}
+
+func newLockTable(d *Discover) *lockTable {
+	t := &lockTable{
+		holders: map[string]*lockHolder{},
+		tokens:  map[string]uint64{},
+	}
+
+	d.handleQuery(lockQueryName, t.handleQuery)
+
+	return t
+}
+
+func (t *lockTable) handleQuery(q *serf.Query) ([]byte, error) {
+	var req lockRequest
+	if err := json.Unmarshal(q.Payload, &req); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(t.apply(&req))
+}
+
+func (t *lockTable) apply(req *lockRequest) *lockResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	h, held := t.holders[req.Name]
+	if held && now.After(h.expires) {
+		delete(t.holders, req.Name)
+		held = false
+	}
+
+	if req.Token > t.tokens[req.Name] {
+		t.tokens[req.Name] = req.Token
+	}
+
+	resp := &lockResponse{
+		Token: t.tokens[req.Name],
+	}
+
+	switch req.Op {
+	case lockAcquire, lockRenew:
+		if held && h.id != req.ID {
+			return resp
+		}
+
+		// a lease can only be renewed while this member still grants it
+		if !held && req.Op == lockRenew {
+			return resp
+		}
+
+		t.holders[req.Name] = &lockHolder{
+			id:      req.ID,
+			expires: now.Add(req.TTL),
+		}
+		resp.Granted = true
+	case lockRelease:
+		if held && h.id == req.ID {
+			delete(t.holders, req.Name)
+		}
+		resp.Granted = true
+	}
+
+	return resp
+}
+
+// Lease is a held distributed lock
+type Lease struct {
+	d      *Discover
+	name   string
+	id     string
+	ttl    time.Duration
+	token  uint64
+	lostCh chan struct{}
+	stopCh chan struct{}
+
+	lostOnce sync.Once
+	stopOnce sync.Once
+}
+
+// Lock acquires the named lock for ttl, retrying until a majority of the
+// known members grant it or ctx is done.  The lease is renewed in the
+// background until Unlock is called or ctx is done.  If a renewal cannot
+// reach a majority before the lease expires the lock is lost and the Lost
+// channel is closed.
+func (d *Discover) Lock(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	if name == "" {
+		return nil, fmt.Errorf("lock name cannot be empty")
+	}
+
+	if ttl <= 0 {
+		return nil, fmt.Errorf("lock ttl must be positive")
+	}
+
+	l := &Lease{
+		d:      d,
+		name:   name,
+		id:     fmt.Sprintf("%s/%d", d.Name(), time.Now().UnixNano()),
+		ttl:    ttl,
+		lostCh: make(chan struct{}),
+		stopCh: make(chan struct{}),
+	}
+
+	backoff := lockRetryInterval
+	var granted time.Time
+	for {
+		ok, token, err := l.request(lockAcquire, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			// make the new token durable on a majority before handing out
+			// the lease so that the next holder sees a higher token
+			l.token = token + 1
+			granted = time.Now()
+			if ok, _, err := l.request(lockRenew, l.token); err == nil && ok {
+				break
+			}
+		}
+
+		// give back any partial grants before trying again
+		if _, _, err := l.request(lockRelease, 0); err != nil {
+			logrus.Warnf("error releasing lock: name=%s err=%s", name, err)
+		}
+
+		// randomize the wait so that contenders do not keep splitting the
+		// votes between them
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(backoff))) + 1):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if backoff *= 2; backoff > lockMaxRetryInterval {
+			backoff = lockMaxRetryInterval
+		}
+	}
+
+	go l.renew(ctx, granted)
+
+	return l, nil
+}
+
+// Token returns the fencing token of the lease.  Tokens increase with every
+// acquisition of the lock.
+func (l *Lease) Token() uint64 {
+	return l.token
+}
+
+// Lost is closed when the lease can no longer be renewed
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lostCh
+}
+
+// Unlock releases the lock
+func (l *Lease) Unlock() error {
+	l.stopOnce.Do(func() {
+		close(l.stopCh)
+	})
+
+	select {
+	case <-l.lostCh:
+		return ErrLockNotHeld
+	default:
+	}
+
+	_, _, err := l.request(lockRelease, l.token)
+	return err
+}
+
+type lockRenewal struct {
+	sent time.Time
+	ok   bool
+	err  error
+}
+
+// renew renews the lease until it is released.  The members count a lease
+// from when they receive a request, so the holder counts it from when it
+// sent the last granted one and gives it up ttl/lockDriftFactor early.
+func (l *Lease) renew(ctx context.Context, granted time.Time) {
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+
+	ttl := l.ttl - l.ttl/lockDriftFactor
+	expires := time.NewTimer(time.Until(granted.Add(ttl)))
+	defer expires.Stop()
+
+	// renewals run in the background so that the lease expires on time
+	// while a request is waiting for responses
+	results := make(chan lockRenewal, 1)
+	renewing := false
+
+	for {
+		select {
+		case <-t.C:
+			if renewing {
+				continue
+			}
+			renewing = true
+
+			go func(sent time.Time) {
+				ok, _, err := l.request(lockRenew, l.token)
+				results <- lockRenewal{sent: sent, ok: ok, err: err}
+			}(time.Now())
+		case r := <-results:
+			renewing = false
+
+			if r.err != nil {
+				logrus.Warnf("error renewing lock: name=%s err=%s", l.name, r.err)
+			}
+
+			if !r.ok {
+				continue
+			}
+
+			if !expires.Stop() {
+				// the lease expired before the renewal came back
+				l.lost()
+				return
+			}
+			expires.Reset(time.Until(r.sent.Add(ttl)))
+		case <-expires.C:
+			l.lost()
+			return
+		case <-ctx.Done():
+			if err := l.Unlock(); err != nil && err != ErrLockNotHeld {
+				logrus.Warnf("error releasing lock: name=%s err=%s", l.name, err)
+			}
+			return
+		case <-l.stopCh:
+			return
+		}
+	}
+}
+
+func (l *Lease) lost() {
+	logrus.Warnf("lock lost: name=%s token=%d", l.name, l.token)
+	l.lostOnce.Do(func() {
+		close(l.lostCh)
+	})
+}
+
+// request sends the lock request to every member and reports whether a
+// majority of the known members granted it along with the highest token
+// any member has seen
+func (l *Lease) request(op string, token uint64) (bool, uint64, error) {
+	data, err := json.Marshal(&lockRequest{
+		Op:    op,
+		Name:  l.name,
+		ID:    l.id,
+		TTL:   l.ttl,
+		Token: token,
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	params := l.d.cluster.DefaultQueryParams()
+	if params.Timeout > l.ttl/3 {
+		params.Timeout = l.ttl / 3
+	}
+
+	resp, err := l.d.query(internalQueryPrefix+lockQueryName, data, params)
+	if err != nil {
+		return false, 0, err
+	}
+
+	granted := 0
+	var maxToken uint64
+	for r := range resp.ResponseCh() {
+		var lr lockResponse
+		if err := json.Unmarshal(r.Payload, &lr); err != nil {
+			logrus.Warnf("error decoding lock response: from=%s err=%s", r.From, err)
+			continue
+		}
+
+		if lr.Granted {
+			granted++
+		}
+
+		if lr.Token > maxToken {
+			maxToken = lr.Token
+		}
+	}
+
+	return l.d.majority(granted), maxToken, nil
+}
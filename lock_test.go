@@ -0,0 +1,109 @@
+package libdiscover_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover/testcluster"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestLockMutualExclusion(t *testing.T) {
+	c := testcluster.New(t, nil)
+
+	lease, err := c.Node(0).Lock(context.Background(), "x", time.Second*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	if _, err := c.Node(1).Lock(ctx, "x", time.Second*10); err != context.DeadlineExceeded {
+		t.Fatalf("expected the held lock to time out; got %v", err)
+	}
+
+	if err := lease.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := c.Node(1).Lock(context.Background(), "x", time.Second*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Unlock()
+
+	if next.Token() <= lease.Token() {
+		t.Fatalf("expected token above %d; got %d", lease.Token(), next.Token())
+	}
+}
+
+func TestLockPartition(t *testing.T) {
+	t.Parallel()
+
+	c := testcluster.New(t, &testcluster.Config{Timeout: time.Second * 30})
+
+	c.PartitionNodes([]int{0}, []int{1, 2})
+	c.WaitForMemberStatus(0, c.Name(1), serf.StatusFailed)
+	c.WaitForMemberStatus(0, c.Name(2), serf.StatusFailed)
+	c.WaitForMemberStatus(1, c.Name(0), serf.StatusFailed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	if l, err := c.Node(0).Lock(ctx, "x", time.Second*10); err == nil {
+		l.Unlock()
+		t.Fatal("expected the minority side to be refused the lock")
+	}
+
+	lease, err := c.Node(1).Lock(context.Background(), "x", time.Second*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Unlock()
+}
+
+func TestLockLostOnPartition(t *testing.T) {
+	t.Parallel()
+
+	c := testcluster.New(t, &testcluster.Config{Timeout: time.Second * 30})
+
+	lease, err := c.Node(0).Lock(context.Background(), "x", time.Second*3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.PartitionNodes([]int{0}, []int{1, 2})
+
+	// the majority side takes the lock once the members expire the lease
+	acquired := make(chan time.Time, 1)
+	go func() {
+		l, err := c.Node(1).Lock(context.Background(), "x", time.Second*3)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer l.Unlock()
+
+		acquired <- time.Now()
+	}()
+
+	var lost time.Time
+	select {
+	case <-lease.Lost():
+		lost = time.Now()
+	case <-time.After(time.Second * 30):
+		t.Fatal("expected the lease of the minority side to be lost")
+	}
+
+	// the old holder must give up the lease before anyone else gets it
+	select {
+	case at := <-acquired:
+		if at.Before(lost) {
+			t.Fatalf("lock acquired at %s before the holder lost it at %s", at, lost)
+		}
+	case <-time.After(time.Second * 30):
+		t.Fatal("expected the majority side to acquire the lock")
+	}
+}
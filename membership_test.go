@@ -0,0 +1,170 @@
+package libdiscover_test
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestMembership(t *testing.T) {
+	c := testcluster.New(t, nil)
+
+	for _, d := range c.Nodes() {
+		if n := len(d.Members()); n != c.Len() {
+			t.Fatalf("expected %d members on %s; got %d", c.Len(), d.Name(), n)
+		}
+	}
+
+	c.KillNode(1)
+	c.WaitForMemberStatus(0, c.Name(1), serf.StatusFailed)
+
+	c.RestartNode(1)
+	c.WaitForMemberStatus(0, c.Name(1), serf.StatusAlive)
+	c.WaitForMemberStatus(1, c.Name(2), serf.StatusAlive)
+
+	// the cluster shuts the node down again when the test finishes
+	if err := c.Node(2).Stop(); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitForMemberStatus(0, c.Name(2), serf.StatusLeft)
+}
+
+func TestShutdown(t *testing.T) {
+	d, err := libdiscover.NewDiscover(&libdiscover.Config{
+		Name:     "node-0",
+		BindAddr: "127.0.0.1:0",
+		Profile:  libdiscover.ProfileLocal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a node that never ran can be stopped
+	if err := d.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := testcluster.New(t, &testcluster.Config{
+		Nodes: 1,
+		Configure: func(i int, cfg *libdiscover.Config) {
+			cfg.Metrics = &libdiscover.MetricsConfig{Sink: libdiscover.MetricsInmem}
+		},
+	})
+
+	if err := c.Node(0).Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Node(0).Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSerfMetrics(t *testing.T) {
+	// only node 0 has metrics
+	c := testcluster.New(t, &testcluster.Config{
+		Nodes: 2,
+		Configure: func(i int, cfg *libdiscover.Config) {
+			if i == 0 {
+				cfg.Metrics = &libdiscover.MetricsConfig{Sink: libdiscover.MetricsPrometheus}
+			}
+		},
+	})
+
+	if c.Node(1).Metrics() != nil {
+		t.Fatal("expected metrics to be off on node 1")
+	}
+
+	sink := c.Node(0).Metrics().(*libdiscover.PrometheusSink)
+
+	// the memberlist goroutines report through the go-metrics global
+	c.WaitFor("memberlist metrics", func() bool {
+		var buf bytes.Buffer
+		if err := sink.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		return strings.Contains(buf.String(), "memberlist_gossip")
+	})
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	d, err := libdiscover.NewDiscover(&libdiscover.Config{
+		Name:          "node-0",
+		BindAddr:      "0.0.0.0:0",
+		AdvertiseAddr: "127.0.0.2:0",
+		Profile:       libdiscover.ProfileLocal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	host, _, err := net.SplitHostPort(d.Addr())
+	if err != nil || host != "127.0.0.2" {
+		t.Fatalf("expected the advertise address; got %s", d.Addr())
+	}
+
+	if addr := d.LocalNode().Addr.String(); addr != host {
+		t.Fatalf("expected memberlist to advertise %s; got %s", host, addr)
+	}
+
+	// members reach the node at the advertised address
+	o, err := libdiscover.NewDiscover(&libdiscover.Config{
+		Name:     "node-1",
+		BindAddr: "127.0.0.1:0",
+		JoinAddr: d.Addr(),
+		Profile:  libdiscover.ProfileLocal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Shutdown()
+
+	if err := o.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range o.Members() {
+		if m.Name == d.Name() && m.Addr.String() != host {
+			t.Fatalf("expected %s at %s; got %s", m.Name, host, m.Addr)
+		}
+	}
+}
+
+func TestHeartbeatsSpread(t *testing.T) {
+	// without push/pull heartbeats only spread on acks
+	c := testcluster.New(t, &testcluster.Config{Nodes: 5, Configure: slowPushPull})
+
+	for i := 0; i < 3; i++ {
+		if err := c.Node(0).Liveness().Beat([]byte("ready")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.WaitFor("the heartbeat on every node", func() bool {
+		for _, d := range c.Nodes() {
+			hb, ok := d.Liveness().Heartbeat(c.Name(0))
+			if !ok || hb.Counter != 3 || string(hb.Status) != "ready" {
+				return false
+			}
+		}
+
+		return true
+	})
+}
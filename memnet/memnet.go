@@ -0,0 +1,368 @@
+// Package memnet connects gossip pools in memory instead of over UDP and
+// TCP so that whole clusters can run inside one test binary without
+// binding ports.
+//
+// Every transport has a virtual address on a host of the network.  Links
+// between hosts can add latency and packet loss, and hosts can be
+// partitioned from each other:
+//
+//	n, _ := memnet.New(&memnet.Config{Link: memnet.Link{Latency: time.Millisecond}})
+//	d, _ := libdiscover.NewDiscover(&libdiscover.Config{
+//		Name:      "node-0",
+//		BindAddr:  "10.0.0.1:7946",
+//		Transport: n.Transport,
+//	})
+package memnet
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	// firstPort is the first port given to transports bound to port 0
+	firstPort = 10000
+	// packetBuffer is the number of packets queued for a transport before
+	// new ones are dropped, like a full socket buffer
+	packetBuffer = 1024
+)
+
+// Link is the quality of the path from one host to another
+type Link struct {
+	// Latency delays every packet and stream dial
+	Latency time.Duration
+	// Loss is the share of packets dropped, from 0 to 1; streams are
+	// reliable
+	Loss float64
+}
+
+func (l Link) validate() error {
+	if l.Latency < 0 {
+		return fmt.Errorf("latency cannot be negative")
+	}
+
+	if l.Loss < 0 || l.Loss > 1 {
+		return fmt.Errorf("loss must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// Config configures a Network
+type Config struct {
+	// Link applies between hosts without a link of their own
+	Link Link
+	// Seed seeds the packet loss so that the same traffic loses the same
+	// packets; defaults to 1
+	Seed int64
+}
+
+// Network connects the transports created from it
+type Network struct {
+	mu         sync.Mutex
+	link       Link
+	links      map[[2]string]Link
+	groups     map[string]int
+	rand       *rand.Rand
+	transports map[string]*Transport
+	ports      map[string]int
+}
+
+// New returns a network without partitions
+func New(cfg *Config) (*Network, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	if err := cfg.Link.validate(); err != nil {
+		return nil, err
+	}
+
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = 1
+	}
+
+	return &Network{
+		link:       cfg.Link,
+		links:      map[[2]string]Link{},
+		groups:     map[string]int{},
+		rand:       rand.New(rand.NewSource(seed)),
+		transports: map[string]*Transport{},
+		ports:      map[string]int{},
+	}, nil
+}
+
+// SetLink sets the link from one host to another; the way back is not
+// changed
+func (n *Network) SetLink(from, to string, l Link) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.links[[2]string{from, to}] = l
+
+	return nil
+}
+
+// Partition splits the hosts into groups that cannot reach each other.
+// Hosts that are not in a group still reach every host.  It replaces the
+// previous partition.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.groups = map[string]int{}
+	for i, hosts := range groups {
+		for _, host := range hosts {
+			n.groups[host] = i
+		}
+	}
+}
+
+// Heal removes the partition
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// Transport creates a transport bound to addr, an IP address and port.
+// Port 0 picks an unused port on the host.  It can be used as
+// libdiscover.Config.Transport.
+func (n *Network) Transport(addr string) (memberlist.Transport, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", host)
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", p)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if port == 0 {
+		if n.ports[host] == 0 {
+			n.ports[host] = firstPort
+		}
+
+		for n.transports[net.JoinHostPort(host, strconv.Itoa(n.ports[host]))] != nil {
+			n.ports[host]++
+		}
+
+		port = n.ports[host]
+	}
+
+	key := net.JoinHostPort(host, strconv.Itoa(port))
+	if n.transports[key] != nil {
+		return nil, &net.OpError{
+			Op:   "listen",
+			Net:  "memnet",
+			Addr: &net.UDPAddr{IP: ip, Port: port},
+			Err:  syscall.EADDRINUSE,
+		}
+	}
+
+	t := &Transport{
+		n:          n,
+		ip:         ip,
+		port:       port,
+		packetCh:   make(chan *memberlist.Packet, packetBuffer),
+		streamCh:   make(chan net.Conn),
+		shutdownCh: make(chan struct{}),
+	}
+	n.transports[key] = t
+
+	return t, nil
+}
+
+// route returns the transport at addr and the link to it from the host;
+// false when there is none or the hosts are partitioned
+func (n *Network) route(from net.IP, addr string) (*Transport, Link, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, Link{}, false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	dst, ok := n.transports[addr]
+	if !ok {
+		return nil, Link{}, false
+	}
+
+	src := from.String()
+	gs, okSrc := n.groups[src]
+	gd, okDst := n.groups[host]
+	if okSrc && okDst && gs != gd {
+		return dst, Link{}, false
+	}
+
+	l, ok := n.links[[2]string{src, host}]
+	if !ok {
+		l = n.link
+	}
+
+	return dst, l, true
+}
+
+// lose reports whether a packet on the link is dropped
+func (n *Network) lose(l Link) bool {
+	if l.Loss == 0 {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.rand.Float64() < l.Loss
+}
+
+func (n *Network) remove(t *Transport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.transports, t.addr())
+}
+
+// Transport is a memberlist transport on a Network
+type Transport struct {
+	n    *Network
+	ip   net.IP
+	port int
+
+	packetCh     chan *memberlist.Packet
+	streamCh     chan net.Conn
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+}
+
+func (t *Transport) addr() string {
+	return net.JoinHostPort(t.ip.String(), strconv.Itoa(t.port))
+}
+
+// FinalAdvertiseAddr returns the address of the transport; other members
+// can only reach it there
+func (t *Transport) FinalAdvertiseAddr(ip string, port int) (net.IP, int, error) {
+	return t.ip, t.port, nil
+}
+
+// WriteTo sends a packet.  Like UDP it is dropped without an error when
+// nothing listens at addr, the hosts are partitioned or the link loses it.
+func (t *Transport) WriteTo(b []byte, addr string) (time.Time, error) {
+	now := time.Now()
+
+	dst, l, ok := t.n.route(t.ip, addr)
+	if !ok || t.n.lose(l) {
+		return now, nil
+	}
+
+	p := &memberlist.Packet{
+		Buf:  append([]byte(nil), b...),
+		From: &net.UDPAddr{IP: t.ip, Port: t.port},
+	}
+
+	if l.Latency > 0 {
+		time.AfterFunc(l.Latency, func() {
+			dst.deliver(p)
+		})
+	} else {
+		dst.deliver(p)
+	}
+
+	return now, nil
+}
+
+func (t *Transport) deliver(p *memberlist.Packet) {
+	p.Timestamp = time.Now()
+
+	select {
+	case t.packetCh <- p:
+	default:
+	}
+}
+
+// PacketCh returns the received packets
+func (t *Transport) PacketCh() <-chan *memberlist.Packet {
+	return t.packetCh
+}
+
+// DialTimeout opens a stream to the transport at addr after the latency of
+// the link.  Dialing a partitioned host waits for the timeout.
+func (t *Transport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	dst, l, ok := t.n.route(t.ip, addr)
+	switch {
+	case dst == nil:
+		return nil, &net.OpError{Op: "dial", Net: "memnet", Err: syscall.ECONNREFUSED}
+	case !ok:
+		time.Sleep(timeout)
+		return nil, &net.OpError{Op: "dial", Net: "memnet", Err: syscall.ETIMEDOUT}
+	case l.Latency >= timeout:
+		time.Sleep(timeout)
+		return nil, &net.OpError{Op: "dial", Net: "memnet", Err: syscall.ETIMEDOUT}
+	}
+
+	time.Sleep(l.Latency)
+
+	local := &net.TCPAddr{IP: t.ip, Port: t.port}
+	remote := &net.TCPAddr{IP: dst.ip, Port: dst.port}
+	c1, c2 := net.Pipe()
+
+	select {
+	case dst.streamCh <- &conn{Conn: c2, local: remote, remote: local}:
+		return &conn{Conn: c1, local: local, remote: remote}, nil
+	case <-dst.shutdownCh:
+	case <-time.After(timeout - l.Latency):
+	}
+
+	c1.Close()
+	c2.Close()
+
+	return nil, &net.OpError{Op: "dial", Net: "memnet", Err: syscall.ECONNREFUSED}
+}
+
+// StreamCh returns the accepted streams
+func (t *Transport) StreamCh() <-chan net.Conn {
+	return t.streamCh
+}
+
+// Shutdown frees the address of the transport
+func (t *Transport) Shutdown() error {
+	t.shutdownOnce.Do(func() {
+		t.n.remove(t)
+		close(t.shutdownCh)
+	})
+
+	return nil
+}
+
+// conn is a stream with the addresses of the transports
+type conn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,286 @@
+package memnet
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// newTransport returns a transport of the network that is shut down when
+// the test finishes
+func newTransport(t *testing.T, n *Network, addr string) *Transport {
+	t.Helper()
+
+	tr, err := n.Transport(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Shutdown() })
+
+	return tr.(*Transport)
+}
+
+// receive waits for a packet on the transport; nil when none arrives
+func receive(tr *Transport, timeout time.Duration) *memberlist.Packet {
+	// a timeout of 0 only takes a packet that already arrived
+	select {
+	case p := <-tr.PacketCh():
+		return p
+	default:
+	}
+
+	select {
+	case p := <-tr.PacketCh():
+		return p
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestTransportAddr(t *testing.T) {
+	n, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTransport(t, n, "10.0.0.1:0")
+	b := newTransport(t, n, "10.0.0.1:0")
+	c := newTransport(t, n, "10.0.0.2:7946")
+
+	for _, tc := range []struct {
+		tr   *Transport
+		addr string
+	}{
+		{a, "10.0.0.1:10000"},
+		{b, "10.0.0.1:10001"},
+		{c, "10.0.0.2:7946"},
+	} {
+		ip, port, err := tc.tr.FinalAdvertiseAddr("", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := (&memberlist.Node{Addr: ip, Port: uint16(port)}).Address(); got != tc.addr {
+			t.Errorf("expected %s; got %s", tc.addr, got)
+		}
+	}
+
+	if _, err := n.Transport("10.0.0.2:7946"); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("expected the address to be in use; got %v", err)
+	}
+
+	// the address is free again after shutdown
+	c.Shutdown()
+	newTransport(t, n, "10.0.0.2:7946")
+
+	for _, addr := range []string{"10.0.0.1", "host:7946", "10.0.0.1:port"} {
+		if _, err := n.Transport(addr); err == nil {
+			t.Errorf("%s: expected an error", addr)
+		}
+	}
+}
+
+func TestPackets(t *testing.T) {
+	n, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTransport(t, n, "10.0.0.1:7946")
+	b := newTransport(t, n, "10.0.0.2:7946")
+
+	if _, err := a.WriteTo([]byte("ping"), "10.0.0.2:7946"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := receive(b, time.Second)
+	if p == nil || string(p.Buf) != "ping" || p.From.String() != "10.0.0.1:7946" {
+		t.Fatalf("unexpected packet %+v", p)
+	}
+
+	// packets to nobody are dropped like UDP
+	if _, err := a.WriteTo([]byte("ping"), "10.0.0.3:7946"); err != nil {
+		t.Fatalf("expected no error; got %s", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	n, err := New(&Config{Link: Link{Latency: time.Millisecond * 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTransport(t, n, "10.0.0.1:7946")
+	b := newTransport(t, n, "10.0.0.2:7946")
+
+	if err := n.SetLink("10.0.0.2", "10.0.0.1", Link{Latency: time.Millisecond * 200}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		from, to *Transport
+		latency  time.Duration
+	}{
+		{a, b, time.Millisecond * 50},
+		{b, a, time.Millisecond * 200},
+	} {
+		sent, err := tc.from.WriteTo([]byte("ping"), tc.to.addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := receive(tc.to, time.Second)
+		if p == nil {
+			t.Fatal("expected the packet")
+		}
+
+		if d := p.Timestamp.Sub(sent); d < tc.latency {
+			t.Fatalf("expected a latency of %s; got %s", tc.latency, d)
+		}
+	}
+
+	if err := n.SetLink("10.0.0.1", "10.0.0.2", Link{Loss: 2}); err == nil {
+		t.Fatal("expected an error for a loss above 1")
+	}
+
+	if err := n.SetLink("10.0.0.1", "10.0.0.2", Link{Latency: -1}); err == nil {
+		t.Fatal("expected an error for a negative latency")
+	}
+}
+
+func TestLoss(t *testing.T) {
+	// lost returns the indexes of the packets lost out of 1000
+	lost := func(seed int64) []int {
+		n, err := New(&Config{Link: Link{Loss: 0.2}, Seed: seed})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := newTransport(t, n, "10.0.0.1:7946")
+		b := newTransport(t, n, "10.0.0.2:7946")
+
+		out := []int{}
+		for i := 0; i < 1000; i++ {
+			a.WriteTo([]byte("ping"), b.addr())
+			if receive(b, 0) == nil {
+				out = append(out, i)
+			}
+		}
+
+		return out
+	}
+
+	first := lost(7)
+	if len(first) < 150 || len(first) > 250 {
+		t.Fatalf("expected about 200 lost packets; got %d", len(first))
+	}
+
+	// the same seed loses the same packets
+	second := lost(7)
+	if len(second) != len(first) {
+		t.Fatalf("expected the same packets lost; got %d and %d", len(first), len(second))
+	}
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected the same packets lost; got %d and %d", first[i], second[i])
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	n, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTransport(t, n, "10.0.0.1:7946")
+	b := newTransport(t, n, "10.0.0.2:7946")
+	c := newTransport(t, n, "10.0.0.3:7946")
+
+	n.Partition([]string{"10.0.0.1"}, []string{"10.0.0.2"})
+
+	a.WriteTo([]byte("ping"), b.addr())
+	if p := receive(b, time.Millisecond*50); p != nil {
+		t.Fatal("expected the partition to drop the packet")
+	}
+
+	if _, err := a.DialTimeout(b.addr(), time.Millisecond*50); !errors.Is(err, syscall.ETIMEDOUT) {
+		t.Fatalf("expected the dial to time out; got %v", err)
+	}
+
+	// hosts outside the partition reach both sides
+	c.WriteTo([]byte("ping"), a.addr())
+	if p := receive(a, time.Second); p == nil {
+		t.Fatal("expected the packet from outside the partition")
+	}
+
+	n.Heal()
+
+	a.WriteTo([]byte("ping"), b.addr())
+	if p := receive(b, time.Second); p == nil {
+		t.Fatal("expected the packet after healing")
+	}
+}
+
+func TestStreams(t *testing.T) {
+	n, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTransport(t, n, "10.0.0.1:7946")
+	b := newTransport(t, n, "10.0.0.2:7946")
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn := <-b.StreamCh()
+		defer conn.Close()
+
+		if conn.RemoteAddr().String() != a.addr() {
+			accepted <- errors.New("unexpected remote address " + conn.RemoteAddr().String())
+			return
+		}
+
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			accepted <- err
+			return
+		}
+
+		_, err := conn.Write(append(buf, '!'))
+		accepted <- err
+	}()
+
+	conn, err := a.DialTimeout(b.addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "ping!" || conn.RemoteAddr().String() != b.addr() {
+		t.Fatalf("unexpected reply %q from %s", buf, conn.RemoteAddr())
+	}
+
+	b.Shutdown()
+	if _, err := a.DialTimeout(b.addr(), time.Second); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected the dial to be refused; got %v", err)
+	}
+}
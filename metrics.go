@@ -0,0 +1,330 @@
+package libdiscover
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/serf/serf"
+)
+
+// MetricsSink selects where metrics are sent
+type MetricsSink string
+
+const (
+	// MetricsInmem keeps recent intervals in memory; they are served by the
+	// API and dumped to stderr on SIGUSR1
+	MetricsInmem MetricsSink = "inmem"
+	// MetricsPrometheus keeps the current values for Prometheus to scrape
+	// from the API
+	MetricsPrometheus MetricsSink = "prometheus"
+	// MetricsStatsd and MetricsStatsite send metrics to the server at
+	// MetricsConfig.Address over UDP and TCP
+	MetricsStatsd   MetricsSink = "statsd"
+	MetricsStatsite MetricsSink = "statsite"
+)
+
+const (
+	defaultMetricsInterval = time.Second * 10
+	defaultMetricsRetain   = time.Minute
+
+	// metricsPrefix prefixes the libdiscover metrics; serf and memberlist
+	// use their own
+	metricsPrefix = "libdiscover"
+
+	// gaugeInterval is how often member counts and queue depths are
+	// reported
+	gaugeInterval = time.Second
+)
+
+// MetricsConfig configures metrics; serf and memberlist metrics are sent to
+// the same sink
+type MetricsConfig struct {
+	Sink MetricsSink
+	// Address is the statsd or statsite server address
+	Address string
+	// Interval and Retain size the intervals kept by the in-memory sink;
+	// default 10s and 1m
+	Interval time.Duration
+	Retain   time.Duration
+}
+
+// Validate checks the metrics config
+func (c *MetricsConfig) Validate() error {
+	switch c.Sink {
+	case MetricsInmem, MetricsPrometheus:
+		if c.Address != "" {
+			return fmt.Errorf("address is only used by the statsd and statsite sinks")
+		}
+	case MetricsStatsd, MetricsStatsite:
+		if c.Address == "" {
+			return fmt.Errorf("%s sink requires an address", c.Sink)
+		}
+
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return fmt.Errorf("invalid %s address: %s", c.Sink, err)
+		}
+	default:
+		return fmt.Errorf("unknown metrics sink %q; expected inmem, prometheus, statsd or statsite", c.Sink)
+	}
+
+	if c.Interval < 0 || c.Retain < 0 {
+		return fmt.Errorf("metrics interval and retain cannot be negative")
+	}
+
+	return nil
+}
+
+// metricsSink wraps the configured sink so it can be shut down while
+// metrics are still being emitted
+type metricsSink struct {
+	mu       sync.RWMutex
+	sink     metrics.MetricSink
+	stopped  bool
+	shutdown func()
+}
+
+func newMetricsSink(cfg *MetricsConfig) (*metricsSink, error) {
+	s := &metricsSink{}
+
+	switch cfg.Sink {
+	case MetricsInmem:
+		interval, retain := cfg.Interval, cfg.Retain
+		if interval == 0 {
+			interval = defaultMetricsInterval
+		}
+
+		if retain == 0 {
+			retain = defaultMetricsRetain
+		}
+
+		inm := metrics.NewInmemSink(interval, retain)
+		sig := metrics.DefaultInmemSignal(inm)
+		s.sink, s.shutdown = inm, sig.Stop
+	case MetricsPrometheus:
+		s.sink = NewPrometheusSink()
+	case MetricsStatsd:
+		sink, err := metrics.NewStatsdSink(cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		s.sink, s.shutdown = sink, sink.Shutdown
+	case MetricsStatsite:
+		sink, err := metrics.NewStatsiteSink(cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		s.sink, s.shutdown = sink, sink.Shutdown
+	}
+
+	return s, nil
+}
+
+func (s *metricsSink) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+
+	if s.shutdown != nil {
+		s.shutdown()
+	}
+}
+
+func (s *metricsSink) emit(fn func(sink metrics.MetricSink)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.stopped {
+		fn(s.sink)
+	}
+}
+
+func (s *metricsSink) SetGauge(key []string, val float32) {
+	s.emit(func(sink metrics.MetricSink) { sink.SetGauge(key, val) })
+}
+
+func (s *metricsSink) EmitKey(key []string, val float32) {
+	s.emit(func(sink metrics.MetricSink) { sink.EmitKey(key, val) })
+}
+
+func (s *metricsSink) IncrCounter(key []string, val float32) {
+	s.emit(func(sink metrics.MetricSink) { sink.IncrCounter(key, val) })
+}
+
+func (s *metricsSink) AddSample(key []string, val float32) {
+	s.emit(func(sink metrics.MetricSink) { sink.AddSample(key, val) })
+}
+
+var (
+	globalSinkLock sync.RWMutex
+	globalSinks    = map[*Discover]metrics.MetricSink{}
+)
+
+// init replaces the go-metrics global before any serf or memberlist
+// goroutine reads it; it is a plain variable, so afterwards only globalSinks
+// changes
+func init() {
+	metrics.NewGlobal(&metrics.Config{TimerGranularity: time.Millisecond}, globalSink{})
+}
+
+// globalSink fans the metrics that serf and memberlist send to the
+// go-metrics global out to the sink of every running Discover.  Their keys
+// do not say which Discover sent them, so with several in a process, such
+// as a testcluster or segments, every sink counts the serf and memberlist
+// metrics of all of them.
+type globalSink struct{}
+
+func (globalSink) each(fn func(sink metrics.MetricSink)) {
+	globalSinkLock.RLock()
+	defer globalSinkLock.RUnlock()
+
+	for _, s := range globalSinks {
+		fn(s)
+	}
+}
+
+func (g globalSink) SetGauge(key []string, val float32) {
+	g.each(func(s metrics.MetricSink) { s.SetGauge(key, val) })
+}
+
+func (g globalSink) EmitKey(key []string, val float32) {
+	g.each(func(s metrics.MetricSink) { s.EmitKey(key, val) })
+}
+
+func (g globalSink) IncrCounter(key []string, val float32) {
+	g.each(func(s metrics.MetricSink) { s.IncrCounter(key, val) })
+}
+
+func (g globalSink) AddSample(key []string, val float32) {
+	g.each(func(s metrics.MetricSink) { s.AddSample(key, val) })
+}
+
+func newMetrics(service string, sink metrics.MetricSink) *metrics.Metrics {
+	m, _ := metrics.New(&metrics.Config{
+		ServiceName:      service,
+		TimerGranularity: time.Millisecond,
+	}, sink)
+
+	return m
+}
+
+// startMetrics creates the sink and starts reporting gauges; segments use
+// the sink of their Discover
+func (d *Discover) startMetrics() error {
+	if d.metricsConfig != nil {
+		sink, err := newMetricsSink(d.metricsConfig)
+		if err != nil {
+			return err
+		}
+		d.metricsSink = sink
+		d.metrics = newMetrics(metricsPrefix, sink)
+
+		globalSinkLock.Lock()
+		globalSinks[d] = sink
+		globalSinkLock.Unlock()
+	}
+
+	if d.metricsSink == nil {
+		return nil
+	}
+
+	go d.reportGauges()
+
+	return nil
+}
+
+// stopMetrics stops sending serf and memberlist metrics to the sink and
+// shuts it down
+func (d *Discover) stopMetrics() {
+	if d.metricsConfig == nil || d.metricsSink == nil {
+		return
+	}
+
+	globalSinkLock.Lock()
+	delete(globalSinks, d)
+	globalSinkLock.Unlock()
+
+	d.metricsSink.stop()
+}
+
+// segmentMetrics sends the metrics of segment s to the sink of d
+func (d *Discover) segmentMetrics(s *Discover, name string) {
+	if d.metricsSink == nil {
+		return
+	}
+
+	s.metricsSink = d.metricsSink
+	s.metrics = newMetrics(metricsPrefix+".segment."+name, d.metricsSink)
+}
+
+// Metrics returns the sink metrics are sent to, or nil when metrics are
+// off.  The API serves *metrics.InmemSink and *PrometheusSink.
+func (d *Discover) Metrics() metrics.MetricSink {
+	if d.metricsSink == nil {
+		return nil
+	}
+
+	return d.metricsSink.sink
+}
+
+func (d *Discover) reportGauges() {
+	t := time.NewTicker(gaugeInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			d.emitGauges()
+		case <-d.stopCh:
+			return
+		}
+	}
+}
+
+// emitGauges reports the member counts by status and the queue depths
+func (d *Discover) emitGauges() {
+	counts := map[serf.MemberStatus]int{
+		serf.StatusAlive:   0,
+		serf.StatusLeaving: 0,
+		serf.StatusLeft:    0,
+		serf.StatusFailed:  0,
+	}
+	for _, m := range d.Members() {
+		counts[m.Status]++
+	}
+
+	for status, n := range counts {
+		d.metrics.SetGauge([]string{"members", status.String()}, float32(n))
+	}
+
+	d.metrics.SetGauge([]string{"queue", "broadcasts"}, float32(d.broadcasts.NumQueued()))
+
+	pending, held, events := d.chaos.queued()
+	d.metrics.SetGauge([]string{"queue", "chaos_outbound"}, float32(pending))
+	d.metrics.SetGauge([]string{"queue", "chaos_inbound"}, float32(held))
+	d.metrics.SetGauge([]string{"queue", "frozen_events"}, float32(events))
+}
+
+// decodeError counts a message or state that could not be decoded
+func (d *Discover) decodeError(kind string) {
+	d.metrics.IncrCounter([]string{"decode_errors", kind}, 1)
+}
+
+// eventKey returns the metric key of an event; user events and queries
+// include their name
+func eventKey(evt serf.Event) []string {
+	switch e := evt.(type) {
+	case serf.UserEvent:
+		return []string{"user", e.Name}
+	case *serf.Query:
+		return []string{"query", e.Name}
+	}
+
+	return []string{EventTypeName(evt.EventType())}
+}
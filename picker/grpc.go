@@ -0,0 +1,162 @@
+package picker
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+// The types below mirror the shapes of the grpc resolver and balancer
+// packages so that a Picker can back a grpc client with a thin adapter and
+// without this package depending on grpc.
+
+// Address is a resolved member address like grpc's resolver.Address
+type Address struct {
+	// Addr is host:port
+	Addr string
+	// ServerName is the member name
+	ServerName string
+	// Attributes are the member tags
+	Attributes map[string]string
+}
+
+// ClientConn receives address updates like grpc's resolver.ClientConn
+type ClientConn interface {
+	UpdateState(addrs []Address) error
+}
+
+// Resolver reports the members of a Picker as addresses to a ClientConn
+// like a grpc resolver
+type Resolver struct {
+	p       *Picker
+	portTag string
+	cc      ClientConn
+
+	mu      sync.Mutex
+	closed  bool
+	unwatch func()
+}
+
+// NewResolver returns a resolver that sends the addresses of the picker
+// members to cc now and after every change.  The port of each address is
+// read from the member tag portTag; members without it use their gossip
+// port.
+func NewResolver(p *Picker, portTag string, cc ClientConn) *Resolver {
+	r := &Resolver{
+		p:       p,
+		portTag: portTag,
+		cc:      cc,
+	}
+
+	r.mu.Lock()
+	r.unwatch = p.Watch(r.update)
+	r.mu.Unlock()
+
+	r.ResolveNow()
+
+	return r
+}
+
+// ResolveNow sends the current addresses to the ClientConn
+func (r *Resolver) ResolveNow() {
+	r.update(r.p.Members())
+}
+
+// Close stops sending updates
+func (r *Resolver) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	r.unwatch()
+}
+
+func (r *Resolver) update(members []serf.Member) {
+	addrs := make([]Address, 0, len(members))
+	for _, m := range members {
+		addrs = append(addrs, memberAddress(m, r.portTag))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	if err := r.cc.UpdateState(addrs); err != nil {
+		logrus.Warnf("picker: error updating resolver state: %s", err)
+	}
+}
+
+func memberAddress(m serf.Member, portTag string) Address {
+	port := strconv.Itoa(int(m.Port))
+	if v, ok := m.Tags[portTag]; ok && portTag != "" {
+		port = v
+	}
+
+	return Address{
+		Addr:       net.JoinHostPort(m.Addr.String(), port),
+		ServerName: m.Name,
+		Attributes: m.Tags,
+	}
+}
+
+// PickInfo describes the call being balanced like grpc's balancer.PickInfo
+type PickInfo struct {
+	FullMethodName string
+	Ctx            context.Context
+}
+
+// DoneInfo is the outcome of a call like grpc's balancer.DoneInfo
+type DoneInfo struct {
+	Err error
+}
+
+// PickResult is the address for a call like grpc's balancer.PickResult.
+// Done must be called when the call finishes.
+type PickResult struct {
+	Addr Address
+	Done func(info DoneInfo)
+}
+
+// Balancer picks an address for every call like grpc's balancer.Picker
+type Balancer struct {
+	p       *Picker
+	portTag string
+}
+
+// NewBalancer returns a balancer over the picker members; portTag is used
+// as with NewResolver
+func NewBalancer(p *Picker, portTag string) *Balancer {
+	return &Balancer{
+		p:       p,
+		portTag: portTag,
+	}
+}
+
+// Pick picks the address for a call.  It returns ErrNoMembers when there is
+// no member to call.
+func (b *Balancer) Pick(info PickInfo) (PickResult, error) {
+	if info.Ctx != nil {
+		if err := info.Ctx.Err(); err != nil {
+			return PickResult{}, err
+		}
+	}
+
+	res, err := b.p.Pick()
+	if err != nil {
+		return PickResult{}, err
+	}
+
+	return PickResult{
+		Addr: memberAddress(res.Member, b.portTag),
+		Done: func(info DoneInfo) {
+			res.Done(info.Err)
+		},
+	}, nil
+}
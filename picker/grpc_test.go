@@ -0,0 +1,103 @@
+package picker
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClientConn records the address updates
+type testClientConn struct {
+	mu      sync.Mutex
+	updates [][]Address
+}
+
+func (c *testClientConn) UpdateState(addrs []Address) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.updates = append(c.updates, addrs)
+
+	return nil
+}
+
+func (c *testClientConn) last() []Address {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.updates) == 0 {
+		return nil
+	}
+
+	return c.updates[len(c.updates)-1]
+}
+
+func addrs(a []Address) []string {
+	s := []string{}
+	for _, addr := range a {
+		s = append(s, addr.ServerName+"="+addr.Addr)
+	}
+
+	return s
+}
+
+func TestResolver(t *testing.T) {
+	src := NewStatic("local", testMember("a", "grpc_port", "9000"), testMember("b"))
+	p := newTestPicker(t, src, &Config{})
+
+	cc := &testClientConn{}
+	r := NewResolver(p, "grpc_port", cc)
+	defer r.Close()
+
+	expected := []string{"a=127.0.0.1:9000", "b=127.0.0.1:7946"}
+	if got := addrs(cc.last()); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v; got %v", expected, got)
+	}
+
+	src.SetMembers(testMember("b"))
+
+	deadline := time.Now().Add(time.Second * 5)
+	for !reflect.DeepEqual(addrs(cc.last()), []string{"b=127.0.0.1:7946"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the update; got %v", addrs(cc.last()))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	r.Close()
+	n := len(cc.updates)
+	r.ResolveNow()
+	if len(cc.updates) != n {
+		t.Fatal("expected no updates after close")
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	src := NewStatic("local", testMember("a"), testMember("b"))
+	p := newTestPicker(t, src, &Config{MaxFailures: 1, EjectionTime: time.Hour})
+	b := NewBalancer(p, "")
+
+	res, err := b.Pick(PickInfo{FullMethodName: "/svc/Call", Ctx: context.Background()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Addr.ServerName != "a" || res.Addr.Addr != "127.0.0.1:7946" {
+		t.Fatalf("unexpected address: %+v", res.Addr)
+	}
+
+	// failed calls count towards ejection
+	res.Done(DoneInfo{Err: errCall})
+	if ejected := p.Ejected(); !reflect.DeepEqual(ejected, []string{"a"}) {
+		t.Fatalf("expected a to be ejected; got %v", ejected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := b.Pick(PickInfo{Ctx: ctx}); err != context.Canceled {
+		t.Fatalf("expected the context error; got %v", err)
+	}
+}
@@ -0,0 +1,527 @@
+// Package picker selects cluster members for outbound calls.
+//
+// A Picker follows membership events and picks a live member that matches
+// the configured tags using round-robin, random, power-of-two-choices or
+// least-RTT selection.  Callers report the outcome of each call and members
+// that keep failing are ejected for a while.
+package picker
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxFailures        = 5
+	defaultEjectionTime       = time.Second * 30
+	defaultMaxEjectionTime    = time.Minute * 5
+	defaultMaxEjectionPercent = 50
+)
+
+var (
+	// ErrNoMembers is returned when no member matches
+	ErrNoMembers = errors.New("no members available")
+
+	errUnknownRTT = errors.New("unknown rtt")
+)
+
+// Strategy selects a member among the candidates
+type Strategy int
+
+const (
+	// RoundRobin cycles through the members in name order
+	RoundRobin Strategy = iota
+	// Random picks a member at random
+	Random
+	// PowerOfTwo picks two members at random and uses the one with fewer
+	// calls in flight
+	PowerOfTwo
+	// LeastRTT picks the member with the lowest estimated round trip time.
+	// Members with the same estimate are used in turn and it falls back to
+	// round-robin when no estimates are known.
+	LeastRTT
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case RoundRobin:
+		return "round-robin"
+	case Random:
+		return "random"
+	case PowerOfTwo:
+		return "power-of-two"
+	case LeastRTT:
+		return "least-rtt"
+	}
+
+	return fmt.Sprintf("strategy(%d)", int(s))
+}
+
+// ParseStrategy returns the strategy with the name
+func ParseStrategy(s string) (Strategy, error) {
+	for _, v := range []Strategy{RoundRobin, Random, PowerOfTwo, LeastRTT} {
+		if v.String() == s {
+			return v, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown strategy %q", s)
+}
+
+// Config configures a Picker
+type Config struct {
+	Strategy Strategy
+	// Tags limits the picker to members with all of the tags
+	Tags map[string]string
+	// Filter further limits the picker to the members for which it returns
+	// true
+	Filter func(m serf.Member) bool
+	// MaxFailures is the number of consecutive failures that eject a
+	// member; defaults to 5
+	MaxFailures int
+	// EjectionTime is how long a member is first ejected for.  Every
+	// further ejection without a success in between adds the same time
+	// again up to MaxEjectionTime.  Defaults to 30s and 5m.
+	EjectionTime    time.Duration
+	MaxEjectionTime time.Duration
+	// MaxEjectionPercent limits the share of members that can be ejected at
+	// once; defaults to 50
+	MaxEjectionPercent int
+	// DisableEjection turns outlier ejection off
+	DisableEjection bool
+}
+
+type member struct {
+	member serf.Member
+	rtt    time.Duration
+	known  bool
+
+	inflight     int
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+func (m *member) ejected(now time.Time) bool {
+	return now.Before(m.ejectedUntil)
+}
+
+// Picker picks members for outbound calls
+type Picker struct {
+	src Source
+	cfg Config
+
+	mu        sync.Mutex
+	members   []*member
+	next      int
+	rand      *rand.Rand
+	watchers  map[int]func(members []serf.Member)
+	watcherID int
+
+	updateCh    chan struct{}
+	stopCh      chan struct{}
+	unsubscribe func()
+	closeOnce   sync.Once
+}
+
+// New returns a picker that is kept in sync with the members of src, which
+// is usually a *libdiscover.Discover
+func New(src Source, cfg *Config) *Picker {
+	p := &Picker{
+		src:      src,
+		cfg:      *cfg,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		watchers: map[int]func(members []serf.Member){},
+		updateCh: make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+	}
+
+	if p.cfg.MaxFailures <= 0 {
+		p.cfg.MaxFailures = defaultMaxFailures
+	}
+
+	if p.cfg.EjectionTime <= 0 {
+		p.cfg.EjectionTime = defaultEjectionTime
+	}
+
+	if p.cfg.MaxEjectionTime <= 0 {
+		p.cfg.MaxEjectionTime = defaultMaxEjectionTime
+	}
+
+	if p.cfg.MaxEjectionPercent <= 0 {
+		p.cfg.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+
+	p.update()
+
+	p.unsubscribe = src.Subscribe(func(evt serf.Event) {
+		if _, ok := evt.(serf.MemberEvent); !ok {
+			return
+		}
+
+		// coalesce updates; the picker is rebuilt from the full member list
+		select {
+		case p.updateCh <- struct{}{}:
+		default:
+		}
+	})
+
+	go p.run()
+
+	return p
+}
+
+// Close stops following membership changes
+func (p *Picker) Close() {
+	p.closeOnce.Do(func() {
+		p.unsubscribe()
+		close(p.stopCh)
+	})
+}
+
+// Watch calls fn with the members after every change in the member set.
+// The returned func stops the watch.
+func (p *Picker) Watch(fn func(members []serf.Member)) func() {
+	p.mu.Lock()
+	id := p.watcherID
+	p.watcherID++
+	p.watchers[id] = fn
+	p.mu.Unlock()
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		delete(p.watchers, id)
+	}
+}
+
+// Members returns the members the picker chooses from sorted by name,
+// including ejected members
+func (p *Picker) Members() []serf.Member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.list()
+}
+
+// Ejected returns the names of the members that are currently ejected
+func (p *Picker) Ejected() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	names := []string{}
+	for _, m := range p.members {
+		if m.ejected(now) {
+			names = append(names, m.member.Name)
+		}
+	}
+
+	return names
+}
+
+// Result is a picked member.  Done must be called once the call finishes.
+type Result struct {
+	Member serf.Member
+
+	p    *Picker
+	once sync.Once
+}
+
+// Done reports the outcome of the call; a non-nil error counts towards
+// ejecting the member
+func (r *Result) Done(err error) {
+	r.once.Do(func() {
+		r.p.mu.Lock()
+		defer r.p.mu.Unlock()
+
+		// the member set may have been rebuilt since the pick
+		if m := r.p.lookup(r.Member.Name); m != nil {
+			if m.inflight > 0 {
+				m.inflight--
+			}
+			r.p.report(m, err)
+		}
+	})
+}
+
+// Pick picks a member for a call
+func (p *Picker) Pick() (*Result, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	candidates := p.available(time.Now())
+	if len(candidates) == 0 {
+		return nil, ErrNoMembers
+	}
+
+	var m *member
+	switch p.cfg.Strategy {
+	case Random:
+		m = candidates[p.rand.Intn(len(candidates))]
+	case PowerOfTwo:
+		m = p.powerOfTwo(candidates)
+	case LeastRTT:
+		m = p.leastRTT(candidates)
+	default:
+		m = p.roundRobin(candidates)
+	}
+
+	m.inflight++
+
+	return &Result{Member: m.member, p: p}, nil
+}
+
+// Report reports the outcome of a call to the member that was not made
+// through Pick
+func (p *Picker) Report(name string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if m := p.lookup(name); m != nil {
+		p.report(m, err)
+	}
+}
+
+func (p *Picker) lookup(name string) *member {
+	for _, m := range p.members {
+		if m.member.Name == name {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// report counts failures and ejects the member after MaxFailures in a row
+func (p *Picker) report(m *member, err error) {
+	if err == nil {
+		m.failures = 0
+		if !m.ejected(time.Now()) {
+			m.ejections = 0
+		}
+		return
+	}
+
+	m.failures++
+	if p.cfg.DisableEjection || m.failures < p.cfg.MaxFailures {
+		return
+	}
+
+	now := time.Now()
+	if m.ejected(now) {
+		return
+	}
+
+	ejected := 0
+	for _, o := range p.members {
+		if o.ejected(now) {
+			ejected++
+		}
+	}
+
+	if (ejected+1)*100 > len(p.members)*p.cfg.MaxEjectionPercent {
+		logrus.Debugf("picker: not ejecting %s: too many members ejected", m.member.Name)
+		return
+	}
+
+	m.ejections++
+	d := p.cfg.EjectionTime * time.Duration(m.ejections)
+	if d > p.cfg.MaxEjectionTime {
+		d = p.cfg.MaxEjectionTime
+	}
+
+	m.failures = 0
+	m.ejectedUntil = now.Add(d)
+
+	logrus.Debugf("picker: ejecting %s for %s", m.member.Name, d)
+}
+
+// available returns the members that are not ejected.  When every member
+// is ejected all of them are used instead of failing.
+func (p *Picker) available(now time.Time) []*member {
+	candidates := make([]*member, 0, len(p.members))
+	for _, m := range p.members {
+		if !m.ejected(now) {
+			candidates = append(candidates, m)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return p.members
+	}
+
+	return candidates
+}
+
+func (p *Picker) roundRobin(candidates []*member) *member {
+	m := candidates[p.next%len(candidates)]
+	p.next++
+
+	return m
+}
+
+func (p *Picker) powerOfTwo(candidates []*member) *member {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	i := p.rand.Intn(len(candidates))
+	j := p.rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := candidates[i], candidates[j]
+	if b.inflight < a.inflight {
+		return b
+	}
+
+	return a
+}
+
+func (p *Picker) leastRTT(candidates []*member) *member {
+	best := []*member{}
+	for _, m := range candidates {
+		if !m.known {
+			continue
+		}
+
+		if len(best) == 0 || m.rtt < best[0].rtt {
+			best = append(best[:0], m)
+		} else if m.rtt == best[0].rtt {
+			best = append(best, m)
+		}
+	}
+
+	if len(best) == 0 {
+		return p.roundRobin(candidates)
+	}
+
+	return p.roundRobin(best)
+}
+
+func (p *Picker) run() {
+	// estimates change without membership events
+	t := time.NewTicker(time.Second * 5)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.updateCh:
+			p.update()
+		case <-t.C:
+			if p.cfg.Strategy == LeastRTT {
+				p.update()
+			}
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+func (p *Picker) match(m serf.Member) bool {
+	if m.Status != serf.StatusAlive {
+		return false
+	}
+
+	for k, v := range p.cfg.Tags {
+		if m.Tags[k] != v {
+			return false
+		}
+	}
+
+	return p.cfg.Filter == nil || p.cfg.Filter(m)
+}
+
+// update rebuilds the member set keeping the state of known members
+func (p *Picker) update() {
+	rtt, _ := p.src.(rttSource)
+
+	members := []*member{}
+	for _, sm := range p.src.Members() {
+		if !p.match(sm) {
+			continue
+		}
+
+		m := &member{member: sm}
+		if rtt != nil {
+			if d, err := rtt.RTT(rtt.Name(), sm.Name); err == nil {
+				m.rtt = d
+				m.known = true
+			}
+		}
+
+		members = append(members, m)
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].member.Name < members[j].member.Name
+	})
+
+	p.mu.Lock()
+	current := map[string]*member{}
+	for _, m := range p.members {
+		current[m.member.Name] = m
+	}
+
+	changed := len(members) != len(p.members)
+	for i, m := range members {
+		if cur, ok := current[m.member.Name]; ok {
+			m.inflight = cur.inflight
+			m.failures = cur.failures
+			m.ejections = cur.ejections
+			m.ejectedUntil = cur.ejectedUntil
+		}
+
+		if !changed && !sameMember(p.members[i].member, m.member) {
+			changed = true
+		}
+	}
+
+	p.members = members
+
+	watchers := []func(members []serf.Member){}
+	if changed {
+		for _, fn := range p.watchers {
+			watchers = append(watchers, fn)
+		}
+	}
+	list := p.list()
+	p.mu.Unlock()
+
+	for _, fn := range watchers {
+		fn(list)
+	}
+}
+
+func (p *Picker) list() []serf.Member {
+	list := make([]serf.Member, len(p.members))
+	for i, m := range p.members {
+		list[i] = m.member
+	}
+
+	return list
+}
+
+func sameMember(a, b serf.Member) bool {
+	if a.Name != b.Name || !a.Addr.Equal(b.Addr) || a.Port != b.Port || len(a.Tags) != len(b.Tags) {
+		return false
+	}
+
+	for k, v := range a.Tags {
+		if b.Tags[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,323 @@
+package picker
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+var errCall = errors.New("call failed")
+
+// testMember returns an alive member with the tags given as key, value pairs
+func testMember(name string, tags ...string) serf.Member {
+	m := serf.Member{
+		Name:   name,
+		Addr:   net.ParseIP("127.0.0.1"),
+		Port:   7946,
+		Tags:   map[string]string{},
+		Status: serf.StatusAlive,
+	}
+
+	for i := 0; i+1 < len(tags); i += 2 {
+		m.Tags[tags[i]] = tags[i+1]
+	}
+
+	return m
+}
+
+// picks returns the names of the next n picks; every call succeeds
+func picks(t *testing.T, p *Picker, n int) []string {
+	t.Helper()
+
+	names := []string{}
+	for i := 0; i < n; i++ {
+		res, err := p.Pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, res.Member.Name)
+		res.Done(nil)
+	}
+
+	return names
+}
+
+func newTestPicker(t *testing.T, src Source, cfg *Config) *Picker {
+	p := New(src, cfg)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func TestParseStrategy(t *testing.T) {
+	for _, s := range []Strategy{RoundRobin, Random, PowerOfTwo, LeastRTT} {
+		v, err := ParseStrategy(s.String())
+		if err != nil || v != s {
+			t.Fatalf("expected %s; got %s, %v", s, v, err)
+		}
+	}
+
+	if _, err := ParseStrategy("fastest"); err == nil {
+		t.Fatal("expected an error for an unknown strategy")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	failed := testMember("d", "role", "web")
+	failed.Status = serf.StatusFailed
+
+	src := NewStatic("local",
+		testMember("c", "role", "web"),
+		testMember("a", "role", "web"),
+		testMember("b", "role", "web"),
+		testMember("e", "role", "db"),
+		failed,
+	)
+	p := newTestPicker(t, src, &Config{Tags: map[string]string{"role": "web"}})
+
+	expected := []string{"a", "b", "c", "a", "b", "c"}
+	if names := picks(t, p, 6); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v; got %v", expected, names)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	src := NewStatic("local", testMember("a"), testMember("b"))
+	p := newTestPicker(t, src, &Config{
+		Filter: func(m serf.Member) bool {
+			return m.Name != "a"
+		},
+	})
+
+	if names := picks(t, p, 2); !reflect.DeepEqual(names, []string{"b", "b"}) {
+		t.Fatalf("expected only b; got %v", names)
+	}
+}
+
+func TestNoMembers(t *testing.T) {
+	p := newTestPicker(t, NewStatic("local"), &Config{})
+
+	if _, err := p.Pick(); err != ErrNoMembers {
+		t.Fatalf("expected ErrNoMembers; got %v", err)
+	}
+}
+
+func TestEjection(t *testing.T) {
+	src := NewStatic("local", testMember("a"), testMember("b"), testMember("c"))
+	p := newTestPicker(t, src, &Config{
+		MaxFailures:  2,
+		EjectionTime: time.Hour,
+	})
+
+	p.Report("b", errCall)
+	if len(p.Ejected()) != 0 {
+		t.Fatal("expected no member to be ejected after one failure")
+	}
+
+	p.Report("b", errCall)
+	if ejected := p.Ejected(); !reflect.DeepEqual(ejected, []string{"b"}) {
+		t.Fatalf("expected b to be ejected; got %v", ejected)
+	}
+
+	for _, name := range picks(t, p, 4) {
+		if name == "b" {
+			t.Fatal("expected the ejected member not to be picked")
+		}
+	}
+
+	// a second ejection would be more than half of the members
+	p.Report("a", errCall)
+	p.Report("a", errCall)
+	if ejected := p.Ejected(); !reflect.DeepEqual(ejected, []string{"b"}) {
+		t.Fatalf("expected only b to be ejected; got %v", ejected)
+	}
+
+	// failures must be consecutive
+	p.Report("c", errCall)
+	p.Report("c", nil)
+	p.Report("c", errCall)
+	if ejected := p.Ejected(); !reflect.DeepEqual(ejected, []string{"b"}) {
+		t.Fatalf("expected only b to be ejected; got %v", ejected)
+	}
+}
+
+func TestEjectionDisabled(t *testing.T) {
+	src := NewStatic("local", testMember("a"), testMember("b"))
+	p := newTestPicker(t, src, &Config{MaxFailures: 1, DisableEjection: true})
+
+	p.Report("a", errCall)
+	if len(p.Ejected()) != 0 {
+		t.Fatal("expected no member to be ejected")
+	}
+}
+
+func TestAllEjected(t *testing.T) {
+	src := NewStatic("local", testMember("a"))
+	p := newTestPicker(t, src, &Config{
+		MaxFailures:        1,
+		EjectionTime:       time.Hour,
+		MaxEjectionPercent: 100,
+	})
+
+	res, err := p.Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Done(errCall)
+
+	if ejected := p.Ejected(); !reflect.DeepEqual(ejected, []string{"a"}) {
+		t.Fatalf("expected a to be ejected; got %v", ejected)
+	}
+
+	// ejected members are used rather than failing every call
+	if names := picks(t, p, 1); names[0] != "a" {
+		t.Fatalf("expected a; got %v", names)
+	}
+}
+
+func TestEjectionExpires(t *testing.T) {
+	src := NewStatic("local", testMember("a"), testMember("b"))
+	p := newTestPicker(t, src, &Config{
+		MaxFailures:  1,
+		EjectionTime: time.Millisecond * 50,
+	})
+
+	p.Report("a", errCall)
+	if len(p.Ejected()) != 1 {
+		t.Fatal("expected a to be ejected")
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	if len(p.Ejected()) != 0 {
+		t.Fatal("expected the ejection to expire")
+	}
+}
+
+func TestPowerOfTwo(t *testing.T) {
+	src := NewStatic("local", testMember("a"), testMember("b"))
+	p := newTestPicker(t, src, &Config{Strategy: PowerOfTwo})
+
+	// with two members both are compared and the idle one wins
+	first, err := p.Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		res, err := p.Pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.Member.Name == first.Member.Name {
+			t.Fatalf("expected the member without calls in flight; got %s", res.Member.Name)
+		}
+		res.Done(nil)
+	}
+
+	first.Done(nil)
+}
+
+func TestRandom(t *testing.T) {
+	src := NewStatic("local", testMember("a"), testMember("b"), testMember("c"))
+	p := newTestPicker(t, src, &Config{Strategy: Random})
+
+	seen := map[string]bool{}
+	for _, name := range picks(t, p, 100) {
+		seen[name] = true
+	}
+
+	if len(seen) != 3 {
+		t.Fatalf("expected every member to be picked; got %v", seen)
+	}
+}
+
+func TestLeastRTT(t *testing.T) {
+	src := NewStatic("local", testMember("a"), testMember("b"), testMember("c"))
+	src.SetRTT("a", time.Millisecond*10)
+	src.SetRTT("b", time.Millisecond)
+	src.SetRTT("c", time.Millisecond)
+
+	p := newTestPicker(t, src, &Config{Strategy: LeastRTT})
+
+	expected := []string{"b", "c", "b", "c"}
+	if names := picks(t, p, 4); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected the closest members in turn; got %v", names)
+	}
+}
+
+func TestLeastRTTUnknown(t *testing.T) {
+	src := NewStatic("local", testMember("a"), testMember("b"))
+	p := newTestPicker(t, src, &Config{Strategy: LeastRTT})
+
+	expected := []string{"a", "b", "a"}
+	if names := picks(t, p, 3); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected round-robin without estimates; got %v", names)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	src := NewStatic("local", testMember("a"))
+	p := newTestPicker(t, src, &Config{MaxFailures: 1, EjectionTime: time.Hour, MaxEjectionPercent: 100})
+
+	ch := make(chan []serf.Member, 4)
+	unwatch := p.Watch(func(members []serf.Member) {
+		ch <- members
+	})
+	defer unwatch()
+
+	p.Report("a", errCall)
+
+	src.SetMembers(testMember("a"), testMember("b"))
+
+	select {
+	case members := <-ch:
+		if len(members) != 2 || members[0].Name != "a" || members[1].Name != "b" {
+			t.Fatalf("unexpected members: %v", members)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the member update")
+	}
+
+	// members keep their state across updates
+	if ejected := p.Ejected(); !reflect.DeepEqual(ejected, []string{"a"}) {
+		t.Fatalf("expected a to stay ejected; got %v", ejected)
+	}
+
+	// an unchanged member set is not reported
+	src.SetMembers(testMember("a"), testMember("b"))
+
+	select {
+	case members := <-ch:
+		t.Fatalf("unexpected update: %v", members)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestDoneAfterRemoval(t *testing.T) {
+	src := NewStatic("local", testMember("a"), testMember("b"))
+	p := newTestPicker(t, src, &Config{})
+
+	res, err := p.Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan []serf.Member, 1)
+	unwatch := p.Watch(func(members []serf.Member) {
+		ch <- members
+	})
+	defer unwatch()
+
+	src.SetMembers(testMember("b"))
+	<-ch
+
+	// the member is gone; reporting it must not fail
+	res.Done(errCall)
+	res.Done(errCall)
+}
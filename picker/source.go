@@ -0,0 +1,123 @@
+package picker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// Source provides the members to pick from and reports membership changes.
+// *libdiscover.Discover is a Source.
+type Source interface {
+	Members() []serf.Member
+	Subscribe(fn func(e serf.Event)) func()
+}
+
+// rttSource is implemented by sources that can estimate latency, such as
+// *libdiscover.Discover
+type rttSource interface {
+	Name() string
+	RTT(a, b string) (time.Duration, error)
+}
+
+// Static is a Source with a fixed set of members that can be replaced.  It
+// needs no network and is meant for tests and static configuration.
+type Static struct {
+	mu          sync.RWMutex
+	name        string
+	members     []serf.Member
+	rtt         map[string]time.Duration
+	subscribers map[int]func(e serf.Event)
+	nextID      int
+}
+
+// NewStatic returns a source with the members; name is the local member
+// used for RTT estimates
+func NewStatic(name string, members ...serf.Member) *Static {
+	return &Static{
+		name:        name,
+		members:     members,
+		rtt:         map[string]time.Duration{},
+		subscribers: map[int]func(e serf.Event){},
+	}
+}
+
+func (s *Static) Name() string {
+	return s.name
+}
+
+func (s *Static) Members() []serf.Member {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]serf.Member(nil), s.members...)
+}
+
+func (s *Static) Subscribe(fn func(e serf.Event)) func() {
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID++
+	s.subscribers[id] = fn
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.subscribers, id)
+	}
+}
+
+// SetMembers replaces the members and notifies subscribers
+func (s *Static) SetMembers(members ...serf.Member) {
+	s.mu.Lock()
+	s.members = members
+	subscribers := make([]func(e serf.Event), 0, len(s.subscribers))
+	for _, fn := range s.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	s.mu.Unlock()
+
+	evt := serf.MemberEvent{
+		Type:    serf.EventMemberUpdate,
+		Members: members,
+	}
+	for _, fn := range subscribers {
+		fn(evt)
+	}
+}
+
+// SetRTT sets the estimated round trip time from the local member to a
+// member
+func (s *Static) SetRTT(name string, rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rtt[name] = rtt
+}
+
+// RTT returns the round trip time set with SetRTT; only times from the
+// local member are known
+func (s *Static) RTT(a, b string) (time.Duration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if a == b {
+		return 0, nil
+	}
+
+	other := b
+	if b == s.name {
+		other = a
+	} else if a != s.name {
+		return 0, errUnknownRTT
+	}
+
+	rtt, ok := s.rtt[other]
+	if !ok {
+		return 0, errUnknownRTT
+	}
+
+	return rtt, nil
+}
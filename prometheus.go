@@ -0,0 +1,308 @@
+package libdiscover
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxLabelValues caps the distinct names kept per metric; further
+	// names are counted as otherLabelValue
+	maxLabelValues  = 256
+	otherLabelValue = "other"
+
+	segmentPrefix = metricsPrefix + ".segment."
+)
+
+// promLabelKeys are the keys that end in a name, such as the name of a user
+// event; the name is reported in the name label of the metric rather than
+// in its name
+var promLabelKeys = []struct {
+	prefix []string
+	metric string
+}{
+	{[]string{metricsPrefix, "events", "sent"}, ""},
+	{[]string{metricsPrefix, "events", "received", "user"}, ""},
+	{[]string{metricsPrefix, "events", "received", "query"}, ""},
+	// the names of metrics that are also reported without a name are
+	// suffixed so that both can be summed
+	{[]string{metricsPrefix, "handler", "errors", "query"}, metricsPrefix + "_handler_errors_query_by_name"},
+	{[]string{"serf", "events"}, "serf_events_by_name"},
+	{[]string{"serf", "queries"}, "serf_queries_by_name"},
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// PrometheusSink is a metrics sink that keeps the current values and
+// serves them in the Prometheus text format.  The go-metrics keys have no
+// labels, so the names in keys, such as user event names, are moved to a
+// name label and segment metrics get a segment label.  At most 256
+// distinct names are kept per metric.
+type PrometheusSink struct {
+	mu       sync.Mutex
+	gauges   map[promSeries]float32
+	counters map[promSeries]float64
+	samples  map[promSeries]*promSummary
+	// names are the distinct name label values per metric
+	names map[string]map[string]bool
+	// owners are the keys each metric name was taken by
+	owners  map[string]string
+	dropped map[string]bool
+}
+
+// promSeries is a metric name and its rendered labels
+type promSeries struct {
+	name   string
+	labels string
+}
+
+type promSummary struct {
+	count int64
+	sum   float64
+}
+
+// NewPrometheusSink returns an empty PrometheusSink
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		gauges:   map[promSeries]float32{},
+		counters: map[promSeries]float64{},
+		samples:  map[promSeries]*promSummary{},
+		names:    map[string]map[string]bool{},
+		owners:   map[string]string{},
+		dropped:  map[string]bool{},
+	}
+}
+
+// promName flattens a key into a valid Prometheus metric name
+func promName(key []string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+			return r
+		}
+
+		return '_'
+	}, strings.Join(key, "_"))
+
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// hasPrefix reports whether key is prefix followed by one more part
+func hasPrefix(key, prefix []string) bool {
+	if len(key) != len(prefix)+1 {
+		return false
+	}
+
+	for i := range prefix {
+		if key[i] != prefix[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// series returns the series of a key and the key that owns its metric
+// name; it must be called with the lock held
+func (p *PrometheusSink) series(key []string) (string, promSeries) {
+	labels := []string{}
+
+	// segment metrics are the libdiscover metrics of the segment
+	if len(key) > 0 && strings.HasPrefix(key[0], segmentPrefix) {
+		labels = append(labels, fmt.Sprintf(`segment="%s"`, promLabelEscaper.Replace(key[0][len(segmentPrefix):])))
+		key = append([]string{metricsPrefix}, key[1:]...)
+	}
+
+	// parts may contain dots, so the owner keeps them apart
+	owner := fmt.Sprintf("%q", key)
+	name := promName(key)
+
+	for _, k := range promLabelKeys {
+		if !hasPrefix(key, k.prefix) {
+			continue
+		}
+
+		owner = fmt.Sprintf("%q", append(k.prefix[:len(k.prefix):len(k.prefix)], "<name>"))
+		name = k.metric
+		if name == "" {
+			name = promName(k.prefix)
+		}
+
+		value := key[len(key)-1]
+		seen, ok := p.names[name]
+		if !ok {
+			seen = map[string]bool{}
+			p.names[name] = seen
+		}
+
+		if !seen[value] {
+			if len(seen) >= maxLabelValues {
+				value = otherLabelValue
+			}
+			seen[value] = true
+		}
+
+		labels = append(labels, fmt.Sprintf(`name="%s"`, promLabelEscaper.Replace(value)))
+		break
+	}
+
+	s := promSeries{name: name}
+	if len(labels) > 0 {
+		sort.Strings(labels)
+		s.labels = "{" + strings.Join(labels, ",") + "}"
+	}
+
+	return owner, s
+}
+
+// claim takes the metric names for a key of the given type; a different
+// key or type that flattens to a taken name is dropped rather than merged
+// into the metric of the other
+func (p *PrometheusSink) claim(typ, owner string, names ...string) bool {
+	owner = typ + " " + owner
+
+	for _, name := range names {
+		if o, ok := p.owners[name]; ok && o != owner {
+			if !p.dropped[owner] {
+				p.dropped[owner] = true
+				logrus.Warnf("dropping metric %s: its name %s is taken by %s", owner, name, o)
+			}
+			return false
+		}
+	}
+
+	for _, name := range names {
+		p.owners[name] = owner
+	}
+
+	return true
+}
+
+func (p *PrometheusSink) SetGauge(key []string, val float32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	owner, s := p.series(key)
+	if p.claim("gauge", owner, s.name) {
+		p.gauges[s] = val
+	}
+}
+
+// EmitKey is reported as a gauge
+func (p *PrometheusSink) EmitKey(key []string, val float32) {
+	p.SetGauge(key, val)
+}
+
+func (p *PrometheusSink) IncrCounter(key []string, val float32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	owner, s := p.series(key)
+	s.name += "_total"
+	if p.claim("counter", owner, s.name) {
+		p.counters[s] += float64(val)
+	}
+}
+
+// AddSample is reported as a summary without quantiles
+func (p *PrometheusSink) AddSample(key []string, val float32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	owner, s := p.series(key)
+	if !p.claim("summary", owner, s.name, s.name+"_sum", s.name+"_count") {
+		return
+	}
+
+	sum, ok := p.samples[s]
+	if !ok {
+		sum = &promSummary{}
+		p.samples[s] = sum
+	}
+	sum.count++
+	sum.sum += float64(val)
+}
+
+// sortSeries returns the series sorted by name and labels
+func sortSeries(series []promSeries) []promSeries {
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+
+		return series[i].labels < series[j].labels
+	})
+
+	return series
+}
+
+// writeType writes the type of a metric before its first series
+func writeType(w io.Writer, series []promSeries, i int, typ string) {
+	if i == 0 || series[i-1].name != series[i].name {
+		fmt.Fprintf(w, "# TYPE %s %s\n", series[i].name, typ)
+	}
+}
+
+// Write writes the metrics in the Prometheus text format
+func (p *PrometheusSink) Write(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	series := []promSeries{}
+	for s := range p.gauges {
+		series = append(series, s)
+	}
+	sortSeries(series)
+
+	for i, s := range series {
+		writeType(bw, series, i, "gauge")
+		fmt.Fprintf(bw, "%s%s %g\n", s.name, s.labels, p.gauges[s])
+	}
+
+	series = series[:0]
+	for s := range p.counters {
+		series = append(series, s)
+	}
+	sortSeries(series)
+
+	for i, s := range series {
+		writeType(bw, series, i, "counter")
+		fmt.Fprintf(bw, "%s%s %g\n", s.name, s.labels, p.counters[s])
+	}
+
+	series = series[:0]
+	for s := range p.samples {
+		series = append(series, s)
+	}
+	sortSeries(series)
+
+	for i, s := range series {
+		writeType(bw, series, i, "summary")
+		sum := p.samples[s]
+		fmt.Fprintf(bw, "%s_sum%s %g\n%s_count%s %d\n", s.name, s.labels, sum.sum, s.name, s.labels, sum.count)
+	}
+
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if err := p.Write(w); err != nil {
+		logrus.Debugf("error writing metrics: %s", err)
+	}
+}
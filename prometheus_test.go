@@ -0,0 +1,91 @@
+package libdiscover
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func promOutput(t *testing.T, p *PrometheusSink) string {
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestPrometheusLabels(t *testing.T) {
+	p := NewPrometheusSink()
+	p.IncrCounter([]string{"libdiscover", "events", "sent", "deploy"}, 1)
+	p.IncrCounter([]string{"libdiscover", "events", "sent", "deploy"}, 1)
+	p.IncrCounter([]string{"libdiscover", "events", "sent", `a.b "c"`}, 1)
+	p.IncrCounter([]string{"libdiscover.segment.web", "events", "received", "user", "deploy"}, 1)
+	p.IncrCounter([]string{"serf", "events"}, 1)
+	p.IncrCounter([]string{"serf", "events", "deploy"}, 1)
+	p.SetGauge([]string{"libdiscover", "members", "alive"}, 3)
+	p.AddSample([]string{"libdiscover", "handler", "user"}, 2)
+	p.AddSample([]string{"libdiscover", "handler", "user"}, 4)
+
+	expected := `# TYPE libdiscover_members_alive gauge
+libdiscover_members_alive 3
+# TYPE libdiscover_events_received_user_total counter
+libdiscover_events_received_user_total{name="deploy",segment="web"} 1
+# TYPE libdiscover_events_sent_total counter
+libdiscover_events_sent_total{name="a.b \"c\""} 1
+libdiscover_events_sent_total{name="deploy"} 2
+# TYPE serf_events_by_name_total counter
+serf_events_by_name_total{name="deploy"} 1
+# TYPE serf_events_total counter
+serf_events_total 1
+# TYPE libdiscover_handler_user summary
+libdiscover_handler_user_sum 6
+libdiscover_handler_user_count 2
+`
+
+	if out := promOutput(t, p); out != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestPrometheusLabelCap(t *testing.T) {
+	p := NewPrometheusSink()
+	for i := 0; i < maxLabelValues+10; i++ {
+		p.IncrCounter([]string{"libdiscover", "events", "sent", fmt.Sprintf("event-%d", i)}, 1)
+	}
+
+	out := promOutput(t, p)
+	if n := strings.Count(out, "libdiscover_events_sent_total{"); n != maxLabelValues+1 {
+		t.Fatalf("expected %d series; got %d", maxLabelValues+1, n)
+	}
+
+	if !strings.Contains(out, `libdiscover_events_sent_total{name="other"} 10`) {
+		t.Fatalf("expected the names over the cap to be counted as other:\n%s", out)
+	}
+
+	// names seen before the cap keep their series
+	p.IncrCounter([]string{"libdiscover", "events", "sent", "event-0"}, 1)
+	if out := promOutput(t, p); !strings.Contains(out, `libdiscover_events_sent_total{name="event-0"} 2`) {
+		t.Fatalf("expected event-0 to be counted:\n%s", out)
+	}
+}
+
+func TestPrometheusCollision(t *testing.T) {
+	p := NewPrometheusSink()
+	p.IncrCounter([]string{"memberlist", "udp", "sent"}, 1)
+	p.IncrCounter([]string{"memberlist", "udp.sent"}, 5)
+	p.SetGauge([]string{"memberlist", "udp", "sent", "total"}, 5)
+	p.SetGauge([]string{"serf", "queue"}, 1)
+	p.AddSample([]string{"serf", "queue"}, 1)
+
+	expected := `# TYPE serf_queue gauge
+serf_queue 1
+# TYPE memberlist_udp_sent_total counter
+memberlist_udp_sent_total 1
+`
+
+	if out := promOutput(t, p); out != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
@@ -0,0 +1,97 @@
+package libdiscover
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+// internalQueryPrefix marks queries that are answered by libdiscover itself
+// and not passed to the application
+const internalQueryPrefix = "libdiscover:"
+
+// ErrReservedQuery is returned for query names that start with the prefix
+// of the queries answered by libdiscover itself
+var ErrReservedQuery = fmt.Errorf("query names starting with %q are reserved", internalQueryPrefix)
+
+// ReservedQuery reports whether the query name is reserved for libdiscover
+func ReservedQuery(name string) bool {
+	return strings.HasPrefix(name, internalQueryPrefix)
+}
+
+// Query sends a query to the cluster.  Responses are read from the
+// returned QueryResponse until it is closed.
+func (d *Discover) Query(name string, payload []byte, params *serf.QueryParam) (*serf.QueryResponse, error) {
+	if ReservedQuery(name) {
+		return nil, ErrReservedQuery
+	}
+
+	return d.query(name, payload, params)
+}
+
+// query sends a query without checking the name
+func (d *Discover) query(name string, payload []byte, params *serf.QueryParam) (*serf.QueryResponse, error) {
+	if params == nil {
+		params = d.cluster.DefaultQueryParams()
+	}
+
+	return d.cluster.Query(name, payload, params)
+}
+
+// majority reports whether n members are a majority of the known members.
+// Failed and leaving members are counted so that each side of a partition
+// cannot have a majority of its own.
+func (d *Discover) majority(n int) bool {
+	known := 0
+	for _, m := range d.Members() {
+		if m.Status != serf.StatusLeft {
+			known++
+		}
+	}
+
+	return n*2 > known
+}
+
+// handleQuery registers the responder for an internal query
+func (d *Discover) handleQuery(name string, fn func(q *serf.Query) ([]byte, error)) {
+	d.queryLock.Lock()
+	defer d.queryLock.Unlock()
+
+	d.queryHandlers[internalQueryPrefix+name] = fn
+}
+
+// respondInternalQuery answers internal queries and reports whether the
+// query was internal
+func (d *Discover) respondInternalQuery(q *serf.Query) bool {
+	if !ReservedQuery(q.Name) {
+		return false
+	}
+
+	d.queryLock.RLock()
+	fn, ok := d.queryHandlers[q.Name]
+	d.queryLock.RUnlock()
+
+	if !ok {
+		logrus.Debugf("no handler for internal query: %s", q.Name)
+		return true
+	}
+
+	resp, err := fn(q)
+	if err != nil {
+		d.metrics.IncrCounter([]string{"handler", "errors", "query", q.Name}, 1)
+		logrus.Errorf("error handling query: name=%s err=%s", q.Name, err)
+		return true
+	}
+
+	if resp == nil {
+		return true
+	}
+
+	if err := q.Respond(resp); err != nil {
+		logrus.Errorf("error responding to query: name=%s err=%s", q.Name, err)
+	}
+
+	return true
+}
@@ -0,0 +1,469 @@
+// Package ring shards keys across the members of a libdiscover cluster.
+//
+// A Ring follows membership events and maps every key to an owning member
+// using either a consistent-hash ring with virtual nodes or rendezvous
+// (highest random weight) hashing.
+package ring
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultVirtualNodes = 128
+
+	// maxWeight caps member weights; every unit of weight adds
+	// VirtualNodes points to the ring
+	maxWeight = 100
+)
+
+// Config configures a Ring
+type Config struct {
+	// VirtualNodes is the number of points each member has on the ring;
+	// defaults to 128
+	VirtualNodes int
+	// WeightTag names a member tag holding an integer weight.  Members
+	// without the tag have a weight of 1; weights above 100 are capped.
+	WeightTag string
+	// Rendezvous uses rendezvous hashing instead of a hash ring
+	Rendezvous bool
+	// Filter limits the ring to the members for which it returns true
+	Filter func(m serf.Member) bool
+	// Hash hashes keys and virtual nodes; defaults to a mixed FNV-1a
+	Hash func(b []byte) uint64
+}
+
+// Range is a span of the hash ring from Start (exclusive) to End
+// (inclusive) that moved between members
+type Range struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// Rebalance describes a change in ownership after a membership change.
+// Moved is only set for hash rings; with rendezvous hashing ownership does
+// not follow contiguous ranges.
+type Rebalance struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Moved   []Range  `json:"moved"`
+}
+
+type member struct {
+	name   string
+	weight int
+}
+
+type point struct {
+	hash  uint64
+	owner string
+}
+
+type state struct {
+	members []member
+	points  []point
+}
+
+// Ring maps keys to cluster members
+type Ring struct {
+	d   *libdiscover.Discover
+	cfg Config
+
+	mu        sync.RWMutex
+	state     *state
+	watchers  map[int]func(r Rebalance)
+	watcherID int
+	// capped are the weight tags that were already warned about
+	capped map[string]string
+
+	updateCh    chan struct{}
+	stopCh      chan struct{}
+	unsubscribe func()
+	closeOnce   sync.Once
+}
+
+// New returns a ring that is kept in sync with the members of d
+func New(d *libdiscover.Discover, cfg *Config) *Ring {
+	r := &Ring{
+		d:        d,
+		cfg:      *cfg,
+		state:    &state{},
+		watchers: map[int]func(r Rebalance){},
+		capped:   map[string]string{},
+		updateCh: make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+	}
+
+	if r.cfg.VirtualNodes <= 0 {
+		r.cfg.VirtualNodes = defaultVirtualNodes
+	}
+
+	if r.cfg.Hash == nil {
+		r.cfg.Hash = hash
+	}
+
+	r.update()
+
+	r.unsubscribe = d.Subscribe(func(evt serf.Event) {
+		if _, ok := evt.(serf.MemberEvent); !ok {
+			return
+		}
+
+		// coalesce updates; the ring is rebuilt from the full member list
+		select {
+		case r.updateCh <- struct{}{}:
+		default:
+		}
+	})
+
+	go r.run()
+
+	return r
+}
+
+// Close stops following membership changes
+func (r *Ring) Close() {
+	r.closeOnce.Do(func() {
+		r.unsubscribe()
+		close(r.stopCh)
+	})
+}
+
+// Watch calls fn after every change in ownership.  The returned func stops
+// the watch.
+func (r *Ring) Watch(fn func(r Rebalance)) func() {
+	r.mu.Lock()
+	id := r.watcherID
+	r.watcherID++
+	r.watchers[id] = fn
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		delete(r.watchers, id)
+	}
+}
+
+// Members returns the sorted names of the members on the ring
+func (r *Ring) Members() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.state.members))
+	for _, m := range r.state.members {
+		names = append(names, m.name)
+	}
+
+	return names
+}
+
+// Owner returns the member that owns the key
+func (r *Ring) Owner(key string) (string, bool) {
+	owners := r.Owners(key, 1)
+	if len(owners) == 0 {
+		return "", false
+	}
+
+	return owners[0], true
+}
+
+// Owners returns up to n distinct members for the key in preference order
+func (r *Ring) Owners(key string, n int) []string {
+	r.mu.RLock()
+	s := r.state
+	r.mu.RUnlock()
+
+	if r.cfg.Rendezvous {
+		return s.rendezvous(r.cfg.Hash, key, n)
+	}
+
+	return s.walk(r.cfg.Hash([]byte(key)), n)
+}
+
+func (r *Ring) run() {
+	for {
+		select {
+		case <-r.updateCh:
+			r.update()
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+func (r *Ring) update() {
+	members := []member{}
+	for _, m := range r.d.Members() {
+		if m.Status != serf.StatusAlive {
+			continue
+		}
+
+		if r.cfg.Filter != nil && !r.cfg.Filter(m) {
+			continue
+		}
+
+		members = append(members, member{name: m.Name, weight: r.weight(m)})
+	}
+
+	next := r.build(members)
+
+	r.mu.Lock()
+	prev := r.state
+	r.state = next
+	watchers := make([]func(r Rebalance), 0, len(r.watchers))
+	for _, fn := range r.watchers {
+		watchers = append(watchers, fn)
+	}
+	r.mu.Unlock()
+
+	rb, changed := r.diff(prev, next)
+	if !changed {
+		return
+	}
+
+	for _, fn := range watchers {
+		fn(rb)
+	}
+}
+
+// weight returns the weight of the member from its weight tag
+func (r *Ring) weight(m serf.Member) int {
+	if r.cfg.WeightTag == "" {
+		return 1
+	}
+
+	v := m.Tags[r.cfg.WeightTag]
+	w, err := strconv.Atoi(v)
+	if err != nil || w <= 0 {
+		return 1
+	}
+
+	if w > maxWeight {
+		if r.capped[m.Name] != v {
+			logrus.Warnf("ring weight above maximum: member=%s weight=%d max=%d", m.Name, w, maxWeight)
+			r.capped[m.Name] = v
+		}
+
+		return maxWeight
+	}
+
+	return w
+}
+
+func (r *Ring) build(members []member) *state {
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].name < members[j].name
+	})
+
+	s := &state{members: members}
+	if r.cfg.Rendezvous {
+		return s
+	}
+
+	for _, m := range members {
+		for i := 0; i < r.cfg.VirtualNodes*m.weight; i++ {
+			s.points = append(s.points, point{
+				hash:  r.cfg.Hash([]byte(m.name + "#" + strconv.Itoa(i))),
+				owner: m.name,
+			})
+		}
+	}
+
+	sort.Slice(s.points, func(i, j int) bool {
+		return s.points[i].hash < s.points[j].hash
+	})
+
+	return s
+}
+
+// diff compares two states and returns the rebalance between them
+func (r *Ring) diff(prev, next *state) (Rebalance, bool) {
+	rb := Rebalance{
+		Added:   []string{},
+		Removed: []string{},
+		Moved:   []Range{},
+	}
+
+	before := map[string]int{}
+	for _, m := range prev.members {
+		before[m.name] = m.weight
+	}
+
+	after := map[string]int{}
+	for _, m := range next.members {
+		after[m.name] = m.weight
+		if _, ok := before[m.name]; !ok {
+			rb.Added = append(rb.Added, m.name)
+		}
+	}
+
+	weightChanged := false
+	for _, m := range prev.members {
+		w, ok := after[m.name]
+		if !ok {
+			rb.Removed = append(rb.Removed, m.name)
+		} else if w != m.weight {
+			weightChanged = true
+		}
+	}
+
+	if len(rb.Added) == 0 && len(rb.Removed) == 0 && !weightChanged {
+		return rb, false
+	}
+
+	if !r.cfg.Rendezvous {
+		rb.Moved = movedRanges(prev, next)
+	}
+
+	return rb, true
+}
+
+// movedRanges splits the ring at every point of both states and lists the
+// spans whose owner differs, merging adjacent spans with the same move
+func movedRanges(prev, next *state) []Range {
+	hashes := make([]uint64, 0, len(prev.points)+len(next.points))
+	for _, p := range prev.points {
+		hashes = append(hashes, p.hash)
+	}
+	for _, p := range next.points {
+		hashes = append(hashes, p.hash)
+	}
+
+	sort.Slice(hashes, func(i, j int) bool {
+		return hashes[i] < hashes[j]
+	})
+
+	moved := []Range{}
+	for i, h := range hashes {
+		start := hashes[(i+len(hashes)-1)%len(hashes)]
+		if i > 0 && start == h {
+			continue
+		}
+
+		from := prev.owner(h)
+		to := next.owner(h)
+		if from == to {
+			continue
+		}
+
+		if n := len(moved); n > 0 && moved[n-1].End == start && moved[n-1].From == from && moved[n-1].To == to {
+			moved[n-1].End = h
+			continue
+		}
+
+		moved = append(moved, Range{
+			Start: start,
+			End:   h,
+			From:  from,
+			To:    to,
+		})
+	}
+
+	return moved
+}
+
+// owner returns the owner of the first point at or after h
+func (s *state) owner(h uint64) string {
+	if len(s.points) == 0 {
+		return ""
+	}
+
+	return s.points[s.search(h)].owner
+}
+
+func (s *state) search(h uint64) int {
+	i := sort.Search(len(s.points), func(i int) bool {
+		return s.points[i].hash >= h
+	})
+
+	if i == len(s.points) {
+		return 0
+	}
+
+	return i
+}
+
+// walk returns up to n distinct owners clockwise from h
+func (s *state) walk(h uint64, n int) []string {
+	owners := []string{}
+	if len(s.points) == 0 || n <= 0 {
+		return owners
+	}
+
+	seen := map[string]bool{}
+	start := s.search(h)
+	for i := 0; i < len(s.points) && len(owners) < n; i++ {
+		p := s.points[(start+i)%len(s.points)]
+		if seen[p.owner] {
+			continue
+		}
+
+		seen[p.owner] = true
+		owners = append(owners, p.owner)
+	}
+
+	return owners
+}
+
+// rendezvous returns up to n members with the highest weighted score for
+// the key
+func (s *state) rendezvous(h func(b []byte) uint64, key string, n int) []string {
+	type score struct {
+		name  string
+		score float64
+	}
+
+	scores := make([]score, 0, len(s.members))
+	for _, m := range s.members {
+		// map the hash into (0, 1) and weight it so that a member with
+		// twice the weight wins twice as many keys
+		u := (float64(h([]byte(m.name+"/"+key))>>11) + 0.5) / (1 << 53)
+		scores = append(scores, score{
+			name:  m.name,
+			score: -float64(m.weight) / math.Log(u),
+		})
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].score != scores[j].score {
+			return scores[i].score > scores[j].score
+		}
+
+		return scores[i].name < scores[j].name
+	})
+
+	owners := []string{}
+	for i := 0; i < len(scores) && i < n; i++ {
+		owners = append(owners, scores[i].name)
+	}
+
+	return owners
+}
+
+// hash is FNV-1a followed by a 64 bit finalizer so that similar inputs such
+// as virtual node names spread evenly around the ring
+func hash(b []byte) uint64 {
+	f := fnv.New64a()
+	f.Write(b)
+
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
@@ -0,0 +1,255 @@
+package ring
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+const testKeys = 20000
+
+// testRing returns a ring over the members without a cluster behind it
+func testRing(cfg Config, members ...member) *Ring {
+	if cfg.VirtualNodes <= 0 {
+		cfg.VirtualNodes = defaultVirtualNodes
+	}
+
+	if cfg.Hash == nil {
+		cfg.Hash = hash
+	}
+
+	r := &Ring{
+		cfg:    cfg,
+		capped: map[string]string{},
+	}
+	r.state = r.build(members)
+
+	return r
+}
+
+// owned counts the keys owned by every member
+func owned(r *Ring) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < testKeys; i++ {
+		owner, _ := r.Owner(fmt.Sprintf("key-%d", i))
+		counts[owner]++
+	}
+
+	return counts
+}
+
+// checkShare fails unless the member owns about share of the keys
+func checkShare(t *testing.T, counts map[string]int, name string, share float64) {
+	t.Helper()
+
+	want := share * testKeys
+	if got := float64(counts[name]); got < want*0.8 || got > want*1.2 {
+		t.Errorf("expected %s to own about %.0f keys; got %.0f", name, want, got)
+	}
+}
+
+func (rg Range) contains(h uint64) bool {
+	if rg.Start < rg.End {
+		return h > rg.Start && h <= rg.End
+	}
+
+	// the range wraps around the top of the ring
+	return h > rg.Start || h <= rg.End
+}
+
+// checkMoved fails unless the moved ranges cover exactly the keys that
+// changed owner between the rings
+func checkMoved(t *testing.T, prev, next *Ring) []Range {
+	t.Helper()
+
+	rb, changed := next.diff(prev.state, next.state)
+	if !changed {
+		t.Fatal("expected a rebalance")
+	}
+
+	for i := 0; i < testKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		h := hash([]byte(key))
+		from, _ := prev.Owner(key)
+		to, _ := next.Owner(key)
+
+		var in *Range
+		for j := range rb.Moved {
+			if rb.Moved[j].contains(h) {
+				in = &rb.Moved[j]
+				break
+			}
+		}
+
+		switch {
+		case from == to && in != nil:
+			t.Fatalf("key %s stayed on %s but is in moved range %+v", key, from, *in)
+		case from != to && in == nil:
+			t.Fatalf("key %s moved from %s to %s outside the moved ranges", key, from, to)
+		case from != to && (in.From != from || in.To != to):
+			t.Fatalf("key %s moved from %s to %s but its range is %+v", key, from, to, *in)
+		}
+	}
+
+	return rb.Moved
+}
+
+func TestDistribution(t *testing.T) {
+	for _, rendezvous := range []bool{false, true} {
+		r := testRing(Config{Rendezvous: rendezvous},
+			member{name: "a", weight: 1},
+			member{name: "b", weight: 1},
+			member{name: "c", weight: 1},
+			member{name: "d", weight: 1},
+		)
+
+		counts := owned(r)
+		for _, name := range []string{"a", "b", "c", "d"} {
+			checkShare(t, counts, name, 0.25)
+		}
+	}
+}
+
+func TestWeighting(t *testing.T) {
+	for _, rendezvous := range []bool{false, true} {
+		r := testRing(Config{Rendezvous: rendezvous},
+			member{name: "a", weight: 1},
+			member{name: "b", weight: 1},
+			member{name: "c", weight: 2},
+		)
+
+		counts := owned(r)
+		checkShare(t, counts, "a", 0.25)
+		checkShare(t, counts, "b", 0.25)
+		checkShare(t, counts, "c", 0.5)
+	}
+}
+
+func TestWeightTag(t *testing.T) {
+	r := testRing(Config{WeightTag: "weight"})
+
+	for _, tc := range []struct {
+		tag    string
+		weight int
+	}{
+		{"", 1},
+		{"x", 1},
+		{"-2", 1},
+		{"3", 3},
+		{"100", 100},
+		{"1000", maxWeight},
+	} {
+		m := serf.Member{Name: "a", Tags: map[string]string{"weight": tc.tag}}
+		if w := r.weight(m); w != tc.weight {
+			t.Errorf("weight %q: expected %d; got %d", tc.tag, tc.weight, w)
+		}
+	}
+}
+
+func TestRendezvousOrder(t *testing.T) {
+	members := []member{
+		{name: "a", weight: 1},
+		{name: "b", weight: 1},
+		{name: "c", weight: 1},
+		{name: "d", weight: 1},
+	}
+	all := testRing(Config{Rendezvous: true}, members...)
+	// without c
+	some := testRing(Config{Rendezvous: true}, members[0], members[1], members[3])
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+
+		owners := all.Owners(key, 4)
+		if len(owners) != 4 {
+			t.Fatalf("expected 4 owners; got %v", owners)
+		}
+
+		if owner, _ := all.Owner(key); owner != owners[0] {
+			t.Fatalf("expected owner %s to be first in %v", owner, owners)
+		}
+
+		// removing a member keeps the order of the others
+		want := []string{}
+		for _, o := range owners {
+			if o != "c" {
+				want = append(want, o)
+			}
+		}
+
+		if got := some.Owners(key, 3); !reflect.DeepEqual(got, want) {
+			t.Fatalf("key %s: expected %v without c; got %v", key, want, got)
+		}
+	}
+}
+
+func TestMovedRangesJoin(t *testing.T) {
+	prev := testRing(Config{},
+		member{name: "a", weight: 1},
+		member{name: "b", weight: 1},
+		member{name: "c", weight: 1},
+	)
+	next := testRing(Config{},
+		member{name: "a", weight: 1},
+		member{name: "b", weight: 1},
+		member{name: "c", weight: 1},
+		member{name: "d", weight: 1},
+	)
+
+	for _, rg := range checkMoved(t, prev, next) {
+		if rg.To != "d" {
+			t.Fatalf("expected ranges to move to the new member; got %+v", rg)
+		}
+	}
+}
+
+func TestMovedRangesLeave(t *testing.T) {
+	prev := testRing(Config{},
+		member{name: "a", weight: 1},
+		member{name: "b", weight: 1},
+		member{name: "c", weight: 1},
+	)
+	next := testRing(Config{},
+		member{name: "a", weight: 1},
+		member{name: "b", weight: 1},
+	)
+
+	for _, rg := range checkMoved(t, prev, next) {
+		if rg.From != "c" {
+			t.Fatalf("expected ranges to move from the departed member; got %+v", rg)
+		}
+	}
+}
+
+func TestMovedRangesWeightChange(t *testing.T) {
+	prev := testRing(Config{},
+		member{name: "a", weight: 1},
+		member{name: "b", weight: 1},
+	)
+	next := testRing(Config{},
+		member{name: "a", weight: 1},
+		member{name: "b", weight: 3},
+	)
+
+	for _, rg := range checkMoved(t, prev, next) {
+		if rg.From != "a" || rg.To != "b" {
+			t.Fatalf("expected ranges to move to the heavier member; got %+v", rg)
+		}
+	}
+}
+
+func TestNoRebalance(t *testing.T) {
+	r := testRing(Config{},
+		member{name: "a", weight: 1},
+		member{name: "b", weight: 1},
+	)
+
+	if _, changed := r.diff(r.state, r.build([]member{
+		{name: "b", weight: 1},
+		{name: "a", weight: 1},
+	})); changed {
+		t.Fatal("expected no rebalance for the same members")
+	}
+}
@@ -0,0 +1,150 @@
+package libdiscover
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SegmentTag holds the segment of a member; members of the default pool do
+// not have it
+const SegmentTag = "segment"
+
+// SegmentConfig configures a segment.  Segments are gossip pools isolated
+// from the default pool and from each other, each with its own address,
+// encryption key and members.
+type SegmentConfig struct {
+	Name          string
+	BindAddr      string
+	AdvertiseAddr string
+	JoinAddr      string
+	EncryptKey    string
+	// Tags are added to the node tags in the segment
+	Tags map[string]string
+}
+
+// newSegments creates a Discover for every segment.  Segments share the
+// node settings of cfg but not the WAN.
+func (d *Discover) newSegments(cfg *Config) error {
+	for _, sc := range cfg.Segments {
+		if sc.Name == "" {
+			return fmt.Errorf("segment name is required")
+		}
+
+		if _, ok := d.segments[sc.Name]; ok {
+			return fmt.Errorf("duplicate segment %s", sc.Name)
+		}
+
+		if sc.BindAddr == "" {
+			return fmt.Errorf("segment %s: bind address is required", sc.Name)
+		}
+
+		tags := map[string]string{}
+		for k, v := range cfg.Tags {
+			tags[k] = v
+		}
+		for k, v := range sc.Tags {
+			tags[k] = v
+		}
+
+		advertiseAddr := sc.AdvertiseAddr
+		if advertiseAddr == "" {
+			advertiseAddr = sc.BindAddr
+		}
+
+		s, err := NewDiscover(&Config{
+			Name:               cfg.Name,
+			BindAddr:           sc.BindAddr,
+			AdvertiseAddr:      advertiseAddr,
+			JoinAddr:           sc.JoinAddr,
+			Logger:             cfg.Logger,
+			EventHandler:       cfg.EventHandler,
+			NodeTimeout:        cfg.NodeTimeout,
+			Debug:              cfg.Debug,
+			Tags:               tags,
+			EncryptKey:         sc.EncryptKey,
+			Announce:           cfg.Announce,
+			Version:            cfg.Version,
+			Capabilities:       cfg.Capabilities,
+			DisableCoordinates: cfg.DisableCoordinates,
+			HeartbeatTimeout:   cfg.HeartbeatTimeout,
+			KVTombstoneTimeout: cfg.KVTombstoneTimeout,
+			Datacenter:         cfg.Datacenter,
+			Profile:            cfg.Profile,
+			Tuning:             cfg.Tuning,
+			Transport:          cfg.Transport,
+		})
+		if err != nil {
+			return fmt.Errorf("segment %s: %s", sc.Name, err)
+		}
+
+		s.segment = sc.Name
+		s.tagLock.Lock()
+		s.setReservedTags(s.tags)
+		s.tagLock.Unlock()
+
+		d.segments[sc.Name] = s
+	}
+
+	return nil
+}
+
+// SegmentName returns the segment served by d; empty for the default pool
+func (d *Discover) SegmentName() string {
+	return d.segment
+}
+
+// Segments returns the sorted names of the segments the node belongs to
+func (d *Discover) Segments() []string {
+	names := make([]string, 0, len(d.segments))
+	for name := range d.segments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Segment returns the Discover of a segment, which has the same API as the
+// default pool but only sees the members of the segment.  An empty name
+// returns the default pool.
+func (d *Discover) Segment(name string) (*Discover, error) {
+	if name == "" || name == d.segment {
+		return d, nil
+	}
+
+	s, ok := d.segments[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown segment %s", name)
+	}
+
+	return s, nil
+}
+
+// runSegments starts the segments after the default pool
+func (d *Discover) runSegments() error {
+	for _, name := range d.Segments() {
+		d.segmentMetrics(d.segments[name], name)
+
+		if err := d.segments[name].Run(); err != nil {
+			return fmt.Errorf("segment %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// stopSegments leaves the segments before the default pool
+func (d *Discover) stopSegments() error {
+	for _, name := range d.Segments() {
+		s := d.segments[name]
+		if s.cluster == nil {
+			continue
+		}
+
+		if err := s.Stop(); err != nil {
+			return fmt.Errorf("segment %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
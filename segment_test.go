@@ -0,0 +1,180 @@
+package libdiscover_test
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+	"github.com/hashicorp/serf/serf"
+)
+
+// segment returns the named segment of node i
+func segment(t *testing.T, c *testcluster.Cluster, i int, name string) *libdiscover.Discover {
+	t.Helper()
+
+	s, err := c.Node(i).Segment(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestSegments(t *testing.T) {
+	keyA := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 16)))
+	keyB := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 16)))
+
+	// nodes 0 and 1 serve tenant a and node 2 serves tenant b
+	c := testcluster.New(t, &testcluster.Config{
+		Configure: func(i int, cfg *libdiscover.Config) {
+			sc := libdiscover.SegmentConfig{
+				Name:       "a",
+				BindAddr:   "127.0.0.1:0",
+				EncryptKey: keyA,
+				Tags:       map[string]string{"tenant": "a"},
+			}
+			if i == 2 {
+				sc.Name = "b"
+				sc.EncryptKey = keyB
+				sc.Tags = map[string]string{"tenant": "b"}
+			}
+
+			cfg.Segments = []libdiscover.SegmentConfig{sc}
+		},
+	})
+
+	a0, a1, b2 := segment(t, c, 0, "a"), segment(t, c, 1, "a"), segment(t, c, 2, "b")
+
+	if _, err := a1.Join(a0.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the other tenant cannot join without the key of the segment
+	if _, err := b2.Join(a0.Addr()); err == nil {
+		t.Fatal("expected joining another segment to fail")
+	}
+
+	c.WaitFor("both members in segment a", func() bool {
+		return len(a0.Members()) == 2 && len(a1.Members()) == 2
+	})
+
+	for _, m := range a0.Members() {
+		if m.Name == c.Name(2) {
+			t.Fatalf("expected %s to stay out of segment a", c.Name(2))
+		}
+
+		if m.Tags[libdiscover.SegmentTag] != "a" || m.Tags["tenant"] != "a" {
+			t.Fatalf("expected the segment tags; got %v", m.Tags)
+		}
+	}
+
+	if members := b2.Members(); len(members) != 1 || members[0].Name != c.Name(2) {
+		t.Fatalf("expected only the local node in segment b; got %v", members)
+	}
+
+	// the default pool still has every node without the segment tags
+	for _, m := range c.Node(0).Members() {
+		if _, ok := m.Tags[libdiscover.SegmentTag]; ok || m.Tags["tenant"] != "" {
+			t.Fatalf("expected no segment tags in the default pool; got %v", m.Tags)
+		}
+	}
+
+	// events stay in their segment
+	subscribe := func(ch chan string, nodes ...*libdiscover.Discover) {
+		for _, d := range nodes {
+			d.Subscribe(func(evt serf.Event) {
+				if e, ok := evt.(serf.UserEvent); ok && e.Name == "tenant-a" {
+					ch <- e.Name
+				}
+			})
+		}
+	}
+
+	delivered, leaked := make(chan string, 16), make(chan string, 16)
+	subscribe(delivered, a1)
+	subscribe(leaked, b2, c.Node(1), c.Node(2))
+
+	if err := a0.SendEvent("tenant-a", nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// by the time the default pool delivers a later event the segment
+	// event would have leaked as well
+	if err := c.Node(0).SendEvent("default", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitForEvent(1, "default")
+	c.WaitForEvent(2, "default")
+
+	c.WaitFor("the event in segment a", func() bool {
+		return len(delivered) > 0
+	})
+
+	if len(leaked) != 0 {
+		t.Fatal("expected the event to stay in segment a")
+	}
+}
+
+func TestSegmentLookup(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{
+		Nodes: 1,
+		Configure: func(i int, cfg *libdiscover.Config) {
+			cfg.Segments = []libdiscover.SegmentConfig{
+				{Name: "b", BindAddr: "127.0.0.1:0"},
+				{Name: "a", BindAddr: "127.0.0.1:0"},
+			}
+		},
+	})
+	d := c.Node(0)
+
+	if names := d.Segments(); len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Fatalf("expected the sorted segments; got %v", names)
+	}
+
+	// the empty name is the default pool
+	if s, err := d.Segment(""); err != nil || s != d {
+		t.Fatalf("expected the default pool; got %v %v", s, err)
+	}
+
+	a := segment(t, c, 0, "a")
+	if a == d || a.SegmentName() != "a" || d.SegmentName() != "" {
+		t.Fatalf("unexpected segment names %q and %q", a.SegmentName(), d.SegmentName())
+	}
+
+	// the empty name addresses the pool it is called on
+	if s, err := a.Segment(""); err != nil || s != a {
+		t.Fatalf("expected the segment itself; got %v %v", s, err)
+	}
+
+	if _, err := d.Segment("missing"); err == nil {
+		t.Fatal("expected an error for an unknown segment")
+	}
+
+	if a.Addr() == d.Addr() {
+		t.Fatalf("expected the segment on its own address; got %s", a.Addr())
+	}
+}
+
+func TestSegmentConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		segments []libdiscover.SegmentConfig
+		err      string
+	}{
+		{[]libdiscover.SegmentConfig{{BindAddr: "127.0.0.1:0"}}, "segment name is required"},
+		{[]libdiscover.SegmentConfig{{Name: "a"}}, "segment a: bind address is required"},
+		{[]libdiscover.SegmentConfig{
+			{Name: "a", BindAddr: "127.0.0.1:0"},
+			{Name: "a", BindAddr: "127.0.0.1:0"},
+		}, "duplicate segment a"},
+	} {
+		_, err := libdiscover.NewDiscover(&libdiscover.Config{
+			Name:     "node-0",
+			Segments: tc.segments,
+		})
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("expected %q; got %v", tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package sim_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/memnet"
+	"github.com/ehazlett/libdiscover/sim"
+	"github.com/hashicorp/serf/serf"
+)
+
+// fastTuning detects failures in about a second
+var fastTuning = &libdiscover.Tuning{
+	ProbeInterval:     time.Millisecond * 200,
+	ProbeTimeout:      time.Millisecond * 100,
+	ReconnectInterval: time.Millisecond * 200,
+}
+
+// detect crashes the last of n nodes running over memnet and returns how
+// long each other node takes to mark it failed
+func detect(t *testing.T, n int, latency time.Duration) []time.Duration {
+	t.Helper()
+
+	network, err := memnet.New(&memnet.Config{
+		Link: memnet.Link{Latency: latency},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := []*libdiscover.Discover{}
+	addrs := []string{}
+	for i := 0; i < n; i++ {
+		d, err := libdiscover.NewDiscover(&libdiscover.Config{
+			Name:      fmt.Sprintf("node-%d", i),
+			BindAddr:  fmt.Sprintf("10.0.0.%d:7946", i+1),
+			Profile:   libdiscover.ProfileLocal,
+			Tuning:    fastTuning,
+			Transport: network.Transport,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Shutdown()
+
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		nodes = append(nodes, d)
+		addrs = append(addrs, d.Addr())
+	}
+
+	// a join gossiped to a few nodes can take a push/pull interval to
+	// reach the rest, so every node joins every other
+	for _, d := range nodes {
+		if _, err := d.Join(addrs...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, func() bool {
+		for _, d := range nodes {
+			if len(d.Members()) != n {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	crashed := nodes[n-1]
+	live := nodes[:n-1]
+
+	start := time.Now()
+	if err := crashed.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	detected := map[int]time.Duration{}
+	waitFor(t, func() bool {
+		for i, d := range live {
+			if _, ok := detected[i]; ok {
+				continue
+			}
+
+			for _, m := range d.Members() {
+				if m.Name == crashed.Name() && m.Status == serf.StatusFailed {
+					detected[i] = time.Since(start)
+				}
+			}
+		}
+
+		return len(detected) == len(live)
+	})
+
+	out := []time.Duration{}
+	for _, d := range detected {
+		out = append(out, d)
+	}
+
+	return out
+}
+
+func waitFor(t *testing.T, fn func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 30)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// TestDetectionMatchesCluster checks the model against libdiscover itself:
+// the same profile and tuning on a cluster over memnet detect a crash in
+// the range the model predicts
+func TestDetectionMatchesCluster(t *testing.T) {
+	const nodes = 5
+	latency := time.Millisecond * 2
+
+	r, err := sim.Run(&sim.Config{
+		Nodes:      nodes,
+		Profile:    libdiscover.ProfileLocal,
+		Tuning:     fastTuning,
+		Network:    sim.Network{Latency: latency},
+		Duration:   time.Second * 30,
+		JoinWindow: time.Second,
+		Failures:   1,
+		FailAt:     time.Second * 10,
+		Seed:       1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Detection.Count != nodes-1 {
+		t.Fatalf("expected the model to detect the failure on every node; got %d", r.Detection.Count)
+	}
+
+	// the model follows the protocol but not every timer of memberlist, so
+	// only the order of magnitude is compared
+	low, high := r.Detection.Min/2, r.Detection.Max*2
+	for _, d := range detect(t, nodes, latency) {
+		if d < low || d > high {
+			t.Errorf("expected detection between %s and %s as modeled; got %s", low, high, d)
+		}
+	}
+}
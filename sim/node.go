@@ -0,0 +1,826 @@
+package sim
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// memberlist packet limits; message sizes are measured by measureSizes
+const (
+	udpSendBuf             = 1400
+	compoundHeaderOverhead = 2
+	compoundOverhead       = 2
+
+	pushPullScaleThreshold = 32
+)
+
+type state int
+
+const (
+	stateAlive state = iota
+	stateSuspect
+	stateDead
+)
+
+type memberState struct {
+	state   state
+	inc     uint32
+	changed time.Duration
+
+	// suspicion of the member; gen invalidates older suspicion timers
+	susp *suspicion
+	gen  int
+}
+
+type suspicion struct {
+	member   int
+	start    time.Duration
+	min, max time.Duration
+	k, n     int
+	confirms map[int]bool
+}
+
+// broadcast is a queued message gossiped up to the retransmit limit
+type broadcast struct {
+	kind      msgKind
+	subject   int
+	inc       uint32
+	from      int
+	size      int
+	transmits int
+	id        int
+}
+
+type msgKind int
+
+const (
+	msgAlive msgKind = iota
+	msgSuspect
+	msgDead
+	msgEvent
+)
+
+type probe struct {
+	target   int
+	done     bool
+	ack      func()
+	nacks    int
+	expected int
+	tcp      bool
+}
+
+// node models a memberlist and serf instance
+type node struct {
+	s   *sim
+	id  int
+	net Network
+	inc uint32
+	up  bool
+	// crashed is set for nodes crashed by the simulation
+	crashed   bool
+	started   bool
+	startedAt time.Duration
+
+	members map[int]*memberState
+	known   []int
+
+	probeOrder []int
+	probeIndex int
+	awareness  int
+	seq        int
+	probes     map[int]*probe
+
+	queue  []*broadcast
+	equeue []*broadcast
+
+	events map[int]bool
+
+	sent     int64
+	received int64
+}
+
+func newNode(s *sim, id int) *node {
+	return &node{
+		s:       s,
+		id:      id,
+		net:     s.cfg.Network,
+		members: map[int]*memberState{},
+		probes:  map[int]*probe{},
+		events:  map[int]bool{},
+	}
+}
+
+// start starts the node and joins the first node with a push/pull
+func (n *node) start() {
+	n.up = true
+	n.started = true
+	n.startedAt = n.s.now
+	n.inc = 1
+	n.members[n.id] = &memberState{state: stateAlive, inc: n.inc, changed: n.s.now}
+	n.known = append(n.known, n.id)
+	n.queueBroadcast(&broadcast{kind: msgAlive, subject: n.id, inc: n.inc, size: n.s.sizes.alive})
+
+	if n.id != 0 {
+		n.pushPull(n.s.nodes[0])
+	}
+
+	s := n.s
+	interval := s.mCfg.ProbeInterval
+	s.at(time.Duration(s.rand.Int63n(int64(interval))), n.probe)
+
+	if s.mCfg.GossipInterval > 0 && s.mCfg.GossipNodes > 0 {
+		s.at(time.Duration(s.rand.Int63n(int64(s.mCfg.GossipInterval))), n.gossip)
+	}
+
+	if s.mCfg.PushPullInterval > 0 {
+		s.at(time.Duration(s.rand.Int63n(int64(s.mCfg.PushPullInterval))), n.pushPullTick)
+	}
+}
+
+func (n *node) numNodes() int {
+	return len(n.known)
+}
+
+// accuracy returns the share of started nodes that the node sees in their
+// actual state
+func (n *node) accuracy() float64 {
+	total, correct := 0, 0
+	for _, o := range n.s.nodes {
+		if !o.started || o.id == n.id {
+			continue
+		}
+		total++
+
+		m, ok := n.members[o.id]
+		if !ok {
+			continue
+		}
+
+		if o.crashed == (m.state == stateDead) {
+			correct++
+		}
+	}
+
+	if total == 0 {
+		return 1
+	}
+
+	return float64(correct) / float64(total)
+}
+
+// randomMembers returns up to k random members that pass the filter like
+// memberlist's kRandomNodes
+func (n *node) randomMembers(k int, ok func(id int, m *memberState) bool) []int {
+	picked := []int{}
+	for i := 0; i < 3*len(n.known) && len(picked) < k; i++ {
+		id := n.known[n.s.rand.Intn(len(n.known))]
+		if id == n.id || !ok(id, n.members[id]) {
+			continue
+		}
+
+		dup := false
+		for _, p := range picked {
+			if p == id {
+				dup = true
+				break
+			}
+		}
+
+		if !dup {
+			picked = append(picked, id)
+		}
+	}
+
+	return picked
+}
+
+// next schedules fn after the interval
+func (n *node) next(interval time.Duration, fn func()) {
+	n.s.at(interval, fn)
+}
+
+// probe runs a round of failure detection
+func (n *node) probe() {
+	if !n.up {
+		return
+	}
+
+	s := n.s
+	interval := s.mCfg.ProbeInterval
+
+	target := -1
+	for checked := 0; checked < len(n.known); checked++ {
+		if n.probeIndex >= len(n.probeOrder) {
+			n.probeOrder = s.rand.Perm(len(n.known))
+			for i, j := range n.probeOrder {
+				n.probeOrder[i] = n.known[j]
+			}
+			n.probeIndex = 0
+		}
+
+		id := n.probeOrder[n.probeIndex]
+		n.probeIndex++
+
+		if id != n.id && n.members[id].state != stateDead {
+			target = id
+			break
+		}
+	}
+
+	if target < 0 {
+		n.next(interval, n.probe)
+		return
+	}
+
+	start := s.now
+	// awareness stretches the probe deadline when the node is unhealthy
+	deadline := interval * time.Duration(n.awareness+1)
+
+	n.seq++
+	seq := n.seq
+	p := &probe{target: target}
+	n.probes[seq] = p
+
+	// finish ends the round and waits for the next tick; the ticker drops
+	// the ticks missed by a long round
+	finish := func(ok bool) {
+		if p.done {
+			return
+		}
+		p.done = true
+		delete(n.probes, seq)
+
+		if ok {
+			n.adjustAwareness(-1)
+		} else {
+			delta := 1
+			if p.expected > 0 {
+				delta = 0
+				if p.nacks < p.expected {
+					delta = 2 * (p.expected - p.nacks)
+				}
+			}
+			n.adjustAwareness(delta)
+
+			if m, ok := n.members[target]; ok {
+				n.suspect(target, m.inc, n.id)
+			}
+		}
+
+		elapsed := s.now - start
+		n.next(interval-elapsed%interval, n.probe)
+	}
+	p.ack = func() {
+		finish(true)
+	}
+
+	m := n.members[target]
+	size := n.s.sizes.ping
+	if m.state == stateSuspect {
+		size += n.s.sizes.suspect
+	}
+
+	t := s.nodes[target]
+	n.send(t, size, func() {
+		t.handlePing(n, seq)
+	})
+
+	s.at(s.mCfg.ProbeTimeout, func() {
+		if !n.up || p.done {
+			return
+		}
+
+		n.indirectProbe(seq, p, deadline-s.mCfg.ProbeTimeout)
+	})
+
+	s.at(deadline, func() {
+		if !n.up || p.done {
+			return
+		}
+
+		finish(p.tcp)
+	})
+}
+
+// indirectProbe asks other members to probe the target and falls back to
+// a TCP ping
+func (n *node) indirectProbe(seq int, p *probe, remaining time.Duration) {
+	s := n.s
+	t := s.nodes[p.target]
+
+	peers := n.randomMembers(s.mCfg.IndirectChecks, func(id int, m *memberState) bool {
+		return id != p.target && m.state == stateAlive
+	})
+	p.expected = len(peers)
+
+	for _, id := range peers {
+		peer := s.nodes[id]
+		n.send(peer, n.s.sizes.indirect, func() {
+			peer.handleIndirect(n, t, seq)
+		})
+	}
+
+	if t.up && s.tcpDelay(n, t, 1) < remaining {
+		p.tcp = true
+	}
+}
+
+func (n *node) adjustAwareness(delta int) {
+	n.awareness += delta
+	if n.awareness < 0 {
+		n.awareness = 0
+	}
+
+	if max := n.s.mCfg.AwarenessMaxMultiplier - 1; n.awareness > max {
+		n.awareness = max
+	}
+}
+
+func (n *node) handlePing(from *node, seq int) {
+	n.send(from, n.s.sizes.ack, func() {
+		from.handleAck(seq)
+	})
+}
+
+func (n *node) handleAck(seq int) {
+	if p, ok := n.probes[seq]; ok {
+		p.ack()
+	}
+}
+
+func (n *node) handleNack(seq int) {
+	if p, ok := n.probes[seq]; ok {
+		p.nacks++
+	}
+}
+
+// handleIndirect pings the target for another member and relays the ack,
+// or a nack when the target does not answer in time
+func (n *node) handleIndirect(from, target *node, seq int) {
+	s := n.s
+
+	n.seq++
+	own := n.seq
+	p := &probe{target: target.id}
+	n.probes[own] = p
+
+	p.ack = func() {
+		p.done = true
+		delete(n.probes, own)
+		n.send(from, n.s.sizes.ack, func() {
+			from.handleAck(seq)
+		})
+	}
+
+	n.send(target, n.s.sizes.ping, func() {
+		target.handlePing(n, own)
+	})
+
+	s.at(s.mCfg.ProbeTimeout, func() {
+		if !n.up || p.done {
+			return
+		}
+		p.done = true
+		delete(n.probes, own)
+
+		n.send(from, n.s.sizes.nack, func() {
+			from.handleNack(seq)
+		})
+	})
+}
+
+// send sends a UDP message with as many broadcasts piggybacked as fit
+func (n *node) send(to *node, size int, fn func()) {
+	msgs := n.broadcasts(udpSendBuf - size - compoundHeaderOverhead)
+	for _, b := range msgs {
+		size += b.size + compoundOverhead
+	}
+
+	n.s.sendUDP(n, to, size, func() {
+		fn()
+		to.receive(msgs)
+	})
+}
+
+// gossip sends the pending broadcasts to random members
+func (n *node) gossip() {
+	if !n.up {
+		return
+	}
+
+	s := n.s
+	targets := n.randomMembers(s.mCfg.GossipNodes, func(id int, m *memberState) bool {
+		switch m.state {
+		case stateAlive, stateSuspect:
+			return true
+		default:
+			return s.now-m.changed <= s.mCfg.GossipToTheDeadTime
+		}
+	})
+
+	for _, id := range targets {
+		msgs := n.broadcasts(udpSendBuf - compoundHeaderOverhead)
+		if len(msgs) == 0 {
+			break
+		}
+
+		size := compoundHeaderOverhead
+		for _, b := range msgs {
+			size += b.size + compoundOverhead
+		}
+
+		to := s.nodes[id]
+		s.sendUDP(n, to, size, func() {
+			to.receive(msgs)
+		})
+	}
+
+	n.next(s.mCfg.GossipInterval, n.gossip)
+}
+
+// retransmitLimit follows memberlist's retransmit limit
+func (n *node) retransmitLimit() int {
+	scale := math.Ceil(math.Log10(float64(n.numNodes() + 1)))
+	return n.s.mCfg.RetransmitMult * int(scale)
+}
+
+// queueBroadcast queues a memberlist broadcast; it replaces older
+// broadcasts about the same member
+func (n *node) queueBroadcast(b *broadcast) {
+	q := n.queue[:0]
+	for _, o := range n.queue {
+		if o.subject != b.subject {
+			q = append(q, o)
+		}
+	}
+	n.queue = append(q, b)
+}
+
+// broadcasts returns the broadcasts that fit in limit bytes, the memberlist
+// broadcasts first and then serf's, fewest transmits first
+func (n *node) broadcasts(limit int) []*broadcast {
+	picked := []*broadcast{}
+	max := n.retransmitLimit()
+
+	for _, q := range []*[]*broadcast{&n.queue, &n.equeue} {
+		for transmits := 0; transmits < max; transmits++ {
+			for i := len(*q) - 1; i >= 0; i-- {
+				b := (*q)[i]
+				if b.transmits != transmits || b.size+compoundOverhead > limit {
+					continue
+				}
+
+				limit -= b.size + compoundOverhead
+				picked = append(picked, b)
+			}
+		}
+
+		kept := (*q)[:0]
+		for _, b := range *q {
+			for _, p := range picked {
+				if p == b {
+					b.transmits++
+					break
+				}
+			}
+
+			if b.transmits < max {
+				kept = append(kept, b)
+			}
+		}
+		*q = kept
+	}
+
+	// receivers get copies so later transmits do not change them
+	msgs := make([]*broadcast, len(picked))
+	for i, b := range picked {
+		c := *b
+		msgs[i] = &c
+	}
+
+	return msgs
+}
+
+func (n *node) receive(msgs []*broadcast) {
+	for _, b := range msgs {
+		switch b.kind {
+		case msgAlive:
+			n.alive(b.subject, b.inc)
+		case msgSuspect:
+			n.suspect(b.subject, b.inc, b.from)
+		case msgDead:
+			n.dead(b.subject, b.inc, b.from)
+		case msgEvent:
+			n.deliver(b.id)
+		}
+	}
+}
+
+func (n *node) add(id int, inc uint32) {
+	n.members[id] = &memberState{state: stateAlive, inc: inc, changed: n.s.now}
+	n.known = append(n.known, id)
+
+	// new members are probed at a random point of the round
+	if len(n.probeOrder) > 0 {
+		i := n.s.rand.Intn(len(n.probeOrder) + 1)
+		n.probeOrder = append(n.probeOrder, 0)
+		copy(n.probeOrder[i+1:], n.probeOrder[i:])
+		n.probeOrder[i] = id
+		if i < n.probeIndex {
+			n.probeIndex++
+		}
+	}
+}
+
+func (n *node) alive(id int, inc uint32) {
+	if id == n.id {
+		return
+	}
+
+	m, ok := n.members[id]
+	if !ok {
+		n.add(id, inc)
+		n.queueBroadcast(&broadcast{kind: msgAlive, subject: id, inc: inc, size: n.s.sizes.alive})
+		return
+	}
+
+	if inc <= m.inc {
+		return
+	}
+
+	m.state = stateAlive
+	m.inc = inc
+	m.changed = n.s.now
+	m.susp = nil
+	m.gen++
+	n.queueBroadcast(&broadcast{kind: msgAlive, subject: id, inc: inc, size: n.s.sizes.alive})
+}
+
+// refute raises the incarnation of the node to clear a suspicion
+func (n *node) refute(inc uint32) {
+	if inc >= n.inc {
+		n.inc = inc + 1
+	} else {
+		n.inc++
+	}
+	n.members[n.id].inc = n.inc
+	n.adjustAwareness(1)
+	n.queueBroadcast(&broadcast{kind: msgAlive, subject: n.id, inc: n.inc, size: n.s.sizes.alive})
+}
+
+func (n *node) suspect(id int, inc uint32, from int) {
+	m, ok := n.members[id]
+	if !ok || inc < m.inc {
+		return
+	}
+
+	if m.susp != nil {
+		if m.susp.confirm(n, from) {
+			n.queueBroadcast(&broadcast{kind: msgSuspect, subject: id, inc: inc, from: from, size: n.s.sizes.suspect})
+		}
+		return
+	}
+
+	if m.state != stateAlive {
+		return
+	}
+
+	if id == n.id {
+		n.refute(inc)
+		return
+	}
+
+	s := n.s
+	if from == n.id && !s.nodes[id].crashed {
+		s.falseSuspicion++
+	}
+
+	n.queueBroadcast(&broadcast{kind: msgSuspect, subject: id, inc: inc, from: from, size: n.s.sizes.suspect})
+	m.state = stateSuspect
+	m.inc = inc
+	m.changed = s.now
+
+	// Lifeguard: start at the max timeout and approach the min timeout as
+	// other members confirm the suspicion
+	k := s.mCfg.SuspicionMult - 2
+	num := n.numNodes()
+	if num-2 < k {
+		k = 0
+	}
+
+	scale := math.Max(1, math.Log10(math.Max(1, float64(num))))
+	min := time.Duration(s.mCfg.SuspicionMult) * time.Duration(scale*1000) * s.mCfg.ProbeInterval / 1000
+	max := time.Duration(s.mCfg.SuspicionMaxTimeoutMult) * min
+
+	m.susp = &suspicion{
+		member:   id,
+		start:    s.now,
+		min:      min,
+		max:      max,
+		k:        k,
+		confirms: map[int]bool{from: true},
+	}
+
+	timeout := max
+	if k < 1 {
+		timeout = min
+	}
+	n.suspicionTimer(id, timeout)
+}
+
+func (n *node) suspicionTimer(id int, timeout time.Duration) {
+	m := n.members[id]
+	m.gen++
+	gen := m.gen
+
+	n.s.at(timeout, func() {
+		if !n.up || m.gen != gen || m.state != stateSuspect {
+			return
+		}
+
+		n.dead(id, m.inc, n.id)
+	})
+}
+
+// confirm counts an independent suspicion and shortens the timeout
+func (sp *suspicion) confirm(n *node, from int) bool {
+	if sp.n >= sp.k || sp.confirms[from] {
+		return false
+	}
+	sp.confirms[from] = true
+	sp.n++
+
+	frac := math.Log(float64(sp.n)+1) / math.Log(float64(sp.k)+1)
+	raw := sp.max.Seconds() - frac*(sp.max.Seconds()-sp.min.Seconds())
+	timeout := time.Duration(math.Floor(1000*raw)) * time.Millisecond
+	if timeout < sp.min {
+		timeout = sp.min
+	}
+
+	remaining := timeout - (n.s.now - sp.start)
+	if remaining < 0 {
+		remaining = 0
+	}
+	n.suspicionTimer(sp.member, remaining)
+
+	return true
+}
+
+func (n *node) dead(id int, inc uint32, from int) {
+	m, ok := n.members[id]
+	if !ok || inc < m.inc || m.state == stateDead {
+		return
+	}
+
+	if id == n.id {
+		n.refute(inc)
+		return
+	}
+
+	s := n.s
+	n.queueBroadcast(&broadcast{kind: msgDead, subject: id, inc: inc, from: from, size: n.s.sizes.dead})
+	m.state = stateDead
+	m.inc = inc
+	m.changed = s.now
+	m.susp = nil
+	m.gen++
+
+	if t := s.nodes[id]; t.crashed {
+		s.detection = append(s.detection, s.now-s.failed)
+	} else {
+		s.falsePositive++
+		s.falseNodes[id] = true
+	}
+}
+
+// userEvent sends a user event from the node
+func (n *node) userEvent(id int) {
+	n.deliver(id)
+}
+
+// deliver delivers a user event once and rebroadcasts it like serf
+func (n *node) deliver(id int) {
+	if n.events[id] {
+		return
+	}
+	n.events[id] = true
+
+	s := n.s
+	for _, e := range s.events {
+		if e.id == id {
+			s.eventLatency = append(s.eventLatency, s.now-e.sent)
+			break
+		}
+	}
+
+	n.equeue = append(n.equeue, &broadcast{kind: msgEvent, subject: -1, id: id, size: s.sizes.event})
+}
+
+// pushPullTick exchanges the full state with a random member on the
+// scaled push/pull interval
+func (n *node) pushPullTick() {
+	if !n.up {
+		return
+	}
+
+	s := n.s
+	peers := n.randomMembers(1, func(id int, m *memberState) bool {
+		return m.state == stateAlive
+	})
+	if len(peers) == 1 {
+		n.pushPull(s.nodes[peers[0]])
+	}
+
+	interval := s.mCfg.PushPullInterval
+	if num := n.numNodes(); num > pushPullScaleThreshold {
+		mult := math.Ceil(math.Log2(float64(num))-math.Log2(pushPullScaleThreshold)) + 1
+		interval = time.Duration(mult) * interval
+	}
+
+	n.next(interval, n.pushPullTick)
+}
+
+// pushPull exchanges the full state with a member over TCP
+func (n *node) pushPull(peer *node) {
+	s := n.s
+
+	size := func(o *node) int {
+		return s.sizes.pushPullHeader + len(o.members)*s.sizes.pushPullNode + len(o.events)*s.sizes.pushPullEvent
+	}
+
+	s.packets++
+	n.sent += int64(size(n))
+
+	d := s.tcpDelay(n, peer, 1)
+	s.at(d/2, func() {
+		if !peer.up || !n.up {
+			return
+		}
+
+		local, remote := n.snapshot(), peer.snapshot()
+		peer.received += int64(size(n))
+		peer.sent += int64(size(peer))
+
+		s.at(d/2, func() {
+			if !n.up {
+				return
+			}
+
+			n.received += int64(size(peer))
+			n.merge(remote)
+		})
+
+		peer.merge(local)
+	})
+}
+
+type snapshot struct {
+	members []snapshotMember
+	events  []int
+}
+
+type snapshotMember struct {
+	id    int
+	state state
+	inc   uint32
+}
+
+// snapshot copies the state in a stable order to keep runs repeatable
+func (n *node) snapshot() *snapshot {
+	sn := &snapshot{
+		members: make([]snapshotMember, 0, len(n.known)),
+	}
+
+	for _, id := range n.known {
+		m := n.members[id]
+		sn.members = append(sn.members, snapshotMember{id: id, state: m.state, inc: m.inc})
+	}
+
+	for id := range n.events {
+		sn.events = append(sn.events, id)
+	}
+	sort.Ints(sn.events)
+
+	return sn
+}
+
+// merge applies remote state; dead members are only suspected like
+// memberlist's mergeState
+func (n *node) merge(sn *snapshot) {
+	for _, m := range sn.members {
+		switch m.state {
+		case stateAlive:
+			n.alive(m.id, m.inc)
+		case stateSuspect, stateDead:
+			if _, ok := n.members[m.id]; !ok {
+				continue
+			}
+			n.suspect(m.id, m.inc, n.id)
+		}
+	}
+
+	for _, id := range sn.events {
+		n.deliver(id)
+	}
+}
@@ -0,0 +1,283 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Point is a sample of a curve
+type Point struct {
+	Time  time.Duration `json:"time"`
+	Value float64       `json:"value"`
+}
+
+// Bucket counts the values up to UpperBound
+type Bucket struct {
+	UpperBound time.Duration `json:"upper_bound"`
+	Count      int           `json:"count"`
+}
+
+// Histogram summarizes latencies
+type Histogram struct {
+	Buckets []Bucket      `json:"buckets"`
+	Count   int           `json:"count"`
+	Min     time.Duration `json:"min"`
+	Max     time.Duration `json:"max"`
+	P50     time.Duration `json:"p50"`
+	P90     time.Duration `json:"p90"`
+	P99     time.Duration `json:"p99"`
+}
+
+// Bandwidth is the gossip traffic of a node; rates are bytes per second
+// over the time the node was up
+type Bandwidth struct {
+	Node         int     `json:"node"`
+	Sent         int64   `json:"sent"`
+	Received     int64   `json:"received"`
+	SentRate     float64 `json:"sent_rate"`
+	ReceivedRate float64 `json:"received_rate"`
+}
+
+// Result holds the measurements of a run; durations are nanoseconds in
+// JSON
+type Result struct {
+	Nodes    int           `json:"nodes"`
+	Duration time.Duration `json:"duration"`
+	Seed     int64         `json:"seed"`
+	// Membership is the share of members every live node sees in their
+	// actual state and Events the share of sent user events it received
+	Membership []Point `json:"membership"`
+	Events     []Point `json:"events"`
+	// JoinConvergence is when every node first saw every other node alive
+	// and FailureConvergence how long after the failures every live node
+	// saw every crashed node dead; zero if never
+	JoinConvergence    time.Duration `json:"join_convergence"`
+	FailureConvergence time.Duration `json:"failure_convergence"`
+	// Detection is the time from the failures to each live node marking a
+	// crashed node dead and EventLatency the time for each node to receive
+	// a user event
+	Detection    Histogram `json:"detection"`
+	EventLatency Histogram `json:"event_latency"`
+	// FalseSuspicions counts failed probes of live nodes and
+	// FalsePositives the times a node marked a live node dead;
+	// FalsePositiveRate is FalsePositives per node per hour
+	FalseSuspicions    int         `json:"false_suspicions"`
+	FalsePositives     int         `json:"false_positives"`
+	FalsePositiveNodes int         `json:"false_positive_nodes"`
+	FalsePositiveRate  float64     `json:"false_positive_rate"`
+	Bandwidth          []Bandwidth `json:"bandwidth"`
+	Packets            int64       `json:"packets"`
+	Lost               int64       `json:"lost"`
+}
+
+func (s *sim) result() *Result {
+	r := &Result{
+		Nodes:              len(s.nodes),
+		Duration:           s.cfg.Duration,
+		Seed:               s.cfg.Seed,
+		Detection:          newHistogram(s.detection),
+		EventLatency:       newHistogram(s.eventLatency),
+		FalseSuspicions:    s.falseSuspicion,
+		FalsePositives:     s.falsePositive,
+		FalsePositiveNodes: len(s.falseNodes),
+		Packets:            s.packets,
+		Lost:               s.lost,
+	}
+
+	r.FalsePositiveRate = float64(s.falsePositive) / float64(len(s.nodes)) / s.cfg.Duration.Hours()
+
+	for _, sm := range s.samples {
+		r.Membership = append(r.Membership, Point{Time: sm.at, Value: sm.members})
+		if s.cfg.Events > 0 && sm.at >= s.cfg.EventAt {
+			r.Events = append(r.Events, Point{Time: sm.at, Value: sm.events})
+		}
+	}
+
+	for _, sm := range s.samples {
+		if s.cfg.Failures > 0 && sm.at >= s.cfg.FailAt {
+			break
+		}
+
+		if sm.members == 1 && sm.at >= s.lastStart() {
+			r.JoinConvergence = sm.at
+			break
+		}
+	}
+
+	if s.cfg.Failures > 0 && len(s.detection) > 0 {
+		crashed := 0
+		for _, n := range s.nodes {
+			if n.crashed {
+				crashed++
+			}
+		}
+
+		live := len(s.nodes) - crashed
+		if len(s.detection) >= live*crashed {
+			r.FailureConvergence = r.Detection.Max
+		}
+	}
+
+	for _, n := range s.nodes {
+		b := Bandwidth{
+			Node:     n.id,
+			Sent:     n.sent,
+			Received: n.received,
+		}
+
+		if secs := (s.cfg.Duration - n.startedAt).Seconds(); n.started && secs > 0 {
+			b.SentRate = float64(n.sent) / secs
+			b.ReceivedRate = float64(n.received) / secs
+		}
+
+		r.Bandwidth = append(r.Bandwidth, b)
+	}
+
+	return r
+}
+
+// lastStart returns when the last node started
+func (s *sim) lastStart() time.Duration {
+	last := time.Duration(0)
+	for _, n := range s.nodes {
+		if n.startedAt > last {
+			last = n.startedAt
+		}
+	}
+
+	return last
+}
+
+// newHistogram buckets the values on powers of two from 100ms
+func newHistogram(values []time.Duration) Histogram {
+	h := Histogram{Count: len(values)}
+	if len(values) == 0 {
+		return h
+	}
+
+	sorted := append([]time.Duration{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	h.Min = sorted[0]
+	h.Max = sorted[len(sorted)-1]
+	h.P50 = percentile(sorted, 0.5)
+	h.P90 = percentile(sorted, 0.9)
+	h.P99 = percentile(sorted, 0.99)
+
+	bound := time.Millisecond * 100
+	i := 0
+	for i < len(sorted) {
+		b := Bucket{UpperBound: bound}
+		for i < len(sorted) && sorted[i] <= bound {
+			b.Count++
+			i++
+		}
+		h.Buckets = append(h.Buckets, b)
+		bound *= 2
+	}
+
+	return h
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+// WriteReport writes the measurements as text
+func (r *Result) WriteReport(w io.Writer) {
+	fmt.Fprintln(w, "estimates from a model of the serf and memberlist protocols")
+	fmt.Fprintf(w, "nodes: %d  duration: %s  seed: %d\n", r.Nodes, r.Duration, r.Seed)
+	fmt.Fprintf(w, "packets: %d  lost: %d\n\n", r.Packets, r.Lost)
+
+	fmt.Fprintf(w, "join convergence: %s\n", formatConvergence(r.JoinConvergence))
+	if r.Detection.Count > 0 {
+		fmt.Fprintf(w, "failure convergence: %s\n", formatConvergence(r.FailureConvergence))
+	}
+	fmt.Fprintf(w, "false suspicions: %d\n", r.FalseSuspicions)
+	fmt.Fprintf(w, "false positives: %d (%d nodes, %.4f per node per hour)\n\n", r.FalsePositives, r.FalsePositiveNodes, r.FalsePositiveRate)
+
+	writeCurve(w, "membership accuracy", r.Membership)
+	if len(r.Events) > 0 {
+		writeCurve(w, "event delivery", r.Events)
+	}
+
+	if r.Detection.Count > 0 {
+		writeHistogram(w, "detection latency", r.Detection)
+	}
+	if r.EventLatency.Count > 0 {
+		writeHistogram(w, "event latency", r.EventLatency)
+	}
+
+	writeBandwidth(w, r.Bandwidth)
+}
+
+func formatConvergence(d time.Duration) string {
+	if d == 0 {
+		return "not converged"
+	}
+
+	return d.String()
+}
+
+// writeCurve draws at most 30 rows of the curve
+func writeCurve(w io.Writer, title string, points []Point) {
+	const width = 50
+
+	fmt.Fprintf(w, "%s:\n", title)
+
+	step := (len(points) + 29) / 30
+	if step < 1 {
+		step = 1
+	}
+
+	for i := 0; i < len(points); i += step {
+		p := points[i]
+		fmt.Fprintf(w, "  %8s %6.2f%% |%s\n", p.Time, p.Value*100, strings.Repeat("#", int(p.Value*width)))
+	}
+
+	if last := points[len(points)-1]; (len(points)-1)%step != 0 {
+		fmt.Fprintf(w, "  %8s %6.2f%% |%s\n", last.Time, last.Value*100, strings.Repeat("#", int(last.Value*width)))
+	}
+	fmt.Fprintln(w)
+}
+
+func writeHistogram(w io.Writer, title string, h Histogram) {
+	const width = 50
+
+	fmt.Fprintf(w, "%s: count %d  min %s  p50 %s  p90 %s  p99 %s  max %s\n", title, h.Count, h.Min, h.P50, h.P90, h.P99, h.Max)
+
+	max := 0
+	for _, b := range h.Buckets {
+		if b.Count > max {
+			max = b.Count
+		}
+	}
+
+	for _, b := range h.Buckets {
+		fmt.Fprintf(w, "  <= %8s %7d |%s\n", b.UpperBound, b.Count, strings.Repeat("#", b.Count*width/max))
+	}
+	fmt.Fprintln(w)
+}
+
+func writeBandwidth(w io.Writer, bw []Bandwidth) {
+	if len(bw) == 0 {
+		return
+	}
+
+	rates := make([]float64, len(bw))
+	var sent, received float64
+	for i, b := range bw {
+		rates[i] = b.SentRate
+		sent += b.SentRate
+		received += b.ReceivedRate
+	}
+	sort.Float64s(rates)
+
+	fmt.Fprintf(w, "bandwidth per node (bytes/s):\n")
+	fmt.Fprintf(w, "  sent: mean %.0f  p50 %.0f  p99 %.0f  max %.0f\n", sent/float64(len(bw)), rates[len(rates)/2], rates[int(float64(len(rates)-1)*0.99)], rates[len(rates)-1])
+	fmt.Fprintf(w, "  received: mean %.0f\n", received/float64(len(bw)))
+}
@@ -0,0 +1,397 @@
+// Package sim estimates how a gossip tuning behaves in large clusters
+// without running them.
+//
+// It is an analytic model, not libdiscover: a discrete-event reimplementation
+// of memberlist's probes, indirect probes, suspicion with confirmations,
+// refutation, piggybacked gossip and push/pull, and of serf's user event
+// broadcasts, run under virtual time over a simulated network.  The
+// vendored serf and memberlist can run over the memnet transport but not
+// on a virtual clock, so their code cannot be driven here; the model
+// follows their protocol and can drift from it when they change, which a
+// test checks against a small cluster over memnet.
+// Timings come from the same profile and tuning a Discover uses and message
+// sizes are measured by encoding copies of the serf and memberlist
+// messages.  Use the results to compare tunings and check them against a
+// real cluster before relying on absolute numbers.
+package sim
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	defaultNodes          = 100
+	defaultDuration       = time.Minute * 5
+	defaultJoinWindow     = time.Second * 10
+	defaultSampleInterval = time.Second
+	defaultEventSize      = 64
+)
+
+// Network describes the links of a node
+type Network struct {
+	// Latency is the mean one way latency and Jitter the most it varies
+	// by
+	Latency time.Duration
+	Jitter  time.Duration
+	// Loss is the probability that a UDP packet is lost; TCP retransmits
+	// lost segments after a timeout instead
+	Loss float64
+}
+
+// Config configures a simulation
+type Config struct {
+	// Nodes is the cluster size; defaults to 100
+	Nodes int
+	// Profile and Tuning are the gossip timings under test
+	Profile libdiscover.Profile
+	Tuning  *libdiscover.Tuning
+	// Network is used by every node except the Degraded share of nodes,
+	// which use DegradedNetwork
+	Network         Network
+	Degraded        float64
+	DegradedNetwork Network
+	// Duration is the virtual time simulated; defaults to 5m
+	Duration time.Duration
+	// JoinWindow spreads the start of the nodes; every node joins through
+	// the first node.  Defaults to 10s.
+	JoinWindow time.Duration
+	// Failures nodes crash at FailAt
+	Failures int
+	FailAt   time.Duration
+	// Events user events of EventSize bytes are sent from random nodes one
+	// second apart starting at EventAt
+	Events    int
+	EventAt   time.Duration
+	EventSize int
+	// SampleInterval is the resolution of the curves; defaults to 1s
+	SampleInterval time.Duration
+	// Seed makes the run repeatable; zero uses a random seed
+	Seed int64
+}
+
+func (c *Config) validate() error {
+	if c.Nodes < 2 {
+		return fmt.Errorf("at least 2 nodes are required")
+	}
+
+	if c.Failures < 0 || c.Failures >= c.Nodes {
+		return fmt.Errorf("failures must be between 0 and the number of nodes")
+	}
+
+	if c.Degraded < 0 || c.Degraded > 1 {
+		return fmt.Errorf("degraded must be between 0 and 1")
+	}
+
+	for _, n := range []Network{c.Network, c.DegradedNetwork} {
+		if n.Loss < 0 || n.Loss >= 1 {
+			return fmt.Errorf("loss must be at least 0 and less than 1")
+		}
+
+		if n.Latency < 0 || n.Jitter < 0 {
+			return fmt.Errorf("latency and jitter cannot be negative")
+		}
+	}
+
+	for _, d := range []time.Duration{c.Duration, c.JoinWindow, c.FailAt, c.EventAt, c.SampleInterval} {
+		if d < 0 {
+			return fmt.Errorf("durations cannot be negative")
+		}
+	}
+
+	if c.Events < 0 || c.EventSize < 0 {
+		return fmt.Errorf("events cannot be negative")
+	}
+
+	return nil
+}
+
+// item is a scheduled action
+type item struct {
+	at  time.Duration
+	seq int
+	fn  func()
+}
+
+type schedule []*item
+
+func (s schedule) Len() int { return len(s) }
+
+func (s schedule) Less(i, j int) bool {
+	if s[i].at != s[j].at {
+		return s[i].at < s[j].at
+	}
+
+	return s[i].seq < s[j].seq
+}
+
+func (s schedule) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s *schedule) Push(x interface{}) { *s = append(*s, x.(*item)) }
+
+func (s *schedule) Pop() interface{} {
+	old := *s
+	it := old[len(old)-1]
+	*s = old[:len(old)-1]
+
+	return it
+}
+
+// sim is the state of a run
+type sim struct {
+	cfg   Config
+	mCfg  *memberlist.Config
+	sCfg  *serf.Config
+	sizes *messageSizes
+
+	now   time.Duration
+	queue schedule
+	seq   int
+	rand  *rand.Rand
+
+	nodes  []*node
+	events []*simEvent
+
+	failed  time.Duration
+	samples []sample
+
+	detection      []time.Duration
+	eventLatency   []time.Duration
+	falseSuspicion int
+	falsePositive  int
+	falseNodes     map[int]bool
+	packets        int64
+	lost           int64
+}
+
+type simEvent struct {
+	id   int
+	sent time.Duration
+}
+
+// at schedules fn after d
+func (s *sim) at(d time.Duration, fn func()) {
+	s.seq++
+	heap.Push(&s.queue, &item{at: s.now + d, seq: s.seq, fn: fn})
+}
+
+// Run simulates the cluster and returns the measurements
+func Run(cfg *Config) (*Result, error) {
+	s := &sim{
+		cfg:        *cfg,
+		falseNodes: map[int]bool{},
+	}
+
+	if s.cfg.Nodes == 0 {
+		s.cfg.Nodes = defaultNodes
+	}
+
+	if s.cfg.Duration == 0 {
+		s.cfg.Duration = defaultDuration
+	}
+
+	if s.cfg.JoinWindow == 0 {
+		s.cfg.JoinWindow = defaultJoinWindow
+	}
+
+	if s.cfg.SampleInterval == 0 {
+		s.cfg.SampleInterval = defaultSampleInterval
+	}
+
+	if s.cfg.EventSize == 0 {
+		s.cfg.EventSize = defaultEventSize
+	}
+
+	if s.cfg.Seed == 0 {
+		s.cfg.Seed = time.Now().UnixNano()
+	}
+
+	if err := s.cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	mCfg, sCfg, err := libdiscover.GossipConfig(s.cfg.Profile, s.cfg.Tuning)
+	if err != nil {
+		return nil, err
+	}
+	s.mCfg = mCfg
+	s.sCfg = sCfg
+
+	if s.sizes, err = measureSizes(s.cfg.Nodes, s.cfg.EventSize); err != nil {
+		return nil, err
+	}
+	s.rand = rand.New(rand.NewSource(s.cfg.Seed))
+
+	for i := 0; i < s.cfg.Nodes; i++ {
+		n := newNode(s, i)
+		if s.rand.Float64() < s.cfg.Degraded {
+			n.net = s.cfg.DegradedNetwork
+		}
+		s.nodes = append(s.nodes, n)
+	}
+
+	// the first node starts the cluster and the others join it
+	s.at(0, s.nodes[0].start)
+	for _, n := range s.nodes[1:] {
+		n := n
+		s.at(time.Duration(s.rand.Int63n(int64(s.cfg.JoinWindow)+1)), n.start)
+	}
+
+	if s.cfg.Failures > 0 {
+		s.at(s.cfg.FailAt, s.fail)
+	}
+
+	for i := 0; i < s.cfg.Events; i++ {
+		i := i
+		s.at(s.cfg.EventAt+time.Duration(i)*time.Second, func() {
+			s.sendEvent(i)
+		})
+	}
+
+	s.at(0, s.sample)
+
+	for len(s.queue) > 0 {
+		it := heap.Pop(&s.queue).(*item)
+		if it.at > s.cfg.Duration {
+			break
+		}
+
+		s.now = it.at
+		it.fn()
+	}
+	s.now = s.cfg.Duration
+
+	return s.result(), nil
+}
+
+// fail crashes random nodes other than the first
+func (s *sim) fail() {
+	s.failed = s.now
+
+	for _, i := range s.rand.Perm(len(s.nodes) - 1)[:s.cfg.Failures] {
+		n := s.nodes[i+1]
+		n.up = false
+		n.crashed = true
+	}
+}
+
+// sendEvent sends a user event from a random live node
+func (s *sim) sendEvent(id int) {
+	live := []*node{}
+	for _, n := range s.nodes {
+		if n.up {
+			live = append(live, n)
+		}
+	}
+
+	if len(live) == 0 {
+		return
+	}
+
+	s.events = append(s.events, &simEvent{id: id, sent: s.now})
+	live[s.rand.Intn(len(live))].userEvent(id)
+}
+
+// delay returns the one way delay of a UDP packet between two nodes
+func (s *sim) delay(a, b *node) time.Duration {
+	d := (a.net.Latency + b.net.Latency) / 2
+	if j := (a.net.Jitter + b.net.Jitter) / 2; j > 0 {
+		d += time.Duration(s.rand.Int63n(int64(j)*2+1)) - j
+	}
+
+	if d < 0 {
+		d = 0
+	}
+
+	return d
+}
+
+// lossy reports whether a packet between two nodes is lost
+func (s *sim) lossy(a, b *node) bool {
+	loss := 1 - (1-a.net.Loss)*(1-b.net.Loss)
+	return loss > 0 && s.rand.Float64() < loss
+}
+
+// tcpDelay returns the time to complete a TCP exchange of the given number
+// of round trips; lost segments are retransmitted after a timeout that
+// doubles, starting at one second
+func (s *sim) tcpDelay(a, b *node, trips int) time.Duration {
+	total := time.Duration(0)
+	for i := 0; i < trips*2; i++ {
+		rto := time.Second
+		for s.lossy(a, b) {
+			total += rto
+			rto *= 2
+		}
+		total += s.delay(a, b)
+	}
+
+	return total
+}
+
+// sendUDP delivers a packet after the network delay unless it is lost
+func (s *sim) sendUDP(from, to *node, size int, fn func()) {
+	const udpOverhead = 28
+
+	s.packets++
+	from.sent += int64(size + udpOverhead)
+
+	if s.lossy(from, to) {
+		s.lost++
+		return
+	}
+
+	s.at(s.delay(from, to), func() {
+		if !to.up {
+			return
+		}
+
+		to.received += int64(size + udpOverhead)
+		fn()
+	})
+}
+
+// sample records the curves
+func (s *sim) sample() {
+	members, events := 0.0, 0.0
+	live := 0
+	for _, n := range s.nodes {
+		if !n.up {
+			continue
+		}
+		live++
+
+		members += n.accuracy()
+
+		if len(s.events) > 0 {
+			got := 0
+			for _, e := range s.events {
+				if n.events[e.id] {
+					got++
+				}
+			}
+			events += float64(got) / float64(len(s.events))
+		}
+	}
+
+	sm := sample{at: s.now}
+	if live > 0 {
+		sm.members = members / float64(live)
+		sm.events = events / float64(live)
+	}
+	s.samples = append(s.samples, sm)
+
+	s.at(s.cfg.SampleInterval, s.sample)
+}
+
+type sample struct {
+	at      time.Duration
+	members float64
+	events  float64
+}
@@ -0,0 +1,76 @@
+package sim
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+)
+
+func TestMeasureSizes(t *testing.T) {
+	small, err := measureSizes(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large, err := measureSizes(10, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the payload is counted once with a larger length prefix
+	if d := large.event - small.event; d < 512 || d > 512+4 {
+		t.Fatalf("expected the event to grow by its payload; grew by %d", d)
+	}
+
+	// longer names make every message that carries one larger
+	names, err := measureSizes(100000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names.ping <= small.ping || names.alive <= small.alive || names.pushPullNode <= small.pushPullNode {
+		t.Fatalf("expected longer names to grow the messages; got %+v and %+v", small, names)
+	}
+
+	if small.nack >= small.ping || small.ping >= small.ack {
+		t.Fatalf("unexpected sizes: %+v", small)
+	}
+}
+
+func TestRun(t *testing.T) {
+	cfg := &Config{
+		Nodes:    20,
+		Profile:  libdiscover.ProfileLAN,
+		Duration: time.Minute * 2,
+		Failures: 1,
+		FailAt:   time.Second * 30,
+		Events:   2,
+		EventAt:  time.Second * 20,
+		Seed:     1,
+	}
+
+	r, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.JoinConvergence == 0 || r.FailureConvergence == 0 {
+		t.Fatalf("expected the cluster to converge; got join %s and failure %s", r.JoinConvergence, r.FailureConvergence)
+	}
+
+	if last := r.Events[len(r.Events)-1]; last.Value != 1 {
+		t.Fatalf("expected every event to be delivered; got %v", last.Value)
+	}
+
+	// the same seed repeats the run
+	again, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(r, again) {
+		t.Fatal("expected runs with the same seed to match")
+	}
+}
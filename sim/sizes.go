@@ -0,0 +1,265 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/serf/coordinate"
+)
+
+// The structs below copy the memberlist and serf messages, which are
+// unexported, so that their sizes can be measured with the same msgpack
+// encoding.  Field names are part of the encoding and must match.
+
+type mlPing struct {
+	SeqNo uint32
+	Node  string
+}
+
+type mlIndirectPingReq struct {
+	SeqNo  uint32
+	Target []byte
+	Port   uint16
+	Node   string
+	Nack   bool
+}
+
+type mlAckResp struct {
+	SeqNo   uint32
+	Payload []byte
+}
+
+type mlNackResp struct {
+	SeqNo uint32
+}
+
+type mlSuspect struct {
+	Incarnation uint32
+	Node        string
+	From        string
+}
+
+type mlDead struct {
+	Incarnation uint32
+	Node        string
+	From        string
+}
+
+type mlAlive struct {
+	Incarnation uint32
+	Node        string
+	Addr        []byte
+	Port        uint16
+	Meta        []byte
+	Vsn         []uint8
+}
+
+type mlPushPullHeader struct {
+	Nodes        int
+	UserStateLen int
+	Join         bool
+}
+
+type mlPushNodeState struct {
+	Name        string
+	Addr        []byte
+	Port        uint16
+	Meta        []byte
+	Incarnation uint32
+	State       int
+	Vsn         []uint8
+}
+
+type serfUserEvent struct {
+	LTime   uint64
+	Name    string
+	Payload []byte
+	CC      bool
+}
+
+type serfEvent struct {
+	Name    string
+	Payload []byte
+}
+
+type serfEvents struct {
+	LTime  uint64
+	Events []serfEvent
+}
+
+type serfPushPull struct {
+	LTime        uint64
+	StatusLTimes map[string]uint64
+	LeftMembers  []string
+	EventLTime   uint64
+	Events       []*serfEvents
+	QueryLTime   uint64
+}
+
+// libdiscoverState wraps the serf push/pull state like the libdiscover
+// gossip delegate
+type libdiscoverState struct {
+	Serf  []byte            `json:"serf"`
+	State map[string][]byte `json:"state"`
+}
+
+const (
+	// serfTagMagic prefixes the msgpack encoded tags in the member meta
+	serfTagMagic = 255
+
+	simEventName = "event"
+)
+
+// messageSizes are the encoded sizes of the messages in bytes, including
+// the message type
+type messageSizes struct {
+	ping     int
+	ack      int
+	nack     int
+	indirect int
+	alive    int
+	suspect  int
+	dead     int
+	event    int
+
+	// a push/pull exchange sends the header, every member and the recent
+	// events
+	pushPullHeader int
+	pushPullNode   int
+	pushPullEvent  int
+}
+
+// measureSizes encodes the messages of a cluster of n members whose names
+// are like node-123 and whose user events carry eventSize bytes.  Members
+// have the tags libdiscover sets by default; the state of the libdiscover
+// subsystems in push/pull, such as the KV store and announcements, is not
+// counted.
+func measureSizes(n, eventSize int) (*messageSizes, error) {
+	name := fmt.Sprintf("node-%d", n)
+	addr := net.ParseIP("10.0.0.1").To4()
+
+	meta, err := msgpackSize(map[string]string{"dc": "dc1"})
+	if err != nil {
+		return nil, err
+	}
+	metaBytes := make([]byte, 1+meta)
+	metaBytes[0] = serfTagMagic
+
+	// acks carry the serf coordinate after a version byte
+	coord, err := msgpackSize(coordinate.NewCoordinate(coordinate.DefaultConfig()))
+	if err != nil {
+		return nil, err
+	}
+
+	vsn := make([]uint8, 6)
+
+	s := &messageSizes{}
+	for _, m := range []struct {
+		size *int
+		msg  interface{}
+	}{
+		{&s.ping, &mlPing{SeqNo: 1 << 31, Node: name}},
+		{&s.ack, &mlAckResp{SeqNo: 1 << 31, Payload: make([]byte, 1+coord)}},
+		{&s.nack, &mlNackResp{SeqNo: 1 << 31}},
+		{&s.indirect, &mlIndirectPingReq{SeqNo: 1 << 31, Target: addr, Port: 7946, Node: name, Nack: true}},
+		{&s.alive, &mlAlive{Incarnation: 1 << 16, Node: name, Addr: addr, Port: 7946, Meta: metaBytes, Vsn: vsn}},
+		{&s.suspect, &mlSuspect{Incarnation: 1 << 16, Node: name, From: name}},
+		{&s.dead, &mlDead{Incarnation: 1 << 16, Node: name, From: name}},
+		{&s.pushPullHeader, &mlPushPullHeader{Nodes: n, UserStateLen: 1 << 16}},
+		{&s.pushPullNode, &mlPushNodeState{Name: name, Addr: addr, Port: 7946, Meta: metaBytes, Incarnation: 1 << 16, Vsn: vsn}},
+	} {
+		size, err := msgpackSize(m.msg)
+		if err != nil {
+			return nil, err
+		}
+
+		// memberlist prefixes the message type
+		*m.size = 1 + size
+	}
+
+	// user events are serf messages inside a memberlist user message
+	event, err := msgpackSize(&serfUserEvent{LTime: 1 << 16, Name: simEventName, Payload: make([]byte, eventSize)})
+	if err != nil {
+		return nil, err
+	}
+	s.event = 2 + event
+
+	// the serf state grows by a status time per member and an entry per
+	// recent event; measure both over many entries to average out the
+	// base64 padding
+	const samples = 100
+
+	base, err := serfStateSize(n, 0, 0, eventSize)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := serfStateSize(n, samples, 0, eventSize)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := serfStateSize(n, 0, samples, eventSize)
+	if err != nil {
+		return nil, err
+	}
+
+	s.pushPullHeader += base
+	s.pushPullNode += (members - base) / samples
+	s.pushPullEvent = (events - base) / samples
+
+	return s, nil
+}
+
+// serfStateSize is the size of the serf push/pull state with the status of
+// members and the recent events as sent by libdiscover; member names are
+// numbered from n so that they are as long as in the cluster
+func serfStateSize(n, members, events, eventSize int) (int, error) {
+	pp := &serfPushPull{
+		LTime:        1 << 16,
+		StatusLTimes: map[string]uint64{},
+		EventLTime:   1 << 16,
+		QueryLTime:   1 << 16,
+	}
+
+	for i := 0; i < members; i++ {
+		pp.StatusLTimes[fmt.Sprintf("node-%d", n+i)] = 1 << 16
+	}
+
+	for i := 0; i < events; i++ {
+		pp.Events = append(pp.Events, &serfEvents{
+			LTime:  uint64(1<<16 + i),
+			Events: []serfEvent{{Name: simEventName, Payload: make([]byte, eventSize)}},
+		})
+	}
+
+	var buf bytes.Buffer
+	// serf prefixes the message type
+	buf.WriteByte(0)
+	if err := codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(pp); err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(&libdiscoverState{
+		Serf:  buf.Bytes(),
+		State: map[string][]byte{},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// libdiscover prefixes a magic byte
+	return 1 + len(data), nil
+}
+
+func msgpackSize(v interface{}) (int, error) {
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(v); err != nil {
+		return 0, err
+	}
+
+	return buf.Len(), nil
+}
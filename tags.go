@@ -0,0 +1,95 @@
+package libdiscover
+
+// Tags returns a copy of the local node tags
+func (d *Discover) Tags() map[string]string {
+	d.tagLock.RLock()
+	defer d.tagLock.RUnlock()
+
+	tags := make(map[string]string, len(d.tags))
+	for k, v := range d.tags {
+		tags[k] = v
+	}
+
+	return tags
+}
+
+// SetTags adds or updates the given local node tags and gossips the change
+func (d *Discover) SetTags(tags map[string]string) error {
+	d.tagLock.Lock()
+
+	updated := make(map[string]string, len(d.tags)+len(tags))
+	for k, v := range d.tags {
+		updated[k] = v
+	}
+	for k, v := range tags {
+		updated[k] = v
+	}
+
+	err := d.applyTags(updated)
+	d.tagLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return d.announceTags()
+}
+
+// DeleteTags removes the given local node tags and gossips the change
+func (d *Discover) DeleteTags(keys ...string) error {
+	d.tagLock.Lock()
+
+	updated := make(map[string]string, len(d.tags))
+	for k, v := range d.tags {
+		updated[k] = v
+	}
+	for _, k := range keys {
+		delete(updated, k)
+	}
+
+	err := d.applyTags(updated)
+	d.tagLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return d.announceTags()
+}
+
+// announceTags announces the new tags once the node is running
+func (d *Discover) announceTags() error {
+	if d.cluster == nil {
+		return nil
+	}
+
+	return d.announcer.announce(false)
+}
+
+// setReservedTags sets the tags libdiscover manages itself
+func (d *Discover) setReservedTags(tags map[string]string) {
+	tags[DatacenterTag] = d.datacenter
+	if d.segment != "" {
+		tags[SegmentTag] = d.segment
+	}
+	if d.wanAdvertiseAddr != "" {
+		tags[WANTag] = d.wanAdvertiseAddr
+	} else {
+		delete(tags, WANTag)
+	}
+}
+
+// applyTags must be called with the tag lock held
+func (d *Discover) applyTags(tags map[string]string) error {
+	d.setReservedTags(tags)
+
+	if d.cluster != nil {
+		if err := d.cluster.SetTags(tags); err != nil {
+			return err
+		}
+	}
+
+	d.tags = tags
+
+	return nil
+}
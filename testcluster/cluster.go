@@ -0,0 +1,525 @@
+// Package testcluster runs a cluster of Discover nodes on the local host for
+// tests.
+//
+// Nodes bind to free ports on 127.0.0.1 and gossip with a shared encryption
+// key.  Partitions are made by moving groups of nodes to their own keys so
+// that they drop the gossip of the other groups.
+package testcluster
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/hashicorp/serf/serf"
+)
+
+const (
+	defaultNodes   = 3
+	defaultTimeout = time.Second * 10
+	pollInterval   = time.Millisecond * 50
+	startAttempts  = 5
+)
+
+// Config configures a Cluster
+type Config struct {
+	// Nodes is the number of nodes started; defaults to 3
+	Nodes int
+	// Timeout bounds the waits of the cluster; defaults to 10s
+	Timeout time.Duration
+	// Configure is called with the config of every node before it is
+	// created, including restarts.  Profile defaults to ProfileLocal;
+	// Name, BindAddr, AdvertiseAddr, JoinAddr and EncryptKey are set by
+	// the cluster.
+	Configure func(i int, cfg *libdiscover.Config)
+	// EncryptKey is the gossip key of the nodes; clusters federated over
+	// the WAN must share it.  Defaults to a new key.
+	EncryptKey string
+}
+
+type node struct {
+	name string
+	addr string
+	d    *libdiscover.Discover
+
+	// key is the partition key in use; empty when not partitioned
+	key string
+
+	events []serf.UserEvent
+}
+
+// Cluster is a set of nodes that are stopped when the test finishes
+type Cluster struct {
+	t   testing.TB
+	cfg Config
+	key string
+
+	mu      sync.Mutex
+	changed *sync.Cond
+	nodes   []*node
+}
+
+// New starts the nodes, waits until every node sees all of them and stops
+// them with t.Cleanup.  It fails the test on errors.
+func New(t testing.TB, cfg *Config) *Cluster {
+	t.Helper()
+
+	c := &Cluster{
+		t: t,
+	}
+	if cfg != nil {
+		c.cfg = *cfg
+	}
+	c.changed = sync.NewCond(&c.mu)
+
+	if c.cfg.Nodes <= 0 {
+		c.cfg.Nodes = defaultNodes
+	}
+
+	if c.cfg.Timeout <= 0 {
+		c.cfg.Timeout = defaultTimeout
+	}
+
+	c.key = c.cfg.EncryptKey
+	if c.key == "" {
+		key, err := newKey()
+		if err != nil {
+			t.Fatalf("testcluster: %s", err)
+		}
+		c.key = key
+	}
+
+	t.Cleanup(c.stop)
+
+	for i := 0; i < c.cfg.Nodes; i++ {
+		n := &node{
+			name: fmt.Sprintf("node-%d", i),
+			addr: "127.0.0.1:0",
+		}
+		c.nodes = append(c.nodes, n)
+
+		if err := c.start(i); err != nil {
+			t.Fatalf("testcluster: %s", err)
+		}
+	}
+
+	c.WaitForMembers(c.cfg.Nodes)
+
+	return c
+}
+
+// Len returns the number of nodes including stopped nodes
+func (c *Cluster) Len() int {
+	return len(c.nodes)
+}
+
+// Node returns node i; it is nil when the node is killed
+func (c *Cluster) Node(i int) *libdiscover.Discover {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nodes[i].d
+}
+
+// Nodes returns the running nodes
+func (c *Cluster) Nodes() []*libdiscover.Discover {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nodes := []*libdiscover.Discover{}
+	for _, n := range c.nodes {
+		if n.d != nil {
+			nodes = append(nodes, n.d)
+		}
+	}
+
+	return nodes
+}
+
+// EncryptKey returns the gossip key of the cluster
+func (c *Cluster) EncryptKey() string {
+	return c.key
+}
+
+// Name returns the name of node i
+func (c *Cluster) Name(i int) string {
+	return c.nodes[i].name
+}
+
+// start creates and runs node i joining the first running node.  A
+// restarted node binds the port of its first start, which another process
+// can take while it is stopped, so a start that fails to bind is retried on
+// a new port.
+func (c *Cluster) start(i int) error {
+	n := c.nodes[i]
+
+	var err error
+	for attempt := 0; attempt < startAttempts; attempt++ {
+		if err = c.run(i); err == nil || !isBindError(err) {
+			return err
+		}
+
+		c.t.Logf("testcluster: retrying %s on a new port: %s", n.name, err)
+
+		c.mu.Lock()
+		n.addr = "127.0.0.1:0"
+		c.mu.Unlock()
+	}
+
+	return err
+}
+
+// run creates and runs node i once
+func (c *Cluster) run(i int) error {
+	n := c.nodes[i]
+
+	cfg := &libdiscover.Config{
+		Profile: libdiscover.ProfileLocal,
+	}
+	if c.cfg.Configure != nil {
+		c.cfg.Configure(i, cfg)
+	}
+	cfg.Name = n.name
+	cfg.EncryptKey = c.key
+
+	c.mu.Lock()
+	cfg.BindAddr = n.addr
+	cfg.AdvertiseAddr = n.addr
+	for j, o := range c.nodes {
+		if j != i && o.d != nil {
+			cfg.JoinAddr = o.d.Addr()
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	d, err := libdiscover.NewDiscover(cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", n.name, err)
+	}
+
+	c.mu.Lock()
+	n.events = nil
+	c.mu.Unlock()
+
+	d.Subscribe(func(e serf.Event) {
+		evt, ok := e.(serf.UserEvent)
+		if !ok {
+			return
+		}
+
+		c.mu.Lock()
+		n.events = append(n.events, evt)
+		c.changed.Broadcast()
+		c.mu.Unlock()
+	})
+
+	if err := d.Run(); err != nil {
+		d.Shutdown()
+		return fmt.Errorf("%s: %w", n.name, err)
+	}
+
+	c.mu.Lock()
+	// restarts keep the port picked on the first start
+	n.addr = d.Addr()
+	n.d = d
+	n.key = ""
+	c.mu.Unlock()
+
+	return nil
+}
+
+// isBindError reports whether the node failed because its port was taken
+func isBindError(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+// stop stops the running nodes
+func (c *Cluster) stop() {
+	c.mu.Lock()
+	nodes := []*libdiscover.Discover{}
+	for _, n := range c.nodes {
+		if n.d != nil {
+			nodes = append(nodes, n.d)
+			n.d = nil
+		}
+	}
+	c.mu.Unlock()
+
+	for _, d := range nodes {
+		if err := d.Shutdown(); err != nil {
+			c.t.Logf("testcluster: error stopping %s: %s", d.Name(), err)
+		}
+	}
+}
+
+// KillNode stops node i without leaving the cluster as if it crashed
+func (c *Cluster) KillNode(i int) {
+	c.t.Helper()
+
+	c.mu.Lock()
+	n := c.nodes[i]
+	d := n.d
+	n.d = nil
+	c.mu.Unlock()
+
+	if d == nil {
+		c.t.Fatalf("testcluster: %s is not running", n.name)
+	}
+
+	if err := d.Shutdown(); err != nil {
+		c.t.Fatalf("testcluster: error killing %s: %s", n.name, err)
+	}
+}
+
+// RestartNode starts node i again with the same name and address after
+// KillNode; a running node is killed first.  The node rejoins through the
+// first running node.
+func (c *Cluster) RestartNode(i int) {
+	c.t.Helper()
+
+	if c.Node(i) != nil {
+		c.KillNode(i)
+	}
+
+	if err := c.start(i); err != nil {
+		c.t.Fatalf("testcluster: error restarting: %s", err)
+	}
+}
+
+// WaitForMembers waits until every running node sees n alive members
+func (c *Cluster) WaitForMembers(n int) {
+	c.t.Helper()
+
+	c.WaitFor(fmt.Sprintf("%d alive members", n), func() bool {
+		for _, d := range c.Nodes() {
+			if aliveMembers(d) != n {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// WaitForMemberStatus waits until node i sees the member with the name in
+// the status
+func (c *Cluster) WaitForMemberStatus(i int, name string, status serf.MemberStatus) {
+	c.t.Helper()
+
+	c.WaitFor(fmt.Sprintf("%s %s on %s", name, status, c.nodes[i].name), func() bool {
+		d := c.Node(i)
+		if d == nil {
+			return false
+		}
+
+		for _, m := range d.Members() {
+			if m.Name == name {
+				return m.Status == status
+			}
+		}
+
+		return false
+	})
+}
+
+// WaitForEvent waits until node i receives a user event with the name and
+// returns it.  Every event is returned once; events received before a
+// restart are dropped.
+func (c *Cluster) WaitForEvent(i int, name string) serf.UserEvent {
+	c.t.Helper()
+
+	timeout := time.AfterFunc(c.cfg.Timeout, func() {
+		c.mu.Lock()
+		c.changed.Broadcast()
+		c.mu.Unlock()
+	})
+	defer timeout.Stop()
+
+	deadline := time.Now().Add(c.cfg.Timeout)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.nodes[i]
+	for {
+		for j, evt := range n.events {
+			if evt.Name == name {
+				n.events = append(n.events[:j], n.events[j+1:]...)
+				return evt
+			}
+		}
+
+		if !time.Now().Before(deadline) {
+			c.t.Fatalf("testcluster: timed out waiting for event %s on %s", name, n.name)
+			return serf.UserEvent{}
+		}
+
+		c.changed.Wait()
+	}
+}
+
+// WaitFor polls fn until it returns true and fails the test after the
+// cluster timeout; desc describes the condition in the failure
+func (c *Cluster) WaitFor(desc string, fn func() bool) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(c.cfg.Timeout)
+	for !fn() {
+		if !time.Now().Before(deadline) {
+			c.t.Fatalf("testcluster: timed out waiting for %s", desc)
+			return
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// PartitionNodes splits the cluster so that the nodes of each group only
+// reach each other.  Nodes not in any group form one more group.  Members
+// across groups are detected as failed after the failure detection time of
+// the profile.
+func (c *Cluster) PartitionNodes(groups ...[]int) {
+	c.t.Helper()
+
+	grouped := map[int]bool{}
+	for _, g := range groups {
+		for _, i := range g {
+			if grouped[i] {
+				c.t.Fatalf("testcluster: %s is in more than one group", c.nodes[i].name)
+			}
+			grouped[i] = true
+		}
+	}
+
+	rest := []int{}
+	for i := range c.nodes {
+		if !grouped[i] {
+			rest = append(rest, i)
+		}
+	}
+	if len(rest) > 0 {
+		groups = append(groups, rest)
+	}
+
+	for _, g := range groups {
+		key, err := newKey()
+		if err != nil {
+			c.t.Fatalf("testcluster: %s", err)
+		}
+
+		for _, i := range g {
+			if err := c.useKey(i, key); err != nil {
+				c.t.Fatalf("testcluster: error partitioning %s: %s", c.nodes[i].name, err)
+			}
+		}
+	}
+}
+
+// Heal removes the partitions and rejoins the nodes
+func (c *Cluster) Heal() {
+	c.t.Helper()
+
+	for i := range c.nodes {
+		if err := c.useKey(i, c.key); err != nil {
+			c.t.Fatalf("testcluster: error healing %s: %s", c.nodes[i].name, err)
+		}
+	}
+
+	nodes := c.Nodes()
+	if len(nodes) == 0 {
+		return
+	}
+
+	addrs := []string{}
+	for _, d := range nodes {
+		addrs = append(addrs, d.Addr())
+	}
+
+	// failed members are only retried every reconnect interval
+	for _, d := range nodes {
+		if _, err := d.Join(addrs...); err != nil {
+			c.t.Fatalf("testcluster: error rejoining %s: %s", d.Name(), err)
+		}
+	}
+}
+
+// useKey makes key the only gossip key of node i
+func (c *Cluster) useKey(i int, key string) error {
+	c.mu.Lock()
+	n := c.nodes[i]
+	d := n.d
+	old := n.key
+	c.mu.Unlock()
+
+	if d == nil {
+		return nil
+	}
+
+	if old == "" {
+		old = c.key
+	}
+
+	if old == key {
+		return nil
+	}
+
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return err
+	}
+
+	o, err := base64.StdEncoding.DecodeString(old)
+	if err != nil {
+		return err
+	}
+
+	kr := d.Keyring()
+	if err := kr.AddKey(k); err != nil {
+		return err
+	}
+
+	if err := kr.UseKey(k); err != nil {
+		return err
+	}
+
+	if err := kr.RemoveKey(o); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if key == c.key {
+		n.key = ""
+	} else {
+		n.key = key
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+func aliveMembers(d *libdiscover.Discover) int {
+	alive := 0
+	for _, m := range d.Members() {
+		if m.Status == serf.StatusAlive {
+			alive++
+		}
+	}
+
+	return alive
+}
+
+func newKey() (string, error) {
+	k := make([]byte, 16)
+	if _, err := rand.Read(k); err != nil {
+		return "", fmt.Errorf("error generating key: %s", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(k), nil
+}
@@ -0,0 +1,175 @@
+package testcluster
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestNew(t *testing.T) {
+	configured := map[int]bool{}
+	c := New(t, &Config{
+		Nodes: 2,
+		Configure: func(i int, cfg *libdiscover.Config) {
+			configured[i] = true
+			// the cluster sets the name and addresses
+			cfg.Name = "ignored"
+			cfg.BindAddr = "ignored"
+		},
+	})
+
+	if c.Len() != 2 || len(c.Nodes()) != 2 || !configured[0] || !configured[1] {
+		t.Fatalf("expected two configured nodes; got %d", len(c.Nodes()))
+	}
+
+	for i := 0; i < c.Len(); i++ {
+		d := c.Node(i)
+		if d.Name() != c.Name(i) || d.Name() != fmt.Sprintf("node-%d", i) {
+			t.Fatalf("expected node-%d; got %s", i, d.Name())
+		}
+
+		if aliveMembers(d) != 2 {
+			t.Fatalf("expected %s to see both members; got %v", d.Name(), d.Members())
+		}
+	}
+
+	if c.Node(0).Addr() == c.Node(1).Addr() {
+		t.Fatalf("expected the nodes on their own ports; got %s", c.Node(0).Addr())
+	}
+
+	if c.EncryptKey() == "" {
+		t.Fatal("expected a generated key")
+	}
+}
+
+func TestEncryptKey(t *testing.T) {
+	key, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(t, &Config{Nodes: 1, EncryptKey: key})
+	if c.EncryptKey() != key {
+		t.Fatalf("expected %s; got %s", key, c.EncryptKey())
+	}
+}
+
+func TestWaitForEvent(t *testing.T) {
+	c := New(t, &Config{Nodes: 2})
+
+	if err := c.Node(0).SendEvent("test", []byte("payload"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if evt := c.WaitForEvent(1, "test"); string(evt.Payload) != "payload" {
+		t.Fatalf("expected the payload; got %q", evt.Payload)
+	}
+
+	// the event is only returned once
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, evt := range c.nodes[1].events {
+		if evt.Name == "test" {
+			t.Fatal("expected the event to be consumed")
+		}
+	}
+}
+
+func TestKillAndRestartNode(t *testing.T) {
+	c := New(t, nil)
+	addr := c.Node(1).Addr()
+
+	c.KillNode(1)
+	if c.Node(1) != nil || len(c.Nodes()) != 2 {
+		t.Fatal("expected the node to be stopped")
+	}
+
+	c.WaitForMemberStatus(0, c.Name(1), serf.StatusFailed)
+
+	c.RestartNode(1)
+	if got := c.Node(1).Addr(); got != addr {
+		t.Fatalf("expected the restarted node on %s; got %s", addr, got)
+	}
+
+	c.WaitForMembers(3)
+}
+
+func TestRestartNodeOnNewPort(t *testing.T) {
+	c := New(t, &Config{Nodes: 2})
+	addr := c.Node(1).Addr()
+
+	c.KillNode(1)
+
+	// another process takes the port while the node is stopped
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c.RestartNode(1)
+	if got := c.Node(1).Addr(); got == addr {
+		t.Fatalf("expected the restarted node on a new port; got %s", got)
+	}
+
+	c.WaitForMembers(2)
+}
+
+func TestPartitionNodes(t *testing.T) {
+	c := New(t, &Config{
+		// fail and reconnect partitioned members quickly
+		Configure: func(i int, cfg *libdiscover.Config) {
+			cfg.Tuning = &libdiscover.Tuning{
+				ProbeInterval:     time.Millisecond * 200,
+				ProbeTimeout:      time.Millisecond * 100,
+				ReconnectInterval: time.Millisecond * 200,
+			}
+		},
+	})
+
+	// node 0 is cut off from the rest
+	c.PartitionNodes([]int{0})
+
+	c.WaitForMemberStatus(0, c.Name(1), serf.StatusFailed)
+	c.WaitForMemberStatus(1, c.Name(0), serf.StatusFailed)
+	c.WaitForMemberStatus(1, c.Name(2), serf.StatusAlive)
+
+	c.Heal()
+	c.WaitForMembers(3)
+
+	for i := 0; i < c.Len(); i++ {
+		if c.nodes[i].key != "" {
+			t.Fatalf("expected %s to use the cluster key", c.Name(i))
+		}
+	}
+}
+
+func TestIsBindError(t *testing.T) {
+	inUse := &net.OpError{
+		Op:  "listen",
+		Net: "tcp",
+		Err: &os.SyscallError{Syscall: "bind", Err: syscall.EADDRINUSE},
+	}
+
+	for _, tc := range []struct {
+		err  error
+		bind bool
+	}{
+		{inUse, true},
+		{fmt.Errorf("node-0: %w", inUse), true},
+		{fmt.Errorf("node-0: %w", syscall.ECONNREFUSED), false},
+		{errors.New("address already in use"), false},
+	} {
+		if got := isBindError(tc.err); got != tc.bind {
+			t.Errorf("%v: expected %t; got %t", tc.err, tc.bind, got)
+		}
+	}
+}
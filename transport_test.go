@@ -0,0 +1,135 @@
+package libdiscover_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/memnet"
+	"github.com/hashicorp/serf/serf"
+)
+
+// memberStatus returns the status of the member seen by d
+func memberStatus(d *libdiscover.Discover, name string) serf.MemberStatus {
+	for _, m := range d.Members() {
+		if m.Name == name {
+			return m.Status
+		}
+	}
+
+	return serf.StatusNone
+}
+
+// waitFor polls fn for up to 10 seconds
+func waitFor(t *testing.T, desc string, fn func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 10)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", desc)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestMemoryTransport(t *testing.T) {
+	n, err := memnet.New(&memnet.Config{
+		Link: memnet.Link{Latency: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := []*libdiscover.Discover{}
+	for i := 0; i < 3; i++ {
+		cfg := &libdiscover.Config{
+			Name:      fmt.Sprintf("node-%d", i),
+			BindAddr:  fmt.Sprintf("10.0.0.%d:7946", i+1),
+			Profile:   libdiscover.ProfileLocal,
+			Transport: n.Transport,
+			// fail and reconnect partitioned members quickly
+			Tuning: &libdiscover.Tuning{
+				ProbeInterval:     time.Millisecond * 200,
+				ProbeTimeout:      time.Millisecond * 100,
+				ReconnectInterval: time.Millisecond * 200,
+			},
+		}
+		if i > 0 {
+			cfg.JoinAddr = nodes[0].Addr()
+		}
+
+		d, err := libdiscover.NewDiscover(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Shutdown()
+
+		if err := d.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		nodes = append(nodes, d)
+	}
+
+	if addr := nodes[2].Addr(); addr != "10.0.0.3:7946" {
+		t.Fatalf("expected the address on the network; got %s", addr)
+	}
+
+	waitFor(t, "every member", func() bool {
+		for _, d := range nodes {
+			if len(d.Members()) != 3 {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	n.Partition([]string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.3"})
+
+	waitFor(t, "node-2 to fail", func() bool {
+		return memberStatus(nodes[0], "node-2") == serf.StatusFailed &&
+			memberStatus(nodes[2], "node-0") == serf.StatusFailed
+	})
+
+	n.Heal()
+
+	waitFor(t, "node-2 to reconnect", func() bool {
+		return memberStatus(nodes[0], "node-2") == serf.StatusAlive &&
+			memberStatus(nodes[2], "node-0") == serf.StatusAlive
+	})
+}
+
+func TestMemoryTransportFreePort(t *testing.T) {
+	n, err := memnet.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := libdiscover.NewDiscover(&libdiscover.Config{
+		Name:        "node-0",
+		BindAddr:    "10.0.0.1:0",
+		WANBindAddr: "10.0.0.1:0",
+		Profile:     libdiscover.ProfileLocal,
+		Transport:   n.Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// both pools get their own port and the WAN tag has the bound port
+	if addr := d.Addr(); addr != "10.0.0.1:10000" {
+		t.Fatalf("expected the first free port; got %s", addr)
+	}
+
+	if addr := d.Tags()[libdiscover.WANTag]; addr != "10.0.0.1:10001" {
+		t.Fatalf("expected the WAN address in the tags; got %s", addr)
+	}
+}
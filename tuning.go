@@ -0,0 +1,241 @@
+package libdiscover
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+// Profile is a base set of gossip timings
+type Profile int
+
+const (
+	// ProfileLAN suits a datacenter network and is the default
+	ProfileLAN Profile = iota
+	// ProfileWAN tolerates higher latency and loss at the cost of slower
+	// failure detection
+	ProfileWAN
+	// ProfileLocal suits nodes on a single host, such as tests
+	ProfileLocal
+	// ProfileFastFailure probes more often and suspects failed members
+	// sooner than ProfileLAN on a reliable network
+	ProfileFastFailure
+)
+
+func (p Profile) String() string {
+	switch p {
+	case ProfileLAN:
+		return "lan"
+	case ProfileWAN:
+		return "wan"
+	case ProfileLocal:
+		return "local"
+	case ProfileFastFailure:
+		return "fast-failure"
+	}
+
+	return fmt.Sprintf("profile(%d)", int(p))
+}
+
+// ParseProfile returns the profile with the name; empty is ProfileLAN
+func ParseProfile(s string) (Profile, error) {
+	if s == "" {
+		return ProfileLAN, nil
+	}
+
+	for _, p := range []Profile{ProfileLAN, ProfileWAN, ProfileLocal, ProfileFastFailure} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown profile %q; expected lan, wan, local or fast-failure", s)
+}
+
+// Tuning overrides the timings of a profile.  Zero values keep the value
+// of the profile.
+type Tuning struct {
+	// ProbeInterval is how often a random member is probed for failure
+	// detection
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long to wait for a probe ack before indirect
+	// probes; it must be less than ProbeInterval
+	ProbeTimeout time.Duration
+	// IndirectChecks is the number of members asked to probe a member that
+	// did not answer
+	IndirectChecks int
+	// SuspicionMult scales how long a suspected member has to refute the
+	// suspicion: SuspicionMult * log(N+1) * ProbeInterval
+	SuspicionMult int
+	// GossipNodes is the number of members gossiped to every GossipInterval
+	GossipNodes    int
+	GossipInterval time.Duration
+	// RetransmitMult scales how often a broadcast is retransmitted:
+	// RetransmitMult * log(N+1)
+	RetransmitMult int
+	// PushPullInterval is how often the full state is synced with a random
+	// member
+	PushPullInterval time.Duration
+	// ReapInterval is how often failed and left members past their timeout
+	// are removed
+	ReapInterval time.Duration
+	// ReconnectInterval is how often a failed member is tried again, for up
+	// to ReconnectTimeout
+	ReconnectInterval time.Duration
+	ReconnectTimeout  time.Duration
+	// CoalescePeriod and QuiescentPeriod coalesce member events: events are
+	// delivered after QuiescentPeriod without new events or at most after
+	// CoalescePeriod.  Both must be set together.
+	CoalescePeriod  time.Duration
+	QuiescentPeriod time.Duration
+	// UserCoalescePeriod and UserQuiescentPeriod coalesce user events sent
+	// with coalescing enabled
+	UserCoalescePeriod  time.Duration
+	UserQuiescentPeriod time.Duration
+	// QueueDepthWarning logs a warning when a broadcast queue grows past
+	// it; MaxQueueDepth drops the oldest broadcasts past it
+	QueueDepthWarning int
+	MaxQueueDepth     int
+	// HandoffQueueDepth is the number of received messages queued for
+	// processing before new ones are dropped
+	HandoffQueueDepth int
+}
+
+// Validate reports every invalid setting for the profile
+func (t *Tuning) Validate(p Profile) error {
+	_, _, err := gossipConfig(p, t)
+	return err
+}
+
+// GossipConfig returns the memberlist and serf configs for the profile
+// with the tuning applied, as used by the gossip pools of a Discover
+func GossipConfig(p Profile, t *Tuning) (*memberlist.Config, *serf.Config, error) {
+	return gossipConfig(p, t)
+}
+
+// gossipConfig returns the memberlist and serf configs for the profile with
+// the tuning applied
+func gossipConfig(p Profile, t *Tuning) (*memberlist.Config, *serf.Config, error) {
+	var mCfg *memberlist.Config
+	switch p {
+	case ProfileLAN:
+		mCfg = memberlist.DefaultLANConfig()
+	case ProfileWAN:
+		mCfg = memberlist.DefaultWANConfig()
+	case ProfileLocal:
+		mCfg = memberlist.DefaultLocalConfig()
+	case ProfileFastFailure:
+		mCfg = memberlist.DefaultLANConfig()
+		mCfg.ProbeInterval = time.Millisecond * 500
+		mCfg.ProbeTimeout = time.Millisecond * 250
+		mCfg.SuspicionMult = 2
+		mCfg.GossipInterval = time.Millisecond * 100
+		mCfg.GossipToTheDeadTime = time.Second * 15
+	default:
+		return nil, nil, fmt.Errorf("unknown profile %d", int(p))
+	}
+
+	cfg := serf.DefaultConfig()
+	if p == ProfileWAN {
+		cfg.ReapInterval = time.Second * 60
+		cfg.ReconnectInterval = time.Second * 60
+	}
+
+	if t == nil {
+		return mCfg, cfg, nil
+	}
+
+	errs := []string{}
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	durations := []struct {
+		name string
+		v    time.Duration
+		dst  *time.Duration
+	}{
+		{"ProbeInterval", t.ProbeInterval, &mCfg.ProbeInterval},
+		{"ProbeTimeout", t.ProbeTimeout, &mCfg.ProbeTimeout},
+		{"GossipInterval", t.GossipInterval, &mCfg.GossipInterval},
+		{"PushPullInterval", t.PushPullInterval, &mCfg.PushPullInterval},
+		{"ReapInterval", t.ReapInterval, &cfg.ReapInterval},
+		{"ReconnectInterval", t.ReconnectInterval, &cfg.ReconnectInterval},
+		{"ReconnectTimeout", t.ReconnectTimeout, &cfg.ReconnectTimeout},
+		{"CoalescePeriod", t.CoalescePeriod, &cfg.CoalescePeriod},
+		{"QuiescentPeriod", t.QuiescentPeriod, &cfg.QuiescentPeriod},
+		{"UserCoalescePeriod", t.UserCoalescePeriod, &cfg.UserCoalescePeriod},
+		{"UserQuiescentPeriod", t.UserQuiescentPeriod, &cfg.UserQuiescentPeriod},
+	}
+	for _, d := range durations {
+		switch {
+		case d.v < 0:
+			invalid("%s cannot be negative", d.name)
+		case d.v > 0:
+			*d.dst = d.v
+		}
+	}
+
+	ints := []struct {
+		name string
+		v    int
+		dst  *int
+	}{
+		{"IndirectChecks", t.IndirectChecks, &mCfg.IndirectChecks},
+		{"SuspicionMult", t.SuspicionMult, &mCfg.SuspicionMult},
+		{"GossipNodes", t.GossipNodes, &mCfg.GossipNodes},
+		{"RetransmitMult", t.RetransmitMult, &mCfg.RetransmitMult},
+		{"QueueDepthWarning", t.QueueDepthWarning, &cfg.QueueDepthWarning},
+		{"MaxQueueDepth", t.MaxQueueDepth, &cfg.MaxQueueDepth},
+		{"HandoffQueueDepth", t.HandoffQueueDepth, &mCfg.HandoffQueueDepth},
+	}
+	for _, i := range ints {
+		switch {
+		case i.v < 0:
+			invalid("%s cannot be negative", i.name)
+		case i.v > 0:
+			*i.dst = i.v
+		}
+	}
+
+	// the checks below apply to the values in effect
+	if mCfg.ProbeTimeout >= mCfg.ProbeInterval {
+		invalid("ProbeTimeout (%s) must be less than ProbeInterval (%s)", mCfg.ProbeTimeout, mCfg.ProbeInterval)
+	}
+
+	if mCfg.PushPullInterval < mCfg.GossipInterval {
+		invalid("PushPullInterval (%s) cannot be less than GossipInterval (%s)", mCfg.PushPullInterval, mCfg.GossipInterval)
+	}
+
+	if cfg.ReconnectInterval >= cfg.ReconnectTimeout {
+		invalid("ReconnectInterval (%s) must be less than ReconnectTimeout (%s)", cfg.ReconnectInterval, cfg.ReconnectTimeout)
+	}
+
+	periods := []struct {
+		coalesceName, quiescentName string
+		coalesce, quiescent         time.Duration
+	}{
+		{"CoalescePeriod", "QuiescentPeriod", cfg.CoalescePeriod, cfg.QuiescentPeriod},
+		{"UserCoalescePeriod", "UserQuiescentPeriod", cfg.UserCoalescePeriod, cfg.UserQuiescentPeriod},
+	}
+	for _, p := range periods {
+		if (p.coalesce > 0) != (p.quiescent > 0) {
+			invalid("%s and %s must be set together", p.coalesceName, p.quiescentName)
+		} else if p.quiescent > p.coalesce {
+			invalid("%s (%s) cannot be greater than %s (%s)", p.quiescentName, p.quiescent, p.coalesceName, p.coalesce)
+		}
+	}
+
+	if cfg.QueueDepthWarning > cfg.MaxQueueDepth {
+		invalid("QueueDepthWarning (%d) cannot be greater than MaxQueueDepth (%d)", cfg.QueueDepthWarning, cfg.MaxQueueDepth)
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("invalid tuning: %s", strings.Join(errs, "; "))
+	}
+
+	return mCfg, cfg, nil
+}
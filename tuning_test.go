@@ -0,0 +1,161 @@
+package libdiscover
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTuningValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		tuning Tuning
+		err    string
+	}{
+		{"ProbeInterval", Tuning{ProbeInterval: -1}, "ProbeInterval cannot be negative"},
+		{"ProbeTimeout", Tuning{ProbeTimeout: -1}, "ProbeTimeout cannot be negative"},
+		{"GossipInterval", Tuning{GossipInterval: -1}, "GossipInterval cannot be negative"},
+		{"PushPullInterval", Tuning{PushPullInterval: -1}, "PushPullInterval cannot be negative"},
+		{"ReapInterval", Tuning{ReapInterval: -1}, "ReapInterval cannot be negative"},
+		{"ReconnectInterval", Tuning{ReconnectInterval: -1}, "ReconnectInterval cannot be negative"},
+		{"ReconnectTimeout", Tuning{ReconnectTimeout: -1}, "ReconnectTimeout cannot be negative"},
+		{"CoalescePeriod", Tuning{CoalescePeriod: -1}, "CoalescePeriod cannot be negative"},
+		{"QuiescentPeriod", Tuning{QuiescentPeriod: -1}, "QuiescentPeriod cannot be negative"},
+		{"UserCoalescePeriod", Tuning{UserCoalescePeriod: -1}, "UserCoalescePeriod cannot be negative"},
+		{"UserQuiescentPeriod", Tuning{UserQuiescentPeriod: -1}, "UserQuiescentPeriod cannot be negative"},
+		{"IndirectChecks", Tuning{IndirectChecks: -1}, "IndirectChecks cannot be negative"},
+		{"SuspicionMult", Tuning{SuspicionMult: -1}, "SuspicionMult cannot be negative"},
+		{"GossipNodes", Tuning{GossipNodes: -1}, "GossipNodes cannot be negative"},
+		{"RetransmitMult", Tuning{RetransmitMult: -1}, "RetransmitMult cannot be negative"},
+		{"QueueDepthWarning", Tuning{QueueDepthWarning: -1}, "QueueDepthWarning cannot be negative"},
+		{"MaxQueueDepth", Tuning{MaxQueueDepth: -1}, "MaxQueueDepth cannot be negative"},
+		{"HandoffQueueDepth", Tuning{HandoffQueueDepth: -1}, "HandoffQueueDepth cannot be negative"},
+		{
+			"probe timeout",
+			Tuning{ProbeTimeout: time.Second},
+			"ProbeTimeout (1s) must be less than ProbeInterval (1s)",
+		},
+		{
+			"push/pull interval",
+			Tuning{PushPullInterval: time.Millisecond * 100},
+			"PushPullInterval (100ms) cannot be less than GossipInterval (200ms)",
+		},
+		{
+			"reconnect interval",
+			Tuning{ReconnectTimeout: time.Second * 30},
+			"ReconnectInterval (30s) must be less than ReconnectTimeout (30s)",
+		},
+		{
+			"coalesce period alone",
+			Tuning{CoalescePeriod: time.Second},
+			"CoalescePeriod and QuiescentPeriod must be set together",
+		},
+		{
+			"quiescent period alone",
+			Tuning{QuiescentPeriod: time.Second},
+			"CoalescePeriod and QuiescentPeriod must be set together",
+		},
+		{
+			"quiescent period",
+			Tuning{CoalescePeriod: time.Second, QuiescentPeriod: time.Second * 2},
+			"QuiescentPeriod (2s) cannot be greater than CoalescePeriod (1s)",
+		},
+		{
+			"user coalesce period alone",
+			Tuning{UserCoalescePeriod: time.Second},
+			"UserCoalescePeriod and UserQuiescentPeriod must be set together",
+		},
+		{
+			"user quiescent period",
+			Tuning{UserCoalescePeriod: time.Second, UserQuiescentPeriod: time.Second * 2},
+			"UserQuiescentPeriod (2s) cannot be greater than UserCoalescePeriod (1s)",
+		},
+		{
+			"queue depth warning",
+			Tuning{QueueDepthWarning: 5000},
+			"QueueDepthWarning (5000) cannot be greater than MaxQueueDepth (4096)",
+		},
+	}
+
+	for _, tt := range tests {
+		err := tt.tuning.Validate(ProfileLAN)
+		if err == nil || err.Error() != "invalid tuning: "+tt.err {
+			t.Errorf("%s: expected %q; got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestTuningValidateReportsEveryError(t *testing.T) {
+	tuning := &Tuning{
+		ProbeInterval:  -1,
+		GossipNodes:    -1,
+		CoalescePeriod: time.Second,
+	}
+
+	err := tuning.Validate(ProfileLAN)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, want := range []string{
+		"ProbeInterval cannot be negative",
+		"GossipNodes cannot be negative",
+		"CoalescePeriod and QuiescentPeriod must be set together",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+}
+
+func TestTuningValidateEffectiveValues(t *testing.T) {
+	// the WAN profile probes every 5s with a 3s timeout
+	if err := (&Tuning{ProbeTimeout: time.Second * 4}).Validate(ProfileWAN); err != nil {
+		t.Fatalf("expected the WAN probe interval to apply: %s", err)
+	}
+
+	if err := (&Tuning{ProbeTimeout: time.Second * 4}).Validate(ProfileLAN); err == nil {
+		t.Fatal("expected the LAN probe interval to apply")
+	}
+}
+
+func TestGossipConfig(t *testing.T) {
+	if _, _, err := gossipConfig(Profile(42), nil); err == nil || err.Error() != "unknown profile 42" {
+		t.Fatalf("expected an unknown profile error; got %v", err)
+	}
+
+	mCfg, cfg, err := gossipConfig(ProfileFastFailure, &Tuning{
+		SuspicionMult:   3,
+		ReapInterval:    time.Second * 5,
+		CoalescePeriod:  time.Second,
+		QuiescentPeriod: time.Millisecond * 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tuned values override the profile and the rest are kept
+	if mCfg.SuspicionMult != 3 || mCfg.ProbeInterval != time.Millisecond*500 {
+		t.Fatalf("unexpected memberlist config %+v", mCfg)
+	}
+
+	if cfg.ReapInterval != time.Second*5 || cfg.CoalescePeriod != time.Second || cfg.QuiescentPeriod != time.Millisecond*100 {
+		t.Fatalf("unexpected serf config %+v", cfg)
+	}
+}
+
+func TestParseProfile(t *testing.T) {
+	for _, p := range []Profile{ProfileLAN, ProfileWAN, ProfileLocal, ProfileFastFailure} {
+		if parsed, err := ParseProfile(p.String()); err != nil || parsed != p {
+			t.Errorf("%s: expected the profile; got %s %v", p, parsed, err)
+		}
+	}
+
+	if p, err := ParseProfile(""); err != nil || p != ProfileLAN {
+		t.Errorf("expected lan by default; got %s %v", p, err)
+	}
+
+	if _, err := ParseProfile("fast"); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
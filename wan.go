@@ -0,0 +1,528 @@
+package libdiscover
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDatacenter = "dc1"
+	defaultWANPort    = 7948
+
+	// DatacenterTag holds the datacenter of a member
+	DatacenterTag = "dc"
+	// WANTag holds the WAN address of the members that are WAN gateways
+	WANTag = "wan"
+
+	wanRelayQueryName = "wan-relay"
+
+	// wanResponseSizeLimit lets gateways relay the responses of a whole
+	// datacenter in a single query response
+	wanResponseSizeLimit = 32 * 1024
+
+	// wanRelayTimeout is added to the timeout of every hop of a relayed
+	// request
+	wanRelayTimeout = time.Second * 5
+)
+
+// relay request kinds
+const (
+	relayEvent       = "event"
+	relayQuery       = "query"
+	relayMembers     = "members"
+	relayDatacenters = "datacenters"
+)
+
+// relayRequest is a request forwarded to a gateway and on to another
+// datacenter
+type relayRequest struct {
+	Kind        string            `json:"kind"`
+	Datacenter  string            `json:"datacenter"`
+	Name        string            `json:"name,omitempty"`
+	Payload     []byte            `json:"payload,omitempty"`
+	Coalesce    bool              `json:"coalesce,omitempty"`
+	FilterNodes []string          `json:"filter_nodes,omitempty"`
+	FilterTags  map[string]string `json:"filter_tags,omitempty"`
+	Timeout     time.Duration     `json:"timeout,omitempty"`
+}
+
+type relayResponse struct {
+	Error       string          `json:"error,omitempty"`
+	Responses   []*NodeResponse `json:"responses,omitempty"`
+	Members     []serf.Member   `json:"members,omitempty"`
+	Datacenters []string        `json:"datacenters,omitempty"`
+}
+
+// NodeResponse is the response of a member to a query sent with QueryIn
+type NodeResponse struct {
+	Datacenter string `json:"datacenter"`
+	From       string `json:"from"`
+	Payload    []byte `json:"payload"`
+}
+
+// Datacenter returns the datacenter of the local node
+func (d *Discover) Datacenter() string {
+	return d.datacenter
+}
+
+// IsGateway reports whether the local node is in the WAN pool
+func (d *Discover) IsGateway() bool {
+	return d.wan != nil
+}
+
+// WANMembers returns the members of the WAN pool when the local node is a
+// gateway.  WAN member names are <node>.<datacenter>.
+func (d *Discover) WANMembers() []serf.Member {
+	if d.wan == nil {
+		return nil
+	}
+
+	return d.wan.Members()
+}
+
+// Datacenters returns the sorted names of the known datacenters.  Nodes
+// that are not gateways ask a gateway of their datacenter.
+func (d *Discover) Datacenters() ([]string, error) {
+	if d.wan != nil {
+		return d.wanDatacenters(), nil
+	}
+
+	if _, err := d.gateway(); err != nil {
+		// not federated
+		return []string{d.datacenter}, nil
+	}
+
+	resp, err := d.relay(&relayRequest{
+		Kind:       relayDatacenters,
+		Datacenter: d.datacenter,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Datacenters, nil
+}
+
+// MembersIn returns the members of a datacenter.  Members of other
+// datacenters are fetched through the WAN gateways.
+func (d *Discover) MembersIn(dc string) ([]serf.Member, error) {
+	if dc == "" || dc == d.datacenter {
+		return d.localMembers(), nil
+	}
+
+	resp, err := d.relay(&relayRequest{
+		Kind:       relayMembers,
+		Datacenter: dc,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Members, nil
+}
+
+// SendEventIn sends a user event to the members of a datacenter
+func (d *Discover) SendEventIn(dc, name string, data []byte, coalesce bool) error {
+	if dc == "" || dc == d.datacenter {
+		return d.SendEvent(name, data, coalesce)
+	}
+
+	_, err := d.relay(&relayRequest{
+		Kind:       relayEvent,
+		Datacenter: dc,
+		Name:       name,
+		Payload:    data,
+		Coalesce:   coalesce,
+	})
+
+	return err
+}
+
+// QueryIn sends a query to the members of a datacenter and returns the
+// responses received before the timeout.  Responses relayed from another
+// datacenter must fit in 32KB together.
+func (d *Discover) QueryIn(dc, name string, payload []byte, params *serf.QueryParam) ([]*NodeResponse, error) {
+	if ReservedQuery(name) {
+		return nil, ErrReservedQuery
+	}
+
+	req := &relayRequest{
+		Kind:       relayQuery,
+		Datacenter: dc,
+		Name:       name,
+		Payload:    payload,
+	}
+
+	if params != nil {
+		req.FilterNodes = params.FilterNodes
+		req.FilterTags = params.FilterTags
+		req.Timeout = params.Timeout
+	}
+
+	if dc == "" || dc == d.datacenter {
+		req.Datacenter = d.datacenter
+		resp := d.executeRelay(req)
+		if resp.Error != "" {
+			return nil, errors.New(resp.Error)
+		}
+
+		return resp.Responses, nil
+	}
+
+	resp, err := d.relay(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Responses, nil
+}
+
+// localMembers returns the LAN members of the local datacenter.  Members
+// without a datacenter tag are counted as local.
+func (d *Discover) localMembers() []serf.Member {
+	members := []serf.Member{}
+	for _, m := range d.Members() {
+		if dc, ok := m.Tags[DatacenterTag]; ok && dc != d.datacenter {
+			continue
+		}
+
+		members = append(members, m)
+	}
+
+	return members
+}
+
+func (d *Discover) wanDatacenters() []string {
+	seen := map[string]bool{d.datacenter: true}
+	for _, m := range d.wan.Members() {
+		if m.Status != serf.StatusAlive {
+			continue
+		}
+
+		if dc := m.Tags[DatacenterTag]; dc != "" {
+			seen[dc] = true
+		}
+	}
+
+	dcs := make([]string, 0, len(seen))
+	for dc := range seen {
+		dcs = append(dcs, dc)
+	}
+	sort.Strings(dcs)
+
+	return dcs
+}
+
+// gateway returns an alive WAN gateway of the local datacenter
+func (d *Discover) gateway() (string, error) {
+	gateways := []string{}
+	for _, m := range d.localMembers() {
+		if m.Status == serf.StatusAlive && m.Tags[WANTag] != "" {
+			gateways = append(gateways, m.Name)
+		}
+	}
+
+	if len(gateways) == 0 {
+		return "", fmt.Errorf("no WAN gateway in datacenter %s", d.datacenter)
+	}
+
+	return gateways[time.Now().UnixNano()%int64(len(gateways))], nil
+}
+
+// remoteGateway returns an alive gateway of another datacenter in the WAN
+// pool
+func (d *Discover) remoteGateway(dc string) (string, error) {
+	gateways := []string{}
+	for _, m := range d.wan.Members() {
+		if m.Status == serf.StatusAlive && m.Tags[DatacenterTag] == dc {
+			gateways = append(gateways, m.Name)
+		}
+	}
+
+	if len(gateways) == 0 {
+		return "", fmt.Errorf("unknown datacenter %s", dc)
+	}
+
+	return gateways[time.Now().UnixNano()%int64(len(gateways))], nil
+}
+
+// relay sends a request for another datacenter through a gateway of the
+// local datacenter; gateways send it on directly
+func (d *Discover) relay(req *relayRequest) (*relayResponse, error) {
+	if d.wan != nil {
+		return d.forward(req)
+	}
+
+	gw, err := d.gateway()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := req.Timeout + 2*wanRelayTimeout
+	resp, err := d.sendRelay(d.cluster, gw, req, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error relaying through gateway %s: %s", gw, err)
+	}
+
+	return resp, nil
+}
+
+// forward sends a request over the WAN to a gateway of the target
+// datacenter
+func (d *Discover) forward(req *relayRequest) (*relayResponse, error) {
+	if req.Kind == relayDatacenters {
+		return &relayResponse{Datacenters: d.wanDatacenters()}, nil
+	}
+
+	if req.Datacenter == d.datacenter {
+		resp := d.executeRelay(req)
+		if resp.Error != "" {
+			return nil, errors.New(resp.Error)
+		}
+
+		return resp, nil
+	}
+
+	gw, err := d.remoteGateway(req.Datacenter)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.sendRelay(d.wan, gw, req, req.Timeout+wanRelayTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error relaying to datacenter %s: %s", req.Datacenter, err)
+	}
+
+	return resp, nil
+}
+
+// sendRelay sends the request as a query to a single node and waits for
+// its response
+func (d *Discover) sendRelay(pool *serf.Serf, node string, req *relayRequest, timeout time.Duration) (*relayResponse, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	qr, err := pool.Query(internalQueryPrefix+wanRelayQueryName, data, &serf.QueryParam{
+		FilterNodes: []string{node},
+		Timeout:     timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer qr.Close()
+
+	r, ok := <-qr.ResponseCh()
+	if !ok {
+		return nil, fmt.Errorf("timeout waiting for %s", node)
+	}
+
+	var resp relayResponse
+	if err := json.Unmarshal(r.Payload, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// handleRelay answers relay queries from the LAN and the WAN.  Relays wait
+// on other queries so they are answered in the background.
+func (d *Discover) handleRelay(q *serf.Query) ([]byte, error) {
+	var req relayRequest
+	if err := json.Unmarshal(q.Payload, &req); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		var resp *relayResponse
+		if d.wan == nil {
+			resp = &relayResponse{Error: fmt.Sprintf("%s is not a WAN gateway", d.name)}
+		} else if r, err := d.forward(&req); err != nil {
+			resp = &relayResponse{Error: err.Error()}
+		} else {
+			resp = r
+		}
+
+		data, err := json.Marshal(resp)
+		if err != nil {
+			logrus.Errorf("error encoding relay response: %s", err)
+			return
+		}
+
+		if err := q.Respond(data); err != nil {
+			logrus.Errorf("error responding to relay: name=%s err=%s", q.Name, err)
+		}
+	}()
+
+	return nil, nil
+}
+
+// executeRelay runs a request in the local datacenter
+func (d *Discover) executeRelay(req *relayRequest) *relayResponse {
+	switch req.Kind {
+	case relayMembers:
+		return &relayResponse{Members: d.localMembers()}
+	case relayEvent:
+		if err := d.SendEvent(req.Name, req.Payload, req.Coalesce); err != nil {
+			return &relayResponse{Error: err.Error()}
+		}
+		return &relayResponse{}
+	case relayQuery:
+		params := d.cluster.DefaultQueryParams()
+		params.FilterNodes = req.FilterNodes
+		params.FilterTags = req.FilterTags
+		if req.Timeout > 0 {
+			params.Timeout = req.Timeout
+		}
+
+		qr, err := d.Query(req.Name, req.Payload, params)
+		if err != nil {
+			return &relayResponse{Error: err.Error()}
+		}
+
+		resp := &relayResponse{Responses: []*NodeResponse{}}
+		for r := range qr.ResponseCh() {
+			resp.Responses = append(resp.Responses, &NodeResponse{
+				Datacenter: d.datacenter,
+				From:       r.From,
+				Payload:    r.Payload,
+			})
+		}
+
+		return resp
+	}
+
+	return &relayResponse{Error: fmt.Sprintf("unknown relay request %q", req.Kind)}
+}
+
+// runWAN joins the WAN pool
+func (d *Discover) runWAN() error {
+	host, port, err := splitHostPort(d.wanBindAddr, defaultWANPort)
+	if err != nil {
+		return fmt.Errorf("invalid WAN bind address: %s", err)
+	}
+
+	advHost, advPort := host, port
+	if d.wanAdvertiseAddr != "" {
+		if advHost, advPort, err = splitHostPort(d.wanAdvertiseAddr, port); err != nil {
+			return fmt.Errorf("invalid WAN advertise address: %s", err)
+		}
+	}
+
+	mCfg, cfg, err := gossipConfig(ProfileWAN, d.wanTuning)
+	if err != nil {
+		return err
+	}
+	mCfg.Logger = d.logger
+	mCfg.Name = d.name + "." + d.datacenter
+	mCfg.BindAddr = host
+	mCfg.BindPort = port
+	mCfg.AdvertiseAddr = advHost
+	mCfg.AdvertisePort = advPort
+
+	if d.transport != nil {
+		t, err := d.transport(net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return fmt.Errorf("WAN: %w", err)
+		}
+
+		mCfg.Transport = t
+	}
+
+	if d.encryptKey != "" {
+		key, err := decodeKey(d.encryptKey)
+		if err != nil {
+			return err
+		}
+
+		mCfg.SecretKey = key
+	}
+
+	cfg.NodeName = mCfg.Name
+	cfg.TombstoneTimeout = d.nodeTimeout
+	cfg.DisableCoordinates = d.disableCoordinates
+	cfg.QueryResponseSizeLimit = wanResponseSizeLimit
+	cfg.QuerySizeLimit = wanResponseSizeLimit
+	cfg.Tags = map[string]string{
+		DatacenterTag: d.datacenter,
+	}
+
+	eventCh := make(chan serf.Event, 64)
+	cfg.EventCh = eventCh
+
+	if !d.debug {
+		cfg.LogOutput = ioutil.Discard
+		mCfg.LogOutput = ioutil.Discard
+	}
+
+	cfg.MemberlistConfig = mCfg
+
+	srv, err := serf.Create(cfg)
+	if err != nil {
+		return fmt.Errorf("error creating WAN pool: %w", err)
+	}
+
+	d.wan = srv
+
+	// with bind port 0 the WAN tag gets the port memberlist bound
+	local := srv.Memberlist().LocalNode()
+	if addr := net.JoinHostPort(local.Addr.String(), strconv.Itoa(int(local.Port))); addr != d.wanAdvertiseAddr {
+		d.tagLock.Lock()
+		d.wanAdvertiseAddr = addr
+		err := d.applyTags(d.tags)
+		d.tagLock.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	go d.wanEventHandler(eventCh)
+
+	if d.wanJoinAddr != "" {
+		logrus.Debugf("joining WAN: addr=%s", d.wanJoinAddr)
+
+		if _, err := srv.Join(strings.Split(d.wanJoinAddr, ","), true); err != nil {
+			return fmt.Errorf("error joining WAN: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// wanEventHandler answers relays from other datacenters; WAN membership is
+// not published to subscribers
+func (d *Discover) wanEventHandler(eventCh chan serf.Event) {
+	for {
+		select {
+		case evt := <-eventCh:
+			switch e := evt.(type) {
+			case *serf.Query:
+				if e.Name == internalQueryPrefix+wanRelayQueryName {
+					d.handleRelay(e)
+				}
+			case serf.MemberEvent:
+				for _, m := range e.Members {
+					logrus.Debugf("wan %s: %s", e.Type, m.Name)
+				}
+			}
+		case <-d.stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package libdiscover_test
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/libdiscover"
+	"github.com/ehazlett/libdiscover/testcluster"
+	"github.com/hashicorp/serf/serf"
+)
+
+// newDatacenter starts a cluster in the datacenter whose node 0 is a WAN
+// gateway joining the gateway at wanJoin.  Every node answers ping queries
+// with its name.
+func newDatacenter(t *testing.T, dc, key, wanJoin string) *testcluster.Cluster {
+	c := testcluster.New(t, &testcluster.Config{
+		Nodes:      2,
+		EncryptKey: key,
+		Timeout:    time.Second * 20,
+		Configure: func(i int, cfg *libdiscover.Config) {
+			cfg.Datacenter = dc
+			if i == 0 {
+				cfg.WANBindAddr = "127.0.0.1:0"
+				cfg.WANJoinAddr = wanJoin
+			}
+		},
+	})
+
+	for _, d := range c.Nodes() {
+		d := d
+		d.Subscribe(func(evt serf.Event) {
+			if q, ok := evt.(*serf.Query); ok && q.Name == "ping" {
+				q.Respond([]byte(d.Name()))
+			}
+		})
+	}
+
+	return c
+}
+
+// wanAddr returns the WAN address of a gateway
+func wanAddr(t *testing.T, d *libdiscover.Discover) string {
+	for _, m := range d.WANMembers() {
+		if m.Name == d.Name()+"."+d.Datacenter() {
+			return fmt.Sprintf("%s:%d", m.Addr, m.Port)
+		}
+	}
+
+	t.Fatalf("%s is not in the WAN pool", d.Name())
+	return ""
+}
+
+func TestWAN(t *testing.T) {
+	t.Parallel()
+
+	east := newDatacenter(t, "east", "", "")
+	west := newDatacenter(t, "west", east.EncryptKey(), wanAddr(t, east.Node(0)))
+
+	east.WaitFor("west gateway in the WAN pool", func() bool {
+		return len(east.Node(0).WANMembers()) == 2
+	})
+
+	if !east.Node(0).IsGateway() || east.Node(1).IsGateway() {
+		t.Fatal("expected only node-0 to be a gateway")
+	}
+
+	// members that are not gateways go through the gateway of their
+	// datacenter
+	east.WaitFor("west datacenter", func() bool {
+		dcs, err := east.Node(1).Datacenters()
+		return err == nil && reflect.DeepEqual(dcs, []string{"east", "west"})
+	})
+
+	members, err := east.Node(1).MembersIn("west")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, m := range members {
+		if m.Tags[libdiscover.DatacenterTag] != "west" {
+			t.Fatalf("expected a west member; got %+v", m)
+		}
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+
+	if !reflect.DeepEqual(names, []string{west.Name(0), west.Name(1)}) {
+		t.Fatalf("expected the west members; got %v", names)
+	}
+
+	// the local datacenter does not include the members of others
+	if local, err := east.Node(1).MembersIn("east"); err != nil || len(local) != 2 {
+		t.Fatalf("expected the 2 east members; got %d, %v", len(local), err)
+	}
+
+	if err := east.Node(1).SendEventIn("west", "deploy", []byte("v2"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if evt := west.WaitForEvent(1, "deploy"); string(evt.Payload) != "v2" {
+		t.Fatalf("expected payload v2; got %q", evt.Payload)
+	}
+
+	responses, err := west.Node(1).QueryIn("east", "ping", nil, &serf.QueryParam{Timeout: time.Second * 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := []string{}
+	for _, r := range responses {
+		if r.Datacenter != "east" || r.From != string(r.Payload) {
+			t.Fatalf("unexpected response: %+v", r)
+		}
+		from = append(from, r.From)
+	}
+	sort.Strings(from)
+
+	if !reflect.DeepEqual(from, []string{east.Name(0), east.Name(1)}) {
+		t.Fatalf("expected responses from the east members; got %v", from)
+	}
+
+	if _, err := west.Node(1).QueryIn("east", "libdiscover:lock", nil, nil); err != libdiscover.ErrReservedQuery {
+		t.Fatalf("expected ErrReservedQuery; got %v", err)
+	}
+
+	if _, err := east.Node(1).MembersIn("north"); err == nil {
+		t.Fatal("expected an error for an unknown datacenter")
+	}
+}
+
+func TestWANNotFederated(t *testing.T) {
+	c := testcluster.New(t, &testcluster.Config{Nodes: 1})
+
+	dcs, err := c.Node(0).Datacenters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(dcs, []string{"dc1"}) {
+		t.Fatalf("expected the default datacenter only; got %v", dcs)
+	}
+
+	if _, err := c.Node(0).MembersIn("west"); err == nil {
+		t.Fatal("expected an error without a gateway")
+	}
+}